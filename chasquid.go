@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -13,19 +14,25 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"blitiri.com.ar/go/chasquid/internal/acme"
 	"blitiri.com.ar/go/chasquid/internal/config"
 	"blitiri.com.ar/go/chasquid/internal/courier"
 	"blitiri.com.ar/go/chasquid/internal/dovecot"
 	"blitiri.com.ar/go/chasquid/internal/maillog"
+	"blitiri.com.ar/go/chasquid/internal/milter"
 	"blitiri.com.ar/go/chasquid/internal/normalize"
+	"blitiri.com.ar/go/chasquid/internal/policy"
 	"blitiri.com.ar/go/chasquid/internal/smtpsrv"
 	"blitiri.com.ar/go/chasquid/internal/sts"
 	"blitiri.com.ar/go/chasquid/internal/userdb"
 	"blitiri.com.ar/go/log"
 	"blitiri.com.ar/go/systemd"
+	"golang.org/x/net/idna"
 )
 
 // Command-line flags.
@@ -78,9 +85,32 @@ func main() {
 
 	s := smtpsrv.NewServer()
 	s.Hostname = conf.Hostname
-	s.MaxDataSize = conf.MaxDataSizeMb * 1024 * 1024
 	s.HookPath = "hooks/"
 	s.HAProxyEnabled = conf.HaproxyIncoming
+	s.HAProxyTrustTLS = conf.HaproxyTrustTls
+	s.DKIMSignedHeaders = conf.DkimSignedHeaders
+
+	// Options that can be changed by reloading.
+	if err := applyConfig(s, conf); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	s.RateLimits = smtpsrv.RateLimits{
+		MaxConnections:            int(conf.MaxConnections),
+		MaxConnectionsPerIP:       int(conf.MaxConnectionsPerIp),
+		MaxConnectionsPerNetwork:  int(conf.MaxConnectionsPerNetwork),
+		MaxConnectionRatePerIP:    int(conf.MaxConnectionRatePerIp),
+		MaxMessagesPerHourPerIP:   int(conf.MaxMessagesPerHourPerIp),
+		MaxRecipientsPerHourPerIP: int(conf.MaxRecipientsPerHourPerIp),
+	}
+
+	if conf.PolicyDaemon != "" {
+		var err error
+		s.Policy, err = policy.NewClient(conf.PolicyDaemon)
+		if err != nil {
+			log.Fatalf("Invalid policy_daemon: %v", err)
+		}
+	}
 
 	s.SetAliasesConfig(*conf.SuffixSeparators, *conf.DropCharacters)
 
@@ -88,43 +118,36 @@ func main() {
 		loadDovecot(s, conf.DovecotUserdbPath, conf.DovecotClientPath)
 	}
 
-	// Load certificates from "certs/<directory>/{fullchain,privkey}.pem".
-	// The structure matches letsencrypt's, to make it easier for that case.
-	log.Infof("Loading certificates")
-	for _, info := range mustReadDir("certs/") {
-		if !info.IsDir() {
-			// Skip non-directories.
-			continue
-		}
+	if conf.TlsClientCa != "" {
+		s.ClientCAs = loadClientCAs(conf.TlsClientCa)
+		s.ClientCertImplicitAuth = conf.TlsClientImplicitAuth
+	}
 
-		name := info.Name()
-		dir := filepath.Join("certs/", name)
-		log.Infof("  %s", name)
+	mode, err := strconv.ParseUint(conf.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		log.Fatalf("Invalid unix_socket_mode: %q", conf.UnixSocketMode)
+	}
+	s.UnixSocketMode = os.FileMode(mode)
+	s.UnixPeerAuth = loadUnixPeerAuth(conf.UnixPeerAuth)
+	s.TrustedNetworks = loadTrustedNetworks(
+		conf.TrustedNetworks, conf.TrustedNetworksListeners)
 
-		certPath := filepath.Join(dir, "fullchain.pem")
-		if _, err := os.Stat(certPath); os.IsNotExist(err) {
-			continue
-		}
-		keyPath := filepath.Join(dir, "privkey.pem")
-		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
-			continue
-		}
+	if conf.Acme != nil {
+		s.ACME = newACMEManager(conf)
+	}
 
-		err := s.AddCerts(certPath, keyPath)
-		if err != nil {
-			log.Fatalf("    %v", err)
+	certs, err := loadCerts()
+	if err != nil {
+		if s.ACME == nil {
+			log.Fatalf("Error loading certificates: %v", err)
 		}
+		log.Infof("No certificates yet, will get them via ACME (%v)", err)
 	}
+	s.SetCerts(certs)
 
-	// Load domains from "domains/".
-	log.Infof("Domain config paths:")
-	for _, info := range mustReadDir("domains/") {
-		domain, err := normalize.Domain(info.Name())
-		if err != nil {
-			log.Fatalf("Invalid name %+q: %v", info.Name(), err)
-		}
-		dir := filepath.Join("domains", info.Name())
-		loadDomain(domain, dir, s)
+	domains, err := loadDomains(s, nil)
+	if err != nil {
+		log.Fatalf("Error loading domains: %v", err)
 	}
 
 	// Always include localhost as local domain.
@@ -134,6 +157,14 @@ func main() {
 
 	dinfo := s.InitDomainInfo(conf.DataDir + "/domaininfo")
 
+	if conf.Greylisting {
+		s.InitGreylist(conf.DataDir+"/greylist",
+			mustParseDuration("greylisting_delay", conf.GreylistingDelay),
+			mustParseDuration("greylisting_retry_window",
+				conf.GreylistingRetryWindow),
+			mustParseDuration("greylisting_expiry", conf.GreylistingExpiry))
+	}
+
 	stsCache, err := sts.NewCache(conf.DataDir + "/sts-cache")
 	if err != nil {
 		log.Fatalf("Failed to initialize STS cache: %v", err)
@@ -164,12 +195,148 @@ func main() {
 		systemdLs["submission"], smtpsrv.ModeSubmission)
 	naddr += loadAddresses(s, conf.SubmissionOverTlsAddress,
 		systemdLs["submission_tls"], smtpsrv.ModeSubmissionTLS)
+	if len(conf.LmtpAddress) > 0 {
+		// LMTP is optional, so only load it if configured, to avoid the
+		// warnings about missing addresses.
+		naddr += loadAddresses(s, conf.LmtpAddress,
+			systemdLs["lmtp"], smtpsrv.ModeLMTP)
+	}
 
 	if naddr == 0 {
 		log.Fatalf("No address to listen on")
 	}
 
+	r := &reloader{s: s, conf: conf, domains: domains}
+	go r.run(mustParseDuration(
+		"reload_check_interval", conf.ReloadCheckInterval))
+
+	gracePeriod := mustParseDuration(
+		"shutdown_grace_period", conf.ShutdownGracePeriod)
+	go func() {
+		reason := <-shutdownRequests
+		log.Infof("Shutting down (%s), grace period: %v", reason, gracePeriod)
+		ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down: %v", err)
+		}
+	}()
+
+	if s.ACME != nil {
+		// The TLS-ALPN-01 challenges need our listeners, which are started
+		// right below; it takes a few requests to the ACME server before
+		// it tries to connect to them.
+		go s.ACME.Run(context.Background())
+	}
+
 	s.ListenAndServe()
+	log.Infof("chasquid shut down")
+}
+
+// Requests to shut down, with the reason. See requestShutdown.
+var shutdownRequests = make(chan string, 1)
+
+// requestShutdown asks main to shut down the server gracefully. Returns
+// false if a shutdown had already been requested.
+func requestShutdown(reason string) bool {
+	select {
+	case shutdownRequests <- reason:
+		return true
+	default:
+		return false
+	}
+}
+
+// newACMEManager returns the ACME manager for the configuration, which
+// obtains certificates for the hostname and for the configured names.
+func newACMEManager(conf *config.Config) *acme.Manager {
+	m := &acme.Manager{
+		DirectoryURL: conf.Acme.DirectoryUrl,
+		Email:        conf.Acme.Email,
+		CertsDir:     "certs",
+		StateDir:     conf.DataDir + "/acme",
+		DNSHook:      "hooks/acme-dns",
+		RenewBefore:  30 * 24 * time.Hour,
+		OnUpdate:     requestCertsReload,
+	}
+	if conf.Acme.RenewBefore != "" {
+		m.RenewBefore = mustParseDuration(
+			"acme renew_before", conf.Acme.RenewBefore)
+	}
+
+	seen := map[string]bool{}
+	for _, name := range append([]string{conf.Hostname}, conf.Acme.Names...) {
+		n, err := idna.Lookup.ToASCII(name)
+		if err != nil {
+			log.Fatalf("Invalid ACME name %q: %v", name, err)
+		}
+		if !seen[n] {
+			m.Names = append(m.Names, n)
+			seen[n] = true
+		}
+	}
+	return m
+}
+
+// loadClientCAs loads the CA certificates to verify TLS client certificates
+// against.
+func loadClientCAs(path string) *x509.CertPool {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading tls_client_ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		log.Fatalf("No certificates found in tls_client_ca %q", path)
+	}
+	log.Infof("Loaded TLS client CAs from %q", path)
+	return pool
+}
+
+// loadUnixPeerAuth returns the addresses to authenticate local users as, by
+// user name.
+func loadUnixPeerAuth(entries []*config.UnixPeerAuth) map[string]string {
+	m := map[string]string{}
+	for _, e := range entries {
+		addr, err := normalize.Addr(e.Address)
+		if err != nil || !strings.Contains(addr, "@") || e.User == "" {
+			log.Fatalf("Invalid unix_peer_auth: %q as %q", e.User, e.Address)
+		}
+		m[e.User] = addr
+	}
+	return m
+}
+
+// Listener modes, by the names used in the configuration (which are the same
+// as the systemd socket names).
+var listenerModes = map[string]smtpsrv.SocketMode{
+	"smtp":           smtpsrv.ModeSMTP,
+	"submission":     smtpsrv.ModeSubmission,
+	"submission_tls": smtpsrv.ModeSubmissionTLS,
+	"lmtp":           smtpsrv.ModeLMTP,
+}
+
+// loadTrustedNetworks returns the trusted networks, for each of the given
+// listeners.
+func loadTrustedNetworks(cidrs, listeners []string) map[smtpsrv.SocketMode][]*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatalf("Invalid trusted_networks: %v", err)
+		}
+		nets = append(nets, n)
+	}
+
+	m := map[smtpsrv.SocketMode][]*net.IPNet{}
+	for _, name := range listeners {
+		mode, ok := listenerModes[name]
+		if !ok {
+			log.Fatalf("Invalid trusted_networks_listeners: %q", name)
+		}
+		m[mode] = nets
+	}
+	return m
 }
 
 func loadAddresses(srv *smtpsrv.Server, addrs []string, ls []net.Listener, mode smtpsrv.SocketMode) int {
@@ -232,8 +399,15 @@ func signalHandler() {
 			if err != nil {
 				log.Fatalf("Error reopening maillog: %v", err)
 			}
+
+			// It also reloads the configuration, see reload.go.
+			requestReload("got signal " + sig.String())
 		case syscall.SIGTERM, syscall.SIGINT:
-			log.Fatalf("Got signal to exit: %v", sig)
+			// The first one starts a graceful shutdown, a second one
+			// exits right away.
+			if !requestShutdown("got signal " + sig.String()) {
+				log.Fatalf("Got signal to exit while shutting down: %v", sig)
+			}
 		default:
 			log.Errorf("Unexpected signal %v", sig)
 		}
@@ -260,6 +434,33 @@ func loadDomain(name, dir string, s *smtpsrv.Server) {
 	if err != nil {
 		log.Errorf("      error: %v", err)
 	}
+
+	loadSendersAndDKIM(name, dir, s)
+}
+
+// loadSendersAndDKIM loads the sender allow-list and the DKIM signer of the
+// domain. It is also used to reload them for domains that were already
+// loaded.
+func loadSendersAndDKIM(name, dir string, s *smtpsrv.Server) {
+	// Allow-list of senders, used if restrict_senders is enabled.
+	err := s.AddSendersFile(name, dir+"/senders")
+	if err != nil {
+		log.Errorf("      error loading senders: %v", err)
+	}
+
+	// DKIM signing is enabled if there is a selector in
+	// "domains/<domain>/dkim_selector", and uses the private key in
+	// "certs/<domain>/dkim_privkey.pem".
+	if selector, err := os.ReadFile(dir + "/dkim_selector"); err == nil {
+		log.Infof("    adding DKIM signer")
+		err = s.AddDKIMSigner(name, strings.TrimSpace(string(selector)),
+			filepath.Join("certs", name, "dkim_privkey.pem"))
+		if err != nil {
+			log.Errorf("      error: %v", err)
+		}
+	} else if os.IsNotExist(err) {
+		s.RemoveDKIMSigner(name)
+	}
 }
 
 func loadDovecot(s *smtpsrv.Server, userdb, client string) {
@@ -272,15 +473,67 @@ func loadDovecot(s *smtpsrv.Server, userdb, client string) {
 	}
 }
 
+// parseMilter parses the milter configuration, applying the defaults.
+func parseMilter(m *config.Milter) (*milter.Filter, error) {
+	network, address, err := milter.ParseAddress(m.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid milter: %v", err)
+	}
+
+	f := &milter.Filter{
+		Network: network,
+		Address: address,
+		Timeout: 30 * time.Second,
+	}
+	if m.Timeout != "" {
+		f.Timeout, err = parseDuration("milter timeout", m.Timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch m.DefaultAction {
+	case "", "tempfail":
+		f.DefaultAction = milter.TempFail
+	case "reject":
+		f.DefaultAction = milter.Reject
+	case "accept":
+		f.DefaultAction = milter.Accept
+	default:
+		return nil, fmt.Errorf("invalid milter default_action: %q",
+			m.DefaultAction)
+	}
+	return f, nil
+}
+
+// parseDuration parses the value of the given config option as a duration,
+// which must not be negative.
+func parseDuration(option, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", option, value)
+	}
+	return d, nil
+}
+
+// mustParseDuration is like parseDuration, but exits on errors.
+func mustParseDuration(option, value string) time.Duration {
+	d, err := parseDuration(option, value)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return d
+}
+
 // Read a directory, which must have at least some entries.
-func mustReadDir(path string) []os.DirEntry {
+func readDir(path string) ([]os.DirEntry, error) {
 	dirs, err := os.ReadDir(path)
 	if err != nil {
-		log.Fatalf("Error reading %q directory: %v", path, err)
+		return nil, fmt.Errorf("error reading %q directory: %v", path, err)
 	}
 	if len(dirs) == 0 {
-		log.Fatalf("No entries found in %q", path)
+		return nil, fmt.Errorf("no entries found in %q", path)
 	}
 
-	return dirs
+	return dirs, nil
 }
@@ -30,6 +30,7 @@ import (
 const usage = `
 Usage:
   chasquid-util [options] user-add <user@domain> [--password=<password>]
+                [--scram[=<iterations>]]
   chasquid-util [options] user-remove <user@domain>
   chasquid-util [options] authenticate <user@domain> [--password=<password>]
   chasquid-util [options] check-userdb <domain>
@@ -143,11 +144,32 @@ func checkUserDB() {
 }
 
 // chasquid-util user-add <user@domain> [--password=<password>]
+// [--scram[=<iterations>]]
 func userAdd() {
 	user, _, db := userDBFromArgs(true)
+
+	// SCRAM-SHA-256 credentials are only stored if requested, as they are
+	// cheaper to brute-force than the password hash.
+	scramIterations := 0
+	if s, ok := args["--scram"]; ok {
+		scramIterations = userdb.DefaultSCRAMIterations
+		if s != "" {
+			var err error
+			scramIterations, err = strconv.Atoi(s)
+			if err != nil {
+				Fatalf("Invalid number of SCRAM iterations: %v", err)
+			}
+		}
+	}
+
 	password := getPassword()
 
-	err := db.AddUser(user, password)
+	var err error
+	if scramIterations != 0 {
+		err = db.AddUserWithSCRAM(user, password, scramIterations)
+	} else {
+		err = db.AddUser(user, password)
+	}
 	if err != nil {
 		Fatalf("Error adding user: %v", err)
 	}
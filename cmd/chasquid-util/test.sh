@@ -39,6 +39,25 @@ if ! r authenticate user@domain --password=passwd > /dev/null; then
 	exit 1
 fi
 
+# SCRAM credentials are only stored if requested.
+if grep -q scram_sha256 .config/domains/domain/users; then
+	echo SCRAM credentials stored without --scram
+	exit 1
+fi
+if ! r user-add user@domain --password=passwd --scram=5000 > /dev/null; then
+	echo user-add --scram failed
+	exit 1
+fi
+if ! grep -q "iterations: *5000" .config/domains/domain/users; then
+	echo SCRAM credentials missing after --scram
+	exit 1
+fi
+if r user-add user@domain --password=passwd --scram=10 > /dev/null; then
+	echo user-add with too few SCRAM iterations worked
+	exit 1
+fi
+check_userdb
+
 if r authenticate user@domain --password=abcd > /dev/null; then
 	echo authenticate with bad password worked
 	exit 1
@@ -0,0 +1,447 @@
+// Package acme implements automatic management of TLS certificates, using
+// the ACME protocol (RFC 8555), as done by Let's Encrypt and others.
+//
+// Certificates are stored in the same layout chasquid loads them from (and
+// that certbot uses): "<dir>/<name>/{fullchain,privkey}.pem".
+//
+// Two challenge types are supported:
+//   - TLS-ALPN-01 (RFC 8737), answered on our own TLS listeners, see
+//     Manager.GetConfigForClient.
+//   - DNS-01, using a hook to add and remove the DNS records.
+//
+// Reference: https://tools.ietf.org/html/rfc8555
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/expvarom"
+	"blitiri.com.ar/go/chasquid/internal/safeio"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+
+	xacme "golang.org/x/crypto/acme"
+)
+
+// Exported variables.
+var (
+	certResults = expvarom.NewMap("chasquid/acme/certResults",
+		"result", "count of ACME certificate requests, by result")
+	dnsHookResults = expvarom.NewMap("chasquid/acme/dnsHookResults",
+		"result", "count of ACME DNS hook runs, by result")
+)
+
+// ALPN protocol used for the TLS-ALPN-01 challenge (RFC 8737).
+const alpnProto = "acme-tls/1"
+
+// Manager obtains and renews certificates. The fields must be set before
+// calling Run or CheckAll, and not changed afterwards.
+type Manager struct {
+	// URL of the ACME server's directory. If empty, Let's Encrypt's
+	// production server is used.
+	DirectoryURL string
+
+	// Contact email for the account, optional.
+	Email string
+
+	// Names to get certificates for. Each one gets its own certificate, in
+	// CertsDir/<name>/.
+	Names []string
+
+	// Directory where the certificates are stored.
+	CertsDir string
+
+	// Directory where we keep our own state (the account key).
+	StateDir string
+
+	// Path to the DNS hook. If it exists, we use the DNS-01 challenge, and
+	// the hook is run to add and remove the records. Otherwise, we use the
+	// TLS-ALPN-01 challenge.
+	DNSHook string
+
+	// Certificates are renewed when they expire within this period.
+	RenewBefore time.Duration
+
+	// Function to call when certificates are written, so they can be
+	// loaded. Optional.
+	OnUpdate func()
+
+	// HTTP client to use to talk to the ACME server. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// ACME client, created on first use. Only used by CheckAll, which
+	// does not run concurrently.
+	client *xacme.Client
+
+	// Certificates for the TLS-ALPN-01 challenges in progress, by name.
+	// Protected by mu.
+	mu             sync.Mutex
+	challengeCerts map[string]*tls.Certificate
+}
+
+// How often to check the certificates, and how soon to try again if there
+// was an error.
+var (
+	checkInterval = 12 * time.Hour
+	retryInterval = 1 * time.Hour
+)
+
+// Run checks the certificates periodically, and obtains or renews them as
+// needed, until the context is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	for {
+		wait := checkInterval
+		if err := m.CheckAll(ctx); err != nil {
+			wait = retryInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// CheckAll checks the certificates for all the names, and obtains or renews
+// the ones that are missing or about to expire. If there is any error, it
+// continues with the other names, and returns the first one.
+func (m *Manager) CheckAll(ctx context.Context) error {
+	tr := trace.New("ACME.CheckAll", m.CertsDir)
+	defer tr.Finish()
+
+	var firstErr error
+	updated := false
+	for _, name := range m.Names {
+		if reason := m.needsCert(name); reason != "" {
+			tr.Printf("%s: obtaining certificate (%s)", name, reason)
+			err := m.obtain(ctx, tr, name)
+			if err != nil {
+				certResults.Add("error", 1)
+				tr.Errorf("%s: error obtaining certificate: %v", name, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			certResults.Add("success", 1)
+			tr.Printf("%s: new certificate stored", name)
+			updated = true
+		}
+	}
+
+	if updated && m.OnUpdate != nil {
+		m.OnUpdate()
+	}
+	return firstErr
+}
+
+// needsCert returns why we need to obtain a certificate for the name, or ""
+// if the one we have is good enough.
+func (m *Manager) needsCert(name string) string {
+	buf, err := os.ReadFile(filepath.Join(m.CertsDir, name, "fullchain.pem"))
+	if err != nil {
+		return "no certificate"
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return "invalid certificate"
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "invalid certificate"
+	}
+	if cert.VerifyHostname(name) != nil {
+		return "certificate does not cover the name"
+	}
+	if time.Until(cert.NotAfter) < m.RenewBefore {
+		return "expires on " + cert.NotAfter.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// getClient returns the ACME client, creating it (and registering the
+// account) if needed.
+func (m *Manager) getClient(ctx context.Context) (*xacme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &xacme.Client{
+		Key:          key,
+		DirectoryURL: m.DirectoryURL,
+		HTTPClient:   m.HTTPClient,
+		UserAgent:    "chasquid",
+	}
+
+	acct := &xacme.Account{}
+	if m.Email != "" {
+		acct.Contact = []string{"mailto:" + m.Email}
+	}
+	_, err = client.Register(ctx, acct, xacme.AcceptTOS)
+	if err != nil && err != xacme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("error registering account: %v", err)
+	}
+
+	m.client = client
+	return client, nil
+}
+
+// accountKey loads the account key from the state directory, or generates
+// and saves a new one if there is none.
+func (m *Manager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.StateDir, "account_key.pem")
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM block found", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(m.StateDir, 0700); err != nil {
+		return nil, err
+	}
+	err = safeio.WriteFile(path,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}),
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// obtain a new certificate for the name, and store it.
+func (m *Manager) obtain(ctx context.Context, tr *trace.Trace, name string) error {
+	client, err := m.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, xacme.DomainIDs(name))
+	if err != nil {
+		return fmt.Errorf("error creating order: %v", err)
+	}
+
+	for _, url := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			return fmt.Errorf("error getting authorization: %v", err)
+		}
+		if authz.Status == xacme.StatusValid {
+			continue
+		}
+		if err := m.authorize(ctx, tr, client, authz); err != nil {
+			return err
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("error waiting for order: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{DNSNames: []string{name}}, key)
+	if err != nil {
+		return err
+	}
+	ders, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("error finalizing order: %v", err)
+	}
+
+	return m.store(name, ders, key)
+}
+
+// authorize completes the authorization, using the challenge we support.
+func (m *Manager) authorize(ctx context.Context, tr *trace.Trace, client *xacme.Client, authz *xacme.Authorization) error {
+	useDNS := false
+	if _, err := os.Stat(m.DNSHook); m.DNSHook != "" && err == nil {
+		useDNS = true
+	}
+
+	var chal *xacme.Challenge
+	for _, c := range authz.Challenges {
+		if (useDNS && c.Type == "dns-01") ||
+			(!useDNS && c.Type == "tls-alpn-01") {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s: no supported challenge offered",
+			authz.Identifier.Value)
+	}
+
+	name := authz.Identifier.Value
+	tr.Debugf("%s: using challenge %s", name, chal.Type)
+	if useDNS {
+		record, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+		fqdn := "_acme-challenge." + name
+		if err := m.runDNSHook(ctx, tr, "add", fqdn, record); err != nil {
+			return err
+		}
+		defer m.runDNSHook(ctx, tr, "remove", fqdn, record)
+	} else {
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, name)
+		if err != nil {
+			return err
+		}
+		m.mu.Lock()
+		if m.challengeCerts == nil {
+			m.challengeCerts = map[string]*tls.Certificate{}
+		}
+		m.challengeCerts[name] = &cert
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			delete(m.challengeCerts, name)
+			m.mu.Unlock()
+		}()
+	}
+
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("error accepting challenge: %v", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization failed: %v", err)
+	}
+	return nil
+}
+
+// runDNSHook runs the DNS hook, to add or remove the TXT record with the
+// given value.
+func (m *Manager) runDNSHook(ctx context.Context, tr *trace.Trace, action, fqdn, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, m.DNSHook, action, fqdn, value)
+	out, err := cmd.CombinedOutput()
+	tr.Debugf("DNS hook %s %s: %q", action, fqdn, out)
+	if err != nil {
+		dnsHookResults.Add(action+":fail", 1)
+		return fmt.Errorf("DNS hook failed to %s %s: %v", action, fqdn, err)
+	}
+	dnsHookResults.Add(action+":success", 1)
+	return nil
+}
+
+// store the certificate chain and key in CertsDir/<name>/.
+func (m *Manager) store(name string, ders [][]byte, key *ecdsa.PrivateKey) error {
+	if len(ders) == 0 {
+		return errors.New("empty certificate chain")
+	}
+
+	chain := []byte{}
+	for _, der := range ders {
+		chain = append(chain,
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(m.CertsDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write the key first: if we fail to write the chain, the old one will
+	// not match, and the pair will fail to load; but the next check will
+	// notice and obtain a new certificate.
+	err = safeio.WriteFile(filepath.Join(dir, "privkey.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		0600)
+	if err != nil {
+		return err
+	}
+	return safeio.WriteFile(filepath.Join(dir, "fullchain.pem"), chain, 0644)
+}
+
+// GetConfigForClient answers the TLS-ALPN-01 challenges. It is meant to be
+// used from the tls.Config.GetConfigForClient of our listeners: for
+// connections from the ACME server validating a challenge in progress, it
+// returns a configuration with the challenge certificate. For all others, it
+// returns nil, so the listener's configuration is used.
+func (m *Manager) GetConfigForClient(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+	if !IsChallenge(chi) {
+		return nil, nil
+	}
+
+	m.mu.Lock()
+	cert := m.challengeCerts[strings.ToLower(chi.ServerName)]
+	m.mu.Unlock()
+	if cert == nil {
+		return nil, fmt.Errorf("no ACME challenge in progress for %q",
+			chi.ServerName)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{alpnProto},
+	}, nil
+}
+
+// IsChallenge returns true if the client is asking for a TLS-ALPN-01
+// challenge.
+func IsChallenge(chi *tls.ClientHelloInfo) bool {
+	for _, p := range chi.SupportedProtos {
+		if p == alpnProto {
+			return true
+		}
+	}
+	return false
+}
+
+// IsChallengeConn returns true if the connection's state shows it was used
+// for a TLS-ALPN-01 challenge. These connections are only used for the
+// handshake, and should be closed afterwards.
+func IsChallengeConn(cs *tls.ConnectionState) bool {
+	return cs.NegotiatedProtocol == alpnProto
+}
@@ -0,0 +1,616 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+)
+
+// fakeCA is an in-process ACME server, implementing just enough of RFC 8555
+// for our client. It does not verify the JWS signatures, but it does
+// validate the challenges, using the validate function.
+type fakeCA struct {
+	srv *httptest.Server
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	// Validates a challenge of the given type, for the name, with the
+	// expected key authorization.
+	validate func(typ, name, keyAuth string) error
+
+	// Validity of the certificates we issue.
+	validity time.Duration
+
+	mu sync.Mutex
+
+	// Thumbprint of the registered account key, and how many times an
+	// account was created.
+	thumbprint  string
+	newAccounts int
+
+	orders []*fakeOrder
+	issued int
+}
+
+type fakeOrder struct {
+	name   string
+	status string // Of the order.
+	authz  string // Status of the authorization.
+	cert   []byte
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	t.Helper()
+	ca := &fakeCA{validity: 90 * 24 * time.Hour}
+
+	var err error
+	ca.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, tmpl, &ca.caKey.PublicKey, ca.caKey)
+	if err != nil {
+		t.Fatalf("error creating CA certificate: %v", err)
+	}
+	ca.caCert, _ = x509.ParseCertificate(der)
+
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.handle))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) url(path string, a ...interface{}) string {
+	return ca.srv.URL + fmt.Sprintf(path, a...)
+}
+
+func (ca *fakeCA) handle(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+	if r.URL.Path == "/directory" {
+		reply(w, http.StatusOK, map[string]string{
+			"newNonce":   ca.url("/nonce"),
+			"newAccount": ca.url("/account"),
+			"newOrder":   ca.url("/order"),
+			"revokeCert": ca.url("/revoke"),
+			"keyChange":  ca.url("/keychange"),
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Everything else is a POST with a JWS.
+	var jws struct{ Protected, Payload string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		problem(w, "malformed", err)
+		return
+	}
+	var protected struct {
+		JWK *struct{ X, Y string }
+		KID string
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err == nil {
+		err = decodeB64JSON(jws.Protected, &protected)
+	}
+	if err != nil {
+		problem(w, "malformed", err)
+		return
+	}
+
+	var id int
+	switch {
+	case r.URL.Path == "/account":
+		tp, err := thumbprint(protected.JWK)
+		if err != nil {
+			problem(w, "malformed", err)
+			return
+		}
+		w.Header().Set("Location", ca.url("/account/1"))
+		status := http.StatusOK
+		if tp != ca.thumbprint {
+			ca.thumbprint = tp
+			ca.newAccounts++
+			status = http.StatusCreated
+		}
+		reply(w, status, map[string]string{"status": "valid"})
+		return
+	case protected.KID != ca.url("/account/1"):
+		problem(w, "accountDoesNotExist", errors.New("unknown account"))
+		return
+	case r.URL.Path == "/order":
+		var req struct {
+			Identifiers []struct{ Value string }
+		}
+		if err := json.Unmarshal(payload, &req); err != nil ||
+			len(req.Identifiers) != 1 {
+			problem(w, "malformed", err)
+			return
+		}
+		ca.orders = append(ca.orders, &fakeOrder{
+			name:   req.Identifiers[0].Value,
+			status: "pending",
+			authz:  "pending",
+		})
+		id = len(ca.orders) - 1
+		w.Header().Set("Location", ca.url("/orders/%d", id))
+		reply(w, http.StatusCreated, ca.orderJSON(id))
+		return
+	}
+
+	var what, typ string
+	fmt.Sscanf(strings.ReplaceAll(r.URL.Path, "/", " "), "%s %d %s",
+		&what, &id, &typ)
+	if id < 0 || id >= len(ca.orders) {
+		http.NotFound(w, r)
+		return
+	}
+	o := ca.orders[id]
+
+	switch what {
+	case "orders":
+		w.Header().Set("Location", ca.url("/orders/%d", id))
+		reply(w, http.StatusOK, ca.orderJSON(id))
+	case "authz":
+		reply(w, http.StatusOK, map[string]interface{}{
+			"status":     o.authz,
+			"identifier": map[string]string{"type": "dns", "value": o.name},
+			"challenges": []interface{}{
+				ca.challengeJSON(id, "tls-alpn-01"),
+				ca.challengeJSON(id, "dns-01"),
+			},
+		})
+	case "chal":
+		// Validate right away, to keep the client from waiting.
+		keyAuth := fmt.Sprintf("token-%d.%s", id, ca.thumbprint)
+		if err := ca.validate(typ, o.name, keyAuth); err != nil {
+			o.authz, o.status = "invalid", "invalid"
+		} else {
+			o.authz, o.status = "valid", "ready"
+		}
+		reply(w, http.StatusOK, ca.challengeJSON(id, typ))
+	case "finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		csrDER, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil || o.status != "ready" ||
+			len(csr.DNSNames) != 1 || csr.DNSNames[0] != o.name {
+			problem(w, "badCSR", fmt.Errorf("bad CSR %v / %v", csr, err))
+			return
+		}
+		o.cert, err = ca.issue(csr)
+		if err != nil {
+			problem(w, "serverInternal", err)
+			return
+		}
+		o.status = "valid"
+		ca.issued++
+		w.Header().Set("Location", ca.url("/orders/%d", id))
+		reply(w, http.StatusOK, ca.orderJSON(id))
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: o.cert}))
+		w.Write(pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw}))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *fakeCA) orderJSON(id int) map[string]interface{} {
+	o := ca.orders[id]
+	j := map[string]interface{}{
+		"status":         o.status,
+		"identifiers":    []interface{}{map[string]string{"type": "dns", "value": o.name}},
+		"authorizations": []string{ca.url("/authz/%d", id)},
+		"finalize":       ca.url("/finalize/%d", id),
+	}
+	if o.status == "valid" {
+		j["certificate"] = ca.url("/cert/%d", id)
+	}
+	return j
+}
+
+func (ca *fakeCA) challengeJSON(id int, typ string) map[string]string {
+	return map[string]string{
+		"type":   typ,
+		"url":    ca.url("/chal/%d/%s", id, typ),
+		"token":  fmt.Sprintf("token-%d", id),
+		"status": ca.orders[id].authz,
+	}
+}
+
+func (ca *fakeCA) issue(csr *x509.CertificateRequest) ([]byte, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(ca.issued + 100)),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(ca.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return x509.CreateCertificate(
+		rand.Reader, tmpl, ca.caCert, csr.PublicKey, ca.caKey)
+}
+
+func (ca *fakeCA) counts() (int, int) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.newAccounts, ca.issued
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func problem(w http.ResponseWriter, typ string, err error) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:" + typ,
+		"detail": fmt.Sprint(err),
+	})
+}
+
+func decodeB64JSON(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// thumbprint of an EC P-256 JWK, as used in the key authorizations.
+func thumbprint(jwk *struct{ X, Y string }) (string, error) {
+	if jwk == nil {
+		return "", errors.New("missing JWK")
+	}
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return "", err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return "", err
+	}
+	return xacme.JWKThumbprint(&ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	})
+}
+
+// Object identifier of the acmeIdentifier extension, RFC 8737 section 6.1.
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// validateTLSALPN validates a TLS-ALPN-01 challenge the way the ACME server
+// would, connecting to addr.
+func validateTLSALPN(addr, name, keyAuth string) error {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         name,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	cs := conn.ConnectionState()
+	if cs.NegotiatedProtocol != "acme-tls/1" {
+		return fmt.Errorf("negotiated protocol %q", cs.NegotiatedProtocol)
+	}
+	cert := cs.PeerCertificates[0]
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != name {
+		return fmt.Errorf("wrong names: %v", cert.DNSNames)
+	}
+	expected := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeAcmeIdentifier) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil {
+			return err
+		}
+		if string(got) != string(expected[:]) {
+			return errors.New("wrong key authorization")
+		}
+		return nil
+	}
+	return errors.New("acmeIdentifier extension not found")
+}
+
+// listenTLS starts a TLS listener that answers the challenges using the
+// manager, like chasquid's listeners do. Returns its address.
+func listenTLS(t *testing.T, m *Manager) string {
+	t.Helper()
+	l, err := tls.Listen("tcp", "localhost:0", &tls.Config{
+		GetConfigForClient: m.GetConfigForClient,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return nil, errors.New("not a challenge")
+		},
+	})
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func newManager(t *testing.T, ca *fakeCA, names ...string) *Manager {
+	dir := t.TempDir()
+	return &Manager{
+		DirectoryURL: ca.url("/directory"),
+		Email:        "admin@example",
+		Names:        names,
+		CertsDir:     filepath.Join(dir, "certs"),
+		StateDir:     filepath.Join(dir, "state"),
+		DNSHook:      filepath.Join(dir, "hooks", "acme-dns"),
+		RenewBefore:  30 * 24 * time.Hour,
+		HTTPClient:   ca.srv.Client(),
+	}
+}
+
+// checkCert checks that there is a valid certificate stored for the name,
+// and returns it.
+func checkCert(t *testing.T, m *Manager, name string) *x509.Certificate {
+	t.Helper()
+	dir := filepath.Join(m.CertsDir, name)
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem"))
+	if err != nil {
+		t.Fatalf("%s: error loading certificate: %v", name, err)
+	}
+	if len(cert.Certificate) != 2 {
+		t.Errorf("%s: expected a chain of 2, got %d",
+			name, len(cert.Certificate))
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if err := leaf.VerifyHostname(name); err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+	return leaf
+}
+
+func TestTLSALPN(t *testing.T) {
+	ca := newFakeCA(t)
+	m := newManager(t, ca, "a.example", "b.example")
+	addr := listenTLS(t, m)
+	ca.validate = func(typ, name, keyAuth string) error {
+		if typ != "tls-alpn-01" {
+			return fmt.Errorf("unexpected challenge %q", typ)
+		}
+		return validateTLSALPN(addr, name, keyAuth)
+	}
+
+	updates := 0
+	m.OnUpdate = func() { updates++ }
+
+	if err := m.CheckAll(context.Background()); err != nil {
+		t.Fatalf("CheckAll: %v", err)
+	}
+	checkCert(t, m, "a.example")
+	checkCert(t, m, "b.example")
+	if accts, issued := ca.counts(); accts != 1 || issued != 2 {
+		t.Errorf("expected 1 account and 2 certs, got %d and %d",
+			accts, issued)
+	}
+	if updates != 1 {
+		t.Errorf("expected 1 update, got %d", updates)
+	}
+
+	// The challenge certificates are gone once we're done.
+	chi := &tls.ClientHelloInfo{
+		ServerName:      "a.example",
+		SupportedProtos: []string{"acme-tls/1"},
+	}
+	if _, err := m.GetConfigForClient(chi); err == nil {
+		t.Errorf("challenge still in progress after CheckAll")
+	}
+	chi.SupportedProtos = []string{"smtp"}
+	if conf, err := m.GetConfigForClient(chi); conf != nil || err != nil {
+		t.Errorf("non-challenge connection got %v, %v", conf, err)
+	}
+
+	// The certificates are fresh, so checking again should do nothing.
+	if err := m.CheckAll(context.Background()); err != nil {
+		t.Fatalf("CheckAll: %v", err)
+	}
+	if _, issued := ca.counts(); issued != 2 || updates != 1 {
+		t.Errorf("unexpected renewal: %d certs, %d updates", issued, updates)
+	}
+
+	// A new manager with the same state reuses the account.
+	m2 := newManager(t, ca, "c.example")
+	m2.StateDir = m.StateDir
+	addr = listenTLS(t, m2)
+	if err := m2.CheckAll(context.Background()); err != nil {
+		t.Fatalf("CheckAll: %v", err)
+	}
+	checkCert(t, m2, "c.example")
+	if accts, issued := ca.counts(); accts != 1 || issued != 3 {
+		t.Errorf("expected 1 account and 3 certs, got %d and %d",
+			accts, issued)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.validity = 10 * 24 * time.Hour
+	m := newManager(t, ca, "a.example")
+	addr := listenTLS(t, m)
+	ca.validate = func(typ, name, keyAuth string) error {
+		return validateTLSALPN(addr, name, keyAuth)
+	}
+
+	if err := m.CheckAll(context.Background()); err != nil {
+		t.Fatalf("CheckAll: %v", err)
+	}
+	first := checkCert(t, m, "a.example")
+
+	// The certificate expires within RenewBefore, so it gets renewed.
+	if err := m.CheckAll(context.Background()); err != nil {
+		t.Fatalf("CheckAll: %v", err)
+	}
+	second := checkCert(t, m, "a.example")
+	if second.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Errorf("certificate not renewed")
+	}
+	if _, issued := ca.counts(); issued != 2 {
+		t.Errorf("expected 2 certs, got %d", issued)
+	}
+
+	// A broken certificate gets replaced too.
+	err := os.WriteFile(
+		filepath.Join(m.CertsDir, "a.example", "fullchain.pem"),
+		[]byte("broken"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := m.needsCert("a.example"); reason != "invalid certificate" {
+		t.Errorf("unexpected reason: %q", reason)
+	}
+	m.RenewBefore = 0
+	if err := m.CheckAll(context.Background()); err != nil {
+		t.Fatalf("CheckAll: %v", err)
+	}
+	checkCert(t, m, "a.example")
+}
+
+func TestDNS(t *testing.T) {
+	ca := newFakeCA(t)
+	m := newManager(t, ca, "a.example")
+
+	hookLog := filepath.Join(t.TempDir(), "hook.log")
+	os.MkdirAll(filepath.Dir(m.DNSHook), 0755)
+	err := os.WriteFile(m.DNSHook, []byte(
+		"#!/bin/sh\necho \"$1 $2 $3\" >> "+hookLog+"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca.validate = func(typ, name, keyAuth string) error {
+		if typ != "dns-01" {
+			return fmt.Errorf("unexpected challenge %q", typ)
+		}
+		sum := sha256.Sum256([]byte(keyAuth))
+		expected := fmt.Sprintf("add _acme-challenge.%s %s\n",
+			name, base64.RawURLEncoding.EncodeToString(sum[:]))
+		log, _ := os.ReadFile(hookLog)
+		if string(log) != expected {
+			return fmt.Errorf("hook log %q, expected %q", log, expected)
+		}
+		return nil
+	}
+
+	if err := m.CheckAll(context.Background()); err != nil {
+		t.Fatalf("CheckAll: %v", err)
+	}
+	checkCert(t, m, "a.example")
+
+	// The record is removed afterwards.
+	log, _ := os.ReadFile(hookLog)
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1],
+		"remove _acme-challenge.a.example ") {
+		t.Errorf("unexpected hook log: %q", log)
+	}
+
+	// If the hook fails, so do we.
+	os.WriteFile(m.DNSHook, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	m.RenewBefore = 1000 * 24 * time.Hour
+	if err := m.CheckAll(context.Background()); err == nil {
+		t.Errorf("CheckAll succeeded with a failing hook")
+	}
+}
+
+func TestChallengeFails(t *testing.T) {
+	ca := newFakeCA(t)
+	m := newManager(t, ca, "a.example", "b.example")
+	addr := listenTLS(t, m)
+	ca.validate = func(typ, name, keyAuth string) error {
+		if name == "a.example" {
+			return errors.New("nope")
+		}
+		return validateTLSALPN(addr, name, keyAuth)
+	}
+
+	updates := 0
+	m.OnUpdate = func() { updates++ }
+
+	// We keep going after the failure, and get the other certificate.
+	if err := m.CheckAll(context.Background()); err == nil {
+		t.Errorf("CheckAll succeeded with a failing challenge")
+	}
+	if _, err := os.Stat(filepath.Join(m.CertsDir, "a.example")); err == nil {
+		t.Errorf("certificate stored for a failed challenge")
+	}
+	checkCert(t, m, "b.example")
+	if updates != 1 {
+		t.Errorf("expected 1 update, got %d", updates)
+	}
+
+	// Connections that don't expect the challenge protocol don't get it.
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         "b.example",
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		conn.Close()
+		t.Errorf("got a certificate outside of a challenge")
+	}
+}
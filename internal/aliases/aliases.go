@@ -66,6 +66,7 @@ import (
 	"blitiri.com.ar/go/chasquid/internal/envelope"
 	"blitiri.com.ar/go/chasquid/internal/expvarom"
 	"blitiri.com.ar/go/chasquid/internal/normalize"
+	"blitiri.com.ar/go/chasquid/internal/policy"
 	"blitiri.com.ar/go/chasquid/internal/trace"
 )
 
@@ -117,6 +118,10 @@ type Resolver struct {
 	// Path to the resolve hook.
 	ResolveHook string
 
+	// Policy daemon to query instead of running the resolve hook, if not
+	// nil.
+	Policy *policy.Client
+
 	// Function to check if a user exists in the userdb.
 	userExistsInDB existsFn
 
@@ -302,6 +307,19 @@ func (v *Resolver) AddDomain(domain string) {
 	v.mu.Unlock()
 }
 
+// RemoveDomain from the resolver, along with its aliases files and aliases.
+func (v *Resolver) RemoveDomain(domain string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.domains, domain)
+	delete(v.files, domain)
+	for addr := range v.aliases {
+		if envelope.DomainOf(addr) == domain {
+			delete(v.aliases, addr)
+		}
+	}
+}
+
 // AddAliasesFile to the resolver. The file will be parsed, and an error
 // returned if it does not exist or parse correctly.
 func (v *Resolver) AddAliasesFile(domain, path string) error {
@@ -343,7 +361,14 @@ func (v *Resolver) AddAliasForTesting(addr, rcpt string, rType RType) {
 func (v *Resolver) Reload() error {
 	newAliases := map[string][]Recipient{}
 
+	v.mu.Lock()
+	files := map[string][]string{}
 	for domain, paths := range v.files {
+		files[domain] = paths
+	}
+	v.mu.Unlock()
+
+	for domain, paths := range files {
 		for _, path := range paths {
 			aliases, err := parseFile(domain, path)
 			if os.IsNotExist(err) {
@@ -475,6 +500,9 @@ func removeChars(s, chars string) string {
 }
 
 func (v *Resolver) runResolveHook(tr *trace.Trace, addr string) ([]Recipient, error) {
+	if v.Policy != nil {
+		return v.queryPolicy(tr, addr)
+	}
 	if v.ResolveHook == "" {
 		hookResults.Add("resolve:notset", 1)
 		return nil, nil
@@ -512,3 +540,35 @@ func (v *Resolver) runResolveHook(tr *trace.Trace, addr string) ([]Recipient, er
 	hookResults.Add("resolve:success", 1)
 	return rs, nil
 }
+
+// queryPolicy asks the policy daemon for the recipients of the address, in
+// place of the resolve hook.
+func (v *Resolver) queryPolicy(tr *trace.Trace, addr string) ([]Recipient, error) {
+	tr = tr.NewChild("Hook.Alias-Resolve", addr)
+	defer tr.Finish()
+
+	resp, err := v.Policy.Query(&policy.Request{
+		Type:  "alias-resolve",
+		Attrs: map[string]string{"address": addr},
+	}, 5*time.Second)
+	if err == nil && resp.Action != policy.Accept {
+		err = fmt.Errorf("policy daemon replied %v", resp)
+	}
+	if err != nil {
+		hookResults.Add("resolve:fail", 1)
+		tr.Error(err)
+		return nil, err
+	}
+
+	// Each alias is in the same format as the right hand side of aliases
+	// file, see parseRHS.
+	domain := envelope.DomainOf(addr)
+	rs := []Recipient{}
+	for _, a := range resp.Aliases {
+		rs = append(rs, parseRHS(strings.TrimSpace(a), domain)...)
+	}
+
+	tr.Debugf("recipients: %v", rs)
+	hookResults.Add("resolve:success", 1)
+	return rs, nil
+}
@@ -3,12 +3,14 @@ package aliases
 import (
 	"bytes"
 	"errors"
+	"net"
 	"os"
 	"os/exec"
 	"reflect"
 	"strings"
 	"testing"
 
+	"blitiri.com.ar/go/chasquid/internal/policy"
 	"blitiri.com.ar/go/chasquid/internal/trace"
 )
 
@@ -451,6 +453,20 @@ func TestManyFiles(t *testing.T) {
 	}
 
 	check()
+
+	// Remove a domain, its aliases should be gone, even after reloading.
+	resolver.RemoveDomain("d1")
+	for i := 0; i < 2; i++ {
+		cases := Cases{
+			{"a@d1", []Recipient{{"a@d1", EMAIL}}, nil},
+			{"a@domain2", []Recipient{{"b@domain2", EMAIL}}, nil},
+		}
+		cases.check(t, resolver)
+
+		if err := resolver.Reload(); err != nil {
+			t.Fatalf("failed to reload: %v", err)
+		}
+	}
 }
 
 func TestHookError(t *testing.T) {
@@ -484,6 +500,46 @@ func TestHookError(t *testing.T) {
 	}
 }
 
+func TestPolicy(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+	srv := &policy.Server{Handler: func(req *policy.Request) *policy.Response {
+		switch req.Attrs["address"] {
+		case "a@localA":
+			return &policy.Response{
+				Action: policy.Accept, Aliases: []string{"b, c@d", "| cmd"}}
+		case "fail@localA":
+			return &policy.Response{Action: policy.TempFail}
+		default:
+			return &policy.Response{Action: policy.Accept}
+		}
+	}}
+	go srv.Serve(l)
+
+	resolver := NewResolver(allUsersExist)
+	resolver.AddDomain("localA")
+	resolver.Policy, _ = policy.NewClient("tcp:" + l.Addr().String())
+
+	// The hook is not run when there's a policy daemon.
+	resolver.ResolveHook = "testdata/erroring-hook.sh"
+
+	Cases{
+		{"a@localA", []Recipient{
+			{"b@locala", EMAIL}, {"c@d", EMAIL}, {"cmd", PIPE}}, nil},
+		{"x@localA", []Recipient{{"x@localA", EMAIL}}, nil},
+	}.check(t, resolver)
+
+	tr := trace.New("TestPolicy", "test")
+	defer tr.Finish()
+	rcpts, err := resolver.Resolve(tr, "fail@localA")
+	if len(rcpts) != 0 || err == nil {
+		t.Errorf("expected error, got %v, %v", rcpts, err)
+	}
+}
+
 // Fuzz testing for the parser.
 func FuzzReader(f *testing.F) {
 	f.Fuzz(func(t *testing.T, data []byte) {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	"blitiri.com.ar/go/chasquid/internal/normalize"
@@ -21,6 +22,23 @@ type Backend interface {
 	Reload() error
 }
 
+// SCRAMBackend is the interface for authentication backends that can
+// provide the stored SCRAM-SHA-256 credentials of their users (as per RFC
+// 5802, section 3), which are needed to support that SASL mechanism.
+// Backends can implement it in addition to Backend or NoErrorBackend.
+type SCRAMBackend interface {
+	// SCRAMCredentials returns the credentials of the user; ok is false if
+	// they are not available.
+	SCRAMCredentials(user string) (
+		salt []byte, iterations int, storedKey, serverKey []byte, ok bool)
+
+	// AllHaveSCRAMCredentials returns true if all the users have SCRAM
+	// credentials. If some don't (for example, because their passwords were
+	// set before the backend supported them), the mechanism is not offered,
+	// as they would not be able to authenticate with it.
+	AllHaveSCRAMCredentials() bool
+}
+
 // NoErrorBackend is the interface for authentication backends that don't need
 // to emit errors.  This allows backends to avoid unnecessary complexity, in
 // exchange for a bit more here.
@@ -37,7 +55,9 @@ type NoErrorBackend interface {
 type Authenticator struct {
 	// Registered backends, map of domain (string) -> Backend.
 	// Backend operations will _not_ include the domain in the username.
+	// Protected by mu, as domains can be added and removed at any time.
 	backends map[string]Backend
+	mu       sync.RWMutex
 
 	// Fallback backend, to use when backends[domain] (which may not exist)
 	// did not yield a positive result.
@@ -49,6 +69,9 @@ type Authenticator struct {
 	// This will be applied both for successful and unsuccessful attempts.
 	// We will increase this number by 0-20%.
 	AuthDuration time.Duration
+
+	// Secret used to make up the SCRAM salts of unknown users.
+	scramSecret []byte
 }
 
 // NewAuthenticator returns a new Authenticator with no backends.
@@ -56,12 +79,41 @@ func NewAuthenticator() *Authenticator {
 	return &Authenticator{
 		backends:     map[string]Backend{},
 		AuthDuration: 100 * time.Millisecond,
+		scramSecret:  newSCRAMSecret(),
 	}
 }
 
 // Register a backend to use for the given domain.
 func (a *Authenticator) Register(domain string, be Backend) {
+	a.mu.Lock()
 	a.backends[domain] = be
+	a.mu.Unlock()
+}
+
+// Unregister the backend for the given domain, if there is one.
+func (a *Authenticator) Unregister(domain string) {
+	a.mu.Lock()
+	delete(a.backends, domain)
+	a.mu.Unlock()
+}
+
+// backend returns the backend for the given domain, if there is one.
+func (a *Authenticator) backend(domain string) (Backend, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	be, ok := a.backends[domain]
+	return be, ok
+}
+
+// allBackends returns a copy of the registered backends.
+func (a *Authenticator) allBackends() map[string]Backend {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	backends := make(map[string]Backend, len(a.backends))
+	for domain, be := range a.backends {
+		backends[domain] = be
+	}
+	return backends
 }
 
 // Authenticate the user@domain with the given password.
@@ -71,17 +123,9 @@ func (a *Authenticator) Authenticate(tr *trace.Trace, user, domain, password str
 
 	// Make sure the call takes a.AuthDuration + 0-20% regardless of the
 	// outcome, to prevent basic timing attacks.
-	defer func(start time.Time) {
-		elapsed := time.Since(start)
-		delay := a.AuthDuration - elapsed
-		if delay > 0 {
-			maxDelta := int64(float64(delay) * 0.2)
-			delay += time.Duration(rand.Int63n(maxDelta))
-			time.Sleep(delay)
-		}
-	}(time.Now())
+	defer a.slowDown(time.Now())
 
-	if be, ok := a.backends[domain]; ok {
+	if be, ok := a.backend(domain); ok {
 		ok, err := be.Authenticate(user, password)
 		tr.Debugf("Backend: %v %v", ok, err)
 		if ok || err != nil {
@@ -103,12 +147,23 @@ func (a *Authenticator) Authenticate(tr *trace.Trace, user, domain, password str
 	return false, nil
 }
 
+// slowDown sleeps so that the time since start is a.AuthDuration + 0-20%.
+func (a *Authenticator) slowDown(start time.Time) {
+	elapsed := time.Since(start)
+	delay := a.AuthDuration - elapsed
+	if delay > 0 {
+		maxDelta := int64(float64(delay) * 0.2)
+		delay += time.Duration(rand.Int63n(maxDelta))
+		time.Sleep(delay)
+	}
+}
+
 // Exists checks that user@domain exists.
 func (a *Authenticator) Exists(tr *trace.Trace, user, domain string) (bool, error) {
 	tr = tr.NewChild("Auth.Exists", user+"@"+domain)
 	defer tr.Finish()
 
-	if be, ok := a.backends[domain]; ok {
+	if be, ok := a.backend(domain); ok {
 		ok, err := be.Exists(user)
 		tr.Debugf("Backend: %v %v", ok, err)
 		if ok || err != nil {
@@ -130,11 +185,57 @@ func (a *Authenticator) Exists(tr *trace.Trace, user, domain string) (bool, erro
 	return false, nil
 }
 
+// scramCredentials returns the SCRAM-SHA-256 credentials of user@domain, if
+// available. See SCRAMBackend for details.
+func (a *Authenticator) scramCredentials(user, domain string) (
+	salt []byte, iterations int, storedKey, serverKey []byte, ok bool) {
+	be, _ := a.backend(domain)
+	if be, found := be.(SCRAMBackend); found {
+		salt, iterations, storedKey, serverKey, ok = be.SCRAMCredentials(user)
+		if ok {
+			return
+		}
+	}
+
+	if be, found := a.Fallback.(SCRAMBackend); found {
+		id := user
+		if domain != "" {
+			id = user + "@" + domain
+		}
+		return be.SCRAMCredentials(id)
+	}
+
+	return nil, 0, nil, nil, false
+}
+
+// supportsSCRAM returns true if all the backends support SCRAM, and have
+// SCRAM credentials for all their users.
+func (a *Authenticator) supportsSCRAM() bool {
+	backends := a.allBackends()
+	if len(backends) == 0 && a.Fallback == nil {
+		return false
+	}
+	for _, be := range backends {
+		if !hasSCRAM(be) {
+			return false
+		}
+	}
+	if a.Fallback != nil && !hasSCRAM(a.Fallback) {
+		return false
+	}
+	return true
+}
+
+func hasSCRAM(be Backend) bool {
+	sbe, ok := be.(SCRAMBackend)
+	return ok && sbe.AllHaveSCRAMCredentials()
+}
+
 // Reload the registered backends.
 func (a *Authenticator) Reload() error {
 	msgs := []string{}
 
-	for domain, be := range a.backends {
+	for domain, be := range a.allBackends() {
 		tr := trace.New("Auth.Reload", domain)
 		err := be.Reload()
 		if err != nil {
@@ -177,7 +278,12 @@ func DecodeResponse(response string) (user, domain, passwd string, err error) {
 	if err != nil {
 		return
 	}
+	return decodePlain(buf)
+}
 
+// decodePlain decodes a (base64-decoded) plain auth response.
+// See DecodeResponse for details.
+func decodePlain(buf []byte) (user, domain, passwd string, err error) {
 	bufsp := bytes.SplitN(buf, []byte{0}, 3)
 	if len(bufsp) != 3 {
 		err = fmt.Errorf("response pieces != 3, as per RFC")
@@ -207,6 +313,13 @@ func DecodeResponse(response string) (user, domain, passwd string, err error) {
 		}
 	}
 
+	user, domain, err = splitIdentity(identity)
+	return
+}
+
+// splitIdentity splits the identity into user and domain, and normalizes
+// them.
+func splitIdentity(identity string) (user, domain string, err error) {
 	if identity == "" {
 		err = fmt.Errorf("empty identity, must be in the form user@domain")
 		return
@@ -239,7 +352,11 @@ func DecodeResponse(response string) (user, domain, passwd string, err error) {
 // WrapNoErrorBackend wraps a NoErrorBackend, converting it into a valid
 // Backend. This is normally used in Auth.Register calls, to register no-error
 // backends.
+// If the backend implements SCRAMBackend, so will the wrapped one.
 func WrapNoErrorBackend(be NoErrorBackend) Backend {
+	if sbe, ok := be.(SCRAMBackend); ok {
+		return &wrapNoErrorSCRAMBackend{wrapNoErrorBackend{be}, sbe}
+	}
 	return &wrapNoErrorBackend{be}
 }
 
@@ -247,6 +364,11 @@ type wrapNoErrorBackend struct {
 	be NoErrorBackend
 }
 
+type wrapNoErrorSCRAMBackend struct {
+	wrapNoErrorBackend
+	SCRAMBackend
+}
+
 func (w *wrapNoErrorBackend) Authenticate(user, password string) (bool, error) {
 	return w.be.Authenticate(user, password), nil
 }
@@ -212,6 +212,11 @@ func TestMultipleBackends(t *testing.T) {
 	for _, c := range cases {
 		check(t, a, c.user, c.domain, c.password, false)
 	}
+
+	// Once unregistered, the domain's users only go to the fallback.
+	a.Unregister("domain1")
+	check(t, a, "user1", "domain1", "passwd1", false)
+	check(t, a, "user4", "domain1", "passwd4", true)
 }
 
 func TestErrors(t *testing.T) {
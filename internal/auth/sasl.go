@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// Errors returned by sessions, so callers can tell them apart (and reply
+// accordingly).
+var (
+	// The client's response could not be parsed.
+	ErrMalformed = errors.New("malformed response")
+
+	// The credentials are not valid.
+	ErrAuthFailed = errors.New("incorrect user or password")
+
+	// The mechanism is unknown, or not supported by the backends.
+	ErrUnsupportedMechanism = errors.New("unsupported mechanism")
+)
+
+// Session is the server side of a single SASL authentication exchange.
+// https://tools.ietf.org/html/rfc4422
+type Session interface {
+	// Next processes the response from the client, and returns the challenge
+	// to send back to it. The response is nil if the client did not send
+	// an initial response.
+	// When the exchange has completed successfully, done is true.
+	// If there is an error, the exchange is aborted; see the errors above for
+	// the ones with special meaning. Other errors are (temporary) backend
+	// failures.
+	Next(response []byte) (challenge []byte, done bool, err error)
+
+	// Identity returns the user and domain being authenticated, if they are
+	// known.
+	Identity() (user, domain string)
+}
+
+// mechanism is an entry in the registry of supported SASL mechanisms.
+type mechanism struct {
+	name string
+
+	// Start a new session.
+	start func(a *Authenticator, tr *trace.Trace) Session
+
+	// Can the authenticator's backends support this mechanism?
+	supported func(a *Authenticator) bool
+}
+
+// Registry of the supported SASL mechanisms, in the order we advertise them.
+var mechanisms = []mechanism{
+	{"PLAIN", newPlainSession, alwaysSupported},
+	{"LOGIN", newLoginSession, alwaysSupported},
+	{"SCRAM-SHA-256", newSCRAMSession, (*Authenticator).supportsSCRAM},
+}
+
+func alwaysSupported(a *Authenticator) bool {
+	return true
+}
+
+// Mechanisms returns the names of the SASL mechanisms that can be used with
+// the registered backends.
+func (a *Authenticator) Mechanisms() []string {
+	names := []string{}
+	for _, m := range mechanisms {
+		if m.supported(a) {
+			names = append(names, m.name)
+		}
+	}
+	return names
+}
+
+// NewSession starts a new SASL session using the given mechanism.
+// The name is expected in upper case, as it's matched exactly.
+func (a *Authenticator) NewSession(tr *trace.Trace, name string) (Session, error) {
+	for _, m := range mechanisms {
+		if m.name == name && m.supported(a) {
+			return m.start(a, tr), nil
+		}
+	}
+	return nil, ErrUnsupportedMechanism
+}
+
+// checkPassword authenticates user@domain with the given password, and
+// returns the results as a Session would.
+func checkPassword(a *Authenticator, tr *trace.Trace, user, domain, passwd string) ([]byte, bool, error) {
+	ok, err := a.Authenticate(tr, user, domain, passwd)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, ErrAuthFailed
+	}
+	return nil, true, nil
+}
+
+// PLAIN mechanism.
+// https://tools.ietf.org/html/rfc4616
+type plainSession struct {
+	a            *Authenticator
+	tr           *trace.Trace
+	user, domain string
+}
+
+func newPlainSession(a *Authenticator, tr *trace.Trace) Session {
+	return &plainSession{a: a, tr: tr}
+}
+
+func (s *plainSession) Next(response []byte) ([]byte, bool, error) {
+	// The client sends the credentials in its first message. If it didn't
+	// send an initial response, ask for it with an empty challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	user, domain, passwd, err := decodePlain(response)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	s.user, s.domain = user, domain
+
+	return checkPassword(s.a, s.tr, user, domain, passwd)
+}
+
+func (s *plainSession) Identity() (string, string) {
+	return s.user, s.domain
+}
+
+// LOGIN mechanism. It is obsolete and was never formally specified, but it
+// is still widely used by older clients.
+// https://datatracker.ietf.org/doc/html/draft-murchison-sasl-login-00
+type loginSession struct {
+	a            *Authenticator
+	tr           *trace.Trace
+	gotUser      bool
+	user, domain string
+}
+
+func newLoginSession(a *Authenticator, tr *trace.Trace) Session {
+	return &loginSession{a: a, tr: tr}
+}
+
+func (s *loginSession) Next(response []byte) ([]byte, bool, error) {
+	if !s.gotUser {
+		// Some clients send the username as the initial response.
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+
+		user, domain, err := splitIdentity(string(response))
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %v", ErrMalformed, err)
+		}
+		s.user, s.domain = user, domain
+		s.gotUser = true
+		return []byte("Password:"), false, nil
+	}
+
+	return checkPassword(s.a, s.tr, s.user, s.domain, string(response))
+}
+
+func (s *loginSession) Identity() (string, string) {
+	return s.user, s.domain
+}
+
+// EXTERNAL mechanism, for clients that were already authenticated by
+// external means, like a TLS client certificate. The exchange only
+// confirms the identity to use.
+// https://tools.ietf.org/html/rfc4422#appendix-A
+//
+// It is not in the registry of mechanisms, as it depends on the connection
+// and not on the backends: use NewExternalSession instead.
+type externalSession struct {
+	tr           *trace.Trace
+	user, domain string
+}
+
+// NewExternalSession starts a SASL EXTERNAL session, for a client that was
+// authenticated as user@domain by external means.
+func NewExternalSession(tr *trace.Trace, user, domain string) Session {
+	return &externalSession{tr: tr, user: user, domain: domain}
+}
+
+func (s *externalSession) Next(response []byte) ([]byte, bool, error) {
+	// The client sends the authorization identity in its first message. If
+	// it didn't send an initial response, ask for it with an empty
+	// challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	// An empty identity means the one we got externally.
+	if len(response) == 0 {
+		return nil, true, nil
+	}
+
+	// Otherwise, it must be the same one: we don't support acting as other
+	// users.
+	user, domain, err := splitIdentity(string(response))
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if user != s.user || domain != s.domain {
+		s.tr.Debugf("external identity %s@%s, requested %s@%s",
+			s.user, s.domain, user, domain)
+		return nil, false, ErrAuthFailed
+	}
+	return nil, true, nil
+}
+
+func (s *externalSession) Identity() (string, string) {
+	return s.user, s.domain
+}
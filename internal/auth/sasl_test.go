@@ -0,0 +1,409 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"blitiri.com.ar/go/chasquid/internal/dovecot"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+	"blitiri.com.ar/go/chasquid/internal/userdb"
+)
+
+// Backend implementation for testing, which supports SCRAM.
+type scramTestBE struct {
+	*TestBE
+	salt       []byte
+	iterations int
+}
+
+func newSCRAMTestBE(salt string) *scramTestBE {
+	s, _ := base64.StdEncoding.DecodeString(salt)
+	return &scramTestBE{TestBE: NewTestBE(), salt: s, iterations: 4096}
+}
+
+func (b *scramTestBE) SCRAMCredentials(user string) (
+	[]byte, int, []byte, []byte, bool) {
+	passwd, ok := b.users[user]
+	if !ok {
+		return nil, 0, nil, nil, false
+	}
+	salted := pbkdf2.Key([]byte(passwd), b.salt, b.iterations,
+		sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(hmacSHA256(salted, []byte("Client Key")))
+	serverKey := hmacSHA256(salted, []byte("Server Key"))
+	return b.salt, b.iterations, storedKey[:], serverKey, true
+}
+
+func (b *scramTestBE) AllHaveSCRAMCredentials() bool {
+	return true
+}
+
+func TestMechanisms(t *testing.T) {
+	// A user database with a user that has no SCRAM credentials, like the
+	// ones written by older versions.
+	oldDB, err := userdb.Load("testdata/no-scram.db")
+	if err != nil {
+		t.Fatalf("error loading database: %v", err)
+	}
+
+	cases := []struct {
+		backends map[string]Backend
+		fallback Backend
+		expected []string
+	}{
+		{nil, nil, []string{"PLAIN", "LOGIN"}},
+		{map[string]Backend{"d": NewTestBE()}, nil,
+			[]string{"PLAIN", "LOGIN"}},
+		{map[string]Backend{"d": newSCRAMTestBE("")}, nil,
+			[]string{"PLAIN", "LOGIN", "SCRAM-SHA-256"}},
+		{map[string]Backend{"d": WrapNoErrorBackend(userdb.New("/dev/null"))},
+			nil, []string{"PLAIN", "LOGIN", "SCRAM-SHA-256"}},
+		{map[string]Backend{"d": WrapNoErrorBackend(oldDB)},
+			nil, []string{"PLAIN", "LOGIN"}},
+		{map[string]Backend{"d1": newSCRAMTestBE(""), "d2": NewTestBE()},
+			nil, []string{"PLAIN", "LOGIN"}},
+		{map[string]Backend{"d": newSCRAMTestBE("")},
+			dovecot.NewAuth("/dev/null", "/dev/null"),
+			[]string{"PLAIN", "LOGIN"}},
+	}
+	for i, c := range cases {
+		a := NewAuthenticator()
+		for domain, be := range c.backends {
+			a.Register(domain, be)
+		}
+		a.Fallback = c.fallback
+
+		if got := a.Mechanisms(); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%d: got %v, expected %v", i, got, c.expected)
+		}
+	}
+
+	// Unsupported mechanisms can't be used.
+	a := NewAuthenticator()
+	a.Register("d", NewTestBE())
+	tr := trace.New("test", "TestMechanisms")
+	defer tr.Finish()
+	for _, name := range []string{"SCRAM-SHA-256", "CRAM-MD5", "plain", ""} {
+		if _, err := a.NewSession(tr, name); err != ErrUnsupportedMechanism {
+			t.Errorf("%q: expected ErrUnsupportedMechanism, got %v",
+				name, err)
+		}
+	}
+}
+
+// exchange runs a SASL session with the given client responses, and returns
+// the server challenges and the final error.
+func exchange(t *testing.T, a *Authenticator, mech string, responses ...string) ([]string, error) {
+	t.Helper()
+	tr := trace.New("test", mech)
+	defer tr.Finish()
+
+	s, err := a.NewSession(tr, mech)
+	if err != nil {
+		t.Fatalf("error starting %s session: %v", mech, err)
+	}
+
+	challenges := []string{}
+	for i, r := range responses {
+		var response []byte
+		if r != "<none>" {
+			response = []byte(r)
+		}
+		challenge, done, err := s.Next(response)
+		if err != nil {
+			return challenges, err
+		}
+		if done {
+			if i != len(responses)-1 {
+				t.Errorf("%s: session done early, after %d responses",
+					mech, i+1)
+			}
+			return challenges, nil
+		}
+		challenges = append(challenges, string(challenge))
+	}
+
+	t.Errorf("%s: session not done after all responses", mech)
+	return challenges, nil
+}
+
+func newTestAuthenticator() *Authenticator {
+	be := newSCRAMTestBE("W22ZaJ0SNY7soEsUEjb6gQ==")
+	be.add("user", "pencil")
+	a := NewAuthenticator()
+	a.Register("", be)
+	a.Register("domain", be)
+	a.AuthDuration = 0
+	return a
+}
+
+func TestPlainSession(t *testing.T) {
+	a := newTestAuthenticator()
+
+	ch, err := exchange(t, a, "PLAIN", "\x00user@domain\x00pencil")
+	if err != nil || len(ch) != 0 {
+		t.Errorf("initial response: got %q, %v", ch, err)
+	}
+
+	ch, err = exchange(t, a, "PLAIN", "<none>", "user@domain\x00\x00pencil")
+	if err != nil || !reflect.DeepEqual(ch, []string{""}) {
+		t.Errorf("no initial response: got %q, %v", ch, err)
+	}
+
+	_, err = exchange(t, a, "PLAIN", "\x00user@domain\x00wrong")
+	if err != ErrAuthFailed {
+		t.Errorf("wrong password: expected ErrAuthFailed, got %v", err)
+	}
+
+	_, err = exchange(t, a, "PLAIN", "user@domain\x00pencil")
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("malformed: expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestLoginSession(t *testing.T) {
+	a := newTestAuthenticator()
+
+	ch, err := exchange(t, a, "LOGIN", "<none>", "user@domain", "pencil")
+	if err != nil || !reflect.DeepEqual(ch, []string{"Username:", "Password:"}) {
+		t.Errorf("no initial response: got %q, %v", ch, err)
+	}
+
+	ch, err = exchange(t, a, "LOGIN", "user@domain", "pencil")
+	if err != nil || !reflect.DeepEqual(ch, []string{"Password:"}) {
+		t.Errorf("initial response: got %q, %v", ch, err)
+	}
+
+	_, err = exchange(t, a, "LOGIN", "user@domain", "wrong")
+	if err != ErrAuthFailed {
+		t.Errorf("wrong password: expected ErrAuthFailed, got %v", err)
+	}
+
+	_, err = exchange(t, a, "LOGIN", "")
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("empty user: expected ErrMalformed, got %v", err)
+	}
+
+	// Backend errors are passed through.
+	be := NewTestBE()
+	be.nextError = errors.New("test error")
+	a = NewAuthenticator()
+	a.Register("domain", be)
+	a.AuthDuration = 0
+	_, err = exchange(t, a, "LOGIN", "user@domain", "pencil")
+	if err != be.nextError {
+		t.Errorf("backend error: expected %v, got %v", be.nextError, err)
+	}
+}
+
+// Example exchange from RFC 7677, section 3.
+const (
+	rfc7677ClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfc7677Nonce       = "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfc7677ServerFirst = "r=" + rfc7677Nonce +
+		",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfc7677ClientFinal = "c=biws,r=" + rfc7677Nonce +
+		",p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfc7677ServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func TestExternalSession(t *testing.T) {
+	tr := trace.New("test", "TestExternalSession")
+	defer tr.Finish()
+
+	cases := []struct {
+		responses []string
+		ok        bool
+		err       error
+	}{
+		// Empty identity, as initial response or after the challenge.
+		{[]string{""}, true, nil},
+		{[]string{"<none>", ""}, true, nil},
+
+		// The same identity, normalized.
+		{[]string{"User@Domain"}, true, nil},
+
+		// Someone else.
+		{[]string{"other@domain"}, false, ErrAuthFailed},
+		{[]string{"user@other"}, false, ErrAuthFailed},
+
+		// Invalid identity.
+		{[]string{"a b@domain"}, false, ErrMalformed},
+	}
+	for _, c := range cases {
+		s := NewExternalSession(tr, "user", "domain")
+		var done bool
+		var err error
+		for _, r := range c.responses {
+			var resp []byte
+			if r != "<none>" {
+				resp = []byte(r)
+			}
+			_, done, err = s.Next(resp)
+		}
+		if done != c.ok || !errors.Is(err, c.err) {
+			t.Errorf("%q: got %v, %v; expected %v, %v",
+				c.responses, done, err, c.ok, c.err)
+		}
+		if user, domain := s.Identity(); user != "user" || domain != "domain" {
+			t.Errorf("%q: unexpected identity %q@%q", c.responses, user, domain)
+		}
+	}
+}
+
+func TestSCRAMSession(t *testing.T) {
+	defer func(f func() string) { scramNonce = f }(scramNonce)
+	scramNonce = func() string { return "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0" }
+
+	a := newTestAuthenticator()
+
+	ch, err := exchange(t, a, "SCRAM-SHA-256",
+		"<none>", rfc7677ClientFirst, rfc7677ClientFinal, "")
+	expected := []string{"", rfc7677ServerFirst, rfc7677ServerFinal}
+	if err != nil || !reflect.DeepEqual(ch, expected) {
+		t.Errorf("RFC 7677 exchange: got %q, %v", ch, err)
+	}
+
+	// Wrong proof.
+	_, err = exchange(t, a, "SCRAM-SHA-256", rfc7677ClientFirst,
+		"c=biws,r="+rfc7677Nonce+
+			",p=AAAAAapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	if err != ErrAuthFailed {
+		t.Errorf("wrong proof: expected ErrAuthFailed, got %v", err)
+	}
+
+	// Unknown user: we must get a plausible server-first message, and fail
+	// at the end.
+	ch, err = exchange(t, a, "SCRAM-SHA-256",
+		"n,,n=unknown,r=rOprNGfwEbeRWgbNEkqO", rfc7677ClientFinal)
+	if err != ErrAuthFailed || len(ch) != 1 || ch[0] == rfc7677ServerFirst {
+		t.Errorf("unknown user: got %q, %v", ch, err)
+	}
+
+	// The salt we make up for an unknown user must not change between
+	// attempts (as it wouldn't for a known one), but differ between users.
+	ch2, _ := exchange(t, a, "SCRAM-SHA-256",
+		"n,,n=unknown,r=rOprNGfwEbeRWgbNEkqO", rfc7677ClientFinal)
+	ch3, _ := exchange(t, a, "SCRAM-SHA-256",
+		"n,,n=unknown2,r=rOprNGfwEbeRWgbNEkqO", rfc7677ClientFinal)
+	if !reflect.DeepEqual(ch, ch2) || reflect.DeepEqual(ch, ch3) {
+		t.Errorf("unknown user: unexpected salts: %q %q %q", ch, ch2, ch3)
+	}
+
+	// Malformed exchanges.
+	cases := [][]string{
+		{"x"},
+		{"p=tls-unique,,n=user,r=abc"},
+		{"n,,r=abc,n=user"},
+		{"n,,n=user"},
+		{"n,,n=user,r="},
+		{"n,,n=us=er,r=abc"},
+		{"n,,n=,r=abc"},
+		{"n,a=other,n=user,r=abc"},
+		{"n,x,n=user,r=abc"},
+		{rfc7677ClientFirst, "c=biws,r=" + rfc7677Nonce},
+		{rfc7677ClientFirst, "c=biws,r=" + rfc7677Nonce + ",p=***"},
+		{rfc7677ClientFirst, "c=eSws,r=" + rfc7677Nonce + ",p=AAAA"},
+		{rfc7677ClientFirst, "c=biws,r=other,p=AAAA"},
+		{rfc7677ClientFirst, "r=" + rfc7677Nonce + ",p=AAAA"},
+		{rfc7677ClientFirst, rfc7677ClientFinal, "x"},
+	}
+	for _, c := range cases {
+		_, err := exchange(t, a, "SCRAM-SHA-256", c...)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("%q: expected ErrMalformed, got %v", c, err)
+		}
+	}
+}
+
+func TestSCRAMWithUserDB(t *testing.T) {
+	db := userdb.New("/dev/null")
+	db.AddUserWithSCRAM("user", "password", 4096)
+
+	a := NewAuthenticator()
+	a.Register("domain", WrapNoErrorBackend(db))
+	a.AuthDuration = 0
+
+	tr := trace.New("test", "TestSCRAMWithUserDB")
+	defer tr.Finish()
+	s, err := a.NewSession(tr, "SCRAM-SHA-256")
+	if err != nil {
+		t.Fatalf("error starting session: %v", err)
+	}
+
+	// Play the client side, with authzid and an escaped username.
+	clientFirstBare := "n=user@domain,r=clientnonce"
+	serverFirst, _, err := s.Next([]byte("n,a=user@domain," + clientFirstBare))
+	if err != nil {
+		t.Fatalf("client-first: %v", err)
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(string(serverFirst), ",") {
+		attrs[kv[:1]] = kv[2:]
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+	if attrs["i"] != "4096" {
+		t.Fatalf("unexpected server-first: %q", serverFirst)
+	}
+
+	salted := pbkdf2.Key([]byte("password"), salt, 4096,
+		sha256.Size, sha256.New)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" +
+		base64.StdEncoding.EncodeToString([]byte("n,a=user@domain,")) +
+		",r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," +
+		withoutProof
+	proof := hmacSHA256(storedKey[:], []byte(authMessage))
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	serverFinal, _, err := s.Next([]byte(withoutProof + ",p=" +
+		base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		t.Fatalf("client-final: %v", err)
+	}
+	serverSignature := hmacSHA256(
+		hmacSHA256(salted, []byte("Server Key")), []byte(authMessage))
+	if string(serverFinal) !=
+		"v="+base64.StdEncoding.EncodeToString(serverSignature) {
+		t.Errorf("unexpected server-final: %q", serverFinal)
+	}
+
+	_, done, err := s.Next([]byte{})
+	if !done || err != nil {
+		t.Errorf("session not done: %v %v", done, err)
+	}
+	if user, domain := s.Identity(); user != "user" || domain != "domain" {
+		t.Errorf("unexpected identity: %q %q", user, domain)
+	}
+}
+
+func TestDecodeSASLName(t *testing.T) {
+	cases := []struct {
+		in, out string
+		ok      bool
+	}{
+		{"user", "user", true},
+		{"a=2Cb=3Dc", "a,b=c", true},
+		{"a=2", "", false},
+		{"a=3d", "", false},
+		{"=", "", false},
+	}
+	for _, c := range cases {
+		out, err := decodeSASLName(c.in)
+		if out != c.out || (err == nil) != c.ok {
+			t.Errorf("decodeSASLName(%q) = %q, %v; expected %q, ok=%v",
+				c.in, out, err, c.out, c.ok)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// SCRAM-SHA-256 mechanism.
+// https://tools.ietf.org/html/rfc5802
+// https://tools.ietf.org/html/rfc7677
+//
+// We don't support channel binding (the -PLUS variant).
+type scramSession struct {
+	a  *Authenticator
+	tr *trace.Trace
+
+	// Step of the exchange we're in: 0 waiting for the client-first message,
+	// 1 for the client-final message, 2 for the client's acknowledgement of
+	// our server-final message.
+	step int
+
+	user, domain string
+
+	// Messages from the exchange, needed to compute the signatures.
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+
+	// Stored credentials of the user. If we don't have them, known is false
+	// and we make up the salt, so we don't reveal whether the user exists.
+	known     bool
+	storedKey []byte
+	serverKey []byte
+}
+
+func newSCRAMSession(a *Authenticator, tr *trace.Trace) Session {
+	return &scramSession{a: a, tr: tr}
+}
+
+func newSCRAMSecret() []byte {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return buf
+}
+
+// Generates the server nonce, can be overridden for testing.
+var scramNonce = func() string {
+	buf := make([]byte, 18)
+	rand.Read(buf)
+	return base64.RawStdEncoding.EncodeToString(buf)
+}
+
+func (s *scramSession) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		// The client starts the exchange. If it didn't send an initial
+		// response, ask for it with an empty challenge.
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		s.step++
+		return s.clientFirst(string(response))
+	case 1:
+		s.step++
+		return s.clientFinal(string(response))
+	default:
+		// The client acknowledges our server-final message with an empty
+		// response.
+		if len(response) != 0 {
+			return nil, false, fmt.Errorf("%w: unexpected response", ErrMalformed)
+		}
+		return nil, true, nil
+	}
+}
+
+func (s *scramSession) Identity() (string, string) {
+	return s.user, s.domain
+}
+
+func (s *scramSession) clientFirst(msg string) ([]byte, bool, error) {
+	// client-first-message = gs2-header client-first-message-bare
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return malformed("invalid client-first message")
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		// "p=" means the client requires channel binding, which we don't
+		// support (and don't advertise).
+		return malformed("unsupported channel binding")
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	// client-first-message-bare = [reserved-mext ","] username "," nonce
+	//                             ["," extensions]
+	attrs := strings.Split(s.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") ||
+		!strings.HasPrefix(attrs[1], "r=") {
+		return malformed("invalid client-first message")
+	}
+
+	username, err := decodeSASLName(attrs[0][2:])
+	if err != nil {
+		return malformed(err.Error())
+	}
+	s.user, s.domain, err = splitIdentity(username)
+	if err != nil {
+		return malformed(err.Error())
+	}
+
+	// The authorization identity, if given, must match the username (we
+	// don't support authorizing as someone else).
+	if parts[1] != "" {
+		authzid, err := decodeSASLName(strings.TrimPrefix(parts[1], "a="))
+		if err != nil || !strings.HasPrefix(parts[1], "a=") {
+			return malformed("invalid authzid")
+		}
+		if authzid != username {
+			return malformed("auth IDs do not match")
+		}
+	}
+
+	clientNonce := attrs[1][2:]
+	if clientNonce == "" {
+		return malformed("empty nonce")
+	}
+	s.nonce = clientNonce + scramNonce()
+
+	salt, iterations, storedKey, serverKey, ok :=
+		s.a.scramCredentials(s.user, s.domain)
+	s.tr.Debugf("SCRAM credentials for %s@%s: %v", s.user, s.domain, ok)
+	if ok {
+		s.known = true
+		s.storedKey = storedKey
+		s.serverKey = serverKey
+	} else {
+		// Derive the salt from the username, so it's the same on every
+		// attempt, as it would be for an existing user.
+		salt = hmacSHA256(s.a.scramSecret,
+			[]byte(s.user+"@"+s.domain))[:16]
+		iterations = 4096
+	}
+
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(salt) +
+		",i=" + strconv.Itoa(iterations)
+	return []byte(s.serverFirst), false, nil
+}
+
+func (s *scramSession) clientFinal(msg string) ([]byte, bool, error) {
+	// client-final-message = client-final-message-without-proof "," proof
+	// client-final-message-without-proof = channel-binding "," nonce
+	//                                      ["," extensions]
+	idx := strings.LastIndex(msg, ",p=")
+	if idx < 0 {
+		return malformed("missing proof")
+	}
+	withoutProof := msg[:idx]
+	proof, err := base64.StdEncoding.DecodeString(msg[idx+3:])
+	if err != nil {
+		return malformed("invalid proof")
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") ||
+		!strings.HasPrefix(attrs[1], "r=") {
+		return malformed("invalid client-final message")
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil || string(cbind) != s.gs2Header {
+		return malformed("channel binding mismatch")
+	}
+	if attrs[1][2:] != s.nonce {
+		return malformed("nonce mismatch")
+	}
+
+	// Make the verification take the same time as other authentications.
+	defer s.a.slowDown(time.Now())
+
+	authMessage := []byte(
+		s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+
+	// ClientKey = ClientProof XOR ClientSignature, and we check that
+	// H(ClientKey) matches the StoredKey.
+	clientSignature := hmacSHA256(s.storedKey, authMessage)
+	if !s.known || len(proof) != len(clientSignature) {
+		return nil, false, ErrAuthFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	computedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(computedKey[:], s.storedKey) != 1 {
+		return nil, false, ErrAuthFailed
+	}
+
+	serverSignature := hmacSHA256(s.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)),
+		false, nil
+}
+
+func malformed(reason string) ([]byte, bool, error) {
+	return nil, false, fmt.Errorf("%w: %s", ErrMalformed, reason)
+}
+
+// decodeSASLName decodes a username or authzid, which have "," and "="
+// encoded as "=2C" and "=3D" respectively.
+func decodeSASLName(s string) (string, error) {
+	r := strings.NewReplacer("=2C", ",", "=3D", "=")
+	d := r.Replace(s)
+	if strings.Count(s, "=") != strings.Count(s, "=2C")+strings.Count(s, "=3D") {
+		return "", fmt.Errorf("invalid encoding in name")
+	}
+	return d, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
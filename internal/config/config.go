@@ -30,6 +30,26 @@ var defaultConfig = &Config{
 	DropCharacters:   proto.String("."),
 
 	MailLogPath: "<syslog>",
+
+	DmarcQuarantineAction: "header",
+
+	DelayNotificationAfter: "4h",
+
+	MaxQueueSizeMb: 1024,
+
+	GreylistingDelay:       "5m",
+	GreylistingRetryWindow: "24h",
+	GreylistingExpiry:      "840h",
+
+	DnsblThreshold: 1,
+	DnsblAction:    "reject",
+
+	ShutdownGracePeriod: "1m",
+	ReloadCheckInterval: "0s",
+
+	UnixSocketMode: "0660",
+
+	TrustedNetworksListeners: []string{"smtp"},
 }
 
 // Load the config from the given file, with the given overrides.
@@ -126,6 +146,139 @@ func override(c, o *Config) {
 	if o.HaproxyIncoming {
 		c.HaproxyIncoming = true
 	}
+	if o.HaproxyTrustTls {
+		c.HaproxyTrustTls = true
+	}
+
+	if len(o.DkimSignedHeaders) > 0 {
+		c.DkimSignedHeaders = o.DkimSignedHeaders
+	}
+	if o.DmarcQuarantineAction != "" {
+		c.DmarcQuarantineAction = o.DmarcQuarantineAction
+	}
+	if o.DelayNotificationAfter != "" {
+		c.DelayNotificationAfter = o.DelayNotificationAfter
+	}
+
+	if o.MaxConnections > 0 {
+		c.MaxConnections = o.MaxConnections
+	}
+	if o.MaxConnectionsPerIp > 0 {
+		c.MaxConnectionsPerIp = o.MaxConnectionsPerIp
+	}
+	if o.MaxConnectionsPerNetwork > 0 {
+		c.MaxConnectionsPerNetwork = o.MaxConnectionsPerNetwork
+	}
+	if o.MaxConnectionRatePerIp > 0 {
+		c.MaxConnectionRatePerIp = o.MaxConnectionRatePerIp
+	}
+	if o.MaxMessagesPerHourPerIp > 0 {
+		c.MaxMessagesPerHourPerIp = o.MaxMessagesPerHourPerIp
+	}
+	if o.MaxRecipientsPerHourPerIp > 0 {
+		c.MaxRecipientsPerHourPerIp = o.MaxRecipientsPerHourPerIp
+	}
+
+	if o.Greylisting {
+		c.Greylisting = true
+	}
+	if o.GreylistingDelay != "" {
+		c.GreylistingDelay = o.GreylistingDelay
+	}
+	if o.GreylistingRetryWindow != "" {
+		c.GreylistingRetryWindow = o.GreylistingRetryWindow
+	}
+	if o.GreylistingExpiry != "" {
+		c.GreylistingExpiry = o.GreylistingExpiry
+	}
+
+	if len(o.Dnsbl) > 0 {
+		c.Dnsbl = o.Dnsbl
+	}
+	if o.DnsblThreshold > 0 {
+		c.DnsblThreshold = o.DnsblThreshold
+	}
+	if o.DnsblAction != "" {
+		c.DnsblAction = o.DnsblAction
+	}
+
+	if o.RestrictSenders {
+		c.RestrictSenders = true
+	}
+
+	if len(o.Milter) > 0 {
+		c.Milter = o.Milter
+	}
+
+	if o.MaxQueueSizeMb > 0 {
+		c.MaxQueueSizeMb = o.MaxQueueSizeMb
+	}
+
+	if o.PolicyDaemon != "" {
+		c.PolicyDaemon = o.PolicyDaemon
+	}
+
+	if o.ShutdownGracePeriod != "" {
+		c.ShutdownGracePeriod = o.ShutdownGracePeriod
+	}
+
+	if o.ReloadCheckInterval != "" {
+		c.ReloadCheckInterval = o.ReloadCheckInterval
+	}
+
+	if o.Acme != nil {
+		c.Acme = o.Acme
+	}
+
+	if o.TlsClientCa != "" {
+		c.TlsClientCa = o.TlsClientCa
+	}
+	if o.TlsClientImplicitAuth {
+		c.TlsClientImplicitAuth = true
+	}
+
+	if len(o.LmtpAddress) > 0 {
+		c.LmtpAddress = o.LmtpAddress
+	}
+
+	if o.UnixSocketMode != "" {
+		c.UnixSocketMode = o.UnixSocketMode
+	}
+	if len(o.UnixPeerAuth) > 0 {
+		c.UnixPeerAuth = o.UnixPeerAuth
+	}
+
+	if len(o.TrustedNetworks) > 0 {
+		c.TrustedNetworks = o.TrustedNetworks
+	}
+	if len(o.TrustedNetworksListeners) > 0 {
+		c.TrustedNetworksListeners = o.TrustedNetworksListeners
+	}
+}
+
+// Changed returns the names of the options that have different values in a
+// and b.
+func Changed(a, b *Config) []string {
+	ra, rb := a.ProtoReflect(), b.ProtoReflect()
+	changed := []string{}
+	fields := ra.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		// Compare configs with only this field, so we can use proto.Equal
+		// for all kinds of fields (including repeated and messages).
+		fa, fb := &Config{}, &Config{}
+		if ra.Has(fd) {
+			fa.ProtoReflect().Set(fd, ra.Get(fd))
+		}
+		if rb.Has(fd) {
+			fb.ProtoReflect().Set(fd, rb.Get(fd))
+		}
+		if !proto.Equal(fa, fb) {
+			changed = append(changed, string(fd.Name()))
+		}
+	}
+	return changed
 }
 
 // LogConfig logs the given configuration, in a human-friendly way.
@@ -136,6 +289,13 @@ func LogConfig(c *Config) {
 	log.Infof("  SMTP Addresses: %v", c.SmtpAddress)
 	log.Infof("  Submission Addresses: %v", c.SubmissionAddress)
 	log.Infof("  Submission+TLS Addresses: %v", c.SubmissionOverTlsAddress)
+	log.Infof("  LMTP Addresses: %v", c.LmtpAddress)
+	log.Infof("  Unix socket mode: %s", c.UnixSocketMode)
+	for _, a := range c.UnixPeerAuth {
+		log.Infof("  Unix peer auth: %s as %s", a.User, a.Address)
+	}
+	log.Infof("  Trusted networks: %v (on: %v)",
+		c.TrustedNetworks, c.TrustedNetworksListeners)
 	log.Infof("  Monitoring address: %s", c.MonitoringAddress)
 	log.Infof("  MDA: %s %v", c.MailDeliveryAgentBin, c.MailDeliveryAgentArgs)
 	log.Infof("  Data directory: %s", c.DataDir)
@@ -152,5 +312,40 @@ func LogConfig(c *Config) {
 	log.Infof("  Mail log: %s", c.MailLogPath)
 	log.Infof("  Dovecot auth: %v (%q, %q)",
 		c.DovecotAuth, c.DovecotUserdbPath, c.DovecotClientPath)
-	log.Infof("  HAProxy incoming: %v", c.HaproxyIncoming)
+	log.Infof("  HAProxy incoming: %v (trust TLS: %v)",
+		c.HaproxyIncoming, c.HaproxyTrustTls)
+	log.Infof("  DKIM signed headers: %v", c.DkimSignedHeaders)
+	log.Infof("  DMARC quarantine action: %s", c.DmarcQuarantineAction)
+	log.Infof("  Delay notification after: %s", c.DelayNotificationAfter)
+	log.Infof("  Max connections: %d (per IP: %d, per network: %d)",
+		c.MaxConnections, c.MaxConnectionsPerIp, c.MaxConnectionsPerNetwork)
+	log.Infof("  Max connection rate per IP (per minute): %d",
+		c.MaxConnectionRatePerIp)
+	log.Infof("  Max messages/recipients per hour per IP: %d/%d",
+		c.MaxMessagesPerHourPerIp, c.MaxRecipientsPerHourPerIp)
+	log.Infof("  Greylisting: %v (delay: %s, retry window: %s, expiry: %s)",
+		c.Greylisting, c.GreylistingDelay, c.GreylistingRetryWindow,
+		c.GreylistingExpiry)
+	for _, z := range c.Dnsbl {
+		log.Infof("  DNSBL: %s (weight: %d, return codes: %v)",
+			z.Zone, z.Weight, z.ReturnCodes)
+	}
+	log.Infof("  DNSBL threshold: %d, action: %s",
+		c.DnsblThreshold, c.DnsblAction)
+	log.Infof("  Restrict senders: %v", c.RestrictSenders)
+	for _, m := range c.Milter {
+		log.Infof("  Milter: %s (timeout: %q, default action: %q)",
+			m.Address, m.Timeout, m.DefaultAction)
+	}
+	log.Infof("  Max queue size (MB): %d", c.MaxQueueSizeMb)
+	log.Infof("  Policy daemon: %s", c.PolicyDaemon)
+	log.Infof("  Shutdown grace period: %s", c.ShutdownGracePeriod)
+	log.Infof("  Reload check interval: %s", c.ReloadCheckInterval)
+	if c.Acme != nil {
+		log.Infof("  ACME: %q (email: %q, names: %v, renew before: %q)",
+			c.Acme.DirectoryUrl, c.Acme.Email, c.Acme.Names,
+			c.Acme.RenewBefore)
+	}
+	log.Infof("  TLS client CA: %q (implicit auth: %v)",
+		c.TlsClientCa, c.TlsClientImplicitAuth)
 }
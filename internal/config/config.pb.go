@@ -37,10 +37,12 @@ type Config struct {
 	// Default: 50.
 	MaxDataSizeMb int64 `protobuf:"varint,2,opt,name=max_data_size_mb,json=maxDataSizeMb,proto3" json:"max_data_size_mb,omitempty"`
 	// Addresses to listen on for SMTP (usually port 25).
+	// Use "unix:<path>" for a unix socket.
 	// Default: "systemd", which means systemd passes sockets to us.
 	// systemd sockets must be named with "FileDescriptorName=smtp".
 	SmtpAddress []string `protobuf:"bytes,3,rep,name=smtp_address,json=smtpAddress,proto3" json:"smtp_address,omitempty"`
 	// Addresses to listen on for submission (usually port 587).
+	// Use "unix:<path>" for a unix socket, see also unix_peer_auth.
 	// Default: "systemd", which means systemd passes sockets to us.
 	// systemd sockets must be named with "FileDescriptorName=submission".
 	SubmissionAddress []string `protobuf:"bytes,4,rep,name=submission_address,json=submissionAddress,proto3" json:"submission_address,omitempty"`
@@ -107,6 +109,165 @@ type Config struct {
 	// This allows deploying chasquid behind a HAProxy server, as the
 	// address information is preserved.
 	HaproxyIncoming bool `protobuf:"varint,16,opt,name=haproxy_incoming,json=haproxyIncoming,proto3" json:"haproxy_incoming,omitempty"`
+	// Headers to include in the DKIM signatures of outgoing (authenticated)
+	// mail. "From" is always included.
+	// Default: a list based on RFC 6376 recommendations (From, Subject, Date,
+	// To, Cc, Message-ID, and a few others).
+	DkimSignedHeaders []string `protobuf:"bytes,17,rep,name=dkim_signed_headers,json=dkimSignedHeaders,proto3" json:"dkim_signed_headers,omitempty"`
+	// What to do with incoming mail that fails DMARC, when the sender's
+	// domain policy is "quarantine". One of:
+	//  - "header": add an X-DMARC-Quarantine header, so it can be filtered
+	//    at delivery time.
+	//  - "reject": reject with a permanent error.
+	//  - "none": only record the result in the Authentication-Results
+	//    header.
+	// Default: "header".
+	DmarcQuarantineAction string `protobuf:"bytes,18,opt,name=dmarc_quarantine_action,json=dmarcQuarantineAction,proto3" json:"dmarc_quarantine_action,omitempty"`
+	// How long a message can be waiting in the queue before we notify the
+	// sender that its delivery is being delayed (only once, and if the
+	// recipients didn't request otherwise). Uses the Go duration format
+	// (e.g. "4h", "90m"). Set to "0s" to disable these notifications.
+	// Default: "4h".
+	DelayNotificationAfter string `protobuf:"bytes,19,opt,name=delay_notification_after,json=delayNotificationAfter,proto3" json:"delay_notification_after,omitempty"`
+	// Maximum number of concurrent incoming connections, in total.
+	MaxConnections int64 `protobuf:"varint,20,opt,name=max_connections,json=maxConnections,proto3" json:"max_connections,omitempty"`
+	// Maximum number of concurrent incoming connections from a single IP
+	// address.
+	MaxConnectionsPerIp int64 `protobuf:"varint,21,opt,name=max_connections_per_ip,json=maxConnectionsPerIp,proto3" json:"max_connections_per_ip,omitempty"`
+	// Maximum number of concurrent incoming connections from a single
+	// network (/24 for IPv4, /64 for IPv6).
+	MaxConnectionsPerNetwork int64 `protobuf:"varint,22,opt,name=max_connections_per_network,json=maxConnectionsPerNetwork,proto3" json:"max_connections_per_network,omitempty"`
+	// Maximum number of new connections per minute from a single IP address.
+	MaxConnectionRatePerIp int64 `protobuf:"varint,23,opt,name=max_connection_rate_per_ip,json=maxConnectionRatePerIp,proto3" json:"max_connection_rate_per_ip,omitempty"`
+	// Maximum number of messages per hour from a single IP address.
+	MaxMessagesPerHourPerIp int64 `protobuf:"varint,24,opt,name=max_messages_per_hour_per_ip,json=maxMessagesPerHourPerIp,proto3" json:"max_messages_per_hour_per_ip,omitempty"`
+	// Maximum number of recipients per hour from a single IP address.
+	MaxRecipientsPerHourPerIp int64 `protobuf:"varint,25,opt,name=max_recipients_per_hour_per_ip,json=maxRecipientsPerHourPerIp,proto3" json:"max_recipients_per_hour_per_ip,omitempty"`
+	// Greylist incoming mail from unauthenticated senders on the SMTP port.
+	// The first delivery attempt for each (client network, sender,
+	// recipient) combination gets a temporary error, and the client has to
+	// retry after a delay. Senders that pass SPF and that we have seen
+	// using TLS before are exempt.
+	// Default: false.
+	Greylisting bool `protobuf:"varint,26,opt,name=greylisting,proto3" json:"greylisting,omitempty"`
+	// How long a client has to wait before retrying, when greylisted.
+	// Uses the Go duration format.
+	// Default: "5m".
+	GreylistingDelay string `protobuf:"bytes,27,opt,name=greylisting_delay,json=greylistingDelay,proto3" json:"greylisting_delay,omitempty"`
+	// How long after the first attempt we accept the retry. Retries after
+	// this window are treated as a first attempt.
+	// Default: "24h".
+	GreylistingRetryWindow string `protobuf:"bytes,28,opt,name=greylisting_retry_window,json=greylistingRetryWindow,proto3" json:"greylisting_retry_window,omitempty"`
+	// How long we remember a combination that passed greylisting, since it
+	// was last seen.
+	// Default: "840h" (35 days).
+	GreylistingExpiry string `protobuf:"bytes,29,opt,name=greylisting_expiry,json=greylistingExpiry,proto3" json:"greylisting_expiry,omitempty"`
+	// DNS blocklists (DNSBLs) to check the address of incoming SMTP
+	// connections against. Each listing adds the zone's weight to the
+	// connection's score. Submission connections are not checked.
+	// Example:
+	//   dnsbl { zone: "zen.spamhaus.org" weight: 2 }
+	//   dnsbl { zone: "bl.spamcop.net" return_codes: "127.0.0.2" }
+	// Default: none.
+	Dnsbl []*DNSBLZone `protobuf:"bytes,30,rep,name=dnsbl,proto3" json:"dnsbl,omitempty"`
+	// Score at which a connection is considered listed.
+	// Default: 1.
+	DnsblThreshold int64 `protobuf:"varint,31,opt,name=dnsbl_threshold,json=dnsblThreshold,proto3" json:"dnsbl_threshold,omitempty"`
+	// What to do with connections from listed addresses. One of:
+	//  - "reject": reject the connection at the greeting.
+	//  - "tag": accept it, but add an X-DNSBL header to the messages.
+	// In both cases, the results are passed to the post-data hook.
+	// Default: "reject".
+	DnsblAction string `protobuf:"bytes,32,opt,name=dnsbl_action,json=dnsblAction,proto3" json:"dnsbl_action,omitempty"`
+	// Only allow authenticated users to send as their own addresses, in both
+	// the envelope (MAIL FROM) and the From header. Variants with suffixes
+	// and drop characters, and aliases that resolve to the user, are also
+	// allowed, as well as the addresses listed for the user in the
+	// domain's "senders" file. Messages without a From header are rejected.
+	// Default: false.
+	RestrictSenders bool `protobuf:"varint,33,opt,name=restrict_senders,json=restrictSenders,proto3" json:"restrict_senders,omitempty"`
+	// Milters (mail filters, using the Sendmail milter protocol) to run on
+	// incoming connections and messages, in order.
+	// Example:
+	//   milter { address: "unix:/run/rspamd/milter.sock" }
+	//   milter { address: "tcp:localhost:8891" default_action: "accept" }
+	// Default: none.
+	Milter []*Milter `protobuf:"bytes,34,rep,name=milter,proto3" json:"milter,omitempty"`
+	// Maximum total size of the messages waiting in the queue, in
+	// megabytes. New messages are rejected with a temporary error while the
+	// queue is over this size.
+	// Default: 1024.
+	MaxQueueSizeMb int64 `protobuf:"varint,35,opt,name=max_queue_size_mb,json=maxQueueSizeMb,proto3" json:"max_queue_size_mb,omitempty"`
+	// Policy daemon to use instead of the hooks, "unix:<path>" or
+	// "tcp:<host>:<port>". chasquid keeps connections open to it, and sends
+	// it a request with the hook's attributes every time it would have run a
+	// hook. See docs/hooks.md for the protocol.
+	// Default: none (run the hooks).
+	PolicyDaemon string `protobuf:"bytes,36,opt,name=policy_daemon,json=policyDaemon,proto3" json:"policy_daemon,omitempty"`
+	// Trust the TLS information sent by the proxy (when using the HAProxy
+	// protocol v2, and the proxy sends the SSL TLV). If the client connected
+	// to the proxy over TLS, the connection is treated as if it was over TLS,
+	// for example to allow authentication.
+	// Default: false.
+	HaproxyTrustTls bool `protobuf:"varint,37,opt,name=haproxy_trust_tls,json=haproxyTrustTls,proto3" json:"haproxy_trust_tls,omitempty"`
+	// How long to wait on shutdown for the open transactions to finish, and
+	// for the delivery attempts in progress to complete. After that, the
+	// remaining connections are closed, and the queue is saved so the
+	// deliveries are retried on the next start.
+	// Default: "1m".
+	ShutdownGracePeriod string `protobuf:"bytes,38,opt,name=shutdown_grace_period,json=shutdownGracePeriod,proto3" json:"shutdown_grace_period,omitempty"`
+	// How often to check the configuration, the certificates and the
+	// domains directory for changes, and reload them if there are any. They
+	// are always reloaded on SIGHUP, this is only needed to do it
+	// automatically. "0s" disables the checks.
+	// Default: "0s".
+	ReloadCheckInterval string `protobuf:"bytes,39,opt,name=reload_check_interval,json=reloadCheckInterval,proto3" json:"reload_check_interval,omitempty"`
+	// Obtain and renew the TLS certificates automatically, using ACME (for
+	// example, from Let's Encrypt). See the ACME message for details.
+	// Default: disabled.
+	Acme *ACME `protobuf:"bytes,40,opt,name=acme,proto3" json:"acme,omitempty"`
+	// Path to a file with the CA certificates (in PEM format) to verify TLS
+	// client certificates against. If set, clients on the submission ports
+	// are asked for a certificate; if it is valid, and its subject
+	// alternative names or subject contain an address in one of our domains,
+	// they can authenticate as it using AUTH EXTERNAL.
+	// Default: none (client certificates are not used).
+	TlsClientCa string `protobuf:"bytes,41,opt,name=tls_client_ca,json=tlsClientCa,proto3" json:"tls_client_ca,omitempty"`
+	// Authenticate clients with a valid TLS client certificate implicitly,
+	// without them needing to use AUTH EXTERNAL.
+	// Default: false.
+	TlsClientImplicitAuth bool `protobuf:"varint,42,opt,name=tls_client_implicit_auth,json=tlsClientImplicitAuth,proto3" json:"tls_client_implicit_auth,omitempty"`
+	// Addresses to listen on for LMTP (RFC 2033), for content filters and
+	// other MTAs in front of chasquid to hand off mail locally. Use
+	// "unix:<path>" for a unix socket, or "systemd" for sockets named with
+	// "FileDescriptorName=lmtp".
+	// Default: none.
+	LmtpAddress []string `protobuf:"bytes,43,rep,name=lmtp_address,json=lmtpAddress,proto3" json:"lmtp_address,omitempty"`
+	// Permissions of the unix sockets we listen on, in octal (like chmod).
+	// Default: "0660".
+	UnixSocketMode string `protobuf:"bytes,44,opt,name=unix_socket_mode,json=unixSocketMode,proto3" json:"unix_socket_mode,omitempty"`
+	// Local users that are authenticated implicitly when they connect to a
+	// submission unix socket, as the given address (which must be in one of
+	// our domains). The user is identified by the kernel, using the peer
+	// credentials of the socket (only supported on Linux).
+	// Example:
+	//   unix_peer_auth { user: "www-data" address: "webapp@example.com" }
+	// Default: none.
+	UnixPeerAuth []*UnixPeerAuth `protobuf:"bytes,45,rep,name=unix_peer_auth,json=unixPeerAuth,proto3" json:"unix_peer_auth,omitempty"`
+	// Networks (in CIDR notation) whose clients can relay mail without
+	// authenticating, like printers or legacy applications in internal
+	// networks, on the listeners in trusted_networks_listeners. They are
+	// also exempt from the SPF, DMARC, DNSBL and greylisting checks. Their
+	// mail is not DKIM-signed, as the sender was not authenticated.
+	// With haproxy_incoming, the client's address is the one given by the
+	// proxy.
+	// Example: trusted_networks: "192.168.1.0/24"
+	// Default: none.
+	TrustedNetworks []string `protobuf:"bytes,46,rep,name=trusted_networks,json=trustedNetworks,proto3" json:"trusted_networks,omitempty"`
+	// Listeners where trusted_networks apply, any of "smtp", "submission",
+	// "submission_tls" and "lmtp".
+	// Default: "smtp".
+	TrustedNetworksListeners []string `protobuf:"bytes,47,rep,name=trusted_networks_listeners,json=trustedNetworksListeners,proto3" json:"trusted_networks_listeners,omitempty"`
 }
 
 func (x *Config) Reset() {
@@ -253,11 +414,506 @@ func (x *Config) GetHaproxyIncoming() bool {
 	return false
 }
 
+func (x *Config) GetDkimSignedHeaders() []string {
+	if x != nil {
+		return x.DkimSignedHeaders
+	}
+	return nil
+}
+
+func (x *Config) GetDmarcQuarantineAction() string {
+	if x != nil {
+		return x.DmarcQuarantineAction
+	}
+	return ""
+}
+
+func (x *Config) GetDelayNotificationAfter() string {
+	if x != nil {
+		return x.DelayNotificationAfter
+	}
+	return ""
+}
+
+func (x *Config) GetMaxConnections() int64 {
+	if x != nil {
+		return x.MaxConnections
+	}
+	return 0
+}
+
+func (x *Config) GetMaxConnectionsPerIp() int64 {
+	if x != nil {
+		return x.MaxConnectionsPerIp
+	}
+	return 0
+}
+
+func (x *Config) GetMaxConnectionsPerNetwork() int64 {
+	if x != nil {
+		return x.MaxConnectionsPerNetwork
+	}
+	return 0
+}
+
+func (x *Config) GetMaxConnectionRatePerIp() int64 {
+	if x != nil {
+		return x.MaxConnectionRatePerIp
+	}
+	return 0
+}
+
+func (x *Config) GetMaxMessagesPerHourPerIp() int64 {
+	if x != nil {
+		return x.MaxMessagesPerHourPerIp
+	}
+	return 0
+}
+
+func (x *Config) GetMaxRecipientsPerHourPerIp() int64 {
+	if x != nil {
+		return x.MaxRecipientsPerHourPerIp
+	}
+	return 0
+}
+
+func (x *Config) GetGreylisting() bool {
+	if x != nil {
+		return x.Greylisting
+	}
+	return false
+}
+
+func (x *Config) GetGreylistingDelay() string {
+	if x != nil {
+		return x.GreylistingDelay
+	}
+	return ""
+}
+
+func (x *Config) GetGreylistingRetryWindow() string {
+	if x != nil {
+		return x.GreylistingRetryWindow
+	}
+	return ""
+}
+
+func (x *Config) GetGreylistingExpiry() string {
+	if x != nil {
+		return x.GreylistingExpiry
+	}
+	return ""
+}
+
+func (x *Config) GetDnsbl() []*DNSBLZone {
+	if x != nil {
+		return x.Dnsbl
+	}
+	return nil
+}
+
+func (x *Config) GetDnsblThreshold() int64 {
+	if x != nil {
+		return x.DnsblThreshold
+	}
+	return 0
+}
+
+func (x *Config) GetDnsblAction() string {
+	if x != nil {
+		return x.DnsblAction
+	}
+	return ""
+}
+
+func (x *Config) GetRestrictSenders() bool {
+	if x != nil {
+		return x.RestrictSenders
+	}
+	return false
+}
+
+func (x *Config) GetMilter() []*Milter {
+	if x != nil {
+		return x.Milter
+	}
+	return nil
+}
+
+func (x *Config) GetMaxQueueSizeMb() int64 {
+	if x != nil {
+		return x.MaxQueueSizeMb
+	}
+	return 0
+}
+
+func (x *Config) GetPolicyDaemon() string {
+	if x != nil {
+		return x.PolicyDaemon
+	}
+	return ""
+}
+
+func (x *Config) GetHaproxyTrustTls() bool {
+	if x != nil {
+		return x.HaproxyTrustTls
+	}
+	return false
+}
+
+func (x *Config) GetShutdownGracePeriod() string {
+	if x != nil {
+		return x.ShutdownGracePeriod
+	}
+	return ""
+}
+
+func (x *Config) GetReloadCheckInterval() string {
+	if x != nil {
+		return x.ReloadCheckInterval
+	}
+	return ""
+}
+
+func (x *Config) GetAcme() *ACME {
+	if x != nil {
+		return x.Acme
+	}
+	return nil
+}
+
+func (x *Config) GetTlsClientCa() string {
+	if x != nil {
+		return x.TlsClientCa
+	}
+	return ""
+}
+
+func (x *Config) GetTlsClientImplicitAuth() bool {
+	if x != nil {
+		return x.TlsClientImplicitAuth
+	}
+	return false
+}
+
+func (x *Config) GetLmtpAddress() []string {
+	if x != nil {
+		return x.LmtpAddress
+	}
+	return nil
+}
+
+func (x *Config) GetUnixSocketMode() string {
+	if x != nil {
+		return x.UnixSocketMode
+	}
+	return ""
+}
+
+func (x *Config) GetUnixPeerAuth() []*UnixPeerAuth {
+	if x != nil {
+		return x.UnixPeerAuth
+	}
+	return nil
+}
+
+func (x *Config) GetTrustedNetworks() []string {
+	if x != nil {
+		return x.TrustedNetworks
+	}
+	return nil
+}
+
+func (x *Config) GetTrustedNetworksListeners() []string {
+	if x != nil {
+		return x.TrustedNetworksListeners
+	}
+	return nil
+}
+
+type DNSBLZone struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Domain of the zone, e.g. "zen.spamhaus.org".
+	Zone string `protobuf:"bytes,1,opt,name=zone,proto3" json:"zone,omitempty"`
+	// Weight to add to the score when the address is listed.
+	// Default: 1.
+	Weight int64 `protobuf:"varint,2,opt,name=weight,proto3" json:"weight,omitempty"`
+	// Return codes that count as a listing, e.g. "127.0.0.2".
+	// Default: any code in 127.0.0.0/8.
+	ReturnCodes []string `protobuf:"bytes,3,rep,name=return_codes,json=returnCodes,proto3" json:"return_codes,omitempty"`
+}
+
+func (x *DNSBLZone) Reset() {
+	*x = DNSBLZone{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_config_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DNSBLZone) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DNSBLZone) ProtoMessage() {}
+
+func (x *DNSBLZone) ProtoReflect() protoreflect.Message {
+	mi := &file_config_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DNSBLZone.ProtoReflect.Descriptor instead.
+func (*DNSBLZone) Descriptor() ([]byte, []int) {
+	return file_config_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DNSBLZone) GetZone() string {
+	if x != nil {
+		return x.Zone
+	}
+	return ""
+}
+
+func (x *DNSBLZone) GetWeight() int64 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+func (x *DNSBLZone) GetReturnCodes() []string {
+	if x != nil {
+		return x.ReturnCodes
+	}
+	return nil
+}
+
+type UnixPeerAuth struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Name of the local (unix) user.
+	User string `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"`
+	// Address to authenticate the user as.
+	Address string `protobuf:"bytes,2,opt,name=address,proto3" json:"address,omitempty"`
+}
+
+func (x *UnixPeerAuth) Reset() {
+	*x = UnixPeerAuth{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_config_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *UnixPeerAuth) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UnixPeerAuth) ProtoMessage() {}
+
+func (x *UnixPeerAuth) ProtoReflect() protoreflect.Message {
+	mi := &file_config_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UnixPeerAuth.ProtoReflect.Descriptor instead.
+func (*UnixPeerAuth) Descriptor() ([]byte, []int) {
+	return file_config_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *UnixPeerAuth) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *UnixPeerAuth) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+type Milter struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Address of the milter, "unix:<path>" or "tcp:<host>:<port>".
+	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+	// Timeout for connecting, and for each exchange with the milter.
+	// Uses the Go duration format.
+	// Default: "30s".
+	Timeout string `protobuf:"bytes,2,opt,name=timeout,proto3" json:"timeout,omitempty"`
+	// What to do if the milter can't be reached, or fails. One of:
+	//  - "tempfail": reject with a temporary error.
+	//  - "reject": reject with a permanent error.
+	//  - "accept": skip the milter.
+	// Default: "tempfail".
+	DefaultAction string `protobuf:"bytes,3,opt,name=default_action,json=defaultAction,proto3" json:"default_action,omitempty"`
+}
+
+func (x *Milter) Reset() {
+	*x = Milter{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_config_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Milter) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Milter) ProtoMessage() {}
+
+func (x *Milter) ProtoReflect() protoreflect.Message {
+	mi := &file_config_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Milter.ProtoReflect.Descriptor instead.
+func (*Milter) Descriptor() ([]byte, []int) {
+	return file_config_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Milter) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *Milter) GetTimeout() string {
+	if x != nil {
+		return x.Timeout
+	}
+	return ""
+}
+
+func (x *Milter) GetDefaultAction() string {
+	if x != nil {
+		return x.DefaultAction
+	}
+	return ""
+}
+
+type ACME struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// URL of the ACME server's directory.
+	// Default: Let's Encrypt's production server,
+	// "https://acme-v02.api.letsencrypt.org/directory".
+	DirectoryUrl string `protobuf:"bytes,1,opt,name=directory_url,json=directoryUrl,proto3" json:"directory_url,omitempty"`
+	// Contact email for the account, used by the CA to notify about
+	// problems with the certificates. Optional.
+	Email string `protobuf:"bytes,2,opt,name=email,proto3" json:"email,omitempty"`
+	// Names to get certificates for, in addition to the hostname. Usually
+	// these are the names the MX records of our domains point to.
+	Names []string `protobuf:"bytes,3,rep,name=names,proto3" json:"names,omitempty"`
+	// Renew the certificates when they expire within this period.
+	// Uses the Go duration format.
+	// Default: "720h" (30 days).
+	RenewBefore string `protobuf:"bytes,4,opt,name=renew_before,json=renewBefore,proto3" json:"renew_before,omitempty"`
+}
+
+func (x *ACME) Reset() {
+	*x = ACME{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_config_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ACME) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ACME) ProtoMessage() {}
+
+func (x *ACME) ProtoReflect() protoreflect.Message {
+	mi := &file_config_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ACME.ProtoReflect.Descriptor instead.
+func (*ACME) Descriptor() ([]byte, []int) {
+	return file_config_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ACME) GetDirectoryUrl() string {
+	if x != nil {
+		return x.DirectoryUrl
+	}
+	return ""
+}
+
+func (x *ACME) GetEmail() string {
+	if x != nil {
+		return x.Email
+	}
+	return ""
+}
+
+func (x *ACME) GetNames() []string {
+	if x != nil {
+		return x.Names
+	}
+	return nil
+}
+
+func (x *ACME) GetRenewBefore() string {
+	if x != nil {
+		return x.RenewBefore
+	}
+	return ""
+}
+
 var File_config_proto protoreflect.FileDescriptor
 
 var file_config_proto_rawDesc = []byte{
-	0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xf4,
-	0x05, 0x0a, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x1a, 0x0a, 0x08, 0x68, 0x6f, 0x73,
+	0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xaa,
+	0x11, 0x0a, 0x06, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x12, 0x1a, 0x0a, 0x08, 0x68, 0x6f, 0x73,
 	0x74, 0x6e, 0x61, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x68, 0x6f, 0x73,
 	0x74, 0x6e, 0x61, 0x6d, 0x65, 0x12, 0x27, 0x0a, 0x10, 0x6d, 0x61, 0x78, 0x5f, 0x64, 0x61, 0x74,
 	0x61, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x5f, 0x6d, 0x62, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52,
@@ -301,13 +957,128 @@ var file_config_proto_rawDesc = []byte{
 	0x6f, 0x76, 0x65, 0x63, 0x6f, 0x74, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x50, 0x61, 0x74, 0x68,
 	0x12, 0x29, 0x0a, 0x10, 0x68, 0x61, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x5f, 0x69, 0x6e, 0x63, 0x6f,
 	0x6d, 0x69, 0x6e, 0x67, 0x18, 0x10, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x68, 0x61, 0x70, 0x72,
-	0x6f, 0x78, 0x79, 0x49, 0x6e, 0x63, 0x6f, 0x6d, 0x69, 0x6e, 0x67, 0x42, 0x14, 0x0a, 0x12, 0x5f,
-	0x73, 0x75, 0x66, 0x66, 0x69, 0x78, 0x5f, 0x73, 0x65, 0x70, 0x61, 0x72, 0x61, 0x74, 0x6f, 0x72,
-	0x73, 0x42, 0x12, 0x0a, 0x10, 0x5f, 0x64, 0x72, 0x6f, 0x70, 0x5f, 0x63, 0x68, 0x61, 0x72, 0x61,
-	0x63, 0x74, 0x65, 0x72, 0x73, 0x42, 0x2c, 0x5a, 0x2a, 0x62, 0x6c, 0x69, 0x74, 0x69, 0x72, 0x69,
-	0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x72, 0x2f, 0x67, 0x6f, 0x2f, 0x63, 0x68, 0x61, 0x73, 0x71,
-	0x75, 0x69, 0x64, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x63, 0x6f, 0x6e,
-	0x66, 0x69, 0x67, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x6f, 0x78, 0x79, 0x49, 0x6e, 0x63, 0x6f, 0x6d, 0x69, 0x6e, 0x67, 0x12, 0x2e, 0x0a, 0x13, 0x64,
+	0x6b, 0x69, 0x6d, 0x5f, 0x73, 0x69, 0x67, 0x6e, 0x65, 0x64, 0x5f, 0x68, 0x65, 0x61, 0x64, 0x65,
+	0x72, 0x73, 0x18, 0x11, 0x20, 0x03, 0x28, 0x09, 0x52, 0x11, 0x64, 0x6b, 0x69, 0x6d, 0x53, 0x69,
+	0x67, 0x6e, 0x65, 0x64, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x36, 0x0a, 0x17, 0x64,
+	0x6d, 0x61, 0x72, 0x63, 0x5f, 0x71, 0x75, 0x61, 0x72, 0x61, 0x6e, 0x74, 0x69, 0x6e, 0x65, 0x5f,
+	0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x12, 0x20, 0x01, 0x28, 0x09, 0x52, 0x15, 0x64, 0x6d,
+	0x61, 0x72, 0x63, 0x51, 0x75, 0x61, 0x72, 0x61, 0x6e, 0x74, 0x69, 0x6e, 0x65, 0x41, 0x63, 0x74,
+	0x69, 0x6f, 0x6e, 0x12, 0x38, 0x0a, 0x18, 0x64, 0x65, 0x6c, 0x61, 0x79, 0x5f, 0x6e, 0x6f, 0x74,
+	0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x61, 0x66, 0x74, 0x65, 0x72, 0x18,
+	0x13, 0x20, 0x01, 0x28, 0x09, 0x52, 0x16, 0x64, 0x65, 0x6c, 0x61, 0x79, 0x4e, 0x6f, 0x74, 0x69,
+	0x66, 0x69, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x41, 0x66, 0x74, 0x65, 0x72, 0x12, 0x27, 0x0a,
+	0x0f, 0x6d, 0x61, 0x78, 0x5f, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73,
+	0x18, 0x14, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x6d, 0x61, 0x78, 0x43, 0x6f, 0x6e, 0x6e, 0x65,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x33, 0x0a, 0x16, 0x6d, 0x61, 0x78, 0x5f, 0x63, 0x6f,
+	0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x69, 0x70,
+	0x18, 0x15, 0x20, 0x01, 0x28, 0x03, 0x52, 0x13, 0x6d, 0x61, 0x78, 0x43, 0x6f, 0x6e, 0x6e, 0x65,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x50, 0x65, 0x72, 0x49, 0x70, 0x12, 0x3d, 0x0a, 0x1b, 0x6d,
+	0x61, 0x78, 0x5f, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x5f, 0x70,
+	0x65, 0x72, 0x5f, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x18, 0x16, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x18, 0x6d, 0x61, 0x78, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x73,
+	0x50, 0x65, 0x72, 0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x12, 0x3a, 0x0a, 0x1a, 0x6d, 0x61,
+	0x78, 0x5f, 0x63, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x72, 0x61, 0x74,
+	0x65, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x69, 0x70, 0x18, 0x17, 0x20, 0x01, 0x28, 0x03, 0x52, 0x16,
+	0x6d, 0x61, 0x78, 0x43, 0x6f, 0x6e, 0x6e, 0x65, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x61, 0x74,
+	0x65, 0x50, 0x65, 0x72, 0x49, 0x70, 0x12, 0x3d, 0x0a, 0x1c, 0x6d, 0x61, 0x78, 0x5f, 0x6d, 0x65,
+	0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x68, 0x6f, 0x75, 0x72, 0x5f,
+	0x70, 0x65, 0x72, 0x5f, 0x69, 0x70, 0x18, 0x18, 0x20, 0x01, 0x28, 0x03, 0x52, 0x17, 0x6d, 0x61,
+	0x78, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x50, 0x65, 0x72, 0x48, 0x6f, 0x75, 0x72,
+	0x50, 0x65, 0x72, 0x49, 0x70, 0x12, 0x41, 0x0a, 0x1e, 0x6d, 0x61, 0x78, 0x5f, 0x72, 0x65, 0x63,
+	0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x73, 0x5f, 0x70, 0x65, 0x72, 0x5f, 0x68, 0x6f, 0x75, 0x72,
+	0x5f, 0x70, 0x65, 0x72, 0x5f, 0x69, 0x70, 0x18, 0x19, 0x20, 0x01, 0x28, 0x03, 0x52, 0x19, 0x6d,
+	0x61, 0x78, 0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x73, 0x50, 0x65, 0x72, 0x48,
+	0x6f, 0x75, 0x72, 0x50, 0x65, 0x72, 0x49, 0x70, 0x12, 0x20, 0x0a, 0x0b, 0x67, 0x72, 0x65, 0x79,
+	0x6c, 0x69, 0x73, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x1a, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0b, 0x67,
+	0x72, 0x65, 0x79, 0x6c, 0x69, 0x73, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x2b, 0x0a, 0x11, 0x67, 0x72,
+	0x65, 0x79, 0x6c, 0x69, 0x73, 0x74, 0x69, 0x6e, 0x67, 0x5f, 0x64, 0x65, 0x6c, 0x61, 0x79, 0x18,
+	0x1b, 0x20, 0x01, 0x28, 0x09, 0x52, 0x10, 0x67, 0x72, 0x65, 0x79, 0x6c, 0x69, 0x73, 0x74, 0x69,
+	0x6e, 0x67, 0x44, 0x65, 0x6c, 0x61, 0x79, 0x12, 0x38, 0x0a, 0x18, 0x67, 0x72, 0x65, 0x79, 0x6c,
+	0x69, 0x73, 0x74, 0x69, 0x6e, 0x67, 0x5f, 0x72, 0x65, 0x74, 0x72, 0x79, 0x5f, 0x77, 0x69, 0x6e,
+	0x64, 0x6f, 0x77, 0x18, 0x1c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x16, 0x67, 0x72, 0x65, 0x79, 0x6c,
+	0x69, 0x73, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x74, 0x72, 0x79, 0x57, 0x69, 0x6e, 0x64, 0x6f,
+	0x77, 0x12, 0x2d, 0x0a, 0x12, 0x67, 0x72, 0x65, 0x79, 0x6c, 0x69, 0x73, 0x74, 0x69, 0x6e, 0x67,
+	0x5f, 0x65, 0x78, 0x70, 0x69, 0x72, 0x79, 0x18, 0x1d, 0x20, 0x01, 0x28, 0x09, 0x52, 0x11, 0x67,
+	0x72, 0x65, 0x79, 0x6c, 0x69, 0x73, 0x74, 0x69, 0x6e, 0x67, 0x45, 0x78, 0x70, 0x69, 0x72, 0x79,
+	0x12, 0x20, 0x0a, 0x05, 0x64, 0x6e, 0x73, 0x62, 0x6c, 0x18, 0x1e, 0x20, 0x03, 0x28, 0x0b, 0x32,
+	0x0a, 0x2e, 0x44, 0x4e, 0x53, 0x42, 0x4c, 0x5a, 0x6f, 0x6e, 0x65, 0x52, 0x05, 0x64, 0x6e, 0x73,
+	0x62, 0x6c, 0x12, 0x27, 0x0a, 0x0f, 0x64, 0x6e, 0x73, 0x62, 0x6c, 0x5f, 0x74, 0x68, 0x72, 0x65,
+	0x73, 0x68, 0x6f, 0x6c, 0x64, 0x18, 0x1f, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x64, 0x6e, 0x73,
+	0x62, 0x6c, 0x54, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x12, 0x21, 0x0a, 0x0c, 0x64,
+	0x6e, 0x73, 0x62, 0x6c, 0x5f, 0x61, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x20, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x0b, 0x64, 0x6e, 0x73, 0x62, 0x6c, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x29,
+	0x0a, 0x10, 0x72, 0x65, 0x73, 0x74, 0x72, 0x69, 0x63, 0x74, 0x5f, 0x73, 0x65, 0x6e, 0x64, 0x65,
+	0x72, 0x73, 0x18, 0x21, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x72, 0x65, 0x73, 0x74, 0x72, 0x69,
+	0x63, 0x74, 0x53, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x73, 0x12, 0x1f, 0x0a, 0x06, 0x6d, 0x69, 0x6c,
+	0x74, 0x65, 0x72, 0x18, 0x22, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x07, 0x2e, 0x4d, 0x69, 0x6c, 0x74,
+	0x65, 0x72, 0x52, 0x06, 0x6d, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12, 0x29, 0x0a, 0x11, 0x6d, 0x61,
+	0x78, 0x5f, 0x71, 0x75, 0x65, 0x75, 0x65, 0x5f, 0x73, 0x69, 0x7a, 0x65, 0x5f, 0x6d, 0x62, 0x18,
+	0x23, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0e, 0x6d, 0x61, 0x78, 0x51, 0x75, 0x65, 0x75, 0x65, 0x53,
+	0x69, 0x7a, 0x65, 0x4d, 0x62, 0x12, 0x23, 0x0a, 0x0d, 0x70, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x5f,
+	0x64, 0x61, 0x65, 0x6d, 0x6f, 0x6e, 0x18, 0x24, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x70, 0x6f,
+	0x6c, 0x69, 0x63, 0x79, 0x44, 0x61, 0x65, 0x6d, 0x6f, 0x6e, 0x12, 0x2a, 0x0a, 0x11, 0x68, 0x61,
+	0x70, 0x72, 0x6f, 0x78, 0x79, 0x5f, 0x74, 0x72, 0x75, 0x73, 0x74, 0x5f, 0x74, 0x6c, 0x73, 0x18,
+	0x25, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x68, 0x61, 0x70, 0x72, 0x6f, 0x78, 0x79, 0x54, 0x72,
+	0x75, 0x73, 0x74, 0x54, 0x6c, 0x73, 0x12, 0x32, 0x0a, 0x15, 0x73, 0x68, 0x75, 0x74, 0x64, 0x6f,
+	0x77, 0x6e, 0x5f, 0x67, 0x72, 0x61, 0x63, 0x65, 0x5f, 0x70, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x18,
+	0x26, 0x20, 0x01, 0x28, 0x09, 0x52, 0x13, 0x73, 0x68, 0x75, 0x74, 0x64, 0x6f, 0x77, 0x6e, 0x47,
+	0x72, 0x61, 0x63, 0x65, 0x50, 0x65, 0x72, 0x69, 0x6f, 0x64, 0x12, 0x32, 0x0a, 0x15, 0x72, 0x65,
+	0x6c, 0x6f, 0x61, 0x64, 0x5f, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x5f, 0x69, 0x6e, 0x74, 0x65, 0x72,
+	0x76, 0x61, 0x6c, 0x18, 0x27, 0x20, 0x01, 0x28, 0x09, 0x52, 0x13, 0x72, 0x65, 0x6c, 0x6f, 0x61,
+	0x64, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x49, 0x6e, 0x74, 0x65, 0x72, 0x76, 0x61, 0x6c, 0x12, 0x19,
+	0x0a, 0x04, 0x61, 0x63, 0x6d, 0x65, 0x18, 0x28, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x05, 0x2e, 0x41,
+	0x43, 0x4d, 0x45, 0x52, 0x04, 0x61, 0x63, 0x6d, 0x65, 0x12, 0x22, 0x0a, 0x0d, 0x74, 0x6c, 0x73,
+	0x5f, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x5f, 0x63, 0x61, 0x18, 0x29, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x0b, 0x74, 0x6c, 0x73, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x43, 0x61, 0x12, 0x37, 0x0a,
+	0x18, 0x74, 0x6c, 0x73, 0x5f, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x5f, 0x69, 0x6d, 0x70, 0x6c,
+	0x69, 0x63, 0x69, 0x74, 0x5f, 0x61, 0x75, 0x74, 0x68, 0x18, 0x2a, 0x20, 0x01, 0x28, 0x08, 0x52,
+	0x15, 0x74, 0x6c, 0x73, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x49, 0x6d, 0x70, 0x6c, 0x69, 0x63,
+	0x69, 0x74, 0x41, 0x75, 0x74, 0x68, 0x12, 0x21, 0x0a, 0x0c, 0x6c, 0x6d, 0x74, 0x70, 0x5f, 0x61,
+	0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x2b, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x6c, 0x6d,
+	0x74, 0x70, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x28, 0x0a, 0x10, 0x75, 0x6e, 0x69,
+	0x78, 0x5f, 0x73, 0x6f, 0x63, 0x6b, 0x65, 0x74, 0x5f, 0x6d, 0x6f, 0x64, 0x65, 0x18, 0x2c, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x0e, 0x75, 0x6e, 0x69, 0x78, 0x53, 0x6f, 0x63, 0x6b, 0x65, 0x74, 0x4d,
+	0x6f, 0x64, 0x65, 0x12, 0x33, 0x0a, 0x0e, 0x75, 0x6e, 0x69, 0x78, 0x5f, 0x70, 0x65, 0x65, 0x72,
+	0x5f, 0x61, 0x75, 0x74, 0x68, 0x18, 0x2d, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0d, 0x2e, 0x55, 0x6e,
+	0x69, 0x78, 0x50, 0x65, 0x65, 0x72, 0x41, 0x75, 0x74, 0x68, 0x52, 0x0c, 0x75, 0x6e, 0x69, 0x78,
+	0x50, 0x65, 0x65, 0x72, 0x41, 0x75, 0x74, 0x68, 0x12, 0x29, 0x0a, 0x10, 0x74, 0x72, 0x75, 0x73,
+	0x74, 0x65, 0x64, 0x5f, 0x6e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x73, 0x18, 0x2e, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x0f, 0x74, 0x72, 0x75, 0x73, 0x74, 0x65, 0x64, 0x4e, 0x65, 0x74, 0x77, 0x6f,
+	0x72, 0x6b, 0x73, 0x12, 0x3c, 0x0a, 0x1a, 0x74, 0x72, 0x75, 0x73, 0x74, 0x65, 0x64, 0x5f, 0x6e,
+	0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x73, 0x5f, 0x6c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x65, 0x72,
+	0x73, 0x18, 0x2f, 0x20, 0x03, 0x28, 0x09, 0x52, 0x18, 0x74, 0x72, 0x75, 0x73, 0x74, 0x65, 0x64,
+	0x4e, 0x65, 0x74, 0x77, 0x6f, 0x72, 0x6b, 0x73, 0x4c, 0x69, 0x73, 0x74, 0x65, 0x6e, 0x65, 0x72,
+	0x73, 0x42, 0x14, 0x0a, 0x12, 0x5f, 0x73, 0x75, 0x66, 0x66, 0x69, 0x78, 0x5f, 0x73, 0x65, 0x70,
+	0x61, 0x72, 0x61, 0x74, 0x6f, 0x72, 0x73, 0x42, 0x12, 0x0a, 0x10, 0x5f, 0x64, 0x72, 0x6f, 0x70,
+	0x5f, 0x63, 0x68, 0x61, 0x72, 0x61, 0x63, 0x74, 0x65, 0x72, 0x73, 0x22, 0x5a, 0x0a, 0x09, 0x44,
+	0x4e, 0x53, 0x42, 0x4c, 0x5a, 0x6f, 0x6e, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x7a, 0x6f, 0x6e, 0x65,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x7a, 0x6f, 0x6e, 0x65, 0x12, 0x16, 0x0a, 0x06,
+	0x77, 0x65, 0x69, 0x67, 0x68, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x06, 0x77, 0x65,
+	0x69, 0x67, 0x68, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x72, 0x65, 0x74, 0x75, 0x72, 0x6e, 0x5f, 0x63,
+	0x6f, 0x64, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x72, 0x65, 0x74, 0x75,
+	0x72, 0x6e, 0x43, 0x6f, 0x64, 0x65, 0x73, 0x22, 0x3c, 0x0a, 0x0c, 0x55, 0x6e, 0x69, 0x78, 0x50,
+	0x65, 0x65, 0x72, 0x41, 0x75, 0x74, 0x68, 0x12, 0x12, 0x0a, 0x04, 0x75, 0x73, 0x65, 0x72, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x73, 0x65, 0x72, 0x12, 0x18, 0x0a, 0x07, 0x61,
+	0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64,
+	0x64, 0x72, 0x65, 0x73, 0x73, 0x22, 0x63, 0x0a, 0x06, 0x4d, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12,
+	0x18, 0x0a, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x74, 0x69, 0x6d,
+	0x65, 0x6f, 0x75, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x74, 0x69, 0x6d, 0x65,
+	0x6f, 0x75, 0x74, 0x12, 0x25, 0x0a, 0x0e, 0x64, 0x65, 0x66, 0x61, 0x75, 0x6c, 0x74, 0x5f, 0x61,
+	0x63, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x64, 0x65, 0x66,
+	0x61, 0x75, 0x6c, 0x74, 0x41, 0x63, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0x7a, 0x0a, 0x04, 0x41, 0x43,
+	0x4d, 0x45, 0x12, 0x23, 0x0a, 0x0d, 0x64, 0x69, 0x72, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x79, 0x5f,
+	0x75, 0x72, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0c, 0x64, 0x69, 0x72, 0x65, 0x63,
+	0x74, 0x6f, 0x72, 0x79, 0x55, 0x72, 0x6c, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x6d, 0x61, 0x69, 0x6c,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x6d, 0x61, 0x69, 0x6c, 0x12, 0x14, 0x0a,
+	0x05, 0x6e, 0x61, 0x6d, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x05, 0x6e, 0x61,
+	0x6d, 0x65, 0x73, 0x12, 0x21, 0x0a, 0x0c, 0x72, 0x65, 0x6e, 0x65, 0x77, 0x5f, 0x62, 0x65, 0x66,
+	0x6f, 0x72, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x72, 0x65, 0x6e, 0x65, 0x77,
+	0x42, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x42, 0x2c, 0x5a, 0x2a, 0x62, 0x6c, 0x69, 0x74, 0x69, 0x72,
+	0x69, 0x2e, 0x63, 0x6f, 0x6d, 0x2e, 0x61, 0x72, 0x2f, 0x67, 0x6f, 0x2f, 0x63, 0x68, 0x61, 0x73,
+	0x71, 0x75, 0x69, 0x64, 0x2f, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x63, 0x6f,
+	0x6e, 0x66, 0x69, 0x67, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -322,16 +1093,24 @@ func file_config_proto_rawDescGZIP() []byte {
 	return file_config_proto_rawDescData
 }
 
-var file_config_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_config_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
 var file_config_proto_goTypes = []interface{}{
-	(*Config)(nil), // 0: Config
+	(*Config)(nil),       // 0: Config
+	(*DNSBLZone)(nil),    // 1: DNSBLZone
+	(*UnixPeerAuth)(nil), // 2: UnixPeerAuth
+	(*Milter)(nil),       // 3: Milter
+	(*ACME)(nil),         // 4: ACME
 }
 var file_config_proto_depIdxs = []int32{
-	0, // [0:0] is the sub-list for method output_type
-	0, // [0:0] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	1, // 0: Config.dnsbl:type_name -> DNSBLZone
+	3, // 1: Config.milter:type_name -> Milter
+	4, // 2: Config.acme:type_name -> ACME
+	2, // 3: Config.unix_peer_auth:type_name -> UnixPeerAuth
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_config_proto_init() }
@@ -352,6 +1131,54 @@ func file_config_proto_init() {
 				return nil
 			}
 		}
+		file_config_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*DNSBLZone); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_config_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*UnixPeerAuth); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_config_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Milter); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_config_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ACME); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	file_config_proto_msgTypes[0].OneofWrappers = []interface{}{}
 	type x struct{}
@@ -360,7 +1187,7 @@ func file_config_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_config_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   1,
+			NumMessages:   5,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -58,6 +58,19 @@ func TestFullConfig(t *testing.T) {
 		monitoring_address: ":1111"
 		max_data_size_mb: 26
 		suffix_separators: ""
+		dkim_signed_headers: "From"
+		dkim_signed_headers: "Subject"
+		dmarc_quarantine_action: "reject"
+		delay_notification_after: "2h"
+		max_connections: 100
+		max_connections_per_ip: 5
+		greylisting_delay: "10m"
+		dnsbl { zone: "bl1" weight: 2 }
+		dnsbl { zone: "bl2" return_codes: "127.0.0.2" }
+		dnsbl_action: "tag"
+		milter { address: "unix:/run/milter1" }
+		milter { address: "unix:/run/milter2" }
+		max_queue_size_mb: 100
 	`
 
 	tmpDir, path := mustCreateConfig(t, confStr)
@@ -68,6 +81,27 @@ func TestFullConfig(t *testing.T) {
 		submission_address: ":999"
 		dovecot_auth: true
 		drop_characters: ""
+		max_connections_per_ip: 10
+		max_recipients_per_hour_per_ip: 1000
+		greylisting: true
+		greylisting_expiry: "720h"
+		restrict_senders: true
+		milter { address: "tcp:localhost:8891" default_action: "accept" }
+		max_queue_size_mb: 200
+		policy_daemon: "unix:/run/policyd.sock"
+		haproxy_trust_tls: true
+		shutdown_grace_period: "30s"
+		reload_check_interval: "5m"
+		acme { email: "admin@proust" names: "mx.proust" }
+		tls_client_ca: "/etc/chasquid/client_ca.pem"
+		tls_client_implicit_auth: true
+		lmtp_address: "unix:/run/chasquid/lmtp.sock"
+		unix_socket_mode: "0666"
+		unix_peer_auth { user: "www-data" address: "webapp@proust" }
+		trusted_networks: "10.0.0.0/8"
+		trusted_networks: "fd00::/8"
+		trusted_networks_listeners: "smtp"
+		trusted_networks_listeners: "submission"
 	`
 
 	expected := &Config{
@@ -90,6 +124,58 @@ func TestFullConfig(t *testing.T) {
 		MailLogPath: "<syslog>",
 
 		DovecotAuth: true,
+
+		DkimSignedHeaders: []string{"From", "Subject"},
+
+		DmarcQuarantineAction: "reject",
+
+		DelayNotificationAfter: "2h",
+
+		MaxConnections:            100,
+		MaxConnectionsPerIp:       10,
+		MaxRecipientsPerHourPerIp: 1000,
+
+		Greylisting:            true,
+		GreylistingDelay:       "10m",
+		GreylistingRetryWindow: "24h",
+		GreylistingExpiry:      "720h",
+
+		Dnsbl: []*DNSBLZone{
+			{Zone: "bl1", Weight: 2},
+			{Zone: "bl2", ReturnCodes: []string{"127.0.0.2"}},
+		},
+		DnsblThreshold: 1,
+		DnsblAction:    "tag",
+
+		RestrictSenders: true,
+
+		Milter: []*Milter{
+			{Address: "tcp:localhost:8891", DefaultAction: "accept"},
+		},
+
+		MaxQueueSizeMb: 200,
+
+		PolicyDaemon: "unix:/run/policyd.sock",
+
+		HaproxyTrustTls: true,
+
+		ShutdownGracePeriod: "30s",
+		ReloadCheckInterval: "5m",
+
+		Acme: &ACME{Email: "admin@proust", Names: []string{"mx.proust"}},
+
+		TlsClientCa:           "/etc/chasquid/client_ca.pem",
+		TlsClientImplicitAuth: true,
+
+		LmtpAddress: []string{"unix:/run/chasquid/lmtp.sock"},
+
+		UnixSocketMode: "0666",
+		UnixPeerAuth: []*UnixPeerAuth{
+			{User: "www-data", Address: "webapp@proust"},
+		},
+
+		TrustedNetworks:          []string{"10.0.0.0/8", "fd00::/8"},
+		TrustedNetworksListeners: []string{"smtp", "submission"},
 	}
 
 	c, err := Load(path, overrideStr)
@@ -134,6 +220,24 @@ func TestBrokenOverride(t *testing.T) {
 	}
 }
 
+func TestChanged(t *testing.T) {
+	a := proto.Clone(defaultConfig).(*Config)
+	b := proto.Clone(defaultConfig).(*Config)
+	if diff := Changed(a, b); len(diff) != 0 {
+		t.Errorf("equal configs have changes: %v", diff)
+	}
+
+	b.MaxDataSizeMb = 10
+	b.SmtpAddress = []string{":25"}
+	b.DropCharacters = nil
+	b.Milter = []*Milter{{Address: "unix:/milter"}}
+	expected := []string{
+		"max_data_size_mb", "smtp_address", "drop_characters", "milter"}
+	if diff := cmp.Diff(expected, Changed(a, b)); diff != "" {
+		t.Errorf("unexpected changes (-want +got):\n%s", diff)
+	}
+}
+
 // Run LogConfig, overriding the default logger first. This exercises the
 // code, we don't yet validate the output, but it is an useful sanity check.
 func testLogConfig(c *Config) {
@@ -1,11 +1,42 @@
 // Package courier implements various couriers for delivering messages.
 package courier
 
+import (
+	"io"
+
+	"blitiri.com.ar/go/chasquid/internal/smtp"
+)
+
 // Courier delivers mail to a single recipient.
 // It is implemented by different couriers, for both local and remote
 // recipients.
 type Courier interface {
 	// Deliver mail to a recipient. Return the error (if any), and whether it
 	// is permanent (true) or transient (false).
-	Deliver(from string, to string, data []byte) (error, bool)
+	// The data may be read more than once (for example, to retry with a
+	// different server), so couriers seek to the beginning before reading it.
+	Deliver(from string, to string, data io.ReadSeeker) (error, bool)
+}
+
+// DSNCourier is a Courier which can relay the delivery status notification
+// (DSN) parameters to the next hop.
+type DSNCourier interface {
+	Courier
+
+	// DeliverDSN is like Deliver, but also relays the DSN parameters if the
+	// next hop supports it. In addition to the error and whether it is
+	// permanent, it returns if the parameters were relayed, in which case
+	// the next hop is now responsible for the notifications.
+	DeliverDSN(from string, to string, data io.ReadSeeker, dsn *smtp.DSN) (err error, permanent bool, relayed bool)
+}
+
+// BinaryMIMECourier is a DSNCourier which can also relay binary MIME
+// messages (RFC 3030), whose body has to be sent as-is.
+type BinaryMIMECourier interface {
+	DSNCourier
+
+	// DeliverBinaryMIME is like DeliverDSN, but for binary MIME messages.
+	// If the next hop does not support them, it fails with a permanent
+	// error.
+	DeliverBinaryMIME(from string, to string, data io.ReadSeeker, dsn *smtp.DSN) (err error, permanent bool, relayed bool)
 }
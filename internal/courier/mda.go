@@ -1,9 +1,9 @@
 package courier
 
 import (
-	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os/exec"
 	"strings"
 	"syscall"
@@ -30,7 +30,7 @@ type MDA struct {
 
 // Deliver an email. On failures, returns an error, and whether or not it is
 // permanent.
-func (p *MDA) Deliver(from string, to string, data []byte) (error, bool) {
+func (p *MDA) Deliver(from string, to string, data io.ReadSeeker) (error, bool) {
 	tr := trace.New("Courier.MDA", to)
 	defer tr.Finish()
 
@@ -57,10 +57,14 @@ func (p *MDA) Deliver(from string, to string, data []byte) (error, bool) {
 	}
 	tr.Debugf("%s %q", p.Binary, args)
 
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return tr.Errorf("error reading data: %v", err), false
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, p.Binary, args...)
-	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdin = data
 
 	output, err := cmd.CombinedOutput()
 	if ctx.Err() == context.DeadlineExceeded {
@@ -3,6 +3,7 @@ package courier
 import (
 	"bytes"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,7 +20,7 @@ func TestMDA(t *testing.T) {
 		Timeout: 1 * time.Minute,
 	}
 
-	err, _ := p.Deliver("from@x", "to@local", []byte("data"))
+	err, _ := p.Deliver("from@x", "to@local", strings.NewReader("data"))
 	if err != nil {
 		t.Fatalf("Deliver: %v", err)
 	}
@@ -33,7 +34,7 @@ func TestMDA(t *testing.T) {
 func TestMDATimeout(t *testing.T) {
 	p := MDA{"/bin/sleep", []string{"1"}, 100 * time.Millisecond}
 
-	err, permanent := p.Deliver("from", "to@local", []byte("data"))
+	err, permanent := p.Deliver("from", "to@local", strings.NewReader("data"))
 	if err != errTimeout {
 		t.Errorf("Unexpected error: %v", err)
 	}
@@ -45,7 +46,7 @@ func TestMDATimeout(t *testing.T) {
 func TestMDABadCommandLine(t *testing.T) {
 	// Non-existent binary.
 	p := MDA{"thisdoesnotexist", nil, 1 * time.Minute}
-	err, permanent := p.Deliver("from", "to", []byte("data"))
+	err, permanent := p.Deliver("from", "to", strings.NewReader("data"))
 	if err == nil {
 		t.Errorf("unexpected success for non-existent binary")
 	}
@@ -55,7 +56,7 @@ func TestMDABadCommandLine(t *testing.T) {
 
 	// Incorrect arguments.
 	p = MDA{"cat", []string{"--fail_unknown_option"}, 1 * time.Minute}
-	err, _ = p.Deliver("from", "to", []byte("data"))
+	err, _ = p.Deliver("from", "to", strings.NewReader("data"))
 	if err == nil {
 		t.Errorf("unexpected success for incorrect arguments")
 	}
@@ -82,7 +83,7 @@ func TestExitCode(t *testing.T) {
 	}
 	for _, c := range cases {
 		p := &MDA{c.cmd, c.args, 5 * time.Second}
-		err, permanent := p.Deliver("from", "to", []byte("data"))
+		err, permanent := p.Deliver("from", "to", strings.NewReader("data"))
 		if err == nil {
 			t.Errorf("%q: pipe delivery worked, expected failure", c.cmd)
 		}
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
+	"io"
 	"net"
 	"time"
 
@@ -56,14 +57,36 @@ type SMTP struct {
 
 // Deliver an email. On failures, returns an error, and whether or not it is
 // permanent.
-func (s *SMTP) Deliver(from string, to string, data []byte) (error, bool) {
+func (s *SMTP) Deliver(from string, to string, data io.ReadSeeker) (error, bool) {
+	err, permanent, _ := s.DeliverDSN(from, to, data, nil)
+	return err, permanent
+}
+
+// DeliverDSN delivers an email, relaying the given DSN parameters if the
+// server supports it (dsn can be nil). On failures, returns an error, and
+// whether or not it is permanent. On success, returns whether the DSN
+// parameters were relayed.
+func (s *SMTP) DeliverDSN(from string, to string, data io.ReadSeeker, dsn *smtp.DSN) (error, bool, bool) {
+	return s.deliver(from, to, data, dsn, false)
+}
+
+// DeliverBinaryMIME is like DeliverDSN, but for binary MIME messages, which
+// are sent as-is. It fails with a permanent error if the server does not
+// support them.
+func (s *SMTP) DeliverBinaryMIME(from string, to string, data io.ReadSeeker, dsn *smtp.DSN) (error, bool, bool) {
+	return s.deliver(from, to, data, dsn, true)
+}
+
+func (s *SMTP) deliver(from string, to string, data io.ReadSeeker, dsn *smtp.DSN, binaryMIME bool) (error, bool, bool) {
 	a := &attempt{
-		courier:  s,
-		from:     from,
-		to:       to,
-		toDomain: envelope.DomainOf(to),
-		data:     data,
-		tr:       trace.New("Courier.SMTP", to),
+		courier:    s,
+		from:       from,
+		to:         to,
+		toDomain:   envelope.DomainOf(to),
+		data:       data,
+		binaryMIME: binaryMIME,
+		dsn:        dsn,
+		tr:         trace.New("Courier.SMTP", to),
 	}
 	defer a.tr.Finish()
 	a.tr.Debugf("%s  ->  %s", from, to)
@@ -79,7 +102,7 @@ func (s *SMTP) Deliver(from string, to string, data []byte) (error, bool) {
 		// This is in line with what other servers (Exim) do. However, the
 		// downside is that temporary DNS issues can affect delivery, so we
 		// have to make sure we try hard enough on the lookup above.
-		return a.tr.Errorf("Could not find mail server: %v", err), perm
+		return a.tr.Errorf("Could not find mail server: %v", err), perm, false
 	}
 
 	a.stsPolicy = s.fetchSTSPolicy(a.tr, a.toDomain)
@@ -93,16 +116,16 @@ func (s *SMTP) Deliver(from string, to string, data []byte) (error, bool) {
 		var permanent bool
 		err, permanent = a.deliver(mx)
 		if err == nil {
-			return nil, false
+			return nil, false, a.dsnRelayed
 		}
 		if permanent {
-			return err, true
+			return err, true, false
 		}
 		a.tr.Errorf("%q returned transient error: %v", mx, err)
 	}
 
 	// We exhausted all MXs failed to deliver, try again later.
-	return a.tr.Errorf("all MXs returned transient failures (last: %v)", err), false
+	return a.tr.Errorf("all MXs returned transient failures (last: %v)", err), false, false
 }
 
 type attempt struct {
@@ -110,7 +133,14 @@ type attempt struct {
 
 	from string
 	to   string
-	data []byte
+	data io.ReadSeeker
+
+	// Is the data binary MIME? If so, it has to be sent as-is.
+	binaryMIME bool
+
+	// DSN parameters to relay (can be nil), and whether we did.
+	dsn        *smtp.DSN
+	dsnRelayed bool
 
 	toDomain string
 
@@ -198,7 +228,13 @@ retry:
 		a.tr.Debugf("STS policy: connection is using valid TLS")
 	}
 
-	if err = c.MailAndRcpt(a.from, a.to); err != nil {
+	if a.binaryMIME {
+		if err = c.SetBinaryMIME(); err != nil {
+			return a.tr.Errorf("BINARYMIME %v", err), true
+		}
+	}
+
+	if err = c.MailAndRcpt(a.from, a.to, a.dsn); err != nil {
 		return a.tr.Errorf("MAIL+RCPT %v", err), smtp.IsPermanent(err)
 	}
 
@@ -206,7 +242,12 @@ retry:
 	if err != nil {
 		return a.tr.Errorf("DATA %v", err), smtp.IsPermanent(err)
 	}
-	_, err = w.Write(a.data)
+	// We may have already tried (and failed) sending the data to a previous
+	// MX, so start from the beginning.
+	_, err = a.data.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(w, a.data)
+	}
 	if err != nil {
 		return a.tr.Errorf("DATA writing: %v", err), smtp.IsPermanent(err)
 	}
@@ -217,7 +258,8 @@ retry:
 	}
 
 	_ = c.Quit()
-	a.tr.Debugf("done")
+	a.dsnRelayed = a.dsn != nil && c.RelaysDSN()
+	a.tr.Debugf("done (DSN relayed: %v)", a.dsnRelayed)
 
 	return nil, false
 }
@@ -69,7 +69,7 @@ func TestSMTP(t *testing.T) {
 
 	s, tmpDir := newSMTP(t)
 	defer testlib.RemoveIfOk(t, tmpDir)
-	err, _ := s.Deliver("me@me", "to@to", []byte("data"))
+	err, _ := s.Deliver("me@me", "to@to", strings.NewReader("data"))
 	if err != nil {
 		t.Errorf("deliver failed: %v", err)
 	}
@@ -133,7 +133,7 @@ func TestSMTPErrors(t *testing.T) {
 
 		s, tmpDir := newSMTP(t)
 		defer testlib.RemoveIfOk(t, tmpDir)
-		err, _ := s.Deliver("me@me", "to@to", []byte("data"))
+		err, _ := s.Deliver("me@me", "to@to", strings.NewReader("data"))
 		if err == nil {
 			t.Errorf("deliver not failed in case %q: %v", rs["_welcome"], err)
 		}
@@ -143,12 +143,40 @@ func TestSMTPErrors(t *testing.T) {
 	}
 }
 
+func TestBinaryMIMENotSupported(t *testing.T) {
+	smtpTotalTimeout = 5 * time.Second
+
+	// The server does not support BINARYMIME, so we can't send the message
+	// to it, and must fail permanently (without falling back to DATA).
+	responses := map[string]string{
+		"_welcome":   "220 welcome\n",
+		"EHLO hello": "250 ehlo ok\n",
+	}
+	srv := newFakeServer(t, responses, 1)
+	defer srv.Cleanup()
+	host, port := srv.HostPort()
+
+	testMX["to"] = []*net.MX{{Host: host, Pref: 10}}
+	*smtpPort = port
+
+	s, tmpDir := newSMTP(t)
+	defer testlib.RemoveIfOk(t, tmpDir)
+	err, permanent, _ := s.DeliverBinaryMIME(
+		"me@me", "to@to", strings.NewReader("data"), nil)
+	if err == nil || !permanent {
+		t.Errorf("expected permanent failure, got %v (permanent: %v)",
+			err, permanent)
+	}
+
+	srv.Wait()
+}
+
 func TestNoMXServer(t *testing.T) {
 	testMX["to"] = []*net.MX{}
 
 	s, tmpDir := newSMTP(t)
 	defer testlib.RemoveIfOk(t, tmpDir)
-	err, permanent := s.Deliver("me@me", "to@to", []byte("data"))
+	err, permanent := s.Deliver("me@me", "to@to", strings.NewReader("data"))
 	if err == nil {
 		t.Errorf("delivery worked, expected failure")
 	}
@@ -267,7 +295,7 @@ func TestTLS(t *testing.T) {
 
 	s, tmpDir := newSMTP(t)
 	defer testlib.RemoveIfOk(t, tmpDir)
-	err, _ := s.Deliver("me@me", "to@to", []byte("data"))
+	err, _ := s.Deliver("me@me", "to@to", strings.NewReader("data"))
 	if err != nil {
 		t.Errorf("deliver failed: %v", err)
 	}
@@ -289,7 +317,7 @@ func TestTLS(t *testing.T) {
 	defer srv.Cleanup()
 	_, *smtpPort = srv.HostPort()
 
-	err, permanent := s.Deliver("me@me", "to@to", []byte("data"))
+	err, permanent := s.Deliver("me@me", "to@to", strings.NewReader("data"))
 	if !strings.Contains(err.Error(),
 		"Security level check failed (level:PLAIN)") {
 		t.Errorf("expected sec level check failed, got: %v", err)
@@ -335,7 +363,7 @@ func TestTLSError(t *testing.T) {
 
 	s, tmpDir := newSMTP(t)
 	defer testlib.RemoveIfOk(t, tmpDir)
-	err, _ := s.Deliver("me@me", "to@to", []byte("data"))
+	err, _ := s.Deliver("me@me", "to@to", strings.NewReader("data"))
 	if err != nil {
 		t.Errorf("deliver failed: %v", err)
 	}
@@ -364,7 +392,7 @@ func TestSTSPolicyEnforcement(t *testing.T) {
 		from:     "me@me",
 		to:       "to@to",
 		toDomain: "to",
-		data:     []byte("data"),
+		data:     strings.NewReader("data"),
 		tr:       trace.New("test", "test"),
 	}
 
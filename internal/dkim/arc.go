@@ -0,0 +1,401 @@
+package dkim
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ARC (Authenticated Received Chain) sealing, which reuses most of the DKIM
+// machinery.
+// https://datatracker.ietf.org/doc/html/rfc8617
+
+// Maximum number of ARC sets in a message.
+// https://datatracker.ietf.org/doc/html/rfc8617#section-4.2.1
+const maxARCInstances = 50
+
+// Chain validation status ("cv=" tag of the ARC-Seal).
+// https://datatracker.ietf.org/doc/html/rfc8617#section-4.4
+const (
+	cvNone = "none"
+	cvPass = "pass"
+	cvFail = "fail"
+)
+
+var (
+	errARCChainFailed   = errors.New("ARC chain has already failed")
+	errARCTooManySets   = errors.New("too many ARC sets")
+	errARCInvalidSet    = errors.New("invalid ARC set")
+	errARCInvalidStatus = errors.New("invalid ARC chain validation status")
+)
+
+// ARCSet contains the values of the headers of a new ARC set, which should
+// be prepended to the message in this order: AuthenticationResults,
+// MessageSignature, Seal (so the ARC-Seal ends up at the top).
+//
+// Like with Sign, the values are folded using "\n", and are compatible with
+// envelope.AddHeader.
+type ARCSet struct {
+	// Value of the ARC-Authentication-Results header.
+	AuthenticationResults string
+
+	// Value of the ARC-Message-Signature header.
+	MessageSignature string
+
+	// Value of the ARC-Seal header.
+	Seal string
+}
+
+// arcSet is an ARC set found in a message.
+type arcSet struct {
+	instance int
+	aar      *header
+	ams      *header
+	seal     *header
+}
+
+// ARCSeal validates the existing ARC chain of the message (if any), and
+// returns a new ARC set to add to it.
+//
+// authResults is the value of the Authentication-Results header with our
+// own results (including the authserv-id), which goes into the
+// ARC-Authentication-Results header. It can be folded using "\n".
+//
+// The message can use either "\n" or "\r\n" as line endings.
+// If the existing chain had already failed, the message must not be sealed,
+// and an error is returned.
+func (s *Signer) ARCSeal(ctx context.Context, message io.Reader, authResults string) (*ARCSet, error) {
+	algo, err := s.algorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(message)
+	hdrs, err := readHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(hdrs.FindAll("From")) == 0 {
+		return nil, errMissingFrom
+	}
+
+	sets, err := findARCSets(hdrs)
+	if err != nil {
+		// Structurally invalid chains are sealed as failed.
+		// https://datatracker.ietf.org/doc/html/rfc8617#section-5.2
+		trace(ctx, "invalid ARC chain: %v", err)
+	}
+	instance := 1
+	if len(sets) > 0 {
+		instance = sets[len(sets)-1].instance + 1
+	}
+	if instance > maxARCInstances {
+		return nil, errARCTooManySets
+	}
+
+	// Compute the body hashes: the one for our signature, and the one for
+	// the latest ARC-Message-Signature (if any), which we need to validate
+	// the chain.
+	ourKey := bodyHashKey{relaxedCanonicalization, -1}
+	bodyHashes := map[bodyHashKey]*bodyHasher{
+		ourKey: newBodyHasher(relaxedCanonicalization, -1),
+	}
+	var lastAMS *signature
+	if err == nil && len(sets) > 0 {
+		lastAMS, err = parseAMS(*sets[len(sets)-1].ams)
+		if err != nil {
+			trace(ctx, "invalid ARC-Message-Signature: %v", err)
+		} else {
+			k := bodyHashKey{lastAMS.bodyC, lastAMS.length}
+			if _, ok := bodyHashes[k]; !ok {
+				bodyHashes[k] = newBodyHasher(lastAMS.bodyC, lastAMS.length)
+			}
+		}
+	}
+	if cerr := computeBodyHashes(r, bodyHashes); cerr != nil {
+		return nil, cerr
+	}
+
+	cv := cvNone
+	if len(sets) > 0 {
+		cv = cvPass
+		if err == nil {
+			bodyHash := bodyHashes[bodyHashKey{lastAMS.bodyC, lastAMS.length}]
+			err = validateARCChain(ctx, hdrs, sets, lastAMS, bodyHash.Sum())
+		}
+		if errors.Is(err, errARCChainFailed) ||
+			errors.Is(err, errTemporaryLookupFail) {
+			// We either must not seal, or can't know the status for sure.
+			return nil, err
+		}
+		if err != nil {
+			trace(ctx, "ARC chain validation failed: %v", err)
+			cv = cvFail
+		}
+	}
+	trace(ctx, "sealing instance %d with cv=%s", instance, cv)
+
+	set := &ARCSet{}
+	aar := fmt.Sprintf("i=%d; %s",
+		instance, strings.ReplaceAll(authResults, "\n", "\r\n "))
+
+	// ARC-Message-Signature: like a DKIM signature, but with "i=" instead
+	// of "v=". We also sign the DKIM signatures, as recommended.
+	// https://datatracker.ietf.org/doc/html/rfc8617#section-4.1.2
+	hNames, signed := s.headersToSign(hdrs, "DKIM-Signature")
+	ams := fmt.Sprintf(
+		"i=%d; a=%s; c=relaxed/relaxed;\r\n"+
+			" d=%s; s=%s; t=%d;\r\n"+
+			" h=%s;\r\n"+
+			" bh=%s;\r\n"+
+			" b=",
+		instance, algo, s.Domain, s.Selector, s.now().Unix(),
+		foldList(hNames, ":"),
+		base64.StdEncoding.EncodeToString(bodyHashes[ourKey].Sum()))
+
+	h := sha256.New()
+	for _, hdr := range signed {
+		io.WriteString(h, relaxedCanonicalization.header(hdr)+"\r\n")
+	}
+	io.WriteString(h, relaxedCanonicalization.header(
+		newHeader("ARC-Message-Signature", ams)))
+	sig, err := s.sign(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	ams += foldString(base64.StdEncoding.EncodeToString(sig), 72)
+
+	// ARC-Seal: signs all the ARC headers, including the new ones.
+	// https://datatracker.ietf.org/doc/html/rfc8617#section-5.1.1
+	seal := fmt.Sprintf(
+		"i=%d; a=%s; cv=%s;\r\n"+
+			" d=%s; s=%s; t=%d;\r\n"+
+			" b=",
+		instance, algo, cv, s.Domain, s.Selector, s.now().Unix())
+
+	h = sha256.New()
+	if cv != cvFail {
+		// When the chain failed, only the new set is signed.
+		// https://datatracker.ietf.org/doc/html/rfc8617#section-5.1.2
+		for _, prev := range sets {
+			prev.hashSealInput(h)
+		}
+	}
+	io.WriteString(h, relaxedCanonicalization.header(
+		newHeader("ARC-Authentication-Results", aar))+"\r\n")
+	io.WriteString(h, relaxedCanonicalization.header(
+		newHeader("ARC-Message-Signature", ams))+"\r\n")
+	io.WriteString(h, relaxedCanonicalization.header(
+		newHeader("ARC-Seal", seal)))
+	sig, err = s.sign(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	seal += foldString(base64.StdEncoding.EncodeToString(sig), 72)
+
+	set.AuthenticationResults = unfoldForAddHeader(aar)
+	set.MessageSignature = unfoldForAddHeader(ams)
+	set.Seal = unfoldForAddHeader(seal)
+	return set, nil
+}
+
+// findARCSets finds the ARC sets in the message headers, and returns them
+// ordered by instance. It returns an error if the sets are not structurally
+// valid, but still returns all the ones it found, so the caller can know
+// which instance comes next.
+// https://datatracker.ietf.org/doc/html/rfc8617#section-4.2
+func findARCSets(hdrs headers) ([]*arcSet, error) {
+	byInstance := map[int]*arcSet{}
+	var err error
+	for _, name := range []string{
+		"ARC-Authentication-Results", "ARC-Message-Signature", "ARC-Seal"} {
+		for _, hdr := range hdrs.FindAll(name) {
+			hdr := hdr
+			i, ierr := arcInstance(hdr)
+			if ierr != nil {
+				err = ierr
+				continue
+			}
+
+			as, ok := byInstance[i]
+			if !ok {
+				as = &arcSet{instance: i}
+				byInstance[i] = as
+			}
+
+			var p **header
+			switch name {
+			case "ARC-Authentication-Results":
+				p = &as.aar
+			case "ARC-Message-Signature":
+				p = &as.ams
+			case "ARC-Seal":
+				p = &as.seal
+			}
+			if *p != nil {
+				err = fmt.Errorf("%w: duplicated %s for i=%d",
+					errARCInvalidSet, name, i)
+				continue
+			}
+			*p = &hdr
+		}
+	}
+
+	// Instances must be consecutive, starting from 1, and each set must be
+	// complete.
+	sets := []*arcSet{}
+	for i := 1; i <= maxARCInstances; i++ {
+		as, ok := byInstance[i]
+		if !ok {
+			continue
+		}
+		if i != len(sets)+1 {
+			err = fmt.Errorf("%w: missing i=%d", errARCInvalidSet, len(sets)+1)
+		}
+		if as.aar == nil || as.ams == nil || as.seal == nil {
+			err = fmt.Errorf("%w: incomplete set i=%d", errARCInvalidSet, i)
+		}
+		sets = append(sets, as)
+	}
+	return sets, err
+}
+
+// arcInstance returns the instance ("i=" tag) of the given ARC header.
+func arcInstance(h header) (int, error) {
+	// The ARC-Authentication-Results header is not a tag list, but it starts
+	// with "i=N;", so we can just parse that part as one.
+	v, _, _ := strings.Cut(h.Value, ";")
+	name, value, found := strings.Cut(v, "=")
+	if !found || strings.TrimSpace(name) != "i" {
+		return 0, fmt.Errorf("%w: %s without instance",
+			errARCInvalidSet, h.Name)
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || i < 1 || i > maxARCInstances {
+		return 0, fmt.Errorf("%w: %s with invalid instance %q",
+			errARCInvalidSet, h.Name, value)
+	}
+	return i, nil
+}
+
+// parseAMS parses an ARC-Message-Signature header.
+func parseAMS(h header) (*signature, error) {
+	t, err := parseTags(h.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// It uses the same tags as DKIM-Signature, except "i=" is the instance,
+	// and there is no "v=".
+	delete(t, "i")
+	t["v"] = "1"
+	sig, err := signatureFromTags(h, t)
+	if sig != nil {
+		sig.arc = true
+	}
+	return sig, err
+}
+
+// validateARCChain validates the existing ARC chain of the message, given
+// its (structurally valid) sets, the parsed latest ARC-Message-Signature,
+// and its body hash.
+// https://datatracker.ietf.org/doc/html/rfc8617#section-5.2
+func validateARCChain(ctx context.Context, hdrs headers, sets []*arcSet, lastAMS *signature, bodyHash []byte) error {
+	// The chain validation status of each seal must be consistent: "none"
+	// for the first one, and "pass" for the rest. If the last one says
+	// "fail", the chain has already failed.
+	for _, as := range sets {
+		t, err := parseTags(as.seal.Value)
+		if err != nil {
+			return err
+		}
+		cv := strings.ToLower(t["cv"])
+		switch {
+		case as.instance == len(sets) && cv == cvFail:
+			return errARCChainFailed
+		case as.instance == 1 && cv != cvNone,
+			as.instance > 1 && cv != cvPass:
+			return fmt.Errorf("%w: cv=%q in i=%d",
+				errARCInvalidStatus, cv, as.instance)
+		}
+	}
+
+	// Only the most recent ARC-Message-Signature is validated.
+	err := lastAMS.verify(ctx, hdrs, bodyHash)
+	if err != nil {
+		return fmt.Errorf("ARC-Message-Signature i=%d: %w",
+			len(sets), err)
+	}
+
+	// All the seals must be valid, starting from the most recent one.
+	for i := len(sets); i >= 1; i-- {
+		err = verifySeal(ctx, sets[:i])
+		if err != nil {
+			return fmt.Errorf("ARC-Seal i=%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// hashSealInput writes the canonicalized headers of the set to h, in the
+// order used to compute the ARC-Seal signatures.
+func (as *arcSet) hashSealInput(h io.Writer) {
+	io.WriteString(h, relaxedCanonicalization.header(*as.aar)+"\r\n")
+	io.WriteString(h, relaxedCanonicalization.header(*as.ams)+"\r\n")
+	io.WriteString(h, relaxedCanonicalization.header(*as.seal)+"\r\n")
+}
+
+// verifySeal verifies the ARC-Seal of the last of the given sets.
+func verifySeal(ctx context.Context, sets []*arcSet) error {
+	last := sets[len(sets)-1]
+	t, err := parseTags(last.seal.Value)
+	if err != nil {
+		return err
+	}
+	for _, tag := range []string{"a", "b", "cv", "d", "s"} {
+		if _, ok := t[tag]; !ok {
+			return fmt.Errorf("%w: %s=", errMissingTag, tag)
+		}
+	}
+
+	sig := &signature{
+		hdr:      *last.seal,
+		algo:     strings.ToLower(t["a"]),
+		domain:   strings.TrimSuffix(t["d"], "."),
+		selector: t["s"],
+		arc:      true,
+	}
+	if sig.algo != "rsa-sha256" && sig.algo != "ed25519-sha256" {
+		return fmt.Errorf("%w: %q", errUnsupportedAlgo, sig.algo)
+	}
+	sig.b, err = decodeBase64(t["b"])
+	if err != nil {
+		return fmt.Errorf("error decoding b=: %w", err)
+	}
+
+	pk, err := findPublicKey(ctx, sig.domain, sig.selector)
+	if err != nil {
+		return err
+	}
+	err = pk.compatibleWith(sig)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	for _, as := range sets[:len(sets)-1] {
+		as.hashSealInput(h)
+	}
+	io.WriteString(h, relaxedCanonicalization.header(*last.aar)+"\r\n")
+	io.WriteString(h, relaxedCanonicalization.header(*last.ams)+"\r\n")
+	io.WriteString(h, relaxedCanonicalization.header(last.seal.withoutB()))
+
+	return pk.verify(h.Sum(nil), sig.b)
+}
@@ -0,0 +1,247 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+)
+
+// arcSeal seals the message with the given signer, and returns the message
+// with the new ARC set added.
+func arcSeal(t *testing.T, ctx context.Context, s *Signer, msg []byte) ([]byte, error) {
+	t.Helper()
+	set, err := s.ARCSeal(ctx, strings.NewReader(string(msg)),
+		s.Domain+";\nspf=pass smtp.mailfrom=x@example.net")
+	if err != nil {
+		return nil, err
+	}
+	msg = envelope.AddHeader(msg, "ARC-Authentication-Results",
+		set.AuthenticationResults)
+	msg = envelope.AddHeader(msg, "ARC-Message-Signature",
+		set.MessageSignature)
+	msg = envelope.AddHeader(msg, "ARC-Seal", set.Seal)
+	return msg, nil
+}
+
+// checkARCTags checks that the ARC headers with the given instance have the
+// expected tags.
+func checkARCTags(t *testing.T, msg []byte, instance, cv string) {
+	t.Helper()
+	hdrs, err := readHeaders(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil {
+		t.Fatalf("error reading headers: %v", err)
+	}
+
+	found := false
+	for _, h := range hdrs.FindAll("ARC-Seal") {
+		tags, err := parseTags(h.Value)
+		if err != nil {
+			t.Fatalf("error parsing ARC-Seal: %v", err)
+		}
+		if tags["i"] != instance {
+			continue
+		}
+		found = true
+		if tags["cv"] != cv {
+			t.Errorf("i=%s: expected cv=%s, got cv=%s",
+				instance, cv, tags["cv"])
+		}
+	}
+	if !found {
+		t.Errorf("ARC-Seal with i=%s not found:\n%s", instance, msg)
+	}
+
+	aars := hdrs.FindAll("ARC-Authentication-Results")
+	if len(aars) == 0 || !strings.HasPrefix(
+		strings.TrimSpace(aars[0].Value), "i="+instance+"; ") {
+		t.Errorf("unexpected ARC-Authentication-Results: %v", aars)
+	}
+}
+
+func TestARCChain(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(rsaKey.Public())
+
+	ctx := fakeDNS(map[string][]string{
+		"rsa._domainkey.example.com": {
+			"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"ed._domainkey.example.org": {
+			"v=DKIM1; k=ed25519; p=" + rfc8463PublicKey},
+	})
+	rsaSigner := &Signer{
+		Domain: "example.com", Selector: "rsa", Signer: rsaKey}
+	edSigner := &Signer{
+		Domain: "example.org", Selector: "ed", Signer: rfc8463Key(t)}
+
+	msg := []byte("From: me@example.net\nTo: you@example.com\n" +
+		"Subject: Hola\n  with folding\n\nBody  with\t whitespace \n\n")
+
+	// First hop: no previous chain.
+	msg, err = arcSeal(t, ctx, rsaSigner, msg)
+	if err != nil {
+		t.Fatalf("error sealing i=1: %v", err)
+	}
+	checkARCTags(t, msg, "1", "none")
+
+	// Second and third hops, the chain must validate.
+	msg, err = arcSeal(t, ctx, edSigner, msg)
+	if err != nil {
+		t.Fatalf("error sealing i=2: %v", err)
+	}
+	checkARCTags(t, msg, "2", "pass")
+
+	msg, err = arcSeal(t, ctx, rsaSigner, msg)
+	if err != nil {
+		t.Fatalf("error sealing i=3: %v", err)
+	}
+	checkARCTags(t, msg, "3", "pass")
+
+	// Modify the body: the latest ARC-Message-Signature no longer
+	// validates, so the chain fails.
+	modified := append(msg[:len(msg):len(msg)], []byte("Extra line\n")...)
+	failed, err := arcSeal(t, ctx, edSigner, modified)
+	if err != nil {
+		t.Fatalf("error sealing modified message: %v", err)
+	}
+	checkARCTags(t, failed, "4", "fail")
+
+	// Once the chain has failed, it must not be sealed again.
+	_, err = arcSeal(t, ctx, rsaSigner, failed)
+	if !errors.Is(err, errARCChainFailed) {
+		t.Errorf("expected errARCChainFailed, got %v", err)
+	}
+
+	// Modify one of the previous ARC headers: the seals no longer validate.
+	modified = []byte(strings.Replace(string(msg),
+		"ARC-Authentication-Results: i=2; example.org;",
+		"ARC-Authentication-Results: i=2; example.org; x=y;", 1))
+	failed, err = arcSeal(t, ctx, edSigner, modified)
+	if err != nil {
+		t.Fatalf("error sealing modified message: %v", err)
+	}
+	checkARCTags(t, failed, "4", "fail")
+
+	// If the key can't be found due to a temporary error, we don't seal.
+	tempCtx := fakeDNS(map[string][]string{
+		"rsa._domainkey.example.com": {"TEMP"},
+	})
+	_, err = arcSeal(t, tempCtx, edSigner, msg)
+	if !errors.Is(err, errTemporaryLookupFail) {
+		t.Errorf("expected errTemporaryLookupFail, got %v", err)
+	}
+}
+
+func TestARCInvalidChains(t *testing.T) {
+	ctx := fakeDNS(map[string][]string{
+		"ed._domainkey.example.org": {
+			"v=DKIM1; k=ed25519; p=" + rfc8463PublicKey},
+	})
+	s := &Signer{
+		Domain: "example.org", Selector: "ed", Signer: rfc8463Key(t)}
+
+	sealed, err := arcSeal(t, ctx, s,
+		[]byte("From: me@example.net\nSubject: Hola\n\nBody\n"))
+	if err != nil {
+		t.Fatalf("error sealing: %v", err)
+	}
+
+	cases := []struct {
+		msg      string
+		instance string
+	}{
+		// Incomplete set.
+		{"ARC-Seal: i=1; cv=none; a=ed25519-sha256; d=x; s=y; b=\n" +
+			"From: me@example.net\n\nBody\n", "2"},
+
+		// Missing instance.
+		{strings.Replace(string(sealed),
+			"ARC-Seal: i=1;", "ARC-Seal: i=2;", 1), "3"},
+
+		// Invalid cv= for the first instance.
+		{strings.Replace(string(sealed), "cv=none", "cv=pass", 1), "2"},
+
+		// Invalid ARC-Message-Signature.
+		{strings.Replace(string(sealed),
+			"ARC-Message-Signature: i=1; a=ed25519-sha256",
+			"ARC-Message-Signature: i=1; a=rsa-sha1", 1), "2"},
+	}
+	for i, c := range cases {
+		msg, err := arcSeal(t, ctx, s, []byte(c.msg))
+		if err != nil {
+			t.Errorf("%d: error sealing: %v", i, err)
+			continue
+		}
+		checkARCTags(t, msg, c.instance, "fail")
+	}
+}
+
+func TestARCSealErrors(t *testing.T) {
+	ctx := fakeDNS(nil)
+
+	s := &Signer{Domain: "example.org", Selector: "ed", Signer: rfc8463Key(t)}
+	_, err := s.ARCSeal(ctx, strings.NewReader("Subject: x\n\nBody\n"), "x")
+	if !errors.Is(err, errMissingFrom) {
+		t.Errorf("expected errMissingFrom, got %v", err)
+	}
+
+	_, err = s.ARCSeal(ctx, strings.NewReader("From x\n\nBody\n"), "x")
+	if !errors.Is(err, errInvalidHeader) {
+		t.Errorf("expected errInvalidHeader, got %v", err)
+	}
+
+	s = &Signer{Domain: "example.org", Selector: "x", Signer: fakeSigner{}}
+	_, err = s.ARCSeal(ctx, strings.NewReader("From: x\n\nBody\n"), "x")
+	if !errors.Is(err, errUnsupportedKeyType) {
+		t.Errorf("expected errUnsupportedKeyType, got %v", err)
+	}
+
+	// Too many sets.
+	msg := "From: x\n"
+	for i := 1; i <= maxARCInstances; i++ {
+		msg = "ARC-Authentication-Results: i=" + strconv.Itoa(i) + "; x\n" +
+			"ARC-Message-Signature: i=" + strconv.Itoa(i) + "; x=y\n" +
+			"ARC-Seal: i=" + strconv.Itoa(i) + "; x=y\n" + msg
+	}
+	s = &Signer{Domain: "example.org", Selector: "ed", Signer: rfc8463Key(t)}
+	_, err = s.ARCSeal(ctx, strings.NewReader(msg+"\nBody\n"), "x")
+	if !errors.Is(err, errARCTooManySets) {
+		t.Errorf("expected errARCTooManySets, got %v", err)
+	}
+}
+
+func TestARCInstance(t *testing.T) {
+	cases := []struct {
+		value    string
+		instance int
+		ok       bool
+	}{
+		{" i=1; a=b", 1, true},
+		{"i = 50 ;", 50, true},
+		{" i=7", 7, true},
+		{" i=0; a=b", 0, false},
+		{" i=51; a=b", 0, false},
+		{" i=x; a=b", 0, false},
+		{" a=b; i=1", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		i, err := arcInstance(header{Name: "ARC-Seal", Value: c.value})
+		if i != c.instance || (err == nil) != c.ok {
+			t.Errorf("arcInstance(%q) = %d, %v; expected %d, ok=%v",
+				c.value, i, err, c.instance, c.ok)
+		}
+	}
+}
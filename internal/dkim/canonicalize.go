@@ -0,0 +1,175 @@
+package dkim
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// canonicalization algorithm, for either headers or bodies.
+// https://datatracker.ietf.org/doc/html/rfc6376#section-3.4
+type canonicalization string
+
+const (
+	simpleCanonicalization  = canonicalization("simple")
+	relaxedCanonicalization = canonicalization("relaxed")
+)
+
+var errUnknownCanonicalization = errors.New("unknown canonicalization")
+
+// parseCanonicalization parses the value of the "c=" tag, returning the
+// header and body canonicalization algorithms.
+// https://datatracker.ietf.org/doc/html/rfc6376#section-3.5
+func parseCanonicalization(s string) (hdr, body canonicalization, err error) {
+	if s == "" {
+		// Default when the tag is missing.
+		return simpleCanonicalization, simpleCanonicalization, nil
+	}
+
+	h, b, found := strings.Cut(s, "/")
+	if !found {
+		// If only one is given, it applies to the header, and the body
+		// uses "simple".
+		b = string(simpleCanonicalization)
+	}
+
+	hdr, err = toCanonicalization(h)
+	if err != nil {
+		return "", "", err
+	}
+	body, err = toCanonicalization(b)
+	if err != nil {
+		return "", "", err
+	}
+	return hdr, body, nil
+}
+
+func toCanonicalization(s string) (canonicalization, error) {
+	switch c := canonicalization(strings.ToLower(strings.TrimSpace(s))); c {
+	case simpleCanonicalization, relaxedCanonicalization:
+		return c, nil
+	default:
+		return "", errUnknownCanonicalization
+	}
+}
+
+// header canonicalizes the given header, returning the canonical form
+// without the final line ending.
+func (c canonicalization) header(h header) string {
+	if c == simpleCanonicalization {
+		// https://datatracker.ietf.org/doc/html/rfc6376#section-3.4.1
+		return h.Source
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc6376#section-3.4.2
+	//  - Convert the name to lowercase.
+	//  - Unfold the value.
+	//  - Convert all sequences of WSP into a single SP.
+	//  - Remove WSP at the end of the value, and before and after the colon.
+	name := strings.ToLower(strings.TrimRight(h.Name, " \t"))
+	value := strings.ReplaceAll(h.Value, "\r\n", "")
+	value = strings.ReplaceAll(value, "\n", "")
+	value = compressWSP(value)
+	value = strings.Trim(value, " ")
+	return name + ":" + value
+}
+
+// compressWSP converts all sequences of whitespace (spaces and tabs) into a
+// single space.
+func compressWSP(s string) string {
+	b := strings.Builder{}
+	b.Grow(len(s))
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// body reads the body from r, and writes its canonical form to w.
+// Lines in r can be terminated by either "\n" or "\r\n"; the output always
+// uses "\r\n".
+func (c canonicalization) body(w io.Writer, r *bufio.Reader) error {
+	bc := c.newBodyCanonicalizer(w)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line != "" {
+			if werr := bc.Line(line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return bc.Close()
+}
+
+// bodyCanonicalizer canonicalizes a body line by line, writing the result
+// to the given writer. This allows us to process the body in a single pass,
+// even when we need the result of different canonicalization algorithms.
+type bodyCanonicalizer struct {
+	c canonicalization
+	w io.Writer
+
+	// Empty lines at the end of the body are ignored in both algorithms, so
+	// we keep track of them and only write them when we find a non-empty
+	// line after them.
+	// https://datatracker.ietf.org/doc/html/rfc6376#section-3.4.3
+	// https://datatracker.ietf.org/doc/html/rfc6376#section-3.4.4
+	pendingEmpty   int
+	wroteSomething bool
+}
+
+func (c canonicalization) newBodyCanonicalizer(w io.Writer) *bodyCanonicalizer {
+	return &bodyCanonicalizer{c: c, w: w}
+}
+
+// Line processes a single line of the body, which can be terminated by
+// either "\n", "\r\n", or nothing (in the case of the last line).
+func (bc *bodyCanonicalizer) Line(line string) error {
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	if bc.c == relaxedCanonicalization {
+		line = strings.TrimRight(compressWSP(line), " ")
+	}
+
+	if line == "" {
+		bc.pendingEmpty++
+		return nil
+	}
+
+	for ; bc.pendingEmpty > 0; bc.pendingEmpty-- {
+		if _, err := io.WriteString(bc.w, "\r\n"); err != nil {
+			return err
+		}
+	}
+	bc.wroteSomething = true
+	_, err := io.WriteString(bc.w, line+"\r\n")
+	return err
+}
+
+// Close finishes the canonicalization. It must be called after the last
+// line was processed.
+func (bc *bodyCanonicalizer) Close() error {
+	// In the simple algorithm, an empty body is canonicalized as a single
+	// line ending. The relaxed algorithm leaves it empty.
+	if !bc.wroteSomething && bc.c == simpleCanonicalization {
+		_, err := io.WriteString(bc.w, "\r\n")
+		return err
+	}
+	return nil
+}
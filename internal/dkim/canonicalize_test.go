@@ -0,0 +1,121 @@
+package dkim
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// Example from RFC 6376, section 3.4.6.
+// https://datatracker.ietf.org/doc/html/rfc6376#section-3.4.6
+const exampleMessage = "A: X\r\n" +
+	"B : Y\t\r\n" +
+	"\tZ  \r\n" +
+	"\r\n" +
+	" C \r\n" +
+	"D \t E\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func TestHeaderCanonicalization(t *testing.T) {
+	hs, err := readHeaders(bufio.NewReader(strings.NewReader(exampleMessage)))
+	if err != nil {
+		t.Fatalf("error reading headers: %v", err)
+	}
+	if len(hs) != 2 {
+		t.Fatalf("expected 2 headers, got %d: %q", len(hs), hs)
+	}
+
+	cases := []struct {
+		c        canonicalization
+		expected []string
+	}{
+		{relaxedCanonicalization, []string{"a:X", "b:Y Z"}},
+		{simpleCanonicalization, []string{"A: X", "B : Y\t\r\n\tZ  "}},
+	}
+	for _, c := range cases {
+		for i, h := range hs {
+			got := c.c.header(h)
+			if got != c.expected[i] {
+				t.Errorf("%s header %d: expected %q, got %q",
+					c.c, i, c.expected[i], got)
+			}
+		}
+	}
+}
+
+func TestBodyCanonicalization(t *testing.T) {
+	cases := []struct {
+		c        canonicalization
+		body     string
+		expected string
+	}{
+		// Example from RFC 6376, section 3.4.6.
+		{relaxedCanonicalization, " C \r\nD \t E\r\n\r\n\r\n",
+			" C\r\nD E\r\n"},
+		{simpleCanonicalization, " C \r\nD \t E\r\n\r\n\r\n",
+			" C \r\nD \t E\r\n"},
+
+		// Same, but with "\n" line endings.
+		{relaxedCanonicalization, " C \nD \t E\n\n\n",
+			" C\r\nD E\r\n"},
+		{simpleCanonicalization, " C \nD \t E\n\n\n",
+			" C \r\nD \t E\r\n"},
+
+		// Empty bodies.
+		{relaxedCanonicalization, "", ""},
+		{relaxedCanonicalization, "\r\n\r\n", ""},
+		{simpleCanonicalization, "", "\r\n"},
+		{simpleCanonicalization, "\n\n", "\r\n"},
+
+		// Missing final line ending.
+		{relaxedCanonicalization, "a\r\nb", "a\r\nb\r\n"},
+		{simpleCanonicalization, "a\r\nb", "a\r\nb\r\n"},
+
+		// Empty lines in the middle are kept.
+		{relaxedCanonicalization, "a\n\n \nb\n", "a\r\n\r\n\r\nb\r\n"},
+	}
+	for _, c := range cases {
+		buf := &strings.Builder{}
+		err := c.c.body(buf, bufio.NewReader(strings.NewReader(c.body)))
+		if err != nil {
+			t.Errorf("%s %q: error: %v", c.c, c.body, err)
+			continue
+		}
+		if buf.String() != c.expected {
+			t.Errorf("%s %q: expected %q, got %q",
+				c.c, c.body, c.expected, buf.String())
+		}
+	}
+}
+
+func TestParseCanonicalization(t *testing.T) {
+	cases := []struct {
+		s          string
+		hdr, body  canonicalization
+		shouldFail bool
+	}{
+		{"", simpleCanonicalization, simpleCanonicalization, false},
+		{"simple", simpleCanonicalization, simpleCanonicalization, false},
+		{"relaxed", relaxedCanonicalization, simpleCanonicalization, false},
+		{"relaxed/relaxed",
+			relaxedCanonicalization, relaxedCanonicalization, false},
+		{"simple/relaxed",
+			simpleCanonicalization, relaxedCanonicalization, false},
+		{"Relaxed/Simple",
+			relaxedCanonicalization, simpleCanonicalization, false},
+		{"bad", "", "", true},
+		{"relaxed/bad", "", "", true},
+	}
+	for _, c := range cases {
+		hdr, body, err := parseCanonicalization(c.s)
+		if (err != nil) != c.shouldFail {
+			t.Errorf("%q: unexpected error result: %v", c.s, err)
+			continue
+		}
+		if hdr != c.hdr || body != c.body {
+			t.Errorf("%q: expected %q/%q, got %q/%q",
+				c.s, c.hdr, c.body, hdr, body)
+		}
+	}
+}
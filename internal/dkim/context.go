@@ -0,0 +1,42 @@
+package dkim
+
+import (
+	"context"
+	"net"
+
+	"blitiri.com.ar/go/chasquid/internal/dnsctx"
+)
+
+var (
+	traceKey     = dnsctx.NewKey("dkim.trace")
+	lookupTXTKey = dnsctx.NewKey("dkim.lookupTXT")
+)
+
+// TraceFunc is used to trace the verification process.
+type TraceFunc = dnsctx.TraceFunc
+
+// WithTraceFunc returns a context that will use the given function to trace
+// the verification process.
+func WithTraceFunc(ctx context.Context, trace TraceFunc) context.Context {
+	return dnsctx.WithTrace(ctx, traceKey, trace)
+}
+
+func trace(ctx context.Context, f string, args ...interface{}) {
+	dnsctx.Trace(ctx, traceKey, f, args...)
+}
+
+// LookupTXTFunc is used to look up TXT records, with the same semantics as
+// net.Resolver.LookupTXT.
+type LookupTXTFunc = dnsctx.LookupFunc
+
+// WithLookupTXTFunc returns a context that will use the given function to
+// look up the public keys' TXT records. By default,
+// net.DefaultResolver.LookupTXT is used. Useful for testing.
+func WithLookupTXTFunc(ctx context.Context, lookupTXT LookupTXTFunc) context.Context {
+	return dnsctx.WithLookup(ctx, lookupTXTKey, lookupTXT)
+}
+
+func lookupTXT(ctx context.Context, domain string) ([]string, error) {
+	return dnsctx.Lookup(ctx, lookupTXTKey, domain,
+		net.DefaultResolver.LookupTXT)
+}
@@ -0,0 +1,127 @@
+package dkim
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// header represents a single header field, as it appears in the message.
+type header struct {
+	// Name of the header, as it appears in the message (case preserved).
+	Name string
+
+	// Value of the header, including folding (if any), but without the final
+	// line ending.
+	Value string
+
+	// Source of the header, exactly as it appears in the message (including
+	// the name, value and folding), but without the final line ending.
+	Source string
+}
+
+// headers is a list of header fields, in the order they appear in the
+// message.
+type headers []header
+
+var errInvalidHeader = errors.New("invalid header")
+
+// readHeaders reads the headers from the given reader, stopping after the
+// empty line that separates them from the body. The reader is left
+// positioned at the beginning of the body.
+// Lines can be terminated by either "\n" or "\r\n".
+func readHeaders(r *bufio.Reader) (headers, error) {
+	hs := headers{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		eof := err == io.EOF
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			// End of the headers (or the message).
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation of the previous header.
+			if len(hs) == 0 {
+				return nil, fmt.Errorf(
+					"%w: continuation without a header", errInvalidHeader)
+			}
+			h := &hs[len(hs)-1]
+			h.Value += "\r\n" + line
+			h.Source += "\r\n" + line
+		} else {
+			name, value, found := strings.Cut(line, ":")
+			if !found {
+				return nil, fmt.Errorf(
+					"%w: missing ':' in %q", errInvalidHeader, line)
+			}
+			hs = append(hs, header{
+				Name:   strings.TrimRight(name, " \t"),
+				Value:  value,
+				Source: line,
+			})
+		}
+
+		if eof {
+			break
+		}
+	}
+
+	return hs, nil
+}
+
+// FindAll returns all the headers with the given name (case-insensitive), in
+// the order they appear in the message.
+func (hs headers) FindAll(name string) headers {
+	found := headers{}
+	for _, h := range hs {
+		if strings.EqualFold(h.Name, name) {
+			found = append(found, h)
+		}
+	}
+	return found
+}
+
+// tags represents a tag-value list, as used in DKIM signatures and public
+// key records.
+// https://datatracker.ietf.org/doc/html/rfc6376#section-3.2
+type tags map[string]string
+
+var errInvalidTag = errors.New("invalid tag")
+
+// parseTags parses a tag-value list.
+func parseTags(s string) (tags, error) {
+	t := tags{}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			// Trailing ";" are allowed, and we are lenient with empty ones.
+			continue
+		}
+
+		name, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("%w: missing '=' in %q", errInvalidTag, part)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("%w: empty name in %q", errInvalidTag, part)
+		}
+		if _, dup := t[name]; dup {
+			// Duplicated tags make the whole list invalid.
+			// https://datatracker.ietf.org/doc/html/rfc6376#section-3.2
+			return nil, fmt.Errorf("%w: duplicated %q", errInvalidTag, name)
+		}
+
+		t[name] = strings.TrimSpace(value)
+	}
+
+	return t, nil
+}
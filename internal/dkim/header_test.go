@@ -0,0 +1,102 @@
+package dkim
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadHeaders(t *testing.T) {
+	msg := "From: Me <me@example.com>\n" +
+		"To: you@example.net,\n" +
+		"  them@example.org\r\n" +
+		"Subject:hola\n" +
+		"\n" +
+		"body\n"
+	r := bufio.NewReader(strings.NewReader(msg))
+	hs, err := readHeaders(r)
+	if err != nil {
+		t.Fatalf("error reading headers: %v", err)
+	}
+
+	expected := headers{
+		{"From", " Me <me@example.com>", "From: Me <me@example.com>"},
+		{"To", " you@example.net,\r\n  them@example.org",
+			"To: you@example.net,\r\n  them@example.org"},
+		{"Subject", "hola", "Subject:hola"},
+	}
+	if diff := cmp.Diff(expected, hs); diff != "" {
+		t.Errorf("headers mismatch (-want +got):\n%s", diff)
+	}
+
+	// The reader must be left at the start of the body.
+	body, _ := io.ReadAll(r)
+	if string(body) != "body\n" {
+		t.Errorf("expected body %q, got %q", "body\n", body)
+	}
+
+	if l := hs.FindAll("from"); len(l) != 1 || l[0].Name != "From" {
+		t.Errorf("FindAll(from) returned %v", l)
+	}
+	if l := hs.FindAll("x-missing"); len(l) != 0 {
+		t.Errorf("FindAll(x-missing) returned %v", l)
+	}
+}
+
+func TestReadHeadersNoBody(t *testing.T) {
+	hs, err := readHeaders(bufio.NewReader(strings.NewReader("A: b")))
+	if err != nil {
+		t.Fatalf("error reading headers: %v", err)
+	}
+	if len(hs) != 1 || hs[0].Value != " b" {
+		t.Errorf("unexpected headers: %q", hs)
+	}
+}
+
+func TestReadHeadersErrors(t *testing.T) {
+	cases := []string{
+		" continuation first\n\n",
+		"No colon here\n\n",
+	}
+	for _, c := range cases {
+		_, err := readHeaders(bufio.NewReader(strings.NewReader(c)))
+		if !errors.Is(err, errInvalidHeader) {
+			t.Errorf("%q: expected invalid header error, got %v", c, err)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	cases := []struct {
+		s        string
+		expected tags
+	}{
+		{"", tags{}},
+		{"a=b", tags{"a": "b"}},
+		{" a = b ; c=d;", tags{"a": "b", "c": "d"}},
+		{"v=1; h=from\r\n\t:to; b=", tags{"v": "1", "h": "from\r\n\t:to", "b": ""}},
+		{"a=b=c", tags{"a": "b=c"}},
+	}
+	for _, c := range cases {
+		got, err := parseTags(c.s)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.s, err)
+			continue
+		}
+		if diff := cmp.Diff(c.expected, got); diff != "" {
+			t.Errorf("%q: mismatch (-want +got):\n%s", c.s, diff)
+		}
+	}
+
+	bad := []string{"a", "=b", "a=b; a=c"}
+	for _, s := range bad {
+		_, err := parseTags(s)
+		if !errors.Is(err, errInvalidTag) {
+			t.Errorf("%q: expected invalid tag error, got %v", s, err)
+		}
+	}
+}
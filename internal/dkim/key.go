@@ -0,0 +1,61 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadPrivateKey loads a private key to use for signing from the given file.
+//
+// The following formats are supported:
+//   - PEM-encoded PKCS#1 RSA keys ("RSA PRIVATE KEY").
+//   - PEM-encoded PKCS#8 RSA or Ed25519 keys ("PRIVATE KEY").
+//   - Base64-encoded raw Ed25519 seeds, as generated by dkimpy's dknewkey.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(raw)
+}
+
+func parsePrivateKey(raw []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		// Not PEM, try a raw Ed25519 seed.
+		seed, err := base64.StdEncoding.DecodeString(
+			strings.TrimSpace(string(raw)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("no PEM block found, and not an ed25519 seed")
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		default:
+			return nil, fmt.Errorf("%w: %T", errUnsupportedKeyType, key)
+		}
+	default:
+		return nil, fmt.Errorf("%w: PEM block type %q",
+			errUnsupportedKeyType, block.Type)
+	}
+}
@@ -0,0 +1,261 @@
+// Package dkim implements DKIM signing and verification, and ARC sealing
+// (which is built on top of DKIM).
+//
+// It only supports relaxed/relaxed canonicalization for signing, which is
+// the most widely used and tolerant to the changes that happen in transit.
+// Verification supports all the standard canonicalizations, and the
+// rsa-sha256 and ed25519-sha256 algorithms.
+//
+// https://datatracker.ietf.org/doc/html/rfc6376
+// https://datatracker.ietf.org/doc/html/rfc8463
+// https://datatracker.ietf.org/doc/html/rfc8617
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultHeadersToSign is the list of headers we sign by default.
+// It is based on the recommendations in RFC 6376, plus Message-ID.
+// https://datatracker.ietf.org/doc/html/rfc6376#section-5.4.1
+var DefaultHeadersToSign = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References",
+	"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe",
+	"List-Post", "List-Owner", "List-Archive",
+	"Message-ID",
+}
+
+// Signer creates DKIM signatures for a given domain and selector.
+type Signer struct {
+	// Domain to sign, which goes in the "d=" tag of the signature.
+	// Must be in ASCII (IDNA) form.
+	Domain string
+
+	// Selector to use, which goes in the "s=" tag of the signature.
+	Selector string
+
+	// Signer to use. Must be either an *rsa.PrivateKey, or an
+	// ed25519.PrivateKey.
+	Signer crypto.Signer
+
+	// Headers to sign. If empty, DefaultHeadersToSign is used.
+	// "From" is always signed, even if it is not included here.
+	Headers []string
+
+	// Function returning the current time, used for the "t=" tag.
+	// If nil, time.Now is used. Useful for testing.
+	Now func() time.Time
+}
+
+var (
+	errUnsupportedKeyType = errors.New("unsupported key type")
+	errMissingFrom        = errors.New("message has no From header")
+)
+
+// Sign the given message. It returns the value of the DKIM-Signature header
+// (without the header name), which should be prepended to the message as-is.
+// The message can use either "\n" or "\r\n" as line endings. The returned
+// value is folded using "\n"; note that the continuation lines do NOT begin
+// with whitespace, so it's compatible with envelope.AddHeader.
+func (s *Signer) Sign(message io.Reader) (string, error) {
+	algo, err := s.algorithm()
+	if err != nil {
+		return "", err
+	}
+
+	r := bufio.NewReader(message)
+	hdrs, err := readHeaders(r)
+	if err != nil {
+		return "", err
+	}
+	if len(hdrs.FindAll("From")) == 0 {
+		return "", errMissingFrom
+	}
+
+	bodyHash, err := relaxedBodyHash(r)
+	if err != nil {
+		return "", err
+	}
+
+	hNames, signed := s.headersToSign(hdrs)
+
+	// Build the header, using "\r\n " for folding. This is what we will hash,
+	// and at the end we convert it to the format the caller expects.
+	// Folding is only done at whitespace, to keep the signed contents
+	// unaffected by relaxed canonicalization.
+	dkimSig := fmt.Sprintf(
+		"v=1; a=%s; c=relaxed/relaxed;\r\n"+
+			" d=%s; s=%s; t=%d;\r\n"+
+			" h=%s;\r\n"+
+			" bh=%s;\r\n"+
+			" b=",
+		algo, s.Domain, s.Selector, s.now().Unix(),
+		foldList(hNames, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash))
+
+	h := sha256.New()
+	for _, hdr := range signed {
+		io.WriteString(h, relaxedCanonicalization.header(hdr)+"\r\n")
+	}
+	io.WriteString(h, relaxedCanonicalization.header(
+		newHeader("DKIM-Signature", dkimSig)))
+
+	sig, err := s.sign(h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+
+	dkimSig += foldString(base64.StdEncoding.EncodeToString(sig), 72)
+
+	// envelope.AddHeader takes care of the indentation of continuation lines.
+	return unfoldForAddHeader(dkimSig), nil
+}
+
+// algorithm returns the signing algorithm ("a=" tag) for the signer's key.
+func (s *Signer) algorithm() (string, error) {
+	switch s.Signer.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("%w: %T", errUnsupportedKeyType, s.Signer)
+	}
+}
+
+// sign the given (SHA256) hash with the signer's key.
+func (s *Signer) sign(hashed []byte) ([]byte, error) {
+	switch k := s.Signer.(type) {
+	case *rsa.PrivateKey:
+		return k.Sign(rand.Reader, hashed, crypto.SHA256)
+	case ed25519.PrivateKey:
+		// Ed25519 signs the hash, not the data itself.
+		// https://datatracker.ietf.org/doc/html/rfc8463#section-3
+		return k.Sign(rand.Reader, hashed, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("%w: %T", errUnsupportedKeyType, s.Signer)
+	}
+}
+
+func (s *Signer) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// headersToSign chooses the headers to sign: every instance of the ones we
+// were told to sign, plus the extra ones given. It returns the lowercase
+// names for the "h=" tag, and the headers themselves, in the same order.
+// Their order doesn't matter for the signature, as long as the "h=" tag lists
+// them in the same order we hash them.
+func (s *Signer) headersToSign(hdrs headers, extra ...string) ([]string, headers) {
+	toSign := s.Headers
+	if len(toSign) == 0 {
+		toSign = DefaultHeadersToSign
+	}
+	if !containsFold(toSign, "From") {
+		toSign = append([]string{"From"}, toSign...)
+	}
+	toSign = append(toSign[:len(toSign):len(toSign)], extra...)
+
+	hNames := []string{}
+	signed := headers{}
+	seen := map[string]bool{}
+	for _, name := range toSign {
+		lname := strings.ToLower(name)
+		if seen[lname] {
+			continue
+		}
+		seen[lname] = true
+
+		// Headers are picked from the bottom up.
+		// https://datatracker.ietf.org/doc/html/rfc6376#section-5.4.2
+		found := hdrs.FindAll(name)
+		for i := len(found) - 1; i >= 0; i-- {
+			hNames = append(hNames, lname)
+			signed = append(signed, found[i])
+		}
+	}
+	return hNames, signed
+}
+
+// relaxedBodyHash reads the body from r, and returns its hash using relaxed
+// canonicalization.
+func relaxedBodyHash(r *bufio.Reader) ([]byte, error) {
+	h := sha256.New()
+	err := relaxedCanonicalization.body(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// newHeader returns a header with the given name and value, as we would
+// write it to the message. The value can be folded using "\r\n ".
+func newHeader(name, value string) header {
+	return header{
+		Name:   name,
+		Value:  " " + value,
+		Source: name + ": " + value,
+	}
+}
+
+// unfoldForAddHeader converts a value folded with "\r\n " (which we use
+// for hashing) to one folded with "\n", as expected by envelope.AddHeader.
+func unfoldForAddHeader(v string) string {
+	return strings.ReplaceAll(v, "\r\n ", "\n")
+}
+
+// foldList joins the given list using sep, adding a fold every few elements
+// to keep lines at a reasonable length.
+func foldList(l []string, sep string) string {
+	s := ""
+	lineLen := 0
+	for i, e := range l {
+		if i > 0 {
+			s += sep
+			if lineLen+len(e) > 60 {
+				s += "\r\n  "
+				lineLen = 0
+			}
+		}
+		s += e
+		lineLen += len(e) + len(sep)
+	}
+	return s
+}
+
+// foldString splits the given string in lines of at most n characters.
+// This is only valid for values where whitespace is ignored, like the
+// signature itself.
+func foldString(s string, n int) string {
+	folded := ""
+	for len(s) > n {
+		folded += s[:n] + "\r\n "
+		s = s[n:]
+	}
+	return folded + s
+}
+
+func containsFold(l []string, s string) bool {
+	for _, e := range l {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
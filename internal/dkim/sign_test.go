@@ -0,0 +1,305 @@
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+)
+
+// Message and key from RFC 8463, appendix A.
+// https://datatracker.ietf.org/doc/html/rfc8463#appendix-A
+const rfc8463Message = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const (
+	rfc8463Seed      = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463PublicKey = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	rfc8463BodyHash  = "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="
+)
+
+func rfc8463Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	seed, err := base64.StdEncoding.DecodeString(rfc8463Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+// checkSignature verifies the signature in the given signed message (which
+// must have the DKIM-Signature header at the top), re-computing the hashes
+// independently. It returns the parsed tags.
+func checkSignature(t *testing.T, signed string, pub crypto.PublicKey) tags {
+	t.Helper()
+
+	// Re-read the signed message, and get the signature tags.
+	hs, err := readHeaders(bufio.NewReader(strings.NewReader(signed)))
+	if err != nil {
+		t.Fatalf("error reading signed headers: %v", err)
+	}
+	if !strings.EqualFold(hs[0].Name, "DKIM-Signature") {
+		t.Fatalf("first header is not the signature: %q", hs[0])
+	}
+	sigH := hs[0]
+	tg, err := parseTags(sigH.Value)
+	if err != nil {
+		t.Fatalf("error parsing signature tags: %v", err)
+	}
+
+	// Compute the header hash, following the "h=" tag.
+	h := sha256.New()
+	used := map[string]int{}
+	for _, name := range strings.Split(tg["h"], ":") {
+		name = strings.TrimSpace(name)
+		found := hs[1:].FindAll(name)
+		used[name]++
+		if used[name] > len(found) {
+			t.Fatalf("header %q signed more times than it appears", name)
+		}
+		hdr := found[len(found)-used[name]]
+		io.WriteString(h, relaxedCanonicalization.header(hdr)+"\r\n")
+	}
+
+	// The signature header itself, with the "b=" value removed.
+	bIdx := strings.LastIndex(sigH.Value, "b=")
+	unsigned := sigH
+	unsigned.Value = sigH.Value[:bIdx+2]
+	io.WriteString(h, relaxedCanonicalization.header(unsigned))
+
+	b, err := base64.StdEncoding.DecodeString(
+		strings.Join(strings.Fields(tg["b"]), ""))
+	if err != nil {
+		t.Fatalf("error decoding b=: %v", err)
+	}
+
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, h.Sum(nil), b) {
+			t.Errorf("ed25519 signature verification failed")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, h.Sum(nil), b)
+		if err != nil {
+			t.Errorf("rsa signature verification failed: %v", err)
+		}
+	default:
+		t.Fatalf("unknown key type %T", pub)
+	}
+
+	return tg
+}
+
+func TestSignEd25519(t *testing.T) {
+	key := rfc8463Key(t)
+	s := &Signer{
+		Domain:   "football.example.com",
+		Selector: "brisbane",
+		Signer:   key,
+		Now:      func() time.Time { return time.Unix(1528637909, 0) },
+	}
+
+	sig, err := s.Sign(strings.NewReader(rfc8463Message))
+	if err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	t.Logf("signature: %q", sig)
+
+	signed := string(envelope.AddHeader(
+		[]byte(rfc8463Message), "DKIM-Signature", sig))
+	tg := checkSignature(t, signed, key.Public())
+
+	expected := map[string]string{
+		"v":  "1",
+		"a":  "ed25519-sha256",
+		"c":  "relaxed/relaxed",
+		"d":  "football.example.com",
+		"s":  "brisbane",
+		"t":  "1528637909",
+		"bh": rfc8463BodyHash,
+	}
+	for k, v := range expected {
+		if tg[k] != v {
+			t.Errorf("tag %q: expected %q, got %q", k, v, tg[k])
+		}
+	}
+
+	// Only the headers present in the message are signed.
+	h := strings.Join(strings.Fields(tg["h"]), "")
+	if h != "from:subject:date:to:message-id" {
+		t.Errorf("unexpected h= %q", h)
+	}
+
+	// Ed25519 is deterministic, so signing again must give the same result.
+	sig2, err := s.Sign(strings.NewReader(rfc8463Message))
+	if err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	if sig != sig2 {
+		t.Errorf("signatures differ:\n%q\n%q", sig, sig2)
+	}
+}
+
+func TestSignRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Use "\n" line endings, like chasquid does internally, and a few
+	// repeated headers.
+	msg := "Received: from somewhere\n" +
+		"From: me@example.com\n" +
+		"To: you@example.net\n" +
+		"To: them@example.net\n" +
+		"X-Not-Signed: true\n" +
+		"\n" +
+		"Hola!  \n\n\n"
+
+	s := &Signer{
+		Domain:   "example.com",
+		Selector: "sel",
+		Signer:   key,
+		Headers:  []string{"to", "subject"},
+	}
+	sig, err := s.Sign(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	t.Logf("signature: %q", sig)
+
+	signed := string(envelope.AddHeader([]byte(msg), "DKIM-Signature", sig))
+	tg := checkSignature(t, signed, key.Public())
+
+	if tg["a"] != "rsa-sha256" {
+		t.Errorf("unexpected a= %q", tg["a"])
+	}
+
+	// From is always included even if not requested, and all instances of
+	// To are signed.
+	h := strings.Join(strings.Fields(tg["h"]), "")
+	if h != "from:to:to" {
+		t.Errorf("unexpected h= %q", h)
+	}
+
+	// Changing the body invalidates the body hash.
+	sig2, err := s.Sign(strings.NewReader(msg + "extra\n"))
+	if err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	tg2, _ := parseTags(sig2)
+	if tg["bh"] == tg2["bh"] {
+		t.Errorf("body hash did not change with different body")
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	key := rfc8463Key(t)
+	s := &Signer{Domain: "d", Selector: "s", Signer: key}
+
+	_, err := s.Sign(strings.NewReader("To: x\n\nbody\n"))
+	if err != errMissingFrom {
+		t.Errorf("expected missing From error, got %v", err)
+	}
+
+	_, err = s.Sign(strings.NewReader(" invalid\n\nbody\n"))
+	if !errors.Is(err, errInvalidHeader) {
+		t.Errorf("expected invalid header error, got %v", err)
+	}
+
+	s.Signer = &fakeSigner{}
+	_, err = s.Sign(strings.NewReader(rfc8463Message))
+	if !errors.Is(err, errUnsupportedKeyType) {
+		t.Errorf("expected unsupported key error, got %v", err)
+	}
+}
+
+type fakeSigner struct{}
+
+func (fakeSigner) Public() crypto.PublicKey { return nil }
+func (fakeSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, nil
+}
+
+func TestLoadPrivateKey(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8RSA, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	pkcs8Ed, _ := x509.MarshalPKCS8PrivateKey(rfc8463Key(t))
+
+	cases := []struct {
+		name    string
+		content string
+		ok      bool
+	}{
+		{"pkcs1", string(pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		})), true},
+		{"pkcs8-rsa", string(pem.EncodeToMemory(&pem.Block{
+			Type: "PRIVATE KEY", Bytes: pkcs8RSA,
+		})), true},
+		{"pkcs8-ed25519", string(pem.EncodeToMemory(&pem.Block{
+			Type: "PRIVATE KEY", Bytes: pkcs8Ed,
+		})), true},
+		{"raw-ed25519", rfc8463Seed + "\n", true},
+		{"bad-pem-type", string(pem.EncodeToMemory(&pem.Block{
+			Type: "CERTIFICATE", Bytes: []byte("x"),
+		})), false},
+		{"bad-pkcs8", string(pem.EncodeToMemory(&pem.Block{
+			Type: "PRIVATE KEY", Bytes: []byte("x"),
+		})), false},
+		{"garbage", "this is not a key", false},
+	}
+	for _, c := range cases {
+		path := dir + "/" + c.name
+		testlib.Rewrite(t, path, c.content)
+		_, err := LoadPrivateKey(path)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expected ok=%v, got error %v", c.name, c.ok, err)
+		}
+	}
+
+	// The raw Ed25519 key must match the RFC's public key.
+	k, err := LoadPrivateKey(dir + "/raw-ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(
+		k.Public().(ed25519.PublicKey))
+	if pub != rfc8463PublicKey {
+		t.Errorf("unexpected public key %q", pub)
+	}
+
+	_, err = LoadPrivateKey(dir + "/doesnotexist")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,658 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// State of the verification of a signature. The values match the ones used
+// in the Authentication-Results header.
+// https://datatracker.ietf.org/doc/html/rfc8601#section-2.7.1
+type State string
+
+// Valid verification states.
+const (
+	None      = State("none")
+	Pass      = State("pass")
+	Fail      = State("fail")
+	TempError = State("temperror")
+	PermError = State("permerror")
+)
+
+// Maximum number of signatures we will verify on a single message, to limit
+// the resources a single message can consume.
+const maxSignatures = 5
+
+// Minimum RSA key size we accept, in bits.
+// https://datatracker.ietf.org/doc/html/rfc8301#section-3.2
+const minRSAKeyBits = 1024
+
+// Errors returned as part of the verification results.
+var (
+	errMissingTag          = errors.New("missing required tag")
+	errUnsupportedVersion  = errors.New("unsupported version")
+	errUnsupportedAlgo     = errors.New("unsupported algorithm")
+	errFromNotSigned       = errors.New("From header is not signed")
+	errInvalidIdentity     = errors.New("identity not in the signing domain")
+	errSignatureExpired    = errors.New("signature expired")
+	errUnsupportedQuery    = errors.New("unsupported query method")
+	errKeyNotFound         = errors.New("public key not found")
+	errKeyRevoked          = errors.New("public key revoked")
+	errKeyTypeMismatch     = errors.New("public key type mismatch")
+	errKeyTooShort         = errors.New("public key too short")
+	errInvalidKey          = errors.New("invalid public key")
+	errIncompatibleKey     = errors.New("public key not valid for this signature")
+	errBodyHashMismatch    = errors.New("body hash mismatch")
+	errVerificationFailed  = errors.New("signature verification failed")
+	errTemporaryLookupFail = errors.New("temporary error looking up key")
+)
+
+// OneResult is the result of verifying a single signature.
+type OneResult struct {
+	// Raw value of the DKIM-Signature header.
+	SignatureHeader string
+
+	// Domain (d=), selector (s=) and signature (b=) of the signature.
+	// Might be empty if the signature could not be parsed.
+	Domain   string
+	Selector string
+	B        string
+
+	// Result of the verification, and the error (if any).
+	State State
+	Error error
+}
+
+// VerifyResult contains the results of verifying all the signatures in a
+// message.
+type VerifyResult struct {
+	// Number of signatures found in the message.
+	Found uint
+
+	// Number of valid signatures.
+	Valid uint
+
+	// Results for each of the signatures that were verified (up to a
+	// maximum; see Found for the total number of signatures).
+	Results []*OneResult
+}
+
+// signature is a parsed DKIM-Signature header.
+type signature struct {
+	hdr header
+
+	algo     string
+	hdrC     canonicalization
+	bodyC    canonicalization
+	domain   string
+	selector string
+	headers  []string
+	bodyHash []byte
+	b        []byte
+
+	// Body length limit (l=), -1 if not present.
+	length int64
+
+	// Is this an ARC-Message-Signature? In that case, "i=" is the instance
+	// and not the identity.
+	arc bool
+}
+
+// VerifyMessage verifies all the DKIM signatures of the given message.
+// The message can use either "\n" or "\r\n" as line endings.
+// It returns an error only if the message could not be read or parsed;
+// per-signature errors are included in the result.
+func VerifyMessage(ctx context.Context, message io.Reader) (*VerifyResult, error) {
+	r := bufio.NewReader(message)
+	hdrs, err := readHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sigHdrs := hdrs.FindAll("DKIM-Signature")
+	result := &VerifyResult{Found: uint(len(sigHdrs))}
+	if len(sigHdrs) == 0 {
+		trace(ctx, "no signatures found")
+		return result, nil
+	}
+	if len(sigHdrs) > maxSignatures {
+		trace(ctx, "too many signatures (%d), only verifying the first %d",
+			len(sigHdrs), maxSignatures)
+		sigHdrs = sigHdrs[:maxSignatures]
+	}
+
+	// Parse all the signatures, and prepare to compute the body hashes.
+	// Signatures can use different body canonicalizations and lengths, so
+	// we keep one hash per combination, and compute them all at once.
+	sigs := make([]*signature, len(sigHdrs))
+	bodyHashes := map[bodyHashKey]*bodyHasher{}
+	for i, h := range sigHdrs {
+		res := &OneResult{SignatureHeader: h.Value}
+		result.Results = append(result.Results, res)
+
+		sig, err := parseSignature(h)
+		if sig != nil {
+			res.Domain = sig.domain
+			res.Selector = sig.selector
+			res.B = base64.StdEncoding.EncodeToString(sig.b)
+		}
+		if err != nil {
+			trace(ctx, "error parsing signature %d: %v", i, err)
+			res.State = PermError
+			res.Error = err
+			continue
+		}
+		sigs[i] = sig
+
+		k := bodyHashKey{sig.bodyC, sig.length}
+		if _, ok := bodyHashes[k]; !ok {
+			bodyHashes[k] = newBodyHasher(sig.bodyC, sig.length)
+		}
+	}
+
+	if len(bodyHashes) > 0 {
+		err = computeBodyHashes(r, bodyHashes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, sig := range sigs {
+		if sig == nil {
+			continue
+		}
+		res := result.Results[i]
+
+		bodyHash := bodyHashes[bodyHashKey{sig.bodyC, sig.length}].Sum()
+		res.Error = sig.verify(ctx, hdrs, bodyHash)
+		res.State = stateFromError(res.Error)
+		if res.State == Pass {
+			result.Valid++
+		}
+		trace(ctx, "signature %d (d=%s s=%s): %s %v",
+			i, sig.domain, sig.selector, res.State, res.Error)
+	}
+
+	return result, nil
+}
+
+func stateFromError(err error) State {
+	switch {
+	case err == nil:
+		return Pass
+	case errors.Is(err, errBodyHashMismatch),
+		errors.Is(err, errVerificationFailed):
+		return Fail
+	case errors.Is(err, errTemporaryLookupFail):
+		return TempError
+	default:
+		return PermError
+	}
+}
+
+// parseSignature parses the given DKIM-Signature header.
+// If the tags can be parsed, the signature is returned even on error, so the
+// caller can use some of its information for reporting.
+func parseSignature(h header) (*signature, error) {
+	t, err := parseTags(h.Value)
+	if err != nil {
+		return nil, err
+	}
+	return signatureFromTags(h, t)
+}
+
+// signatureFromTags builds a signature from the given (already parsed) tags
+// of the header.
+func signatureFromTags(h header, t tags) (*signature, error) {
+	var err error
+
+	// https://datatracker.ietf.org/doc/html/rfc6376#section-3.5
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := t[tag]; !ok {
+			return nil, fmt.Errorf("%w: %s=", errMissingTag, tag)
+		}
+	}
+
+	sig := &signature{
+		hdr:      h,
+		algo:     strings.ToLower(t["a"]),
+		domain:   strings.TrimSuffix(t["d"], "."),
+		selector: t["s"],
+		length:   -1,
+	}
+
+	// Base64 values can contain whitespace, which must be ignored.
+	sig.b, err = decodeBase64(t["b"])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding b=: %w", err)
+	}
+	sig.bodyHash, err = decodeBase64(t["bh"])
+	if err != nil {
+		return sig, fmt.Errorf("error decoding bh=: %w", err)
+	}
+
+	if t["v"] != "1" {
+		return sig, fmt.Errorf("%w: %q", errUnsupportedVersion, t["v"])
+	}
+
+	// Note rsa-sha1 is explicitly not supported, as it is insecure.
+	// https://datatracker.ietf.org/doc/html/rfc8301#section-3.1
+	if sig.algo != "rsa-sha256" && sig.algo != "ed25519-sha256" {
+		return sig, fmt.Errorf("%w: %q", errUnsupportedAlgo, sig.algo)
+	}
+
+	sig.hdrC, sig.bodyC, err = parseCanonicalization(t["c"])
+	if err != nil {
+		return sig, err
+	}
+
+	fromSigned := false
+	for _, name := range strings.Split(t["h"], ":") {
+		name = strings.TrimSpace(name)
+		sig.headers = append(sig.headers, name)
+		if strings.EqualFold(name, "From") {
+			fromSigned = true
+		}
+	}
+	if !fromSigned {
+		return sig, errFromNotSigned
+	}
+
+	if i, ok := t["i"]; ok {
+		// The identity's domain must be the same or a subdomain of d=.
+		_, idomain, _ := strings.Cut(i, "@")
+		idomain = strings.ToLower(strings.TrimSuffix(idomain, "."))
+		domain := strings.ToLower(sig.domain)
+		if idomain != domain && !strings.HasSuffix(idomain, "."+domain) {
+			return sig, fmt.Errorf("%w: %q", errInvalidIdentity, i)
+		}
+	}
+
+	if l, ok := t["l"]; ok {
+		sig.length, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || sig.length < 0 {
+			return sig, fmt.Errorf("invalid l= %q", l)
+		}
+	}
+
+	if q, ok := t["q"]; ok && !containsFold(strings.Split(q, ":"), "dns/txt") {
+		return sig, fmt.Errorf("%w: %q", errUnsupportedQuery, q)
+	}
+
+	if x, ok := t["x"]; ok {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return sig, fmt.Errorf("invalid x= %q", x)
+		}
+		if time.Now().Unix() > exp {
+			return sig, errSignatureExpired
+		}
+	}
+
+	return sig, nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// verify the signature, given the message headers and the (already
+// computed) body hash.
+func (sig *signature) verify(ctx context.Context, hdrs headers, bodyHash []byte) error {
+	if !bytes.Equal(bodyHash, sig.bodyHash) {
+		return errBodyHashMismatch
+	}
+
+	pk, err := findPublicKey(ctx, sig.domain, sig.selector)
+	if err != nil {
+		return err
+	}
+	err = pk.compatibleWith(sig)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+
+	// Headers are selected from the bottom up; if a header is listed more
+	// times than it appears, the extra instances are treated as empty (and
+	// not included in the hash).
+	// https://datatracker.ietf.org/doc/html/rfc6376#section-5.4.2
+	used := map[string]int{}
+	for _, name := range sig.headers {
+		lname := strings.ToLower(name)
+		found := hdrs.FindAll(name)
+		used[lname]++
+		if used[lname] > len(found) {
+			continue
+		}
+		hdr := found[len(found)-used[lname]]
+		io.WriteString(h, sig.hdrC.header(hdr)+"\r\n")
+	}
+
+	// Finally, the signature header itself, with the value of "b=" removed,
+	// and without the final line ending.
+	io.WriteString(h, sig.hdrC.header(sig.hdr.withoutB()))
+
+	return pk.verify(h.Sum(nil), sig.b)
+}
+
+// withoutB returns a copy of the (DKIM-Signature) header, with the value of
+// the "b=" tag removed.
+// https://datatracker.ietf.org/doc/html/rfc6376#section-3.7
+func (h header) withoutB() header {
+	parts := strings.Split(h.Value, ";")
+	for i, part := range parts {
+		name, _, found := strings.Cut(part, "=")
+		if found && strings.TrimSpace(name) == "b" {
+			parts[i] = name + "="
+		}
+	}
+
+	n := h
+	n.Value = strings.Join(parts, ";")
+	n.Source = h.Source[:len(h.Source)-len(h.Value)] + n.Value
+	return n
+}
+
+// publicKey is a parsed DKIM public key record.
+// https://datatracker.ietf.org/doc/html/rfc6376#section-3.6.1
+type publicKey struct {
+	key     crypto.PublicKey
+	keyType string
+
+	// Acceptable hash algorithms (h=), nil means any.
+	hashes []string
+
+	// Strict mode (t=s): the identity domain must match d= exactly.
+	strict bool
+}
+
+func findPublicKey(ctx context.Context, domain, selector string) (*publicKey, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := lookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("%w: %s", errKeyNotFound, name)
+		}
+		return nil, fmt.Errorf("%w: %v", errTemporaryLookupFail, err)
+	}
+	if len(txts) == 0 {
+		return nil, fmt.Errorf("%w: %s", errKeyNotFound, name)
+	}
+
+	// Multiple records are not allowed, but are not uncommon, so we just
+	// use the first one that parses correctly.
+	// https://datatracker.ietf.org/doc/html/rfc6376#section-3.6.2.2
+	for _, txt := range txts {
+		pk, perr := parsePublicKey(txt)
+		if perr == nil {
+			return pk, nil
+		}
+		trace(ctx, "error parsing key record %q: %v", txt, perr)
+		err = perr
+	}
+	return nil, err
+}
+
+func parsePublicKey(txt string) (*publicKey, error) {
+	t, err := parseTags(txt)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := t["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("%w: %q", errUnsupportedVersion, v)
+	}
+
+	pk := &publicKey{keyType: "rsa"}
+	if k, ok := t["k"]; ok {
+		pk.keyType = strings.ToLower(k)
+	}
+	if h, ok := t["h"]; ok {
+		for _, alg := range strings.Split(h, ":") {
+			pk.hashes = append(pk.hashes, strings.ToLower(strings.TrimSpace(alg)))
+		}
+	}
+	if s, ok := t["s"]; ok {
+		services := strings.Split(s, ":")
+		if !containsFold(services, "*") && !containsFold(services, "email") {
+			return nil, fmt.Errorf("%w: service type %q", errInvalidKey, s)
+		}
+	}
+	for _, flag := range strings.Split(t["t"], ":") {
+		if strings.TrimSpace(flag) == "s" {
+			pk.strict = true
+		}
+	}
+
+	p, ok := t["p"]
+	if !ok {
+		return nil, fmt.Errorf("%w: p=", errMissingTag)
+	}
+	if p == "" {
+		return nil, errKeyRevoked
+	}
+	raw, err := decodeBase64(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidKey, err)
+	}
+
+	switch pk.keyType {
+	case "rsa":
+		// The RFC says it's a SubjectPublicKeyInfo, but some records use a
+		// bare RSAPublicKey, so we accept both.
+		var key interface{}
+		key, err = x509.ParsePKIXPublicKey(raw)
+		if err != nil {
+			key, err = x509.ParsePKCS1PublicKey(raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidKey, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: not an RSA key", errInvalidKey)
+		}
+		if rsaKey.N.BitLen() < minRSAKeyBits {
+			return nil, errKeyTooShort
+		}
+		pk.key = rsaKey
+	case "ed25519":
+		// https://datatracker.ietf.org/doc/html/rfc8463#section-4
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: ed25519 key of length %d",
+				errInvalidKey, len(raw))
+		}
+		pk.key = ed25519.PublicKey(raw)
+	default:
+		return nil, fmt.Errorf("%w: key type %q", errInvalidKey, pk.keyType)
+	}
+
+	return pk, nil
+}
+
+// compatibleWith checks if the key can be used to verify the signature.
+func (pk *publicKey) compatibleWith(sig *signature) error {
+	keyType, hashAlg, _ := strings.Cut(sig.algo, "-")
+	if keyType != pk.keyType {
+		return fmt.Errorf("%w: key is %q, signature is %q",
+			errKeyTypeMismatch, pk.keyType, keyType)
+	}
+	if pk.hashes != nil && !containsFold(pk.hashes, hashAlg) {
+		return fmt.Errorf("%w: hash %q not allowed", errIncompatibleKey, hashAlg)
+	}
+	if pk.strict && !sig.arc {
+		t, _ := parseTags(sig.hdr.Value)
+		if i, ok := t["i"]; ok {
+			_, idomain, _ := strings.Cut(i, "@")
+			if !strings.EqualFold(idomain, sig.domain) {
+				return fmt.Errorf("%w: strict key, identity %q",
+					errIncompatibleKey, i)
+			}
+		}
+	}
+	return nil
+}
+
+func (pk *publicKey) verify(hashed, sig []byte) error {
+	switch k := pk.key.(type) {
+	case *rsa.PublicKey:
+		err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, sig)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errVerificationFailed, err)
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hashed, sig) {
+			return errVerificationFailed
+		}
+	default:
+		return fmt.Errorf("%w: %T", errInvalidKey, pk.key)
+	}
+	return nil
+}
+
+// bodyHashKey identifies the parameters that affect the body hash.
+type bodyHashKey struct {
+	c      canonicalization
+	length int64
+}
+
+// bodyHasher computes a body hash incrementally.
+type bodyHasher struct {
+	h  hash.Hash
+	bc *bodyCanonicalizer
+}
+
+func newBodyHasher(c canonicalization, length int64) *bodyHasher {
+	h := sha256.New()
+	var w io.Writer = h
+	if length >= 0 {
+		w = &limitedWriter{w: h, n: length}
+	}
+	return &bodyHasher{h: h, bc: c.newBodyCanonicalizer(w)}
+}
+
+// Sum returns the hash. It must be called after the body was fully
+// processed.
+func (bh *bodyHasher) Sum() []byte {
+	return bh.h.Sum(nil)
+}
+
+// computeBodyHashes reads the body from r once, and computes all the given
+// body hashes.
+func computeBodyHashes(r *bufio.Reader, hashers map[bodyHashKey]*bodyHasher) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if line != "" {
+			for _, bh := range hashers {
+				if werr := bh.bc.Line(line); werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	for _, bh := range hashers {
+		if err := bh.bc.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitedWriter writes up to n bytes to w, and silently discards the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	if int64(len(p)) > lw.n {
+		p = p[:lw.n]
+	}
+	n, err := lw.w.Write(p)
+	lw.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return total, nil
+}
+
+// AuthenticationResults returns the DKIM part of an Authentication-Results
+// header representing this result, with one entry per signature, each one
+// on its own line.
+// https://datatracker.ietf.org/doc/html/rfc8601
+// https://datatracker.ietf.org/doc/html/rfc6008
+func (r *VerifyResult) AuthenticationResults() string {
+	if len(r.Results) == 0 {
+		return "dkim=none"
+	}
+
+	lines := []string{}
+	for _, res := range r.Results {
+		s := "dkim=" + string(res.State)
+		if res.Error != nil {
+			s += " reason=" + quoteValue(res.Error.Error())
+		}
+		if res.Domain != "" {
+			s += " header.d=" + quoteValue(res.Domain)
+		}
+		if res.Selector != "" {
+			s += " header.s=" + quoteValue(res.Selector)
+		}
+		if len(res.B) >= 8 {
+			// The first 8 characters are enough to tell signatures apart.
+			s += " header.b=" + quoteValue(res.B[:8])
+		}
+		lines = append(lines, s)
+	}
+	return strings.Join(lines, ";\n")
+}
+
+// ValidDomains returns the list of domains with valid signatures.
+func (r *VerifyResult) ValidDomains() []string {
+	domains := []string{}
+	for _, res := range r.Results {
+		if res.State == Pass {
+			domains = append(domains, res.Domain)
+		}
+	}
+	return domains
+}
+
+// quoteValue quotes the value if needed, so it can be used in an
+// Authentication-Results header. Values are MIME tokens, so they need to be
+// quoted if they contain special characters.
+// https://datatracker.ietf.org/doc/html/rfc2045#section-5.1
+func quoteValue(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t()<>@,;:\\\"/[]?=") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,394 @@
+package dkim
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+)
+
+// The ed25519 signature of the RFC 8463 example message.
+// https://datatracker.ietf.org/doc/html/rfc8463#appendix-A.3
+const rfc8463Signature = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n"
+
+// fakeDNS returns a context that resolves TXT records using the given map.
+// Values of "TEMP" cause a temporary error.
+func fakeDNS(records map[string][]string) context.Context {
+	return WithLookupTXTFunc(context.Background(),
+		func(ctx context.Context, domain string) ([]string, error) {
+			txts, ok := records[domain]
+			if !ok {
+				return nil, &net.DNSError{
+					Err: "no such host", Name: domain, IsNotFound: true}
+			}
+			if len(txts) == 1 && txts[0] == "TEMP" {
+				return nil, &net.DNSError{
+					Err: "timeout", Name: domain, IsTimeout: true}
+			}
+			return txts, nil
+		})
+}
+
+var rfc8463DNS = map[string][]string{
+	"brisbane._domainkey.football.example.com": {
+		"v=DKIM1; k=ed25519; p=" + rfc8463PublicKey},
+}
+
+func TestVerifyRFC8463(t *testing.T) {
+	ctx := fakeDNS(rfc8463DNS)
+	msg := rfc8463Signature + rfc8463Message
+
+	res, err := VerifyMessage(ctx, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if res.Found != 1 || res.Valid != 1 || len(res.Results) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	r := res.Results[0]
+	if r.State != Pass || r.Error != nil {
+		t.Errorf("expected pass, got %v (%v)", r.State, r.Error)
+	}
+	if r.Domain != "football.example.com" || r.Selector != "brisbane" {
+		t.Errorf("unexpected domain/selector: %q %q", r.Domain, r.Selector)
+	}
+
+	expected := "dkim=pass header.d=football.example.com header.s=brisbane" +
+		` header.b="/gCrinpc"`
+	if ar := res.AuthenticationResults(); ar != expected {
+		t.Errorf("expected A-R %q, got %q", expected, ar)
+	}
+
+	// Same, but with "\n" line endings, as chasquid uses internally.
+	msg = strings.ReplaceAll(msg, "\r\n", "\n")
+	res, err = VerifyMessage(ctx, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if res.Valid != 1 {
+		t.Errorf("\\n message failed verification: %v", res.Results[0].Error)
+	}
+}
+
+func TestVerifyModified(t *testing.T) {
+	ctx := fakeDNS(rfc8463DNS)
+
+	cases := []struct {
+		msg string
+		err error
+	}{
+		// Modified body.
+		{rfc8463Signature + rfc8463Message + "Added line.\r\n",
+			errBodyHashMismatch},
+
+		// Modified signed header.
+		{rfc8463Signature + strings.Replace(
+			rfc8463Message, "dinner", "lunch", 1),
+			errVerificationFailed},
+
+		// Additional From header (which was over-signed).
+		{rfc8463Signature + rfc8463Message[:strings.Index(rfc8463Message, "\r\n\r\n")] +
+			"\r\nFrom: attacker@example.com" +
+			rfc8463Message[strings.Index(rfc8463Message, "\r\n\r\n"):],
+			errVerificationFailed},
+	}
+	for i, c := range cases {
+		res, err := VerifyMessage(ctx, strings.NewReader(c.msg))
+		if err != nil {
+			t.Fatalf("%d: error verifying: %v", i, err)
+		}
+		r := res.Results[0]
+		if res.Valid != 0 || r.State != Fail || !errors.Is(r.Error, c.err) {
+			t.Errorf("%d: expected fail with %v, got %v (%v)",
+				i, c.err, r.State, r.Error)
+		}
+	}
+
+	// Unsigned headers and whitespace changes in the body (relaxed) can be
+	// modified without breaking the signature.
+	msg := rfc8463Signature + "X-Unsigned: true\r\n" +
+		strings.Replace(rfc8463Message, "Joe.", "Joe.   ", 1) + "\r\n\r\n"
+	res, err := VerifyMessage(ctx, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if res.Valid != 1 {
+		t.Errorf("expected valid, got %v", res.Results[0].Error)
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	edKey := rfc8463Key(t)
+
+	ctx := fakeDNS(map[string][]string{
+		"rsa._domainkey.example.com": {
+			"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"ed._domainkey.example.com": {
+			"v=DKIM1; k=ed25519; p=" + rfc8463PublicKey},
+	})
+
+	msg := "From: me@example.com\nTo: you@example.net\n" +
+		"Subject: Hola\n  with folding\n\nBody  with\t whitespace \n\n"
+
+	// Sign with both keys, and verify both signatures.
+	signed := []byte(msg)
+	for _, s := range []*Signer{
+		{Domain: "example.com", Selector: "rsa", Signer: rsaKey},
+		{Domain: "example.com", Selector: "ed", Signer: edKey},
+	} {
+		sig, err := s.Sign(strings.NewReader(string(signed)))
+		if err != nil {
+			t.Fatalf("error signing with %s: %v", s.Selector, err)
+		}
+		signed = envelope.AddHeader(signed, "DKIM-Signature", sig)
+	}
+
+	res, err := VerifyMessage(ctx, strings.NewReader(string(signed)))
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if res.Found != 2 || res.Valid != 2 {
+		for _, r := range res.Results {
+			t.Logf("%s: %v %v", r.Selector, r.State, r.Error)
+		}
+		t.Fatalf("expected 2 valid signatures, got %d/%d",
+			res.Valid, res.Found)
+	}
+
+	domains := res.ValidDomains()
+	if len(domains) != 2 || domains[0] != "example.com" {
+		t.Errorf("unexpected valid domains: %v", domains)
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, _ := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	rsaPubB64 := base64.StdEncoding.EncodeToString(rsaPub)
+	rsaPKCS1B64 := base64.StdEncoding.EncodeToString(
+		x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey))
+
+	cases := []struct {
+		txt   []string
+		state State
+		err   error
+	}{
+		{nil, PermError, errKeyNotFound},
+		{[]string{"TEMP"}, TempError, errTemporaryLookupFail},
+		{[]string{"v=DKIM1; k=ed25519; p="}, PermError, errKeyRevoked},
+		{[]string{"v=DKIM1; k=ed25519"}, PermError, errMissingTag},
+		{[]string{"v=DKIM2; k=ed25519; p=" + rfc8463PublicKey},
+			PermError, errUnsupportedVersion},
+		{[]string{"v=DKIM1; k=ed25519; p=AAAA"}, PermError, errInvalidKey},
+		{[]string{"v=DKIM1; k=dsa; p=AAAA"}, PermError, errInvalidKey},
+		{[]string{"v=DKIM1; k=rsa; p=AAAA"}, PermError, errInvalidKey},
+		{[]string{"v=DKIM1; k=rsa; p=" + rsaPubB64},
+			PermError, errKeyTypeMismatch},
+		{[]string{"v=DKIM1; p=" + rsaPKCS1B64},
+			PermError, errKeyTypeMismatch},
+		{[]string{"v=DKIM1; k=ed25519; h=sha1; p=" + rfc8463PublicKey},
+			PermError, errIncompatibleKey},
+		{[]string{"v=DKIM1; k=ed25519; s=other; p=" + rfc8463PublicKey},
+			PermError, errInvalidKey},
+		// Strict mode, but the identity matches the domain exactly.
+		{[]string{"v=DKIM1; k=ed25519; t=s; p=" + rfc8463PublicKey},
+			Pass, nil},
+		{[]string{"garbage", "v=DKIM1; k=ed25519; p=" + rfc8463PublicKey},
+			Pass, nil},
+	}
+
+	msg := rfc8463Signature + rfc8463Message
+	for i, c := range cases {
+		dns := map[string][]string{}
+		if c.txt != nil {
+			dns["brisbane._domainkey.football.example.com"] = c.txt
+		}
+		res, err := VerifyMessage(fakeDNS(dns), strings.NewReader(msg))
+		if err != nil {
+			t.Fatalf("%d: error verifying: %v", i, err)
+		}
+		r := res.Results[0]
+		if r.State != c.state || !errors.Is(r.Error, c.err) {
+			t.Errorf("%d: expected %v (%v), got %v (%v)",
+				i, c.state, c.err, r.State, r.Error)
+		}
+	}
+}
+
+func TestVerifyBadSignatures(t *testing.T) {
+	ctx := fakeDNS(rfc8463DNS)
+	base := map[string]string{
+		"v": "1", "a": "ed25519-sha256", "c": "relaxed/relaxed",
+		"d": "football.example.com", "s": "brisbane",
+		"h": "from:to", "bh": rfc8463BodyHash, "b": "AAAA",
+	}
+
+	cases := []struct {
+		override map[string]string
+		err      error
+	}{
+		{map[string]string{"v": ""}, errMissingTag},
+		{map[string]string{"v": "2"}, errUnsupportedVersion},
+		{map[string]string{"a": "rsa-sha1"}, errUnsupportedAlgo},
+		{map[string]string{"c": "bad"}, errUnknownCanonicalization},
+		{map[string]string{"h": "to:subject"}, errFromNotSigned},
+		{map[string]string{"i": "@example.com"}, errInvalidIdentity},
+		{map[string]string{"q": "http"}, errUnsupportedQuery},
+		{map[string]string{"x": "1"}, errSignatureExpired},
+		{map[string]string{"b": "*"}, base64.CorruptInputError(0)},
+	}
+	for i, c := range cases {
+		tags := []string{}
+		for k, v := range base {
+			if o, ok := c.override[k]; ok {
+				v = o
+				if v == "" {
+					continue
+				}
+			}
+			tags = append(tags, k+"="+v)
+		}
+		for k, v := range c.override {
+			if _, ok := base[k]; !ok {
+				tags = append(tags, k+"="+v)
+			}
+		}
+
+		msg := "DKIM-Signature: " + strings.Join(tags, "; ") + "\r\n" +
+			rfc8463Message
+		res, err := VerifyMessage(ctx, strings.NewReader(msg))
+		if err != nil {
+			t.Fatalf("%d: error verifying: %v", i, err)
+		}
+		r := res.Results[0]
+		if r.State != PermError || !errors.Is(r.Error, c.err) {
+			t.Errorf("%d: expected permerror (%v), got %v (%v)",
+				i, c.err, r.State, r.Error)
+		}
+	}
+}
+
+func TestVerifyNoSignatures(t *testing.T) {
+	res, err := VerifyMessage(context.Background(),
+		strings.NewReader(rfc8463Message))
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if res.Found != 0 || res.Valid != 0 || len(res.Results) != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if ar := res.AuthenticationResults(); ar != "dkim=none" {
+		t.Errorf("unexpected A-R: %q", ar)
+	}
+
+	// Invalid headers are reported as an error.
+	_, err = VerifyMessage(context.Background(),
+		strings.NewReader(" invalid\n\nbody\n"))
+	if !errors.Is(err, errInvalidHeader) {
+		t.Errorf("expected invalid header error, got %v", err)
+	}
+}
+
+func TestVerifyTooManySignatures(t *testing.T) {
+	ctx := fakeDNS(rfc8463DNS)
+	msg := strings.Repeat(rfc8463Signature, maxSignatures+2) + rfc8463Message
+	res, err := VerifyMessage(ctx, strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	if res.Found != maxSignatures+2 || len(res.Results) != maxSignatures {
+		t.Errorf("unexpected found %d, results %d",
+			res.Found, len(res.Results))
+	}
+}
+
+func TestBodyLength(t *testing.T) {
+	body := "Body\r\nMore lines\r\n"
+	hashAll := newBodyHasher(relaxedCanonicalization, -1)
+	hashPrefix := newBodyHasher(relaxedCanonicalization, 6)
+	hashAllExplicit := newBodyHasher(relaxedCanonicalization,
+		int64(len(body)))
+
+	msg := "From: x\r\n\r\n" + body + "Extra line, not covered\r\n"
+	hashers := map[bodyHashKey]*bodyHasher{
+		{relaxedCanonicalization, -1}:               hashAll,
+		{relaxedCanonicalization, 6}:                hashPrefix,
+		{relaxedCanonicalization, int64(len(body))}: hashAllExplicit,
+	}
+	r := bufio.NewReader(strings.NewReader(msg))
+	_, _ = readHeaders(r)
+	if err := computeBodyHashes(r, hashers); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := newBodyHasher(relaxedCanonicalization, -1)
+	_ = prefix.bc.Line("Body\r\n")
+	_ = prefix.bc.Close()
+	if string(prefix.Sum()) != string(hashPrefix.Sum()) {
+		t.Errorf("l=6 hash does not match the hash of the first line")
+	}
+
+	full := newBodyHasher(relaxedCanonicalization, -1)
+	_ = full.bc.Line("Body\r\n")
+	_ = full.bc.Line("More lines\r\n")
+	_ = full.bc.Close()
+	if string(full.Sum()) != string(hashAllExplicit.Sum()) {
+		t.Errorf("explicit length hash does not match")
+	}
+	if string(full.Sum()) == string(hashAll.Sum()) {
+		t.Errorf("unlimited hash should include the extra line")
+	}
+}
+
+func TestQuoteValue(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"example.com", "example.com"},
+		{"abc+def", "abc+def"},
+		{"", `""`},
+		{"a/b", `"a/b"`},
+		{"a b", `"a b"`},
+		{`a"b\c`, `"a\"b\\c"`},
+	}
+	for _, c := range cases {
+		if got := quoteValue(c.in); got != c.out {
+			t.Errorf("quoteValue(%q) = %q, expected %q", c.in, got, c.out)
+		}
+	}
+}
+
+func TestWithoutB(t *testing.T) {
+	h := header{
+		Name:   "DKIM-Signature",
+		Value:  " v=1; b=abc\r\n def; bh=xyz",
+		Source: "DKIM-Signature : v=1; b=abc\r\n def; bh=xyz",
+	}
+	n := h.withoutB()
+	if n.Value != " v=1; b=; bh=xyz" {
+		t.Errorf("unexpected value %q", n.Value)
+	}
+	if n.Source != "DKIM-Signature : v=1; b=; bh=xyz" {
+		t.Errorf("unexpected source %q", n.Source)
+	}
+}
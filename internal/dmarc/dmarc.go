@@ -0,0 +1,405 @@
+// Package dmarc implements DMARC (Domain-based Message Authentication,
+// Reporting, and Conformance) policy evaluation, RFC 7489.
+//
+// Note that reporting is not supported.
+//
+// Reference: https://datatracker.ietf.org/doc/html/rfc7489
+package dmarc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Result of the DMARC evaluation, using the values from the
+// Authentication-Results header.
+// https://datatracker.ietf.org/doc/html/rfc7489#section-11.2
+type Result string
+
+// Valid results.
+const (
+	None      = Result("none")
+	Pass      = Result("pass")
+	Fail      = Result("fail")
+	TempError = Result("temperror")
+	PermError = Result("permerror")
+)
+
+// Policy requested by the domain owner, for messages that fail the
+// evaluation.
+// https://datatracker.ietf.org/doc/html/rfc7489#section-6.3
+type Policy string
+
+// Valid policies.
+const (
+	PolicyNone       = Policy("none")
+	PolicyQuarantine = Policy("quarantine")
+	PolicyReject     = Policy("reject")
+)
+
+// Alignment mode, for either DKIM or SPF identifiers.
+// https://datatracker.ietf.org/doc/html/rfc7489#section-3.1
+type Alignment string
+
+// Valid alignment modes.
+const (
+	Relaxed = Alignment("r")
+	Strict  = Alignment("s")
+)
+
+// Errors.
+var (
+	errInvalidRecord  = errors.New("invalid DMARC record")
+	errInvalidFrom    = errors.New("invalid From header")
+	errMultipleFrom   = errors.New("multiple From domains")
+	errTemporaryError = errors.New("temporary error looking up the record")
+)
+
+// Record is a DMARC policy record, as published by the domain owner.
+// https://datatracker.ietf.org/doc/html/rfc7489#section-6.3
+type Record struct {
+	// Policy for the domain (p=).
+	Policy Policy
+
+	// Policy for the subdomains (sp=). Defaults to Policy.
+	SubdomainPolicy Policy
+
+	// Alignment modes for DKIM (adkim=) and SPF (aspf=).
+	DKIMAlignment Alignment
+	SPFAlignment  Alignment
+
+	// Percentage of messages the policy should be applied to (pct=).
+	Percent int
+}
+
+// ParseRecord parses a DMARC record.
+func ParseRecord(s string) (*Record, error) {
+	// The first tag must be "v=DMARC1".
+	// https://datatracker.ietf.org/doc/html/rfc7489#section-6.4
+	parts := strings.Split(s, ";")
+	v, found := cutTag(parts[0])
+	if !found || v[0] != "v" || v[1] != "DMARC1" {
+		return nil, fmt.Errorf("%w: does not begin with v=DMARC1",
+			errInvalidRecord)
+	}
+
+	r := &Record{
+		DKIMAlignment: Relaxed,
+		SPFAlignment:  Relaxed,
+		Percent:       100,
+	}
+	hasRUA := false
+	var err error
+	for _, part := range parts[1:] {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		tag, found := cutTag(part)
+		if !found {
+			return nil, fmt.Errorf("%w: invalid tag %q",
+				errInvalidRecord, part)
+		}
+
+		// Unknown tags must be ignored.
+		switch name, value := tag[0], tag[1]; name {
+		case "p":
+			r.Policy, err = toPolicy(value)
+		case "sp":
+			r.SubdomainPolicy, err = toPolicy(value)
+		case "adkim":
+			r.DKIMAlignment, err = toAlignment(value)
+		case "aspf":
+			r.SPFAlignment, err = toAlignment(value)
+		case "pct":
+			r.Percent, err = strconv.Atoi(value)
+			if err == nil && (r.Percent < 0 || r.Percent > 100) {
+				err = fmt.Errorf("pct out of range: %d", r.Percent)
+			}
+		case "rua":
+			hasRUA = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidRecord, err)
+		}
+	}
+
+	if r.Policy == "" {
+		// If the policy is missing but there's an aggregate report URI, the
+		// record must be treated as if it had "p=none".
+		// https://datatracker.ietf.org/doc/html/rfc7489#section-6.6.3
+		if !hasRUA {
+			return nil, fmt.Errorf("%w: missing policy", errInvalidRecord)
+		}
+		r.Policy = PolicyNone
+	}
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+
+	return r, nil
+}
+
+// cutTag splits a "name=value" tag, returning the trimmed name and value.
+func cutTag(s string) ([2]string, bool) {
+	name, value, found := strings.Cut(s, "=")
+	return [2]string{strings.TrimSpace(name), strings.TrimSpace(value)}, found
+}
+
+func toPolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q", s)
+	}
+}
+
+func toAlignment(s string) (Alignment, error) {
+	switch a := Alignment(strings.ToLower(s)); a {
+	case Relaxed, Strict:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown alignment mode %q", s)
+	}
+}
+
+// Evaluation is the result of evaluating the DMARC policy for a message.
+type Evaluation struct {
+	// Domain of the header From (the RFC5322.From domain).
+	Domain string
+
+	// Result of the evaluation.
+	Result Result
+
+	// The domain's published record, if one was found.
+	Record *Record
+
+	// Policy that should be applied to the message, taking into account the
+	// subdomain policy and the percentage. Only relevant if the result is
+	// Fail; PolicyNone otherwise.
+	Policy Policy
+
+	// Error found during evaluation, if any.
+	Error error
+}
+
+// Evaluate the DMARC policy for a message.
+//
+// The message is expected to have its headers terminated by "\n" or "\r\n".
+// spfDomain is the domain that passed SPF (usually the domain of the MAIL
+// FROM address), or "" if SPF did not pass. dkimDomains are the domains
+// ("d=" tag) of the valid DKIM signatures.
+func Evaluate(ctx context.Context, message []byte, spfDomain string, dkimDomains []string) *Evaluation {
+	ev := &Evaluation{Policy: PolicyNone}
+
+	domain, err := FromDomain(message)
+	if err != nil {
+		// Messages without a single valid From domain can't be evaluated.
+		// https://datatracker.ietf.org/doc/html/rfc7489#section-6.6.1
+		trace(ctx, "From domain: %v", err)
+		ev.Result = PermError
+		ev.Error = err
+		return ev
+	}
+	ev.Domain = domain
+	trace(ctx, "From domain: %q", domain)
+
+	record, isSubdomain, err := lookupRecord(ctx, domain)
+	if err != nil {
+		ev.Result = TempError
+		ev.Error = err
+		return ev
+	}
+	if record == nil {
+		ev.Result = None
+		return ev
+	}
+	ev.Record = record
+
+	if record.SPFAlignment.aligned(spfDomain, domain) {
+		trace(ctx, "SPF domain %q aligned (%s)",
+			spfDomain, record.SPFAlignment)
+		ev.Result = Pass
+		return ev
+	}
+	for _, d := range dkimDomains {
+		if record.DKIMAlignment.aligned(d, domain) {
+			trace(ctx, "DKIM domain %q aligned (%s)",
+				d, record.DKIMAlignment)
+			ev.Result = Pass
+			return ev
+		}
+	}
+
+	trace(ctx, "no aligned identifiers (SPF: %q, DKIM: %q)",
+		spfDomain, dkimDomains)
+	ev.Result = Fail
+	ev.Policy = record.Policy
+	if isSubdomain {
+		ev.Policy = record.SubdomainPolicy
+	}
+
+	// If the message is not selected for the policy, we move down to the
+	// next policy in the list.
+	// https://datatracker.ietf.org/doc/html/rfc7489#section-6.6.4
+	if record.Percent < 100 && rand.Intn(100) >= record.Percent {
+		trace(ctx, "message not selected by pct=%d, policy downgraded",
+			record.Percent)
+		switch ev.Policy {
+		case PolicyReject:
+			ev.Policy = PolicyQuarantine
+		case PolicyQuarantine:
+			ev.Policy = PolicyNone
+		}
+	}
+
+	return ev
+}
+
+// lookupRecord finds the DMARC record for the given domain. If the domain
+// doesn't have one, it looks it up in the organizational domain, and returns
+// isSubdomain = true if it was found there.
+// Returns a nil record if no (valid) record was found.
+// https://datatracker.ietf.org/doc/html/rfc7489#section-6.6.3
+func lookupRecord(ctx context.Context, domain string) (r *Record, isSubdomain bool, err error) {
+	r, err = lookupOneRecord(ctx, domain)
+	if r != nil || err != nil {
+		return r, false, err
+	}
+
+	orgDomain := organizationalDomain(domain)
+	if orgDomain == domain {
+		return nil, false, nil
+	}
+
+	r, err = lookupOneRecord(ctx, orgDomain)
+	return r, r != nil, err
+}
+
+func lookupOneRecord(ctx context.Context, domain string) (*Record, error) {
+	txts, err := lookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			trace(ctx, "_dmarc.%s: no records", domain)
+			return nil, nil
+		}
+		trace(ctx, "_dmarc.%s: lookup error: %v", domain, err)
+		return nil, fmt.Errorf("%w: %v", errTemporaryError, err)
+	}
+
+	// Discard the records that are not DMARC (or are invalid). If there is
+	// not exactly one left, then the domain has no policy.
+	var record *Record
+	found := 0
+	for _, txt := range txts {
+		r, err := ParseRecord(txt)
+		if err != nil {
+			trace(ctx, "_dmarc.%s: skipping %q: %v", domain, txt, err)
+			continue
+		}
+		record = r
+		found++
+	}
+	if found != 1 {
+		trace(ctx, "_dmarc.%s: %d valid records found", domain, found)
+		return nil, nil
+	}
+
+	trace(ctx, "_dmarc.%s: found record %+v", domain, *record)
+	return record, nil
+}
+
+// organizationalDomain returns the organizational domain for the given
+// domain, using the public suffix list.
+// https://datatracker.ietf.org/doc/html/rfc7489#section-3.2
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		// This happens if the domain is a public suffix itself.
+		return domain
+	}
+	return org
+}
+
+// aligned checks if the given identifier domain is aligned with the From
+// domain.
+func (a Alignment) aligned(id, from string) bool {
+	id = strings.ToLower(strings.TrimSuffix(id, "."))
+	if id == "" {
+		return false
+	}
+	if a == Strict {
+		return id == from
+	}
+	return organizationalDomain(id) == organizationalDomain(from)
+}
+
+// FromDomain returns the domain of the header From (the RFC5322.From
+// domain), in lowercase ASCII form. It fails if the message doesn't have
+// exactly one From header, or if its addresses are not all in the same
+// domain.
+func FromDomain(message []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(message))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidFrom, err)
+	}
+
+	froms := msg.Header["From"]
+	if len(froms) != 1 {
+		return "", fmt.Errorf("%w: found %d From headers",
+			errInvalidFrom, len(froms))
+	}
+
+	addrs, err := mail.ParseAddressList(froms[0])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errInvalidFrom, err)
+	}
+
+	domain := ""
+	for _, addr := range addrs {
+		d := addr.Address[strings.LastIndexByte(addr.Address, '@')+1:]
+		d, err = idna.ToASCII(strings.ToLower(d))
+		if err != nil || d == "" {
+			return "", fmt.Errorf("%w: invalid domain in %q",
+				errInvalidFrom, addr.Address)
+		}
+		if domain != "" && d != domain {
+			return "", errMultipleFrom
+		}
+		domain = d
+	}
+	return domain, nil
+}
+
+var reasonEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// AuthenticationResults returns the result in the format used by the
+// Authentication-Results header, without the authserv-id.
+// https://datatracker.ietf.org/doc/html/rfc7489#section-11.2
+func (ev *Evaluation) AuthenticationResults() string {
+	s := "dmarc=" + string(ev.Result)
+	if ev.Record != nil {
+		s += fmt.Sprintf(" (p=%s", ev.Record.Policy)
+		if ev.Result == Fail {
+			s += fmt.Sprintf(" dis=%s", ev.Policy)
+		}
+		s += ")"
+	} else if ev.Error != nil {
+		s += ` reason="` + reasonEscaper.Replace(ev.Error.Error()) + `"`
+	}
+	if ev.Domain != "" {
+		s += " header.from=" + ev.Domain
+	}
+	return s
+}
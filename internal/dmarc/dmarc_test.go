@@ -0,0 +1,270 @@
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRecord(t *testing.T) {
+	cases := []struct {
+		s   string
+		r   *Record
+		err error
+	}{
+		{"v=DMARC1; p=none", &Record{
+			Policy: PolicyNone, SubdomainPolicy: PolicyNone,
+			DKIMAlignment: Relaxed, SPFAlignment: Relaxed, Percent: 100,
+		}, nil},
+		{"v=DMARC1;p=reject;sp=quarantine;adkim=s;aspf=s;pct=20;", &Record{
+			Policy: PolicyReject, SubdomainPolicy: PolicyQuarantine,
+			DKIMAlignment: Strict, SPFAlignment: Strict, Percent: 20,
+		}, nil},
+		{" v = DMARC1 ; p = Quarantine ; fo=1; ruf=mailto:x@y", &Record{
+			Policy: PolicyQuarantine, SubdomainPolicy: PolicyQuarantine,
+			DKIMAlignment: Relaxed, SPFAlignment: Relaxed, Percent: 100,
+		}, nil},
+
+		// Missing policy, but with rua, is treated as p=none.
+		{"v=DMARC1; rua=mailto:x@y", &Record{
+			Policy: PolicyNone, SubdomainPolicy: PolicyNone,
+			DKIMAlignment: Relaxed, SPFAlignment: Relaxed, Percent: 100,
+		}, nil},
+
+		{"", nil, errInvalidRecord},
+		{"v=spf1 -all", nil, errInvalidRecord},
+		{"p=reject; v=DMARC1", nil, errInvalidRecord},
+		{"v=DMARC1", nil, errInvalidRecord},
+		{"v=DMARC1; p=blah", nil, errInvalidRecord},
+		{"v=DMARC1; p=none; sp=blah", nil, errInvalidRecord},
+		{"v=DMARC1; p=none; adkim=x", nil, errInvalidRecord},
+		{"v=DMARC1; p=none; aspf=x", nil, errInvalidRecord},
+		{"v=DMARC1; p=none; pct=x", nil, errInvalidRecord},
+		{"v=DMARC1; p=none; pct=101", nil, errInvalidRecord},
+		{"v=DMARC1; p=none; blah", nil, errInvalidRecord},
+	}
+	for _, c := range cases {
+		r, err := ParseRecord(c.s)
+		if diff := cmp.Diff(c.r, r); diff != "" {
+			t.Errorf("ParseRecord(%q) diff (-want +got):\n%s", c.s, diff)
+		}
+		if !errors.Is(err, c.err) {
+			t.Errorf("ParseRecord(%q) error: expected %v, got %v",
+				c.s, c.err, err)
+		}
+	}
+}
+
+func TestFromDomain(t *testing.T) {
+	cases := []struct {
+		msg    string
+		domain string
+		err    error
+	}{
+		{"From: a@b\n\n", "b", nil},
+		{"From: A <a@B.Com>\r\nSubject: x\r\n\r\nbody", "b.com", nil},
+		{"From: a@b.com, c@B.com\n\n", "b.com", nil},
+		{"From: a@ñaca.com\n\n", "xn--aca-6ma.com", nil},
+		{"Subject: x\n\n", "", errInvalidFrom},
+		{"From: a@b\nFrom: a@b\n\n", "", errInvalidFrom},
+		{"From: <>\n\n", "", errInvalidFrom},
+		{"From: a\n\n", "", errInvalidFrom},
+		{"From: a@b.com, a@c.com\n\n", "", errMultipleFrom},
+		{"From", "", errInvalidFrom},
+	}
+	for _, c := range cases {
+		domain, err := FromDomain([]byte(c.msg))
+		if domain != c.domain || !errors.Is(err, c.err) {
+			t.Errorf("FromDomain(%q) = %q, %v; expected %q, %v",
+				c.msg, domain, err, c.domain, c.err)
+		}
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	cases := []struct{ domain, org string }{
+		{"example.com", "example.com"},
+		{"a.b.example.com", "example.com"},
+		{"example.co.uk", "example.co.uk"},
+		{"mail.example.co.uk", "example.co.uk"},
+		{"com", "com"},
+		{"localhost", "localhost"},
+	}
+	for _, c := range cases {
+		if org := organizationalDomain(c.domain); org != c.org {
+			t.Errorf("organizationalDomain(%q) = %q, expected %q",
+				c.domain, org, c.org)
+		}
+	}
+}
+
+func TestAligned(t *testing.T) {
+	cases := []struct {
+		a        Alignment
+		id, from string
+		aligned  bool
+	}{
+		{Relaxed, "example.com", "example.com", true},
+		{Relaxed, "mail.example.com", "example.com", true},
+		{Relaxed, "example.com", "news.example.com", true},
+		{Relaxed, "Example.COM.", "example.com", true},
+		{Relaxed, "example.net", "example.com", false},
+		{Relaxed, "a.co.uk", "b.co.uk", false},
+		{Relaxed, "", "example.com", false},
+		{Strict, "example.com", "example.com", true},
+		{Strict, "mail.example.com", "example.com", false},
+		{Strict, "", "example.com", false},
+	}
+	for _, c := range cases {
+		if got := c.a.aligned(c.id, c.from); got != c.aligned {
+			t.Errorf("%s.aligned(%q, %q) = %v, expected %v",
+				c.a, c.id, c.from, got, c.aligned)
+		}
+	}
+}
+
+// fakeDNS returns a context that resolves TXT records using the given map.
+// Records with the value "TEMP" result in a temporary error.
+func fakeDNS(records map[string][]string) context.Context {
+	return WithLookupTXTFunc(context.Background(),
+		func(ctx context.Context, domain string) ([]string, error) {
+			txts, ok := records[domain]
+			if !ok {
+				return nil, &net.DNSError{
+					Err: "not found", Name: domain, IsNotFound: true}
+			}
+			if len(txts) == 1 && txts[0] == "TEMP" {
+				return nil, &net.DNSError{
+					Err: "temporary", Name: domain, IsTemporary: true}
+			}
+			return txts, nil
+		})
+}
+
+func TestEvaluate(t *testing.T) {
+	ctx := fakeDNS(map[string][]string{
+		"_dmarc.reject.com":     {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.quarantine.com": {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+		"_dmarc.none.com":       {"v=spf1 -all", "v=DMARC1; p=none"},
+		"_dmarc.multiple.com":   {"v=DMARC1; p=none", "v=DMARC1; p=reject"},
+		"_dmarc.invalid.com":    {"v=DMARC1; p=blah"},
+		"_dmarc.temp.com":       {"TEMP"},
+	})
+
+	cases := []struct {
+		from        string
+		spfDomain   string
+		dkimDomains []string
+		result      Result
+		policy      Policy
+		authRes     string
+	}{
+		// No records.
+		{"a@nodmarc.com", "", nil, None, PolicyNone,
+			"dmarc=none header.from=nodmarc.com"},
+		{"a@multiple.com", "", nil, None, PolicyNone,
+			"dmarc=none header.from=multiple.com"},
+		{"a@invalid.com", "", nil, None, PolicyNone,
+			"dmarc=none header.from=invalid.com"},
+
+		// Alignment via SPF or DKIM.
+		{"a@reject.com", "reject.com", nil, Pass, PolicyNone,
+			"dmarc=pass (p=reject) header.from=reject.com"},
+		{"a@reject.com", "bounces.reject.com", nil, Pass, PolicyNone,
+			"dmarc=pass (p=reject) header.from=reject.com"},
+		{"a@reject.com", "", []string{"other.com", "reject.com"},
+			Pass, PolicyNone,
+			"dmarc=pass (p=reject) header.from=reject.com"},
+		{"a@quarantine.com", "quarantine.com", nil, Pass, PolicyNone,
+			"dmarc=pass (p=quarantine) header.from=quarantine.com"},
+		{"a@none.com", "", []string{"none.com"}, Pass, PolicyNone,
+			"dmarc=pass (p=none) header.from=none.com"},
+
+		// Failures.
+		{"a@reject.com", "other.com", []string{"other.com"},
+			Fail, PolicyReject,
+			"dmarc=fail (p=reject dis=reject) header.from=reject.com"},
+		{"a@quarantine.com", "x.quarantine.com",
+			[]string{"x.quarantine.com"}, Fail, PolicyQuarantine,
+			"dmarc=fail (p=quarantine dis=quarantine) " +
+				"header.from=quarantine.com"},
+		{"a@none.com", "", nil, Fail, PolicyNone,
+			"dmarc=fail (p=none dis=none) header.from=none.com"},
+
+		// Subdomain policy.
+		{"a@sub.reject.com", "", nil, Fail, PolicyQuarantine,
+			"dmarc=fail (p=reject dis=quarantine) " +
+				"header.from=sub.reject.com"},
+		{"a@sub.reject.com", "reject.com", nil, Pass, PolicyNone,
+			"dmarc=pass (p=reject) header.from=sub.reject.com"},
+
+		// Errors.
+		{"a@temp.com", "", nil, TempError, PolicyNone,
+			"dmarc=temperror reason=\"temporary error looking up the " +
+				"record: lookup _dmarc.temp.com: temporary\" " +
+				"header.from=temp.com"},
+		{"", "", nil, PermError, PolicyNone,
+			"dmarc=permerror reason=\"invalid From header: " +
+				"found 0 From headers\""},
+	}
+	for _, c := range cases {
+		msg := "Subject: test\n\nbody\n"
+		if c.from != "" {
+			msg = "From: " + c.from + "\n" + msg
+		}
+
+		ev := Evaluate(ctx, []byte(msg), c.spfDomain, c.dkimDomains)
+		if ev.Result != c.result || ev.Policy != c.policy {
+			t.Errorf("%q %q %q: got %v/%v, expected %v/%v",
+				c.from, c.spfDomain, c.dkimDomains,
+				ev.Result, ev.Policy, c.result, c.policy)
+		}
+		if authRes := ev.AuthenticationResults(); authRes != c.authRes {
+			t.Errorf("%q %q %q: got A-R %q, expected %q",
+				c.from, c.spfDomain, c.dkimDomains, authRes, c.authRes)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	ctx := fakeDNS(map[string][]string{
+		"_dmarc.never.com":  {"v=DMARC1; p=reject; pct=0"},
+		"_dmarc.never2.com": {"v=DMARC1; p=quarantine; pct=0"},
+	})
+
+	// With pct=0 the message is never selected, so the policy is always
+	// downgraded.
+	for domain, policy := range map[string]Policy{
+		"never.com":  PolicyQuarantine,
+		"never2.com": PolicyNone,
+	} {
+		msg := []byte("From: a@" + domain + "\n\n")
+		for i := 0; i < 10; i++ {
+			ev := Evaluate(ctx, msg, "", nil)
+			if ev.Result != Fail || ev.Policy != policy {
+				t.Errorf("%s: got %v/%v, expected fail/%v",
+					domain, ev.Result, ev.Policy, policy)
+			}
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	ctx := fakeDNS(map[string][]string{
+		"_dmarc.example.com": {"v=DMARC1; p=reject"},
+	})
+
+	traces := []string{}
+	ctx = WithTraceFunc(ctx, func(f string, a ...interface{}) {
+		traces = append(traces, f)
+	})
+
+	Evaluate(ctx, []byte("From: a@example.com\n\n"), "example.com", nil)
+	if !strings.Contains(strings.Join(traces, "\n"), "aligned") {
+		t.Errorf("unexpected traces: %q", traces)
+	}
+}
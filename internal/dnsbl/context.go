@@ -0,0 +1,42 @@
+package dnsbl
+
+import (
+	"context"
+	"net"
+
+	"blitiri.com.ar/go/chasquid/internal/dnsctx"
+)
+
+var (
+	traceKey      = dnsctx.NewKey("dnsbl.trace")
+	lookupHostKey = dnsctx.NewKey("dnsbl.lookupHost")
+)
+
+// TraceFunc is used to trace the checks.
+type TraceFunc = dnsctx.TraceFunc
+
+// WithTraceFunc returns a context that will use the given function to trace
+// the checks.
+func WithTraceFunc(ctx context.Context, trace TraceFunc) context.Context {
+	return dnsctx.WithTrace(ctx, traceKey, trace)
+}
+
+func trace(ctx context.Context, f string, args ...interface{}) {
+	dnsctx.Trace(ctx, traceKey, f, args...)
+}
+
+// LookupHostFunc is used to look up A records, with the same semantics as
+// net.Resolver.LookupHost.
+type LookupHostFunc = dnsctx.LookupFunc
+
+// WithLookupHostFunc returns a context that will use the given function to
+// query the zones. By default, net.DefaultResolver.LookupHost is used.
+// Useful for testing.
+func WithLookupHostFunc(ctx context.Context, lookupHost LookupHostFunc) context.Context {
+	return dnsctx.WithLookup(ctx, lookupHostKey, lookupHost)
+}
+
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	return dnsctx.Lookup(ctx, lookupHostKey, host,
+		net.DefaultResolver.LookupHost)
+}
@@ -0,0 +1,252 @@
+// Package dnsbl implements checks against IP-based DNS blocklists (DNSBLs,
+// also known as RBLs).
+//
+// Reference: https://datatracker.ietf.org/doc/html/rfc5782
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/expvarom"
+)
+
+// Exported variables.
+var (
+	lookups = expvarom.NewMap("chasquid/dnsbl/lookups",
+		"zone", "count of DNSBL lookups, by zone")
+	listings = expvarom.NewMap("chasquid/dnsbl/listings",
+		"zone", "count of addresses found listed, by zone")
+	lookupErrors = expvarom.NewMap("chasquid/dnsbl/errors",
+		"zone", "count of DNSBL lookup errors, by zone")
+	cacheHits = expvarom.NewInt("chasquid/dnsbl/cache/hits",
+		"count of DNSBL cache hits")
+)
+
+// How long we cache the results for. Results with errors are not cached.
+var cacheTTL = 15 * time.Minute
+
+// Zone is a DNS blocklist to check.
+type Zone struct {
+	// Domain of the zone, e.g. "zen.spamhaus.org".
+	Domain string
+
+	// Weight to add to the score if the address is listed in the zone.
+	Weight int
+
+	// Return codes (e.g. "127.0.0.2") that count as a listing. If empty,
+	// any code in 127.0.0.0/8 does.
+	Codes []string
+}
+
+// Listing of an address in a zone.
+type Listing struct {
+	Zone   string
+	Codes  []string
+	Weight int
+}
+
+// Result of checking an address.
+type Result struct {
+	// Sum of the weights of the zones the address is listed on.
+	Score int
+
+	// Zones the address is listed on, in the order they were configured.
+	Listings []Listing
+
+	// Zones that could not be checked (the address is assumed not to be
+	// listed on them).
+	Errors []string
+}
+
+// Zones returns the domains of the zones the address is listed on.
+func (r *Result) Zones() []string {
+	zones := []string{}
+	for _, l := range r.Listings {
+		zones = append(zones, l.Zone)
+	}
+	return zones
+}
+
+// String returns a human-readable representation of the result.
+func (r *Result) String() string {
+	s := fmt.Sprintf("score %d", r.Score)
+	for _, l := range r.Listings {
+		s += fmt.Sprintf(", %s (%s)", l.Zone, strings.Join(l.Codes, " "))
+	}
+	return s
+}
+
+// Checker checks addresses against a list of zones, and caches the results.
+type Checker struct {
+	zones []Zone
+
+	// Protects the cache.
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+
+	// Last time we removed expired entries from the cache.
+	lastSweep time.Time
+}
+
+type cacheEntry struct {
+	result  *Result
+	expires time.Time
+}
+
+// NewChecker returns a new Checker for the given zones. Zones without a
+// weight get a weight of 1.
+func NewChecker(zones []Zone) *Checker {
+	c := &Checker{
+		cache: map[string]cacheEntry{},
+	}
+	for _, z := range zones {
+		if z.Weight == 0 {
+			z.Weight = 1
+		}
+		c.zones = append(c.zones, z)
+	}
+	return c
+}
+
+// Check the given IP address against all the zones.
+func (c *Checker) Check(ctx context.Context, ip net.IP) *Result {
+	if ip.To16() == nil {
+		trace(ctx, "invalid IP address %v, skipping", ip)
+		return &Result{}
+	}
+
+	key := ip.String()
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.cache[key]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		cacheHits.Add(1)
+		trace(ctx, "cached result for %s: %v", key, e.result)
+		return e.result
+	}
+	c.mu.Unlock()
+
+	res := &Result{}
+	listed := make([]*Listing, len(c.zones))
+	errs := make([]error, len(c.zones))
+
+	wg := sync.WaitGroup{}
+	for i, z := range c.zones {
+		wg.Add(1)
+		go func(i int, z Zone) {
+			defer wg.Done()
+			listed[i], errs[i] = checkZone(ctx, ip, z)
+		}(i, z)
+	}
+	wg.Wait()
+
+	for i, z := range c.zones {
+		if errs[i] != nil {
+			lookupErrors.Add(z.Domain, 1)
+			trace(ctx, "error checking %s on %s: %v", key, z.Domain, errs[i])
+			res.Errors = append(res.Errors, z.Domain)
+			continue
+		}
+		if listed[i] == nil {
+			continue
+		}
+		listings.Add(z.Domain, 1)
+		trace(ctx, "%s listed on %s: %v", key, z.Domain, listed[i].Codes)
+		res.Listings = append(res.Listings, *listed[i])
+		res.Score += listed[i].Weight
+	}
+
+	if len(res.Errors) == 0 {
+		c.mu.Lock()
+		c.cache[key] = cacheEntry{res, now.Add(cacheTTL)}
+		if now.Sub(c.lastSweep) > cacheTTL {
+			c.sweep(now)
+		}
+		c.mu.Unlock()
+	}
+
+	return res
+}
+
+// sweep removes the expired entries from the cache. Must be called with
+// c.mu held.
+func (c *Checker) sweep(now time.Time) {
+	for k, e := range c.cache {
+		if now.After(e.expires) {
+			delete(c.cache, k)
+		}
+	}
+	c.lastSweep = now
+}
+
+// checkZone checks if the IP address is listed on the given zone.
+// Returns nil if it is not.
+func checkZone(ctx context.Context, ip net.IP, z Zone) (*Listing, error) {
+	lookups.Add(z.Domain, 1)
+	addrs, err := lookupHost(ctx, reverse(ip)+"."+z.Domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	l := &Listing{Zone: z.Domain, Weight: z.Weight}
+	for _, addr := range addrs {
+		if validCode(addr, z.Codes) {
+			l.Codes = append(l.Codes, addr)
+		}
+	}
+	if len(l.Codes) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+var loopbackNet = &net.IPNet{
+	IP:   net.IPv4(127, 0, 0, 0),
+	Mask: net.CIDRMask(8, 32),
+}
+
+// validCode checks if the return code counts as a listing.
+func validCode(addr string, codes []string) bool {
+	if len(codes) > 0 {
+		for _, code := range codes {
+			if addr == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Listings must be within 127.0.0.0/8, other codes are not valid.
+	// https://datatracker.ietf.org/doc/html/rfc5782#section-2.1
+	ip := net.ParseIP(addr)
+	return ip != nil && loopbackNet.Contains(ip)
+}
+
+// reverse returns the name to query for the given IP address, without the
+// zone: the octets in reverse order for IPv4, and the nibbles in reverse
+// order for IPv6.
+// https://datatracker.ietf.org/doc/html/rfc5782#section-2.4
+func reverse(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	ip = ip.To16()
+	const hex = "0123456789abcdef"
+	buf := make([]byte, 0, 64)
+	for i := len(ip) - 1; i >= 0; i-- {
+		buf = append(buf, hex[ip[i]&0xf], '.', hex[ip[i]>>4], '.')
+	}
+	return string(buf[:len(buf)-1])
+}
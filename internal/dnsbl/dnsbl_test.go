@@ -0,0 +1,174 @@
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReverse(t *testing.T) {
+	cases := []struct {
+		ip, expected string
+	}{
+		{"192.0.2.99", "99.2.0.192"},
+		{"::ffff:192.0.2.99", "99.2.0.192"},
+		{"2001:db8:1:2:3:4:567:89ab",
+			"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+	for _, c := range cases {
+		if got := reverse(net.ParseIP(c.ip)); got != c.expected {
+			t.Errorf("reverse(%q) = %q, expected %q", c.ip, got, c.expected)
+		}
+	}
+}
+
+func TestValidCode(t *testing.T) {
+	cases := []struct {
+		addr  string
+		codes []string
+		valid bool
+	}{
+		{"127.0.0.2", nil, true},
+		{"127.0.0.10", nil, true},
+		{"127.255.255.254", []string{"127.0.0.2"}, false},
+		{"127.0.0.2", []string{"127.0.0.3", "127.0.0.2"}, true},
+		{"10.0.0.1", nil, false},
+		{"invalid", nil, false},
+	}
+	for _, c := range cases {
+		if got := validCode(c.addr, c.codes); got != c.valid {
+			t.Errorf("validCode(%q, %v) = %v, expected %v",
+				c.addr, c.codes, got, c.valid)
+		}
+	}
+}
+
+var notFound = &net.DNSError{Err: "no such host", IsNotFound: true}
+
+// fakeDNS returns a lookup function that resolves using the given map, and
+// counts the queries.
+func fakeDNS(results map[string][]string, queries *int) LookupHostFunc {
+	mu := &sync.Mutex{}
+	return func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		*queries++
+		mu.Unlock()
+
+		if host == "99.2.0.192.broken" {
+			return nil, errors.New("temporary failure")
+		}
+		addrs, ok := results[host]
+		if !ok {
+			return nil, notFound
+		}
+		return addrs, nil
+	}
+}
+
+func TestCheck(t *testing.T) {
+	queries := 0
+	ctx := WithLookupHostFunc(context.Background(), fakeDNS(
+		map[string][]string{
+			"99.2.0.192.zone1": {"127.0.0.2"},
+			"99.2.0.192.zone2": {"127.0.0.4", "127.0.0.10"},
+			"99.2.0.192.zone3": {"127.0.0.2"},
+			"98.2.0.192.zone1": {"127.255.255.254"},
+		}, &queries))
+
+	c := NewChecker([]Zone{
+		{Domain: "zone1", Codes: []string{"127.0.0.2"}},
+		{Domain: "zone2", Weight: 3},
+		{Domain: "zone3", Weight: 5, Codes: []string{"127.0.0.3"}},
+		{Domain: "zone4", Weight: 7},
+	})
+
+	res := c.Check(ctx, net.ParseIP("192.0.2.99"))
+	expected := &Result{
+		Score: 4,
+		Listings: []Listing{
+			{Zone: "zone1", Codes: []string{"127.0.0.2"}, Weight: 1},
+			{Zone: "zone2", Codes: []string{"127.0.0.4", "127.0.0.10"},
+				Weight: 3},
+		},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+	if s := res.String(); s !=
+		"score 4, zone1 (127.0.0.2), zone2 (127.0.0.4 127.0.0.10)" {
+		t.Errorf("unexpected string: %q", s)
+	}
+	if z := res.Zones(); !reflect.DeepEqual(z, []string{"zone1", "zone2"}) {
+		t.Errorf("unexpected zones: %v", z)
+	}
+	if queries != 4 {
+		t.Errorf("expected 4 queries, got %d", queries)
+	}
+
+	// The result should be cached.
+	res2 := c.Check(ctx, net.ParseIP("192.0.2.99"))
+	if res2 != res || queries != 4 {
+		t.Errorf("result was not cached (%d queries)", queries)
+	}
+
+	// Unexpected codes are not listings.
+	res = c.Check(ctx, net.ParseIP("192.0.2.98"))
+	if res.Score != 0 || len(res.Listings) != 0 || len(res.Errors) != 0 {
+		t.Errorf("unexpected result: %#v", res)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	queries := 0
+	ctx := WithLookupHostFunc(context.Background(), fakeDNS(
+		map[string][]string{
+			"99.2.0.192.ok": {"127.0.0.2"},
+		}, &queries))
+
+	c := NewChecker([]Zone{{Domain: "ok"}, {Domain: "broken"}})
+
+	res := c.Check(ctx, net.ParseIP("192.0.2.99"))
+	if res.Score != 1 || !reflect.DeepEqual(res.Errors, []string{"broken"}) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+
+	// Results with errors are not cached.
+	c.Check(ctx, net.ParseIP("192.0.2.99"))
+	if queries != 4 {
+		t.Errorf("expected 4 queries, got %d", queries)
+	}
+
+	// Invalid IPs are skipped.
+	res = c.Check(ctx, nil)
+	if res.Score != 0 || queries != 4 {
+		t.Errorf("invalid IP: %#v, %d queries", res, queries)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	defer func(ttl time.Duration) { cacheTTL = ttl }(cacheTTL)
+	cacheTTL = time.Millisecond
+
+	queries := 0
+	ctx := WithLookupHostFunc(context.Background(),
+		fakeDNS(map[string][]string{}, &queries))
+	c := NewChecker([]Zone{{Domain: "zone"}})
+
+	c.Check(ctx, net.ParseIP("192.0.2.1"))
+	time.Sleep(5 * time.Millisecond)
+	c.Check(ctx, net.ParseIP("192.0.2.1"))
+	if queries != 2 {
+		t.Errorf("expected 2 queries, got %d", queries)
+	}
+
+	// Expired entries get removed when adding new ones.
+	time.Sleep(5 * time.Millisecond)
+	c.Check(ctx, net.ParseIP("192.0.2.2"))
+	if len(c.cache) != 1 {
+		t.Errorf("expired entries were not removed: %v", c.cache)
+	}
+}
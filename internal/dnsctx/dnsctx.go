@@ -0,0 +1,58 @@
+// Package dnsctx carries tracing and DNS lookup functions in a context, for
+// the packages that do DNS-based checks (like dkim, dmarc and dnsbl).
+package dnsctx
+
+import "context"
+
+// Key for a value in the context. Each package uses its own keys, so they
+// can have different functions in the same context.
+type Key struct {
+	name string
+}
+
+// NewKey returns a new key. The name is only used for debugging.
+func NewKey(name string) *Key {
+	return &Key{name: name}
+}
+
+func (k *Key) String() string {
+	return "dnsctx." + k.name
+}
+
+// TraceFunc is used to trace the checks.
+type TraceFunc func(f string, a ...interface{})
+
+// WithTrace returns a context that will use the given function for tracing
+// under the given key.
+func WithTrace(ctx context.Context, key *Key, trace TraceFunc) context.Context {
+	return context.WithValue(ctx, key, trace)
+}
+
+// Trace calls the tracing function for the key, if the context has one.
+func Trace(ctx context.Context, key *Key, f string, args ...interface{}) {
+	traceFunc, ok := ctx.Value(key).(TraceFunc)
+	if !ok {
+		return
+	}
+	traceFunc(f, args...)
+}
+
+// LookupFunc is used to look up DNS records, with the same semantics as the
+// net.Resolver lookup functions (like LookupTXT or LookupHost).
+type LookupFunc func(ctx context.Context, name string) ([]string, error)
+
+// WithLookup returns a context that will use the given function for the
+// lookups under the given key.
+func WithLookup(ctx context.Context, key *Key, lookup LookupFunc) context.Context {
+	return context.WithValue(ctx, key, lookup)
+}
+
+// Lookup the given name, using the function for the key if the context has
+// one, or the default one otherwise.
+func Lookup(ctx context.Context, key *Key, name string, def LookupFunc) ([]string, error) {
+	lookupFunc, ok := ctx.Value(key).(LookupFunc)
+	if !ok {
+		return def(ctx, name)
+	}
+	return lookupFunc(ctx, name)
+}
@@ -0,0 +1,53 @@
+package dnsctx
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	k1, k2 := NewKey("k1"), NewKey("k2")
+	ctx := context.Background()
+
+	// Without a function, tracing does nothing.
+	Trace(ctx, k1, "nothing")
+
+	got := []string{}
+	ctx = WithTrace(ctx, k1, func(f string, a ...interface{}) {
+		got = append(got, "1: "+fmt.Sprintf(f, a...))
+	})
+	ctx = WithTrace(ctx, k2, func(f string, a ...interface{}) {
+		got = append(got, "2: "+fmt.Sprintf(f, a...))
+	})
+	Trace(ctx, k1, "a %d", 1)
+	Trace(ctx, k2, "b %d", 2)
+
+	if len(got) != 2 || got[0] != "1: a 1" || got[1] != "2: b 2" {
+		t.Errorf("unexpected traces: %q", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	k := NewKey("lookup")
+	def := func(ctx context.Context, name string) ([]string, error) {
+		return []string{"default " + name}, nil
+	}
+	ctx := context.Background()
+
+	if r, _ := Lookup(ctx, k, "x", def); len(r) != 1 || r[0] != "default x" {
+		t.Errorf("unexpected default lookup result: %q", r)
+	}
+
+	ctx = WithLookup(ctx, k, func(ctx context.Context, name string) ([]string, error) {
+		return nil, fmt.Errorf("no %s", name)
+	})
+	if _, err := Lookup(ctx, k, "x", def); err == nil || err.Error() != "no x" {
+		t.Errorf("unexpected lookup error: %v", err)
+	}
+
+	// Other keys are not affected.
+	if r, _ := Lookup(ctx, NewKey("other"), "y", def); len(r) != 1 {
+		t.Errorf("unexpected lookup result for other key: %q", r)
+	}
+}
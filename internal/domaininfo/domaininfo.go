@@ -123,6 +123,19 @@ func (db *DB) IncomingSecLevel(tr *trace.Trace, domain string, level SecLevel) b
 	}
 }
 
+// KnownIncomingSecLevel returns the incoming security level we have on
+// record for the domain, without modifying it. Unknown domains are PLAIN.
+func (db *DB) KnownIncomingSecLevel(domain string) SecLevel {
+	db.Lock()
+	defer db.Unlock()
+
+	d, exists := db.info[domain]
+	if !exists {
+		return SecLevel_PLAIN
+	}
+	return d.IncomingSecLevel
+}
+
 // OutgoingSecLevel checks an incoming security level for the domain.
 // Returns true if allowed, false otherwise.
 func (db *DB) OutgoingSecLevel(tr *trace.Trace, domain string, level SecLevel) bool {
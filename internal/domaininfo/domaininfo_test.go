@@ -35,6 +35,13 @@ func TestBasic(t *testing.T) {
 	if db2.IncomingSecLevel(tr, "d1", SecLevel_TLS_INSECURE) {
 		t.Errorf("decrement to tls-insecure was allowed in new DB")
 	}
+
+	if l := db2.KnownIncomingSecLevel("d1"); l != SecLevel_TLS_SECURE {
+		t.Errorf("known level for d1 is %s, expected tls-secure", l)
+	}
+	if l := db2.KnownIncomingSecLevel("unknown"); l != SecLevel_PLAIN {
+		t.Errorf("known level for unknown domain is %s, expected plain", l)
+	}
 }
 
 func TestNewDomain(t *testing.T) {
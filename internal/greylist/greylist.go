@@ -0,0 +1,225 @@
+// Package greylist implements a greylisting database, to temporarily reject
+// mail from unknown (network, sender, recipient) triplets.
+//
+// Legitimate senders retry after a temporary failure, while many spam
+// sources don't. See https://en.wikipedia.org/wiki/Greylisting for more
+// details.
+package greylist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/protoio"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// Command to generate greylist.pb.go.
+//go:generate protoc --go_out=. --go_opt=paths=source_relative greylist.proto
+
+// Result of a greylisting check.
+type Result string
+
+// Valid results.
+const (
+	// First time we see the triplet (or it had expired); it should be
+	// rejected temporarily.
+	Unknown = Result("unknown")
+
+	// The triplet was seen recently, but the delay has not passed yet; it
+	// should be rejected temporarily.
+	TooEarly = Result("early")
+
+	// The client retried after the delay, and within the retry window; it
+	// should be accepted from now on.
+	Passed = Result("passed")
+
+	// The triplet had already passed; it should be accepted.
+	Known = Result("known")
+)
+
+// Accepted returns true if the result means the mail should be accepted.
+func (r Result) Accepted() bool {
+	return r == Passed || r == Known
+}
+
+// How often we update the last seen time of known triplets on disk.
+// Doing it on every message would be wasteful, and we don't need that
+// precision for expiration.
+const lastSeenResolution = time.Hour
+
+// DB represents the persistent greylisting database.
+type DB struct {
+	// Minimum time before a retry is accepted.
+	Delay time.Duration
+
+	// Maximum time after the first attempt for the retry to be accepted. If
+	// the client retries after it, it's treated as a new triplet.
+	RetryWindow time.Duration
+
+	// How long a triplet that passed is remembered after it was last seen.
+	Expiry time.Duration
+
+	// Persistent store with the entries.
+	store *protoio.Store
+
+	// Entries, by id.
+	entries map[string]*Entry
+	sync.Mutex
+
+	// Time source, can be overridden for testing.
+	now func() time.Time
+}
+
+// New opens a greylisting database on the given dir, creating it if
+// necessary, and loads it.
+func New(dir string, delay, retryWindow, expiry time.Duration) (*DB, error) {
+	st, err := protoio.NewStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		Delay:       delay,
+		RetryWindow: retryWindow,
+		Expiry:      expiry,
+		store:       st,
+		entries:     map[string]*Entry{},
+		now:         time.Now,
+	}
+
+	err = db.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *DB) load() error {
+	tr := trace.New("Greylist.Load", "load")
+	defer tr.Finish()
+
+	db.Lock()
+	defer db.Unlock()
+
+	ids, err := db.store.ListIDs()
+	if err != nil {
+		tr.Error(err)
+		return err
+	}
+
+	for _, id := range ids {
+		e := &Entry{}
+		_, err := db.store.Get(id, e)
+		if err != nil {
+			tr.Errorf("id %q: %v", id, err)
+			return fmt.Errorf("error loading %q: %v", id, err)
+		}
+
+		db.entries[id] = e
+	}
+
+	tr.Debugf("loaded %d entries", len(ids))
+	return nil
+}
+
+// entryID returns the id for the given triplet. We use a hash because the
+// addresses can be long, and the ids are used as file names.
+func entryID(network, from, to string) string {
+	h := sha256.Sum256([]byte(network + "\x00" + from + "\x00" + to))
+	return hex.EncodeToString(h[:16])
+}
+
+func (db *DB) write(tr *trace.Trace, id string, e *Entry) {
+	err := db.store.Put(id, e)
+	if err != nil {
+		tr.Errorf("error saving greylist entry: %v", err)
+	}
+}
+
+// expired returns true if the entry should be forgotten.
+func (db *DB) expired(e *Entry, now time.Time) bool {
+	if e.Passed {
+		return now.Sub(time.Unix(e.LastSeen, 0)) > db.Expiry
+	}
+	return now.Sub(time.Unix(e.FirstSeen, 0)) > db.RetryWindow
+}
+
+// Check the given triplet, and record the attempt.
+// The network is the client's network (usually in CIDR notation); from and
+// to are the envelope addresses.
+func (db *DB) Check(tr *trace.Trace, network, from, to string) Result {
+	tr = tr.NewChild("Greylist.Check", network)
+	defer tr.Finish()
+
+	id := entryID(network, from, to)
+	now := db.now()
+
+	db.Lock()
+	defer db.Unlock()
+
+	e, ok := db.entries[id]
+	if !ok || db.expired(e, now) {
+		e = &Entry{
+			Network:   network,
+			From:      from,
+			To:        to,
+			FirstSeen: now.Unix(),
+		}
+		db.entries[id] = e
+		db.write(tr, id, e)
+		tr.Debugf("%s %s -> %s: unknown", network, from, to)
+		return Unknown
+	}
+
+	if e.Passed {
+		if now.Sub(time.Unix(e.LastSeen, 0)) > lastSeenResolution {
+			e.LastSeen = now.Unix()
+			db.write(tr, id, e)
+		}
+		tr.Debugf("%s %s -> %s: known", network, from, to)
+		return Known
+	}
+
+	if now.Sub(time.Unix(e.FirstSeen, 0)) < db.Delay {
+		tr.Debugf("%s %s -> %s: too early", network, from, to)
+		return TooEarly
+	}
+
+	e.Passed = true
+	e.LastSeen = now.Unix()
+	db.write(tr, id, e)
+	tr.Debugf("%s %s -> %s: passed", network, from, to)
+	return Passed
+}
+
+// Expire removes the entries that have expired, both from memory and from
+// disk.
+func (db *DB) Expire() {
+	tr := trace.New("Greylist.Expire", "expire")
+	defer tr.Finish()
+
+	now := db.now()
+
+	db.Lock()
+	defer db.Unlock()
+
+	n := 0
+	for id, e := range db.entries {
+		if !db.expired(e, now) {
+			continue
+		}
+
+		delete(db.entries, id)
+		n++
+		if err := db.store.Delete(id); err != nil {
+			tr.Errorf("error deleting %q: %v", id, err)
+		}
+	}
+
+	tr.Debugf("expired %d entries, %d left", n, len(db.entries))
+}
@@ -0,0 +1,135 @@
+package greylist
+
+import (
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// newTestDB returns a database with a fake clock, and a function to advance
+// it.
+func newTestDB(t *testing.T, dir string) (*DB, func(time.Duration)) {
+	t.Helper()
+	db, err := New(dir, 5*time.Minute, 24*time.Hour, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.now = func() time.Time { return now }
+	return db, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBasic(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	db, advance := newTestDB(t, dir)
+	tr := trace.New("test", "basic")
+	defer tr.Finish()
+
+	check := func(network, from, to string, expected Result) {
+		t.Helper()
+		if r := db.Check(tr, network, from, to); r != expected {
+			t.Errorf("Check(%q, %q, %q) = %q, expected %q",
+				network, from, to, r, expected)
+		}
+	}
+
+	check("1.2.3.0/24", "a@x", "b@y", Unknown)
+	advance(time.Minute)
+	check("1.2.3.0/24", "a@x", "b@y", TooEarly)
+
+	// Different triplets are independent.
+	check("1.2.4.0/24", "a@x", "b@y", Unknown)
+	check("1.2.3.0/24", "a@x", "c@y", Unknown)
+
+	advance(5 * time.Minute)
+	check("1.2.3.0/24", "a@x", "b@y", Passed)
+	check("1.2.3.0/24", "a@x", "b@y", Known)
+
+	// Check that the entries were saved, and a new db sees them.
+	db2, _ := newTestDB(t, dir)
+	if len(db2.entries) != 3 {
+		t.Errorf("expected 3 entries in the new db, got %v", db2.entries)
+	}
+	e := db2.entries[entryID("1.2.3.0/24", "a@x", "b@y")]
+	if e == nil || !e.Passed || e.From != "a@x" || e.To != "b@y" {
+		t.Errorf("unexpected entry in the new db: %v", e)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	db, advance := newTestDB(t, dir)
+	tr := trace.New("test", "expiry")
+	defer tr.Finish()
+
+	db.Check(tr, "n", "passed@x", "b@y")
+	db.Check(tr, "n", "never-retried@x", "b@y")
+	advance(10 * time.Minute)
+	if r := db.Check(tr, "n", "passed@x", "b@y"); r != Passed {
+		t.Fatalf("expected passed, got %q", r)
+	}
+
+	// Retrying after the retry window counts as a new attempt.
+	db.Check(tr, "n", "late@x", "b@y")
+	advance(25 * time.Hour)
+	if r := db.Check(tr, "n", "late@x", "b@y"); r != Unknown {
+		t.Errorf("expected late retry to be unknown, got %q", r)
+	}
+
+	// The entry that was never retried is now expired, the others are
+	// still around.
+	db.Expire()
+	if len(db.entries) != 2 {
+		t.Errorf("expected 2 entries, got %v", db.entries)
+	}
+
+	// Known triplets stay as long as they are seen.
+	for i := 0; i < 3; i++ {
+		advance(20 * 24 * time.Hour)
+		if r := db.Check(tr, "n", "passed@x", "b@y"); r != Known {
+			t.Errorf("%d: expected known, got %q", i, r)
+		}
+	}
+
+	// And expire when they're not.
+	advance(31 * 24 * time.Hour)
+	db.Expire()
+	if len(db.entries) != 0 {
+		t.Errorf("expected no entries, got %v", db.entries)
+	}
+	if ids, err := db.store.ListIDs(); len(ids) != 0 || err != nil {
+		t.Errorf("expected no ids in the store, got %v - %v", ids, err)
+	}
+}
+
+func TestAccepted(t *testing.T) {
+	for r, expected := range map[Result]bool{
+		Unknown: false, TooEarly: false, Passed: true, Known: true,
+	} {
+		if r.Accepted() != expected {
+			t.Errorf("%q.Accepted() = %v, expected %v",
+				r, r.Accepted(), expected)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+
+	// An invalid entry should make loading fail.
+	testlib.Rewrite(t, dir+"/s:broken", "this is not a valid entry")
+	if _, err := New(dir, 0, 0, 0); err == nil {
+		t.Errorf("loaded invalid entry without errors")
+	}
+
+	// So should an inaccessible directory.
+	if _, err := New("/proc/doesnotexist", 0, 0, 0); err == nil {
+		t.Errorf("opened /proc/doesnotexist without errors")
+	}
+}
@@ -1,11 +1,15 @@
 // Package haproxy implements the handshake for the HAProxy client protocol
-// version 1, as described in
-// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt.
+// (also known as the PROXY protocol), versions 1 and 2, as described in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
 package haproxy
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"hash/crc32"
+	"io"
 	"net"
 	"strconv"
 	"strings"
@@ -19,15 +23,107 @@ var (
 	errInvalidDstIP   = errors.New("invalid dst ip")
 	errInvalidSrcPort = errors.New("invalid src port")
 	errInvalidDstPort = errors.New("invalid dst port")
+
+	errInvalidVersion = errors.New("invalid version")
+	errInvalidCommand = errors.New("invalid command")
+	errInvalidFamily  = errors.New("invalid address family")
+	errShortAddresses = errors.New("addresses too short")
+	errInvalidTLV     = errors.New("invalid TLV")
+	errInvalidCRC     = errors.New("CRC32C mismatch")
+)
+
+// Header is the information sent by the proxy.
+type Header struct {
+	// Version of the protocol used, 1 or 2.
+	Version int
+
+	// Source and destination addresses of the connection. They are nil if
+	// the proxy did not give them, for example on connections it makes on
+	// its own behalf (like health checks); in that case the real addresses
+	// of the connection should be used.
+	Src, Dst net.Addr
+
+	// Host name the client connected to (PP2_TYPE_AUTHORITY), usually taken
+	// from TLS SNI. Only in version 2, empty if not given.
+	Authority string
+
+	// TLS information (PP2_TYPE_SSL). Only in version 2, nil if not given.
+	SSL *SSL
+}
+
+// SSL is the TLS information about the client's connection to the proxy.
+type SSL struct {
+	// Did the client connect over TLS? (PP2_CLIENT_SSL)
+	TLS bool
+
+	// Did the client present a certificate (PP2_CLIENT_CERT_CONN or
+	// PP2_CLIENT_CERT_SESS), and was it successfully verified?
+	ClientCert bool
+	Verified   bool
+
+	// TLS version (e.g. "TLSv1.3"), cipher (e.g.
+	// "TLS_AES_256_GCM_SHA384"), and common name of the client certificate,
+	// as given by the proxy. Empty if not given.
+	Version string
+	Cipher  string
+	CN      string
+}
+
+// Signature of the version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Constants for the version 2 header.
+const (
+	// Commands.
+	cmdLocal = 0x0
+	cmdProxy = 0x1
+
+	// Address families (high nibble).
+	famUnspec = 0x0
+	famInet   = 0x1
+	famInet6  = 0x2
+	famUnix   = 0x3
+
+	// TLV types.
+	tlvAuthority  = 0x02
+	tlvCRC32C     = 0x03
+	tlvSSL        = 0x20
+	tlvSSLVersion = 0x21
+	tlvSSLCN      = 0x22
+	tlvSSLCipher  = 0x23
+
+	// Bits of the client field of the SSL TLV.
+	clientSSL      = 0x01
+	clientCertConn = 0x02
+	clientCertSess = 0x04
 )
 
-// Handshake performs the HAProxy protocol v1 handshake on the given reader,
-// which is expected to be backed by a network connection.
-// It returns the source and destination addresses, or an error if the
-// handshake could not complete.
+// Handshake performs the HAProxy protocol handshake on the given reader,
+// which is expected to be backed by a network connection. The version is
+// detected automatically.
+// It returns the header sent by the proxy, or an error if the handshake
+// could not complete.
 // Note that any timeouts or limits must be set by the caller on the
 // underlying connection, this is helper only to perform the handshake.
-func Handshake(r *bufio.Reader) (src, dst net.Addr, err error) {
+func Handshake(r *bufio.Reader) (*Header, error) {
+	// Version 2 headers start with a fixed signature. Version 1 headers are
+	// always longer than it, so we can peek without risk of blocking.
+	// On errors (e.g. if the header is short), we fall back to version 1,
+	// which will return them.
+	if b, _ := r.Peek(len(v2Signature)); bytes.Equal(b, v2Signature) {
+		return handshakeV2(r)
+	}
+
+	src, dst, err := handshakeV1(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Version: 1, Src: src, Dst: dst}, nil
+}
+
+// handshakeV1 performs the version 1 handshake, and returns the source and
+// destination addresses.
+func handshakeV1(r *bufio.Reader) (src, dst net.Addr, err error) {
 	line, err := r.ReadString('\n')
 	if err != nil {
 		return nil, nil, err
@@ -74,3 +170,166 @@ func Handshake(r *bufio.Reader) (src, dst net.Addr, err error) {
 	dst = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
 	return src, dst, nil
 }
+
+// handshakeV2 performs the version 2 (binary) handshake.
+func handshakeV2(r *bufio.Reader) (*Header, error) {
+	// Fixed part: signature (12 bytes), version and command (1), address
+	// family and protocol (1), and length of the rest (2).
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:12], v2Signature) {
+		return nil, errInvalidProtoID
+	}
+	if buf[12]>>4 != 2 {
+		return nil, errInvalidVersion
+	}
+
+	length := binary.BigEndian.Uint16(buf[14:16])
+	buf = append(buf, make([]byte, length)...)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	cmd := buf[12] & 0xf
+	family := buf[13] >> 4
+	rest := buf[16:]
+
+	if cmd != cmdLocal && cmd != cmdProxy {
+		return nil, errInvalidCommand
+	}
+
+	// Parse the addresses, even for LOCAL connections (which we then
+	// ignore), as we need to skip them to get to the TLVs.
+	var src, dst net.Addr
+	switch family {
+	case famUnspec:
+		// No addresses.
+	case famInet, famInet6:
+		ipLen := net.IPv4len
+		if family == famInet6 {
+			ipLen = net.IPv6len
+		}
+		if len(rest) < 2*ipLen+4 {
+			return nil, errShortAddresses
+		}
+		src = &net.TCPAddr{
+			IP:   net.IP(rest[:ipLen]),
+			Port: int(binary.BigEndian.Uint16(rest[2*ipLen:])),
+		}
+		dst = &net.TCPAddr{
+			IP:   net.IP(rest[ipLen : 2*ipLen]),
+			Port: int(binary.BigEndian.Uint16(rest[2*ipLen+2:])),
+		}
+		rest = rest[2*ipLen+4:]
+	case famUnix:
+		if len(rest) < 2*108 {
+			return nil, errShortAddresses
+		}
+		src = &net.UnixAddr{Name: cString(rest[:108]), Net: "unix"}
+		dst = &net.UnixAddr{Name: cString(rest[108:216]), Net: "unix"}
+		rest = rest[216:]
+	default:
+		return nil, errInvalidFamily
+	}
+
+	if cmd == cmdProxy {
+		h.Src, h.Dst = src, dst
+	}
+
+	crcOffset := len(buf) - len(rest)
+	for len(rest) > 0 {
+		typ, value, next, err := readTLV(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case tlvAuthority:
+			h.Authority = string(value)
+		case tlvCRC32C:
+			if len(value) != 4 {
+				return nil, errInvalidTLV
+			}
+			if !checkCRC(buf, crcOffset+3) {
+				return nil, errInvalidCRC
+			}
+		case tlvSSL:
+			h.SSL, err = parseSSL(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		crcOffset += len(rest) - len(next)
+		rest = next
+	}
+
+	return h, nil
+}
+
+// readTLV reads a TLV from the buffer, and returns its type, value, and the
+// rest of the buffer.
+func readTLV(b []byte) (typ byte, value, rest []byte, err error) {
+	if len(b) < 3 {
+		return 0, nil, nil, errInvalidTLV
+	}
+	l := int(binary.BigEndian.Uint16(b[1:3]))
+	if len(b) < 3+l {
+		return 0, nil, nil, errInvalidTLV
+	}
+	return b[0], b[3 : 3+l], b[3+l:], nil
+}
+
+// parseSSL parses the value of the SSL TLV.
+func parseSSL(b []byte) (*SSL, error) {
+	// Client field (1 byte), verify result (4 bytes), and then sub-TLVs.
+	if len(b) < 5 {
+		return nil, errInvalidTLV
+	}
+	ssl := &SSL{
+		TLS:        b[0]&clientSSL != 0,
+		ClientCert: b[0]&(clientCertConn|clientCertSess) != 0,
+	}
+	ssl.Verified = ssl.ClientCert && binary.BigEndian.Uint32(b[1:5]) == 0
+
+	rest := b[5:]
+	for len(rest) > 0 {
+		typ, value, next, err := readTLV(rest)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case tlvSSLVersion:
+			ssl.Version = string(value)
+		case tlvSSLCipher:
+			ssl.Cipher = string(value)
+		case tlvSSLCN:
+			ssl.CN = string(value)
+		}
+		rest = next
+	}
+	return ssl, nil
+}
+
+// checkCRC checks the CRC32C of the header, which is stored at the given
+// offset, and is calculated with that field set to 0.
+func checkCRC(header []byte, offset int) bool {
+	expected := binary.BigEndian.Uint32(header[offset : offset+4])
+
+	b := make([]byte, len(header))
+	copy(b, header)
+	copy(b[offset:offset+4], []byte{0, 0, 0, 0})
+
+	return crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)) == expected
+}
+
+// cString returns the string in b, up to the first NUL.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
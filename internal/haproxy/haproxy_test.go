@@ -2,15 +2,20 @@ package haproxy
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"net"
 	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestNoNewline(t *testing.T) {
 	r := bufio.NewReader(strings.NewReader("PROXY "))
-	_, _, err := Handshake(r)
+	_, err := Handshake(r)
 	if err != io.EOF {
 		t.Errorf("expected EOF, got %v", err)
 	}
@@ -68,17 +73,162 @@ func TestBasic(t *testing.T) {
 	for i, c := range cases {
 		t.Logf("testing %d: %v", i, c.str)
 
-		src, dst, err := Handshake(newR(c.str))
+		h, err := Handshake(newR(c.str))
+		if err != c.err {
+			t.Errorf("%d: got error %v, expected %v", i, err, c.err)
+		}
+		if err != nil {
+			continue
+		}
 
-		if !addrEq(src, c.src) {
-			t.Errorf("%d: got src %v, expected %v", i, src, c.src)
+		if h.Version != 1 {
+			t.Errorf("%d: got version %d, expected 1", i, h.Version)
+		}
+		if !addrEq(h.Src, c.src) {
+			t.Errorf("%d: got src %v, expected %v", i, h.Src, c.src)
 		}
-		if !addrEq(dst, c.dst) {
-			t.Errorf("%d: got dst %v, expected %v", i, dst, c.dst)
+		if !addrEq(h.Dst, c.dst) {
+			t.Errorf("%d: got dst %v, expected %v", i, h.Dst, c.dst)
 		}
+	}
+}
+
+// v2Header builds a version 2 header, with the given command, address
+// family and protocol, addresses, and TLVs.
+func v2Header(cmd, fam byte, addrs []byte, tlvs ...[]byte) []byte {
+	rest := append([]byte{}, addrs...)
+	for _, tlv := range tlvs {
+		rest = append(rest, tlv...)
+	}
+
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|cmd, fam)
+	b = append(b, byte(len(rest)>>8), byte(len(rest)))
+	return append(b, rest...)
+}
+
+func tlv(typ byte, value []byte) []byte {
+	b := []byte{typ}
+	b = append(b, byte(len(value)>>8), byte(len(value)))
+	return append(b, value...)
+}
+
+func TestV2(t *testing.T) {
+	var (
+		src4, _ = net.ResolveTCPAddr("tcp", "1.1.1.1:3333")
+		dst4, _ = net.ResolveTCPAddr("tcp", "2.2.2.2:4444")
+		src6, _ = net.ResolveTCPAddr("tcp", "[5::5]:7777")
+		dst6, _ = net.ResolveTCPAddr("tcp", "[6::6]:8888")
+	)
+
+	addrs4 := []byte{1, 1, 1, 1, 2, 2, 2, 2, 0x0d, 0x05, 0x11, 0x5c}
+	addrs6 := append(append(
+		src6.IP.To16(), dst6.IP.To16()...), 0x1e, 0x61, 0x22, 0xb8)
+	addrsUnix := make([]byte, 216)
+	copy(addrsUnix, "/src")
+	copy(addrsUnix[108:], "/dst")
+
+	ssl := tlv(tlvSSL, append(
+		[]byte{clientSSL | clientCertConn, 0, 0, 0, 0},
+		append(tlv(tlvSSLVersion, []byte("TLSv1.3")),
+			tlv(tlvSSLCipher, []byte("TLS_AES_256_GCM_SHA384"))...)...))
+
+	cases := []struct {
+		hdr       []byte
+		src, dst  net.Addr
+		authority string
+		ssl       *SSL
+		err       error
+	}{
+		{v2Header(cmdProxy, 0x11, addrs4), src4, dst4, "", nil, nil},
+		{v2Header(cmdProxy, 0x21, addrs6), src6, dst6, "", nil, nil},
+		{v2Header(cmdProxy, 0x31, addrsUnix),
+			&net.UnixAddr{Name: "/src", Net: "unix"},
+			&net.UnixAddr{Name: "/dst", Net: "unix"}, "", nil, nil},
+
+		// LOCAL connections, and UNSPEC families, have no addresses.
+		{v2Header(cmdLocal, 0x11, addrs4), nil, nil, "", nil, nil},
+		{v2Header(cmdLocal, 0x00, nil), nil, nil, "", nil, nil},
+		{v2Header(cmdProxy, 0x00, nil), nil, nil, "", nil, nil},
+
+		// TLVs, including unknown ones which are ignored.
+		{v2Header(cmdProxy, 0x11, addrs4,
+			tlv(tlvAuthority, []byte("mail.example.com")),
+			tlv(0xe0, []byte("unknown")),
+			ssl),
+			src4, dst4, "mail.example.com",
+			&SSL{TLS: true, ClientCert: true, Verified: true,
+				Version: "TLSv1.3", Cipher: "TLS_AES_256_GCM_SHA384"},
+			nil},
+		{v2Header(cmdProxy, 0x11, addrs4,
+			tlv(tlvSSL, []byte{0, 0, 0, 0, 1})),
+			src4, dst4, "", &SSL{}, nil},
+
+		// Errors.
+		{v2Header(cmdProxy, 0x11, addrs4[:11]), nil, nil, "", nil,
+			errShortAddresses},
+		{v2Header(cmdProxy, 0x21, addrs4), nil, nil, "", nil,
+			errShortAddresses},
+		{v2Header(cmdProxy, 0x31, addrs4), nil, nil, "", nil,
+			errShortAddresses},
+		{v2Header(cmdProxy, 0x41, addrs4), nil, nil, "", nil,
+			errInvalidFamily},
+		{v2Header(0x2, 0x11, addrs4), nil, nil, "", nil,
+			errInvalidCommand},
+		{v2Header(cmdProxy, 0x11, addrs4, []byte{1, 0}), nil, nil, "", nil,
+			errInvalidTLV},
+		{v2Header(cmdProxy, 0x11, addrs4, []byte{1, 0, 5, 1}), nil, nil, "",
+			nil, errInvalidTLV},
+		{v2Header(cmdProxy, 0x11, addrs4, tlv(tlvSSL, []byte{1})),
+			nil, nil, "", nil, errInvalidTLV},
+		{v2Header(cmdProxy, 0x11, addrs4, tlv(tlvCRC32C, []byte{1})),
+			nil, nil, "", nil, errInvalidTLV},
+		{v2Header(cmdProxy, 0x11, addrs4, tlv(tlvCRC32C, []byte{1, 2, 3, 4})),
+			nil, nil, "", nil, errInvalidCRC},
+	}
+
+	for i, c := range cases {
+		h, err := Handshake(bufio.NewReader(bytes.NewReader(c.hdr)))
 		if err != c.err {
 			t.Errorf("%d: got error %v, expected %v", i, err, c.err)
 		}
+		if err != nil {
+			continue
+		}
+
+		if h.Version != 2 {
+			t.Errorf("%d: got version %d, expected 2", i, h.Version)
+		}
+		if !addrEq(h.Src, c.src) {
+			t.Errorf("%d: got src %v, expected %v", i, h.Src, c.src)
+		}
+		if !addrEq(h.Dst, c.dst) {
+			t.Errorf("%d: got dst %v, expected %v", i, h.Dst, c.dst)
+		}
+		if h.Authority != c.authority {
+			t.Errorf("%d: got authority %q, expected %q",
+				i, h.Authority, c.authority)
+		}
+		if diff := cmp.Diff(c.ssl, h.SSL); diff != "" {
+			t.Errorf("%d: SSL mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestV2CRC(t *testing.T) {
+	hdr := v2Header(cmdProxy, 0x11,
+		[]byte{1, 1, 1, 1, 2, 2, 2, 2, 0x0d, 0x05, 0x11, 0x5c},
+		tlv(tlvCRC32C, []byte{0, 0, 0, 0}))
+	crc := crc32.Checksum(hdr, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(hdr[len(hdr)-4:], crc)
+
+	// Also check that the data after the header is left untouched.
+	r := bufio.NewReader(bytes.NewReader(append(hdr, "EHLO"...)))
+	if _, err := Handshake(r); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "EHLO" {
+		t.Errorf("unexpected data after the header: %q", rest)
 	}
 }
 
@@ -91,6 +241,11 @@ func addrEq(a, b net.Addr) bool {
 		return a == nil && b == nil
 	}
 
+	if ua, ok := a.(*net.UnixAddr); ok {
+		ub, ok := b.(*net.UnixAddr)
+		return ok && *ua == *ub
+	}
+
 	ta := a.(*net.TCPAddr)
 	tb := b.(*net.TCPAddr)
 	return ta.IP.Equal(tb.IP) && ta.Port == tb.Port
@@ -113,6 +113,12 @@ func (l *Logger) Rejected(netAddr net.Addr, from string, to []string, err string
 	l.printf("%s rejected%s%s - %v\n", netAddr, from, toStr, err)
 }
 
+// Relayed logs that we've allowed an unauthenticated client to relay an email
+// to a non-local address, and why.
+func (l *Logger) Relayed(netAddr net.Addr, from, to, reason string) {
+	l.printf("%s relay allowed from=%s to=%s - %s\n", netAddr, from, to, reason)
+}
+
 // Queued logs that we have queued an email.
 func (l *Logger) Queued(netAddr net.Addr, from string, to []string, id string) {
 	l.printf("%s from=%s queued ip=%s to=%v\n", id, from, netAddr, to)
@@ -164,6 +170,12 @@ func Rejected(netAddr net.Addr, from string, to []string, err string) {
 	Default.Rejected(netAddr, from, to, err)
 }
 
+// Relayed logs that we've allowed an unauthenticated client to relay an email
+// to a non-local address, and why.
+func Relayed(netAddr net.Addr, from, to, reason string) {
+	Default.Relayed(netAddr, from, to, reason)
+}
+
 // Queued logs that we have queued an email.
 func Queued(netAddr net.Addr, from string, to []string, id string) {
 	Default.Queued(netAddr, from, to, id)
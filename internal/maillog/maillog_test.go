@@ -47,6 +47,10 @@ func TestLogger(t *testing.T) {
 	expect(t, buf, `1.2.3.4:4321 rejected from=from to=\[to1 to2\] - error`)
 	buf.Reset()
 
+	l.Relayed(netAddr, "from", "to", "reason")
+	expect(t, buf, `1.2.3.4:4321 relay allowed from=from to=to - reason`)
+	buf.Reset()
+
 	l.Queued(netAddr, "from", []string{"to1", "to2"}, "qid")
 	expect(t, buf, `qid from=from queued ip=1.2.3.4:4321 to=\[to1 to2\]`)
 	buf.Reset()
@@ -94,6 +98,10 @@ func TestDefault(t *testing.T) {
 	expect(t, buf, `1.2.3.4:4321 rejected from=from to=\[to1 to2\] - error`)
 	buf.Reset()
 
+	Relayed(netAddr, "from", "to", "reason")
+	expect(t, buf, `1.2.3.4:4321 relay allowed from=from to=to - reason`)
+	buf.Reset()
+
 	Queued(netAddr, "from", []string{"to1", "to2"}, "qid")
 	expect(t, buf, `qid from=from queued ip=1.2.3.4:4321 to=\[to1 to2\]`)
 	buf.Reset()
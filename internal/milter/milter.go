@@ -0,0 +1,635 @@
+// Package milter implements a client for the Sendmail milter protocol
+// (version 6), which is used to run mail filters (milters) during the SMTP
+// conversation.
+//
+// The protocol is not formally specified, it is defined by Sendmail's
+// libmilter implementation (include/libmilter/mfdef.h).
+// Postfix's documentation has a good overview of how it is used:
+// https://www.postfix.org/MILTER_README.html
+package milter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the protocol we speak.
+const protocolVersion = 6
+
+// Commands, sent from the MTA to the filter (SMFIC_*).
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+)
+
+// Responses, sent from the filter to the MTA (SMFIR_*).
+const (
+	respAddRcpt    = '+'
+	respDelRcpt    = '-'
+	respAddRcptPar = '2'
+	respAccept     = 'a'
+	respReplBody   = 'b'
+	respContinue   = 'c'
+	respDiscard    = 'd'
+	respChgFrom    = 'e'
+	respAddHeader  = 'h'
+	respInsHeader  = 'i'
+	respChgHeader  = 'm'
+	respProgress   = 'p'
+	respQuarantine = 'q'
+	respReject     = 'r'
+	respSkip       = 's'
+	respTempFail   = 't'
+	respReplyCode  = 'y'
+)
+
+// Actions the filter can take at the end of the message (SMFIF_*).
+// We support all of them except SMFIF_SETSYMLIST.
+const (
+	actAddHeaders  = 0x01
+	actChangeBody  = 0x02
+	actAddRcpt     = 0x04
+	actDelRcpt     = 0x08
+	actChgHeaders  = 0x10
+	actQuarantine  = 0x20
+	actChangeFrom  = 0x40
+	actAddRcptPar  = 0x80
+	allowedActions = actAddHeaders | actChangeBody | actAddRcpt |
+		actDelRcpt | actChgHeaders | actQuarantine | actChangeFrom |
+		actAddRcptPar
+)
+
+// Protocol flags, which the filter uses to tell us which commands it does
+// not want, and which ones it will not reply to (SMFIP_*).
+const (
+	protoNoConnect = 0x01
+	protoNoHelo    = 0x02
+	protoNoMail    = 0x04
+	protoNoRcpt    = 0x08
+	protoNoBody    = 0x10
+	protoNoHeaders = 0x20
+	protoNoEOH     = 0x40
+	protoNRHeader  = 0x80
+	protoNoUnknown = 0x100
+	protoNoData    = 0x200
+	protoSkip      = 0x400
+	protoNRConnect = 0x1000
+	protoNRHelo    = 0x2000
+	protoNRMail    = 0x4000
+	protoNRRcpt    = 0x8000
+	protoNRData    = 0x10000
+	protoNREOH     = 0x40000
+	protoNRBody    = 0x80000
+
+	// We never send unknown commands, so we don't need to handle the
+	// corresponding "no reply" flag.
+	allowedProtocol = protoNoConnect | protoNoHelo | protoNoMail |
+		protoNoRcpt | protoNoBody | protoNoHeaders | protoNoEOH |
+		protoNRHeader | protoNoUnknown | protoNoData | protoSkip |
+		protoNRConnect | protoNRHelo | protoNRMail | protoNRRcpt |
+		protoNRData | protoNREOH | protoNRBody
+)
+
+// Maximum size of a body chunk (MILTER_CHUNK_SIZE).
+const maxChunkSize = 65535
+
+// Maximum size of a packet we accept from the filter. Replacement bodies
+// are sent in chunks, so this is plenty.
+const maxPacketSize = 1024 * 1024
+
+// Filter is the configuration of a milter.
+type Filter struct {
+	// Network ("tcp" or "unix") and address of the filter.
+	Network string
+	Address string
+
+	// Timeout for connecting, and for each exchange with the filter.
+	Timeout time.Duration
+
+	// What the caller should do if the filter can't be reached or fails:
+	// Accept (skip the filter), Reject or TempFail.
+	DefaultAction Action
+}
+
+func (f *Filter) String() string {
+	return f.Network + ":" + f.Address
+}
+
+// ParseAddress parses a filter address, of the form "unix:/path/to/socket"
+// or "tcp:host:port". For compatibility with other MTAs, "inet:host:port"
+// is also accepted.
+func ParseAddress(s string) (network, address string, err error) {
+	network, address, ok := strings.Cut(s, ":")
+	if !ok || address == "" {
+		return "", "", fmt.Errorf("invalid milter address %q", s)
+	}
+	switch network {
+	case "unix":
+	case "tcp", "inet":
+		network = "tcp"
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("invalid milter address %q: %v", s, err)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid milter address %q: "+
+			"unknown network %q", s, network)
+	}
+	return network, address, nil
+}
+
+// Action the filter wants us to take.
+type Action int
+
+// Possible actions.
+const (
+	// Continue processing the connection or message.
+	Continue Action = iota
+
+	// Accept the connection or message, without further filtering.
+	Accept
+
+	// Reject the connection, message or recipient.
+	Reject
+
+	// Reject with a temporary failure.
+	TempFail
+
+	// Accept the message, but silently discard it.
+	Discard
+
+	// Reply with the given code and text. The code determines if it is a
+	// temporary or permanent rejection.
+	ReplyCode
+
+	// Internal action, used when the filter does not want the rest of the
+	// body.
+	skipBody Action = -1
+)
+
+var actionNames = map[Action]string{
+	Continue:  "continue",
+	Accept:    "accept",
+	Reject:    "reject",
+	TempFail:  "tempfail",
+	Discard:   "discard",
+	ReplyCode: "replycode",
+}
+
+func (a Action) String() string {
+	if s, ok := actionNames[a]; ok {
+		return s
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// Response from the filter to a command.
+type Response struct {
+	Action Action
+
+	// SMTP code and text to reply with, for ReplyCode. The text can have
+	// multiple lines, separated by "\n".
+	Code int
+	Text string
+}
+
+func (r *Response) String() string {
+	if r.Action == ReplyCode {
+		return fmt.Sprintf("%d %s", r.Code, r.Text)
+	}
+	return r.Action.String()
+}
+
+// Macros to send to the filter, as name -> value. Single-character names
+// are sent as they are, longer ones are wrapped in braces (e.g.
+// "client_addr" is sent as "{client_addr}").
+type Macros map[string]string
+
+var errUnexpectedResponse = errors.New("unexpected response")
+
+// Session with a filter. Sessions are tied to a single SMTP connection.
+type Session struct {
+	filter *Filter
+	conn   net.Conn
+	r      *bufio.Reader
+
+	// Negotiated actions and protocol flags.
+	actions  uint32
+	protocol uint32
+}
+
+// Dial the filter, and negotiate the options. The caller must call Close
+// when done with the session.
+func Dial(f *Filter) (*Session, error) {
+	conn, err := net.DialTimeout(f.Network, f.Address, f.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		filter: f,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+	}
+	if err := s.negotiate(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error negotiating: %v", err)
+	}
+	return s, nil
+}
+
+func (s *Session) negotiate() error {
+	s.conn.SetDeadline(time.Now().Add(s.filter.Timeout))
+
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], protocolVersion)
+	binary.BigEndian.PutUint32(data[4:], allowedActions)
+	binary.BigEndian.PutUint32(data[8:], allowedProtocol)
+	if err := s.send(cmdOptNeg, data); err != nil {
+		return err
+	}
+
+	code, data, err := s.read()
+	if err != nil {
+		return err
+	}
+	if code != cmdOptNeg || len(data) < 12 {
+		return errUnexpectedResponse
+	}
+
+	version := binary.BigEndian.Uint32(data[0:])
+	if version < 2 || version > protocolVersion {
+		return fmt.Errorf("unsupported version %d", version)
+	}
+
+	// Filters may ask for things we didn't offer; we ignore them.
+	// Version 6 filters can also send the list of macros they want; we
+	// ignore that too.
+	s.actions = binary.BigEndian.Uint32(data[4:]) & allowedActions
+	s.protocol = binary.BigEndian.Uint32(data[8:]) & allowedProtocol
+	return nil
+}
+
+// Connect sends the connection information: the hostname of the remote
+// end, and its address.
+func (s *Session) Connect(hostname string, addr net.Addr, macros Macros) (*Response, error) {
+	if s.protocol&protoNoConnect != 0 {
+		return &Response{Action: Continue}, nil
+	}
+
+	data := cstring(hostname)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		family := byte('4')
+		if a.IP.To4() == nil {
+			family = '6'
+		}
+		data = append(data, family, byte(a.Port>>8), byte(a.Port))
+		data = append(data, cstring(a.IP.String())...)
+	case *net.UnixAddr:
+		data = append(data, 'L', 0, 0)
+		data = append(data, cstring(a.Name)...)
+	default:
+		data = append(data, 'U')
+	}
+
+	return s.command(cmdConnect, data, macros, s.protocol&protoNRConnect != 0)
+}
+
+// Helo sends the domain given by the client at HELO/EHLO.
+func (s *Session) Helo(domain string, macros Macros) (*Response, error) {
+	if s.protocol&protoNoHelo != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return s.command(cmdHelo, cstring(domain), macros,
+		s.protocol&protoNRHelo != 0)
+}
+
+// Mail sends the envelope sender, and the parameters to the MAIL command.
+func (s *Session) Mail(from string, args []string, macros Macros) (*Response, error) {
+	if s.protocol&protoNoMail != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return s.command(cmdMail, addrArgs(from, args), macros,
+		s.protocol&protoNRMail != 0)
+}
+
+// Rcpt sends an envelope recipient, and the parameters to the RCPT command.
+// A rejection applies only to this recipient.
+func (s *Session) Rcpt(to string, args []string, macros Macros) (*Response, error) {
+	if s.protocol&protoNoRcpt != 0 {
+		return &Response{Action: Continue}, nil
+	}
+	return s.command(cmdRcpt, addrArgs(to, args), macros,
+		s.protocol&protoNRRcpt != 0)
+}
+
+// Message sends the message, given as its header and body (which must use
+// "\n" as line endings), and returns the final response, and the
+// modifications the filter wants to make. Modifications are only returned if
+// the response is Continue or Accept.
+// If binary is set (for BINARYMIME messages), the body is sent as-is,
+// without converting its line endings.
+// The body is read in chunks, so it doesn't need to be in memory.
+func (s *Session) Message(header []byte, body io.Reader, binary bool, macros Macros) (*Response, []Modification, error) {
+	if s.protocol&protoNoData == 0 {
+		resp, err := s.command(cmdData, nil, macros,
+			s.protocol&protoNRData != 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.Action != Continue {
+			return resp, nil, nil
+		}
+	}
+
+	headers, rest := splitMessage(header)
+	body = io.MultiReader(bytes.NewReader(rest), body)
+
+	if s.protocol&protoNoHeaders == 0 {
+		for _, h := range headers {
+			hdr := append(cstring(h.name), cstring(h.value)...)
+			resp, err := s.command(cmdHeader, hdr, nil,
+				s.protocol&protoNRHeader != 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			if resp.Action != Continue {
+				return resp, nil, nil
+			}
+		}
+	}
+
+	if s.protocol&protoNoEOH == 0 {
+		resp, err := s.command(cmdEOH, nil, nil, s.protocol&protoNREOH != 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.Action != Continue {
+			return resp, nil, nil
+		}
+	}
+
+	if s.protocol&protoNoBody == 0 {
+		// The body is sent with CRLF line endings, as it would be on the
+		// wire. We read at most half a chunk at a time, so it still fits
+		// after the conversion.
+		buf := make([]byte, maxChunkSize/2)
+		for {
+			n, err := io.ReadFull(body, buf)
+			if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil, nil, fmt.Errorf("error reading body: %v", err)
+			}
+
+			chunk := buf[:n]
+			if !binary {
+				chunk = toCRLF(chunk)
+			}
+			resp, err := s.command(cmdBody, chunk, nil,
+				s.protocol&protoNRBody != 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			if resp.Action == skipBody {
+				break
+			}
+			if resp.Action != Continue {
+				return resp, nil, nil
+			}
+		}
+	}
+
+	if err := s.send(cmdEOB, nil); err != nil {
+		return nil, nil, err
+	}
+
+	mods := []Modification{}
+	for {
+		code, data, err := s.read()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, err := s.parseResponse(code, data)
+		if err == nil {
+			if resp.Action != Continue && resp.Action != Accept {
+				mods = nil
+			}
+			return resp, mods, nil
+		}
+		if err != errUnexpectedResponse {
+			return nil, nil, err
+		}
+
+		mod, err := s.parseModification(code, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		mods = append(mods, mod)
+	}
+}
+
+// Abort the current message. The session can be used for the next message
+// in the same connection.
+func (s *Session) Abort() error {
+	s.conn.SetDeadline(time.Now().Add(s.filter.Timeout))
+	return s.send(cmdAbort, nil)
+}
+
+// Close the session.
+func (s *Session) Close() error {
+	s.conn.SetDeadline(time.Now().Add(s.filter.Timeout))
+	err := s.send(cmdQuit, nil)
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// command sends the macros for the command (if any), then the command
+// itself, and reads the response unless noReply is set.
+func (s *Session) command(code byte, data []byte, macros Macros, noReply bool) (*Response, error) {
+	s.conn.SetDeadline(time.Now().Add(s.filter.Timeout))
+
+	if len(macros) > 0 {
+		if err := s.send(cmdMacro, encodeMacros(code, macros)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.send(code, data); err != nil {
+		return nil, err
+	}
+	if noReply {
+		return &Response{Action: Continue}, nil
+	}
+
+	rcode, rdata, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if rcode == respSkip && code == cmdBody && s.protocol&protoSkip != 0 {
+		return &Response{Action: skipBody}, nil
+	}
+
+	resp, err := s.parseResponse(rcode, rdata)
+	if err != nil {
+		return nil, fmt.Errorf("%v to %q: %q", err, code, rcode)
+	}
+	return resp, nil
+}
+
+// parseResponse parses a response to a command. Progress responses are
+// handled by read, so they're never seen here. Returns
+// errUnexpectedResponse if the response code is not a valid response
+// (e.g. it is a modification).
+func (s *Session) parseResponse(code byte, data []byte) (*Response, error) {
+	switch code {
+	case respContinue:
+		return &Response{Action: Continue}, nil
+	case respAccept:
+		return &Response{Action: Accept}, nil
+	case respReject:
+		return &Response{Action: Reject}, nil
+	case respTempFail:
+		return &Response{Action: TempFail}, nil
+	case respDiscard:
+		return &Response{Action: Discard}, nil
+	case respReplyCode:
+		return parseReplyCode(readCString(data))
+	}
+	return nil, errUnexpectedResponse
+}
+
+// parseReplyCode parses the reply of a ReplyCode response, of the form
+// "550 5.7.1 Text", or "550-5.7.1 Text\r\n550 5.7.1 More text" for
+// multi-line replies.
+func parseReplyCode(s string) (*Response, error) {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	resp := &Response{Action: ReplyCode}
+	text := []string{}
+	for _, line := range lines {
+		if len(line) < 3 {
+			return nil, fmt.Errorf("invalid reply code %q", s)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || code < 400 || code > 599 {
+			return nil, fmt.Errorf("invalid reply code %q", s)
+		}
+		if resp.Code != 0 && code != resp.Code {
+			return nil, fmt.Errorf("inconsistent reply code %q", s)
+		}
+		resp.Code = code
+		text = append(text, strings.TrimLeft(line[3:], " -"))
+	}
+	resp.Text = strings.Join(text, "\n")
+	return resp, nil
+}
+
+// send a packet to the filter.
+func (s *Session) send(code byte, data []byte) error {
+	buf := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = code
+	buf = append(buf, data...)
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+// read a packet from the filter, skipping progress notifications (which
+// extend the timeout).
+func (s *Session) read() (byte, []byte, error) {
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(s.r, hdr); err != nil {
+			return 0, nil, err
+		}
+		l := binary.BigEndian.Uint32(hdr)
+		if l < 1 || l > maxPacketSize {
+			return 0, nil, fmt.Errorf("invalid packet length %d", l)
+		}
+
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(s.r, buf); err != nil {
+			return 0, nil, err
+		}
+
+		if buf[0] == respProgress {
+			s.conn.SetDeadline(time.Now().Add(s.filter.Timeout))
+			continue
+		}
+		return buf[0], buf[1:], nil
+	}
+}
+
+// cstring returns s as a NUL-terminated byte slice.
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+// readCString returns the first NUL-terminated string in data. If there is
+// no NUL, the whole data is returned.
+func readCString(data []byte) string {
+	s, _, _ := strings.Cut(string(data), "\x00")
+	return s
+}
+
+// splitCStrings splits data into NUL-terminated strings.
+func splitCStrings(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\x00")
+	return strings.Split(s, "\x00")
+}
+
+// addrArgs encodes an address (in angle brackets) and the command
+// parameters.
+func addrArgs(addr string, args []string) []byte {
+	if addr != "<>" {
+		addr = "<" + addr + ">"
+	}
+	data := cstring(addr)
+	for _, arg := range args {
+		data = append(data, cstring(arg)...)
+	}
+	return data
+}
+
+func encodeMacros(code byte, macros Macros) []byte {
+	names := []string{}
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := []byte{code}
+	for _, name := range names {
+		value := macros[name]
+		if len(name) > 1 {
+			name = "{" + name + "}"
+		}
+		data = append(data, cstring(name)...)
+		data = append(data, cstring(value)...)
+	}
+	return data
+}
@@ -0,0 +1,552 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type packet struct {
+	code byte
+	data string
+}
+
+// fakeMilter is an in-process milter, which records the packets it
+// receives, and replies with the configured responses.
+type fakeMilter struct {
+	l net.Listener
+
+	// Actions and protocol flags to negotiate.
+	actions  uint32
+	protocol uint32
+
+	// Responses to each command. Commands without an entry get a
+	// "continue", unless they don't expect a reply.
+	responses map[byte][]packet
+
+	mu       sync.Mutex
+	received []packet
+}
+
+func newFakeMilter(t *testing.T) *fakeMilter {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	m := &fakeMilter{
+		l:         l,
+		actions:   allowedActions,
+		responses: map[byte][]packet{},
+	}
+	go m.serve()
+	t.Cleanup(func() { l.Close() })
+	return m
+}
+
+func (m *fakeMilter) filter() *Filter {
+	return &Filter{
+		Network: "tcp",
+		Address: m.l.Addr().String(),
+		Timeout: time.Second,
+	}
+}
+
+func (m *fakeMilter) serve() {
+	for {
+		conn, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *fakeMilter) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(hdr))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		p := packet{buf[0], string(buf[1:])}
+
+		m.mu.Lock()
+		m.received = append(m.received, p)
+		responses, ok := m.responses[p.code]
+		m.mu.Unlock()
+
+		if !ok {
+			responses = []packet{{respContinue, ""}}
+		}
+
+		switch p.code {
+		case cmdOptNeg:
+			data := make([]byte, 12)
+			binary.BigEndian.PutUint32(data[0:], 6)
+			binary.BigEndian.PutUint32(data[4:], m.actions)
+			binary.BigEndian.PutUint32(data[8:], m.protocol)
+			responses = []packet{{cmdOptNeg, string(data)}}
+		case cmdMacro, cmdAbort:
+			responses = nil
+		case cmdConnect, cmdHelo, cmdMail, cmdRcpt, cmdData, cmdHeader,
+			cmdEOH, cmdBody:
+			if m.protocol&noReplyFlags[p.code] != 0 {
+				responses = nil
+			}
+		case cmdQuit:
+			return
+		}
+
+		for _, resp := range responses {
+			writePacket(conn, resp)
+		}
+	}
+}
+
+// Protocol flags that indicate that the filter does not reply to the
+// command.
+var noReplyFlags = map[byte]uint32{
+	cmdConnect: protoNRConnect,
+	cmdHelo:    protoNRHelo,
+	cmdMail:    protoNRMail,
+	cmdRcpt:    protoNRRcpt,
+	cmdData:    protoNRData,
+	cmdHeader:  protoNRHeader,
+	cmdEOH:     protoNREOH,
+	cmdBody:    protoNRBody,
+}
+
+func writePacket(w io.Writer, p packet) {
+	buf := make([]byte, 5)
+	binary.BigEndian.PutUint32(buf, uint32(len(p.data)+1))
+	buf[4] = p.code
+	w.Write(append(buf, p.data...))
+}
+
+// commands returns the codes of the commands received so far.
+func (m *fakeMilter) commands() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := ""
+	for _, p := range m.received {
+		s += string(p.code)
+	}
+	return s
+}
+
+// last returns the last packet received with the given code.
+func (m *fakeMilter) last(code byte) packet {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.received) - 1; i >= 0; i-- {
+		if m.received[i].code == code {
+			return m.received[i]
+		}
+	}
+	return packet{}
+}
+
+func (m *fakeMilter) setResponse(code byte, resps ...packet) {
+	m.mu.Lock()
+	m.responses[code] = resps
+	m.mu.Unlock()
+}
+
+func mustDial(t *testing.T, m *fakeMilter) *Session {
+	t.Helper()
+	s, err := Dial(m.filter())
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	return s
+}
+
+func expectAction(t *testing.T, resp *Response, err error, action Action) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Action != action {
+		t.Fatalf("expected %v, got %v", action, resp)
+	}
+}
+
+// waitFor waits until the milter has received the given commands. Commands
+// that don't expect a reply can be processed after we return.
+func waitFor(t *testing.T, m *fakeMilter, cmds string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if m.commands() == cmds {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected commands %q, got %q", cmds, m.commands())
+}
+
+func TestSession(t *testing.T) {
+	m := newFakeMilter(t)
+	m.setResponse(cmdEOB,
+		packet{respProgress, ""},
+		packet{respAddHeader, "X-Spam\x00yes\x00"},
+		packet{respChgHeader, "\x00\x00\x00\x01Subject\x00[SPAM] hi\x00"},
+		packet{respInsHeader, "\x00\x00\x00\x00X-First\x001\x00"},
+		packet{respReplBody, "new\r\n"},
+		packet{respReplBody, "body\r\n"},
+		packet{respAddRcpt, "<new@dom>\x00"},
+		packet{respAddRcptPar, "<new2@dom>\x00NOTIFY=NEVER\x00"},
+		packet{respDelRcpt, "<old@dom>\x00"},
+		packet{respChgFrom, "<>\x00"},
+		packet{respQuarantine, "suspicious\x00"},
+		packet{respContinue, ""})
+
+	s := mustDial(t, m)
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	resp, err := s.Connect("remote.example", addr,
+		Macros{"j": "mx.dom", "client_addr": "192.0.2.1"})
+	expectAction(t, resp, err, Continue)
+
+	resp, err = s.Helo("helo.example", nil)
+	expectAction(t, resp, err, Continue)
+
+	resp, err = s.Mail("from@example", []string{"BODY=8BITMIME"}, nil)
+	expectAction(t, resp, err, Continue)
+
+	resp, err = s.Rcpt("to@dom", nil, Macros{"rcpt_addr": "to@dom"})
+	expectAction(t, resp, err, Continue)
+
+	hdr := "Subject: hi\nTo: to@dom,\n other@dom\n\n"
+	resp, mods, err := s.Message([]byte(hdr),
+		strings.NewReader("line1\nline2\n"), false, nil)
+	expectAction(t, resp, err, Continue)
+
+	if err := s.Close(); err != nil {
+		t.Errorf("error closing: %v", err)
+	}
+	waitFor(t, m, "ODCHMDRTLLNBEQ")
+
+	expectedPackets := []packet{
+		{cmdMacro, "R{rcpt_addr}\x00to@dom\x00"},
+		{cmdConnect, "remote.example\x004\x04\xd2192.0.2.1\x00"},
+		{cmdHelo, "helo.example\x00"},
+		{cmdMail, "<from@example>\x00BODY=8BITMIME\x00"},
+		{cmdRcpt, "<to@dom>\x00"},
+		{cmdHeader, "To\x00to@dom,\n other@dom\x00"},
+		{cmdBody, "line1\r\nline2\r\n"},
+	}
+	connMacros := packet{cmdMacro,
+		"C{client_addr}\x00192.0.2.1\x00j\x00mx.dom\x00"}
+	m.mu.Lock()
+	if m.received[1] != connMacros {
+		t.Errorf("expected packet %q, got %q", connMacros, m.received[1])
+	}
+	m.mu.Unlock()
+	for _, p := range expectedPackets {
+		if got := m.last(p.code); got != p {
+			t.Errorf("expected packet %q, got %q", p, got)
+		}
+	}
+
+	expectedMods := []Modification{
+		{Type: AddHeader, Name: "X-Spam", Value: "yes"},
+		{Type: ChangeHeader, Index: 1, Name: "Subject", Value: "[SPAM] hi"},
+		{Type: InsertHeader, Index: 0, Name: "X-First", Value: "1"},
+		{Type: ReplaceBody, Body: []byte("new\r\n")},
+		{Type: ReplaceBody, Body: []byte("body\r\n")},
+		{Type: AddRcpt, Addr: "new@dom"},
+		{Type: AddRcpt, Addr: "new2@dom"},
+		{Type: DelRcpt, Addr: "old@dom"},
+		{Type: ChangeFrom, Addr: "<>"},
+		{Type: Quarantine, Reason: "suspicious"},
+	}
+	if !reflect.DeepEqual(mods, expectedMods) {
+		t.Errorf("unexpected modifications:\n  %v\nexpected:\n  %v",
+			mods, expectedMods)
+	}
+
+	data := ApplyModifications([]byte(hdr), mods)
+	expected := "X-First: 1\nSubject: [SPAM] hi\nTo: to@dom,\n other@dom\n" +
+		"X-Spam: yes\n\n"
+	if string(data) != expected {
+		t.Errorf("unexpected message:\n%q\nexpected:\n%q", data, expected)
+	}
+}
+
+func TestResponses(t *testing.T) {
+	m := newFakeMilter(t)
+	s := mustDial(t, m)
+	defer s.Close()
+
+	cases := []struct {
+		resp     packet
+		expected Response
+	}{
+		{packet{respAccept, ""}, Response{Action: Accept}},
+		{packet{respReject, ""}, Response{Action: Reject}},
+		{packet{respTempFail, ""}, Response{Action: TempFail}},
+		{packet{respDiscard, ""}, Response{Action: Discard}},
+		{packet{respReplyCode, "550 5.7.1 Go away\x00"},
+			Response{Action: ReplyCode, Code: 550, Text: "5.7.1 Go away"}},
+	}
+	for _, c := range cases {
+		m.setResponse(cmdRcpt, c.resp)
+		resp, err := s.Rcpt("to@dom", nil, nil)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.resp, err)
+			continue
+		}
+		if *resp != c.expected {
+			t.Errorf("%q: expected %v, got %v", c.resp, c.expected, resp)
+		}
+	}
+
+	// A rejection at the end of the message discards the modifications.
+	m.setResponse(cmdEOB,
+		packet{respAddHeader, "X-Spam\x00yes\x00"},
+		packet{respReject, ""})
+	resp, mods, err := s.Message([]byte("Subject: x\n\n"), strings.NewReader("body\n"), false, nil)
+	expectAction(t, resp, err, Reject)
+	if mods != nil {
+		t.Errorf("unexpected modifications: %v", mods)
+	}
+
+	// Rejections in the middle of the message end it early.
+	m.setResponse(cmdHeader, packet{respTempFail, ""})
+	resp, _, err = s.Message([]byte("Subject: x\nTo: y\n\n"),
+		strings.NewReader("body\n"), false, nil)
+	expectAction(t, resp, err, TempFail)
+
+	m.setResponse(cmdData, packet{respAccept, ""})
+	resp, _, err = s.Message([]byte("Subject: x\n\n"), strings.NewReader("body\n"), false, nil)
+	expectAction(t, resp, err, Accept)
+
+	if err := s.Abort(); err != nil {
+		t.Errorf("error aborting: %v", err)
+	}
+	waitFor(t, m, "ORRRRRTLNBETLTA")
+}
+
+func TestProtocolFlags(t *testing.T) {
+	m := newFakeMilter(t)
+	m.protocol = protoNoConnect | protoNRHelo | protoNoMail | protoNoRcpt |
+		protoNoData | protoNoHeaders | protoNoEOH | protoSkip
+	m.setResponse(cmdBody, packet{respSkip, ""})
+	s := mustDial(t, m)
+	defer s.Close()
+
+	resp, err := s.Connect("remote", &net.UnixAddr{Name: "/sock"}, nil)
+	expectAction(t, resp, err, Continue)
+	resp, err = s.Helo("helo", nil)
+	expectAction(t, resp, err, Continue)
+	resp, err = s.Mail("from@dom", nil, nil)
+	expectAction(t, resp, err, Continue)
+	resp, err = s.Rcpt("to@dom", nil, nil)
+	expectAction(t, resp, err, Continue)
+
+	// The body takes more than one chunk, but the filter asks us to skip the
+	// rest after the first one.
+	body := strings.Repeat("x", maxChunkSize*2)
+	resp, mods, err := s.Message([]byte("Subject: x\n\n"),
+		strings.NewReader(body), false, nil)
+	expectAction(t, resp, err, Continue)
+	if len(mods) != 0 {
+		t.Errorf("unexpected modifications: %v", mods)
+	}
+
+	waitFor(t, m, "OHBE")
+	if l := len(m.last(cmdBody).data); l != maxChunkSize/2 {
+		t.Errorf("unexpected body chunk length: %d", l)
+	}
+}
+
+func TestBinaryBody(t *testing.T) {
+	m := newFakeMilter(t)
+	s := mustDial(t, m)
+	defer s.Close()
+
+	// Binary bodies are sent as-is, without converting the line endings.
+	body := "bin\nary\r\n\x00\r"
+	resp, _, err := s.Message([]byte("Subject: x\n\n"),
+		strings.NewReader(body), true, nil)
+	expectAction(t, resp, err, Continue)
+
+	waitFor(t, m, "OTLNBE")
+	if got := m.last(cmdBody).data; got != body {
+		t.Errorf("unexpected body: %q", got)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	m := newFakeMilter(t)
+	m.actions = actAddHeaders
+
+	// Modifications that were not negotiated.
+	m.setResponse(cmdEOB, packet{respReplBody, "body"})
+	s := mustDial(t, m)
+	_, _, err := s.Message([]byte("Subject: x\n\n"), strings.NewReader("body\n"), false, nil)
+	if err == nil || !strings.Contains(err.Error(), "not negotiated") {
+		t.Errorf("expected negotiation error, got %v", err)
+	}
+	s.Close()
+
+	// Unexpected responses.
+	m.setResponse(cmdHelo, packet{respAddHeader, "X\x00y\x00"})
+	s = mustDial(t, m)
+	_, err = s.Helo("helo", nil)
+	if err == nil || !strings.Contains(err.Error(), "unexpected response") {
+		t.Errorf("expected unexpected response error, got %v", err)
+	}
+	s.Close()
+
+	// Invalid reply code.
+	m.setResponse(cmdMail, packet{respReplyCode, "250 ok\x00"})
+	s = mustDial(t, m)
+	_, err = s.Mail("from@dom", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid reply code") {
+		t.Errorf("expected reply code error, got %v", err)
+	}
+	s.Close()
+
+	// Filter that does not reply in time.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+	f := &Filter{
+		Network: "tcp",
+		Address: l.Addr().String(),
+		Timeout: 50 * time.Millisecond,
+	}
+	_, err = Dial(f)
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	// Filter that can't be reached.
+	l.Close()
+	if _, err = Dial(f); err == nil {
+		t.Errorf("expected error dialing a closed listener")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	cases := []struct {
+		addr, network, address string
+		ok                     bool
+	}{
+		{"unix:/run/milter.sock", "unix", "/run/milter.sock", true},
+		{"tcp:localhost:8891", "tcp", "localhost:8891", true},
+		{"inet:[::1]:8891", "tcp", "[::1]:8891", true},
+		{"tcp:localhost", "", "", false},
+		{"unix:", "", "", false},
+		{"/run/milter.sock", "", "", false},
+		{"udp:localhost:53", "", "", false},
+	}
+	for _, c := range cases {
+		network, address, err := ParseAddress(c.addr)
+		if (err == nil) != c.ok || network != c.network ||
+			address != c.address {
+			t.Errorf("ParseAddress(%q) = %q, %q, %v",
+				c.addr, network, address, err)
+		}
+	}
+}
+
+func TestParseReplyCode(t *testing.T) {
+	cases := []struct {
+		s    string
+		code int
+		text string
+	}{
+		{"550 5.7.1 Rejected", 550, "5.7.1 Rejected"},
+		{"451 4.7.1 Try\r\n451 4.7.1 again", 451, "4.7.1 Try\n4.7.1 again"},
+		{"550-5.7.1 Line 1\r\n550 5.7.1 Line 2", 550,
+			"5.7.1 Line 1\n5.7.1 Line 2"},
+	}
+	for _, c := range cases {
+		resp, err := parseReplyCode(c.s)
+		if err != nil || resp.Code != c.code || resp.Text != c.text {
+			t.Errorf("parseReplyCode(%q) = %v, %v", c.s, resp, err)
+		}
+	}
+
+	for _, s := range []string{"", "55", "250 Ok", "abc def",
+		"550 a\r\n451 b"} {
+		if resp, err := parseReplyCode(s); err == nil {
+			t.Errorf("parseReplyCode(%q) = %v, expected error", s, resp)
+		}
+	}
+}
+
+func TestApplyModifications(t *testing.T) {
+	msg := "A: 1\nB: 2\n  folded\nA: 3\n\nbody\n"
+	cases := []struct {
+		mods     []Modification
+		expected string
+	}{
+		{nil, msg},
+		{[]Modification{{Type: AddHeader, Name: "C", Value: "x\r\ny"}},
+			"A: 1\nB: 2\n  folded\nA: 3\nC: x\n\ty\n\nbody\n"},
+		{[]Modification{{Type: InsertHeader, Index: 1, Name: "C", Value: ""}},
+			"A: 1\nC:\nB: 2\n  folded\nA: 3\n\nbody\n"},
+		{[]Modification{{Type: InsertHeader, Index: 10, Name: "C", Value: "x"}},
+			"A: 1\nB: 2\n  folded\nA: 3\nC: x\n\nbody\n"},
+		{[]Modification{{Type: ChangeHeader, Index: 2, Name: "a", Value: "x"}},
+			"A: 1\nB: 2\n  folded\nA: x\n\nbody\n"},
+		{[]Modification{{Type: ChangeHeader, Index: 1, Name: "B", Value: ""}},
+			"A: 1\nA: 3\n\nbody\n"},
+		{[]Modification{{Type: ChangeHeader, Index: 3, Name: "A", Value: ""}},
+			msg},
+		{[]Modification{{Type: ChangeHeader, Index: 0, Name: "D", Value: "x"}},
+			"A: 1\nB: 2\n  folded\nA: 3\nD: x\n\nbody\n"},
+		{[]Modification{{Type: Quarantine, Reason: "x"},
+			{Type: AddRcpt, Addr: "x@y"},
+			{Type: ReplaceBody, Body: []byte{}}}, msg},
+	}
+	for i, c := range cases {
+		got := string(ApplyModifications([]byte(msg), c.mods))
+		if got != c.expected {
+			t.Errorf("%d: %v\n  got      %q\n  expected %q",
+				i, c.mods, got, c.expected)
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	cases := []struct {
+		msg     string
+		headers []string
+		body    string
+	}{
+		{"A: 1\n\nbody\n", []string{"A=1"}, "body\n"},
+		{"A:1\nB:  2\n\tx\n\n", []string{"A=1", "B= 2\n\tx"}, ""},
+		{"A: 1\nnot a header\n", []string{"A=1"}, "not a header\n"},
+		{"A: 1", []string{"A=1"}, ""},
+		{"\nbody", []string{}, "body"},
+		{" folded: 1\n", []string{}, " folded: 1\n"},
+	}
+	for _, c := range cases {
+		headers, body := splitMessage([]byte(c.msg))
+		got := []string{}
+		for _, h := range headers {
+			got = append(got, h.name+"="+h.value)
+		}
+		if !reflect.DeepEqual(got, c.headers) || string(body) != c.body {
+			t.Errorf("splitMessage(%q) = %q, %q", c.msg, got, body)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ModificationType is the kind of a Modification.
+type ModificationType int
+
+// Possible modification types.
+const (
+	AddHeader ModificationType = iota
+	InsertHeader
+	ChangeHeader
+	ReplaceBody
+	AddRcpt
+	DelRcpt
+	ChangeFrom
+	Quarantine
+)
+
+var modificationNames = map[ModificationType]string{
+	AddHeader:    "add-header",
+	InsertHeader: "insert-header",
+	ChangeHeader: "change-header",
+	ReplaceBody:  "replace-body",
+	AddRcpt:      "add-rcpt",
+	DelRcpt:      "del-rcpt",
+	ChangeFrom:   "change-from",
+	Quarantine:   "quarantine",
+}
+
+func (t ModificationType) String() string {
+	if s, ok := modificationNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("ModificationType(%d)", int(t))
+}
+
+// Modification to the message or its envelope, requested by the filter at
+// the end of the message.
+type Modification struct {
+	Type ModificationType
+
+	// Header name and value, for AddHeader, InsertHeader and ChangeHeader.
+	// For ChangeHeader, an empty value means the header must be removed.
+	Name  string
+	Value string
+
+	// For InsertHeader, the position of the new header (0 is the first
+	// one). For ChangeHeader, which occurrence of the header to change (1
+	// is the first one).
+	Index int
+
+	// Chunk of the new body, for ReplaceBody. The body is replaced with the
+	// concatenation of all the chunks. It is given as sent by the filter,
+	// so it uses "\r\n" as line endings; a line ending can be split across
+	// two chunks, so they must not be converted one by one.
+	Body []byte
+
+	// Address, for AddRcpt, DelRcpt and ChangeFrom. The null sender is "<>".
+	Addr string
+
+	// Reason, for Quarantine.
+	Reason string
+}
+
+func (m Modification) String() string {
+	switch m.Type {
+	case AddHeader:
+		return fmt.Sprintf("%s %q: %q", m.Type, m.Name, m.Value)
+	case InsertHeader, ChangeHeader:
+		return fmt.Sprintf("%s %d %q: %q", m.Type, m.Index, m.Name, m.Value)
+	case ReplaceBody:
+		return fmt.Sprintf("%s (%d bytes)", m.Type, len(m.Body))
+	case AddRcpt, DelRcpt, ChangeFrom:
+		return fmt.Sprintf("%s %s", m.Type, m.Addr)
+	case Quarantine:
+		return fmt.Sprintf("%s %q", m.Type, m.Reason)
+	}
+	return m.Type.String()
+}
+
+// parseModification parses a modification sent by the filter, checking
+// that it was negotiated.
+func (s *Session) parseModification(code byte, data []byte) (Modification, error) {
+	m := Modification{}
+	var action uint32
+	switch code {
+	case respAddHeader:
+		action = actAddHeaders
+		m.Type = AddHeader
+		m.Name, m.Value = nameValue(data)
+	case respInsHeader, respChgHeader:
+		action = actAddHeaders
+		m.Type = InsertHeader
+		if code == respChgHeader {
+			action = actChgHeaders
+			m.Type = ChangeHeader
+		}
+		if len(data) < 4 {
+			return m, fmt.Errorf("%q response too short", code)
+		}
+		m.Index = int(binary.BigEndian.Uint32(data))
+		m.Name, m.Value = nameValue(data[4:])
+	case respReplBody:
+		action = actChangeBody
+		m.Type = ReplaceBody
+		m.Body = data
+	case respAddRcpt, respAddRcptPar:
+		action = actAddRcpt
+		if code == respAddRcptPar {
+			action = actAddRcptPar
+		}
+		m.Type = AddRcpt
+		m.Addr = trimAngles(readCString(data))
+	case respDelRcpt:
+		action = actDelRcpt
+		m.Type = DelRcpt
+		m.Addr = trimAngles(readCString(data))
+	case respChgFrom:
+		action = actChangeFrom
+		m.Type = ChangeFrom
+		m.Addr = trimAngles(readCString(data))
+	case respQuarantine:
+		action = actQuarantine
+		m.Type = Quarantine
+		m.Reason = readCString(data)
+	default:
+		return m, fmt.Errorf("unknown response %q", code)
+	}
+
+	if s.actions&action == 0 {
+		return m, fmt.Errorf("%s was not negotiated", m.Type)
+	}
+	return m, nil
+}
+
+// nameValue parses a "name\0value\0" pair.
+func nameValue(data []byte) (string, string) {
+	parts := splitCStrings(data)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// trimAngles removes the angle brackets around an address. The null sender
+// is left as "<>".
+func trimAngles(addr string) string {
+	if addr == "<>" || len(addr) < 2 || addr[0] != '<' ||
+		addr[len(addr)-1] != '>' {
+		return addr
+	}
+	return addr[1 : len(addr)-1]
+}
+
+// header of a message.
+type header struct {
+	name string
+
+	// Value, without the leading space, and with the folded lines separated
+	// by "\n".
+	value string
+
+	// Original lines of the header, nil if it was added or modified.
+	raw []byte
+}
+
+// splitMessage splits the message into headers and body. The message must
+// use "\n" as line endings.
+func splitMessage(data []byte) ([]*header, []byte) {
+	headers := []*header{}
+	for len(data) > 0 {
+		line, rest := data, []byte(nil)
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, rest = data[:i+1], data[i+1:]
+		}
+
+		text := strings.TrimRight(string(line), "\r\n")
+		if text == "" {
+			// Empty line, the body begins after it.
+			return headers, rest
+		}
+
+		if (text[0] == ' ' || text[0] == '\t') && len(headers) > 0 {
+			// Continuation of the previous header.
+			h := headers[len(headers)-1]
+			h.value += "\n" + text
+			h.raw = append(h.raw, line...)
+			data = rest
+			continue
+		}
+
+		name, value, ok := strings.Cut(text, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			// Not a header, so the body begins here.
+			return headers, data
+		}
+
+		headers = append(headers, &header{
+			name:  name,
+			value: strings.TrimPrefix(value, " "),
+			raw:   line[:len(line):len(line)],
+		})
+		data = rest
+	}
+	return headers, nil
+}
+
+// joinMessage is the inverse of splitMessage.
+func joinMessage(headers []*header, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	for _, h := range headers {
+		if h.raw != nil {
+			buf.Write(h.raw)
+			continue
+		}
+
+		buf.WriteString(h.name + ":")
+		for i, line := range strings.Split(h.value, "\n") {
+			if i == 0 {
+				if line != "" {
+					buf.WriteString(" " + line)
+				}
+				continue
+			}
+			buf.WriteString("\n")
+			if line == "" || (line[0] != ' ' && line[0] != '\t') {
+				buf.WriteString("\t")
+			}
+			buf.WriteString(line)
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// ApplyModifications applies the header modifications to the given header,
+// which must use "\n" as line endings. Other modifications (including
+// ReplaceBody) are ignored, and must be handled by the caller.
+func ApplyModifications(hdr []byte, mods []Modification) []byte {
+	headers, rest := splitMessage(hdr)
+
+	for _, m := range mods {
+		value := strings.ReplaceAll(m.Value, "\r\n", "\n")
+		switch m.Type {
+		case AddHeader:
+			headers = append(headers, &header{name: m.Name, value: value})
+		case InsertHeader:
+			i := m.Index
+			if i < 0 {
+				i = 0
+			} else if i > len(headers) {
+				i = len(headers)
+			}
+			h := &header{name: m.Name, value: value}
+			headers = append(headers[:i],
+				append([]*header{h}, headers[i:]...)...)
+		case ChangeHeader:
+			headers = changeHeader(headers, m.Name, value, m.Index)
+		}
+	}
+
+	return joinMessage(headers, rest)
+}
+
+// changeHeader changes the index-th occurrence (starting at 1) of the
+// header with the given name. If value is empty, the header is removed.
+// If there is no such occurrence, the header is added.
+func changeHeader(headers []*header, name, value string, index int) []*header {
+	if index < 1 {
+		index = 1
+	}
+
+	n := 0
+	for i, h := range headers {
+		if !strings.EqualFold(h.name, name) {
+			continue
+		}
+		n++
+		if n != index {
+			continue
+		}
+
+		if value == "" {
+			return append(headers[:i], headers[i+1:]...)
+		}
+		h.value = value
+		h.raw = nil
+		return headers
+	}
+
+	if value != "" {
+		headers = append(headers, &header{name: name, value: value})
+	}
+	return headers
+}
+
+// toCRLF converts the line endings of data from "\n" to "\r\n".
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,435 @@
+// Package policy implements chasquid's policy daemon protocol, which lets a
+// long-running daemon take the place of the hooks, to avoid the cost of
+// running a new process every time, and so it can keep state across them.
+//
+// The protocol is line based, and inspired by Postfix's policy delegation
+// protocol (https://www.postfix.org/SMTPD_POLICY_README.html).
+//
+// A request is a sequence of "name=value" lines, terminated by an empty
+// line. The first one is always "request", with the name of the hook that
+// the request takes the place of (e.g. "post-data"). The rest are the
+// variables that the hook would get in its environment, with lowercase names
+// (e.g. "remote_addr"). If the request carries data (the message, for
+// post-data), the last attribute is "size", and the data follows the empty
+// line.
+//
+// The response has the same format (without data), with the following
+// attributes:
+//
+//   - action: "accept", "tempfail" or "reject".
+//   - message: the text to reply with, for "tempfail" and "reject".
+//   - header: for post-data, a header line to add to the message. Can
+//     appear more than once.
+//   - alias: for alias-resolve, recipients in the same format as the
+//     right-hand side of the aliases file. Can appear more than once.
+//
+// Unknown attributes are ignored, so the protocol can be extended.
+// A connection can be used for any number of requests, one at a time.
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions the daemon can reply with.
+const (
+	Accept   = "accept"
+	TempFail = "tempfail"
+	Reject   = "reject"
+)
+
+// Maximum size of the attributes of a request or response.
+const maxAttrsSize = 1024 * 1024
+
+// Maximum number of idle connections the client keeps open.
+const maxIdle = 8
+
+// Request to the policy daemon.
+type Request struct {
+	// Name of the hook the request takes the place of, e.g. "post-data".
+	Type string
+
+	// Attributes, as name -> value. Values can't contain newlines, and
+	// "request" and "size" are reserved.
+	Attrs map[string]string
+
+	// Data that goes with the request, and its size. Data is nil if there
+	// is none.
+	Data io.Reader
+	Size int64
+}
+
+// Response from the policy daemon.
+type Response struct {
+	// What to do: Accept, TempFail or Reject.
+	Action string
+
+	// Text to reply to the client with, for TempFail and Reject.
+	Message string
+
+	// Header lines to add to the message (post-data only).
+	Headers []string
+
+	// Recipients, in the aliases file format (alias-resolve only).
+	Aliases []string
+}
+
+func (r *Response) String() string {
+	if r.Message != "" {
+		return r.Action + " " + r.Message
+	}
+	return r.Action
+}
+
+type attr struct {
+	name, value string
+}
+
+func writeAttr(w io.Writer, name, value string) error {
+	if name == "" || strings.ContainsAny(name, "=\n") {
+		return fmt.Errorf("invalid attribute name %q", name)
+	}
+	if strings.Contains(value, "\n") {
+		return fmt.Errorf("invalid value for attribute %q", name)
+	}
+	_, err := fmt.Fprintf(w, "%s=%s\n", name, value)
+	return err
+}
+
+// readAttrs reads "name=value" lines until an empty line, and returns them
+// in order.
+func readAttrs(r *bufio.Reader) ([]attr, error) {
+	attrs := []attr{}
+	size := 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size += len(line)
+		if size > maxAttrsSize {
+			return nil, errors.New("attributes too big")
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return attrs, nil
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		attrs = append(attrs, attr{name, value})
+	}
+}
+
+func writeRequest(w *bufio.Writer, req *Request) error {
+	if err := writeAttr(w, "request", req.Type); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(req.Attrs))
+	for name := range req.Attrs {
+		if name == "request" || name == "size" {
+			return fmt.Errorf("reserved attribute %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := writeAttr(w, name, req.Attrs[name]); err != nil {
+			return err
+		}
+	}
+
+	if req.Data != nil {
+		writeAttr(w, "size", strconv.FormatInt(req.Size, 10))
+	}
+	w.WriteString("\n")
+
+	if req.Data != nil {
+		n, err := io.CopyN(w, req.Data, req.Size)
+		if err != nil {
+			return fmt.Errorf("error writing data (%d/%d bytes): %v",
+				n, req.Size, err)
+		}
+	}
+	return w.Flush()
+}
+
+func readRequest(r *bufio.Reader) (*Request, error) {
+	attrs, err := readAttrs(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) == 0 || attrs[0].name != "request" {
+		return nil, errors.New("missing request type")
+	}
+
+	req := &Request{
+		Type:  attrs[0].value,
+		Attrs: map[string]string{},
+	}
+	for _, a := range attrs[1:] {
+		if a.name == "size" {
+			req.Size, err = strconv.ParseInt(a.value, 10, 64)
+			if err != nil || req.Size < 0 {
+				return nil, fmt.Errorf("invalid size %q", a.value)
+			}
+			req.Data = io.LimitReader(r, req.Size)
+			continue
+		}
+		req.Attrs[a.name] = a.value
+	}
+	return req, nil
+}
+
+func writeResponse(w *bufio.Writer, resp *Response) error {
+	attrs := []attr{{"action", resp.Action}}
+	if resp.Message != "" {
+		attrs = append(attrs, attr{"message", resp.Message})
+	}
+	for _, h := range resp.Headers {
+		attrs = append(attrs, attr{"header", h})
+	}
+	for _, a := range resp.Aliases {
+		attrs = append(attrs, attr{"alias", a})
+	}
+
+	for _, a := range attrs {
+		if err := writeAttr(w, a.name, a.value); err != nil {
+			return err
+		}
+	}
+	w.WriteString("\n")
+	return w.Flush()
+}
+
+func readResponse(r *bufio.Reader) (*Response, error) {
+	attrs, err := readAttrs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Response{}
+	for _, a := range attrs {
+		switch a.name {
+		case "action":
+			resp.Action = a.value
+		case "message":
+			resp.Message = a.value
+		case "header":
+			resp.Headers = append(resp.Headers, a.value)
+		case "alias":
+			resp.Aliases = append(resp.Aliases, a.value)
+		}
+	}
+
+	switch resp.Action {
+	case Accept, TempFail, Reject:
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("invalid action %q", resp.Action)
+	}
+}
+
+// Client for a policy daemon. It keeps connections open, and reuses them
+// for later requests. It is safe for concurrent use; concurrent requests go
+// over different connections.
+type Client struct {
+	network string
+	address string
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewClient returns a client for the policy daemon at the given address,
+// of the form "unix:/path/to/socket" or "tcp:host:port". It does not
+// connect until the first request.
+func NewClient(addr string) (*Client, error) {
+	network, address, ok := strings.Cut(addr, ":")
+	if !ok || address == "" {
+		return nil, fmt.Errorf("invalid policy daemon address %q", addr)
+	}
+	switch network {
+	case "unix":
+	case "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid policy daemon address %q: %v",
+				addr, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid policy daemon address %q: "+
+			"unknown network %q", addr, network)
+	}
+	return &Client{network: network, address: address}, nil
+}
+
+func (c *Client) String() string {
+	return c.network + ":" + c.address
+}
+
+// Query sends the request to the daemon, and returns its response. The
+// timeout covers connecting, sending the request and reading the response.
+func (c *Client) Query(req *Request, timeout time.Duration) (*Response, error) {
+	deadline := time.Now().Add(timeout)
+	cn, reused, err := c.get(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cn.query(req, deadline)
+	if err != nil && reused && req.Data == nil {
+		// The daemon may have closed the connection while we were not
+		// looking, so try again with a new one. Requests with data can't be
+		// retried, as we may have consumed it already.
+		cn.Close()
+		cn, err = c.dial(deadline)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = cn.query(req, deadline)
+	}
+	if err != nil {
+		cn.Close()
+		return nil, err
+	}
+
+	c.put(cn)
+	return resp, nil
+}
+
+// Close the idle connections.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cn := range c.idle {
+		cn.Close()
+	}
+	c.idle = nil
+}
+
+// get returns a connection to use, reusing an idle one if possible.
+// Also returns if it was reused.
+func (c *Client) get(deadline time.Time) (*conn, bool, error) {
+	for {
+		c.mu.Lock()
+		if len(c.idle) == 0 {
+			c.mu.Unlock()
+			break
+		}
+		cn := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		c.mu.Unlock()
+
+		if cn.alive() {
+			return cn, true, nil
+		}
+		cn.Close()
+	}
+
+	cn, err := c.dial(deadline)
+	return cn, false, err
+}
+
+// put the connection back into the idle list, or close it if it's full.
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdle {
+		cn.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+func (c *Client) dial(deadline time.Time) (*conn, error) {
+	nc, err := net.DialTimeout(c.network, c.address, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		Conn: nc,
+		r:    bufio.NewReader(nc),
+		w:    bufio.NewWriter(nc),
+	}, nil
+}
+
+// alive checks if an idle connection can still be used. It can't if the
+// daemon closed it, or sent something unexpected.
+func (cn *conn) alive() bool {
+	cn.SetReadDeadline(time.Now())
+	_, err := cn.r.Peek(1)
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+func (cn *conn) query(req *Request, deadline time.Time) (*Response, error) {
+	cn.SetDeadline(deadline)
+	if err := writeRequest(cn.w, req); err != nil {
+		return nil, err
+	}
+	return readResponse(cn.r)
+}
+
+// Handler processes a request, and returns the response to send back.
+type Handler func(req *Request) *Response
+
+// Server is a simple policy daemon, which runs a Handler for each request.
+// It is the reference implementation of the daemon side of the protocol,
+// and is also useful for tests.
+type Server struct {
+	Handler Handler
+}
+
+// Serve connections from the listener, until it returns an error (e.g.
+// because it was closed).
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(nc)
+	}
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	w := bufio.NewWriter(nc)
+	for {
+		req, err := readRequest(r)
+		if err != nil {
+			return
+		}
+
+		resp := s.Handler(req)
+
+		// Skip the data the handler did not read, to get to the next
+		// request.
+		if req.Data != nil {
+			io.Copy(io.Discard, req.Data)
+		}
+
+		if err := writeResponse(w, resp); err != nil {
+			return
+		}
+	}
+}
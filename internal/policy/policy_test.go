@@ -0,0 +1,248 @@
+package policy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newServer(t *testing.T, h Handler) (*Client, net.Listener) {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &Server{Handler: h}
+	go s.Serve(l)
+
+	c, err := NewClient("tcp:" + l.Addr().String())
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c, l
+}
+
+func TestQuery(t *testing.T) {
+	c, _ := newServer(t, func(req *Request) *Response {
+		switch req.Type {
+		case "post-data":
+			data, _ := io.ReadAll(req.Data)
+			return &Response{
+				Action: Accept,
+				Headers: []string{
+					"X-From: " + req.Attrs["mail_from"],
+					"X-Data: " + string(data),
+				},
+			}
+		case "alias-resolve":
+			return &Response{
+				Action:  Accept,
+				Aliases: []string{"a@x, b@x", "| cmd"},
+			}
+		default:
+			return &Response{Action: Reject, Message: "5.7.1 No " + req.Type}
+		}
+	})
+
+	resp, err := c.Query(&Request{
+		Type:  "post-data",
+		Attrs: map[string]string{"mail_from": "from@x", "rcpt_to": "to@y"},
+		Data:  strings.NewReader("message data"),
+		Size:  int64(len("message data")),
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("post-data error: %v", err)
+	}
+	if resp.Action != Accept || len(resp.Headers) != 2 ||
+		resp.Headers[0] != "X-From: from@x" ||
+		resp.Headers[1] != "X-Data: message data" {
+		t.Errorf("unexpected post-data response: %#v", resp)
+	}
+
+	resp, err = c.Query(&Request{
+		Type:  "alias-resolve",
+		Attrs: map[string]string{"address": "a@x"},
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("alias-resolve error: %v", err)
+	}
+	if resp.Action != Accept || len(resp.Aliases) != 2 ||
+		resp.Aliases[0] != "a@x, b@x" || resp.Aliases[1] != "| cmd" {
+		t.Errorf("unexpected alias-resolve response: %#v", resp)
+	}
+
+	resp, err = c.Query(&Request{Type: "post-rcpt"}, time.Second)
+	if err != nil {
+		t.Fatalf("post-rcpt error: %v", err)
+	}
+	if resp.String() != "reject 5.7.1 No post-rcpt" {
+		t.Errorf("unexpected post-rcpt response: %v", resp)
+	}
+
+	// All the queries went over the same connection.
+	if len(c.idle) != 1 {
+		t.Errorf("expected 1 idle connection, got %d", len(c.idle))
+	}
+}
+
+func TestUnreadData(t *testing.T) {
+	// The handler does not read the data, the server must skip it.
+	c, _ := newServer(t, func(req *Request) *Response {
+		return &Response{Action: Accept, Message: req.Attrs["n"]}
+	})
+
+	for _, n := range []string{"1", "2", "3"} {
+		resp, err := c.Query(&Request{
+			Type:  "post-data",
+			Attrs: map[string]string{"n": n},
+			Data:  strings.NewReader("data\n\nmore data\n"),
+			Size:  16,
+		}, time.Second)
+		if err != nil {
+			t.Fatalf("%s: error: %v", n, err)
+		}
+		if resp.Message != n {
+			t.Errorf("%s: unexpected response: %v", n, resp)
+		}
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	c, _ := newServer(t, func(req *Request) *Response {
+		time.Sleep(10 * time.Millisecond)
+		return &Response{Action: Accept, Message: req.Attrs["n"]}
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		n := strings.Repeat("x", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := c.Query(&Request{
+				Type:  "post-rcpt",
+				Attrs: map[string]string{"n": n},
+			}, time.Second)
+			if err != nil || resp.Message != n {
+				t.Errorf("%q: got %v, %v", n, resp, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(c.idle) > maxIdle {
+		t.Errorf("too many idle connections: %d", len(c.idle))
+	}
+}
+
+func TestClosedByDaemon(t *testing.T) {
+	// A daemon that closes the connection after each response.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(nc)
+			w := bufio.NewWriter(nc)
+			if _, err := readRequest(r); err == nil {
+				writeResponse(w, &Response{Action: Accept})
+			}
+			nc.Close()
+		}
+	}()
+
+	c, _ := NewClient("tcp:" + l.Addr().String())
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		_, err := c.Query(&Request{Type: "post-mail"}, time.Second)
+		if err != nil {
+			t.Errorf("%d: error: %v", i, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, addr := range []string{
+		"", "unix", "unix:", "tcp:host", "udp:host:25", "/path"} {
+		if _, err := NewClient(addr); err == nil {
+			t.Errorf("%q: expected error, got nil", addr)
+		}
+	}
+
+	c, _ := newServer(t, func(req *Request) *Response {
+		return &Response{Action: req.Attrs["action"]}
+	})
+
+	cases := []*Request{
+		{Type: "post-rcpt", Attrs: map[string]string{"action": "dunno"}},
+		{Type: "post-rcpt", Attrs: map[string]string{"a": "b\nc"}},
+		{Type: "post-rcpt", Attrs: map[string]string{"a=b": "c"}},
+		{Type: "post-rcpt", Attrs: map[string]string{"size": "1"}},
+		{Type: "post-data", Data: strings.NewReader("short"), Size: 10},
+	}
+	for _, req := range cases {
+		if resp, err := c.Query(req, time.Second); err == nil {
+			t.Errorf("%v: expected error, got %v", req, resp)
+		}
+	}
+
+	// The client still works after the errors.
+	req := &Request{
+		Type: "post-rcpt", Attrs: map[string]string{"action": TempFail}}
+	if resp, err := c.Query(req, time.Second); err != nil ||
+		resp.Action != TempFail {
+		t.Errorf("unexpected response: %v, %v", resp, err)
+	}
+
+	// Nobody listening.
+	c, _ = NewClient("unix:/does/not/exist")
+	if resp, err := c.Query(req, time.Second); err == nil {
+		t.Errorf("expected error, got %v", resp)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	c, _ := newServer(t, func(req *Request) *Response {
+		time.Sleep(200 * time.Millisecond)
+		return &Response{Action: Accept}
+	})
+
+	_, err := c.Query(&Request{Type: "post-rcpt"}, 50*time.Millisecond)
+	if err == nil {
+		t.Errorf("expected timeout, got nil")
+	}
+}
+
+func TestReadAttrs(t *testing.T) {
+	cases := []struct {
+		in  string
+		ok  bool
+		num int
+	}{
+		{"\n", true, 0},
+		{"a=b\nc=\n\n", true, 2},
+		{"a=b=c\n\n", true, 1},
+		{"a=b\n", false, 0},
+		{"ab\n\n", false, 0},
+		{strings.Repeat("a=b\n", maxAttrsSize/4+1) + "\n", false, 0},
+	}
+	for _, c := range cases {
+		attrs, err := readAttrs(bufio.NewReader(strings.NewReader(c.in)))
+		if c.ok != (err == nil) || len(attrs) != c.num {
+			t.Errorf("%.20q: got %v, %v", c.in, attrs, err)
+		}
+	}
+}
@@ -93,6 +93,15 @@ func (s *Store) Get(id string, m proto.Message) (bool, error) {
 	return err == nil, err
 }
 
+// Delete a message from the store. It is not an error if it does not exist.
+func (s *Store) Delete(id string) error {
+	err := os.Remove(s.idToFname(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 // ListIDs in the store.
 func (s *Store) ListIDs() ([]string, error) {
 	ids := []string{}
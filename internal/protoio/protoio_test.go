@@ -83,6 +83,18 @@ func TestStore(t *testing.T) {
 	if ids, err := st.ListIDs(); len(ids) != 1 || ids[0] != "f" || err != nil {
 		t.Errorf("expected [f], got %v - %v", ids, err)
 	}
+
+	if err := st.Delete("f"); err != nil {
+		t.Errorf("Delete(f): %v", err)
+	}
+	if ok, err := st.Get("f", pb2); err != nil || ok {
+		t.Errorf("Get(f) after delete: %v - %v", ok, err)
+	}
+
+	// Deleting something that does not exist is not an error.
+	if err := st.Delete("notexists"); err != nil {
+		t.Errorf("Delete(notexists): %v", err)
+	}
 }
 
 func mustCreate(t *testing.T, fname string) {
@@ -2,6 +2,7 @@ package queue
 
 import (
 	"bytes"
+	"fmt"
 	"net/mail"
 	"strings"
 	"text/template"
@@ -16,11 +17,16 @@ const maxOrigMsgLen = 256 * 1024
 
 // deliveryStatusNotification creates a delivery status notification (DSN) for
 // the given item, and puts it in the queue.
+// If delayed is true, the notification is for the recipients whose delivery
+// is being delayed; otherwise it's the final one, for the failed recipients
+// and the successful ones that requested it.
+// If there is nothing to report, it returns nil.
 //
 // References:
+// - https://tools.ietf.org/html/rfc3461 (SMTP DSN extension)
 // - https://tools.ietf.org/html/rfc3464 (DSN)
 // - https://tools.ietf.org/html/rfc6533 (Internationalized DSN)
-func deliveryStatusNotification(domainFrom string, item *Item) ([]byte, error) {
+func deliveryStatusNotification(domainFrom string, item *Item, delayed bool) ([]byte, error) {
 	info := dsnInfo{
 		OurDomain:   domainFrom,
 		Destination: item.From,
@@ -29,10 +35,35 @@ func deliveryStatusNotification(domainFrom string, item *Item) ([]byte, error) {
 		To:          item.To,
 		Recipients:  item.Rcpt,
 		FailedTo:    map[string]string{},
+		DelayedTo:   map[string]string{},
+		DeliveredTo: map[string]string{},
+		EnvID:       item.DsnEnvid,
+		RetryUntil:  item.CreatedAt.Add(giveUpAfter).Format(time.RFC1123Z),
 	}
 
 	for _, rcpt := range item.Rcpt {
-		if rcpt.Status != Recipient_SENT {
+		switch {
+		case delayed:
+			if rcpt.Status == Recipient_PENDING && rcpt.notifies("DELAY") {
+				info.DelayedTo[rcpt.OriginalAddress] = rcpt.OriginalAddress
+				info.DelayedRecipients = append(info.DelayedRecipients, rcpt)
+			}
+		case rcpt.Status == Recipient_SENT:
+			if !rcpt.notifies("SUCCESS") {
+				continue
+			}
+			switch rcpt.Delivery {
+			case Recipient_DELIVERED:
+				info.DeliveredRecipients = append(info.DeliveredRecipients, rcpt)
+			case Recipient_RELAYED:
+				info.RelayedRecipients = append(info.RelayedRecipients, rcpt)
+			default:
+				// The DSN parameters were relayed, so the next hop is
+				// responsible for notifying the sender.
+				continue
+			}
+			info.DeliveredTo[rcpt.OriginalAddress] = rcpt.OriginalAddress
+		case rcpt.notifies("FAILURE"):
 			info.FailedTo[rcpt.OriginalAddress] = rcpt.OriginalAddress
 			switch rcpt.Status {
 			case Recipient_FAILED:
@@ -43,21 +74,98 @@ func deliveryStatusNotification(domainFrom string, item *Item) ([]byte, error) {
 		}
 	}
 
-	if len(item.Data) > maxOrigMsgLen {
-		info.OriginalMessage = string(item.Data[:maxOrigMsgLen])
+	switch {
+	case len(info.FailedTo) > 0:
+		info.Subject = "Mail delivery failed: returning message to sender"
+		info.OriginalDescription = "Undelivered Message"
+	case len(info.DelayedTo) > 0:
+		info.Subject = "Mail delivery delayed: still trying to deliver"
+		info.OriginalDescription = "Delayed Message"
+	case len(info.DeliveredTo) > 0:
+		info.Subject = "Mail delivery succeeded"
+		info.OriginalDescription = "Delivered Message"
+	default:
+		// Nothing to report.
+		return nil, nil
+	}
+
+	// We never include more than maxOrigMsgLen bytes of the original
+	// message, so there's no need to read more than that.
+	orig, err := item.readData(maxOrigMsgLen)
+	if err != nil {
+		return nil, fmt.Errorf("error reading message data: %v", err)
+	}
+	msgID := getMessageID(orig)
+
+	// By default, we only return the full message on failures.
+	// https://tools.ietf.org/html/rfc3461#section-4.3
+	// Binary MIME bodies can't be included in the notification (which is
+	// plain text), so for those we always return only the headers.
+	full := item.DsnRet == "FULL" ||
+		(item.DsnRet == "" && len(info.FailedTo) > 0)
+	full = full && !item.BinaryMime
+	if full {
+		info.OriginalContentType = "message/rfc822"
+	} else {
+		info.OriginalContentType = "text/rfc822-headers"
+		info.OriginalDescription += " Headers"
+		orig = headersOf(orig)
+	}
+
+	if len(orig) > maxOrigMsgLen {
+		info.OriginalMessage = string(orig[:maxOrigMsgLen])
 	} else {
-		info.OriginalMessage = string(item.Data)
+		info.OriginalMessage = string(orig)
 	}
 
-	info.OriginalMessageID = getMessageID(item.Data)
+	info.OriginalMessageID = msgID
 
 	info.Boundary = <-newID
 
 	buf := &bytes.Buffer{}
-	err := dsnTemplate.Execute(buf, info)
+	err = dsnTemplate.Execute(buf, info)
 	return buf.Bytes(), err
 }
 
+// notifies returns true if the recipient wants notifications of the given
+// type ("SUCCESS", "FAILURE" or "DELAY").
+func (r *Recipient) notifies(what string) bool {
+	if len(r.DsnNotify) == 0 {
+		// By default we notify failures; delays are up to us, and we notify
+		// them too.
+		// https://tools.ietf.org/html/rfc3461#section-4.1
+		return what == "FAILURE" || what == "DELAY"
+	}
+
+	for _, n := range r.DsnNotify {
+		if n == what {
+			return true
+		}
+	}
+	return false
+}
+
+// originalRecipient returns the value for the Original-Recipient field of the
+// recipient: the ORCPT parameter if given, or the original address otherwise.
+func originalRecipient(r *Recipient) string {
+	if r.DsnOrcpt != "" {
+		return r.DsnOrcpt
+	}
+	return "utf-8; " + r.OriginalAddress
+}
+
+// headersOf returns the headers of the message, including the empty line that
+// separates them from the body.
+func headersOf(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte("\n")) {
+		return data[:1]
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		return data[:i+2]
+	}
+	return data
+}
+
 func getMessageID(data []byte) string {
 	msg, err := mail.ReadMessage(bytes.NewBuffer(data))
 	if err != nil {
@@ -67,16 +175,37 @@ func getMessageID(data []byte) string {
 }
 
 type dsnInfo struct {
-	OurDomain         string
-	Destination       string
-	MessageID         string
-	Date              string
-	To                []string
-	FailedTo          map[string]string
-	Recipients        []*Recipient
-	FailedRecipients  []*Recipient
-	PendingRecipients []*Recipient
-	OriginalMessage   string
+	OurDomain   string
+	Destination string
+	MessageID   string
+	Date        string
+	Subject     string
+	To          []string
+
+	// Original addresses, for the text part.
+	FailedTo    map[string]string
+	DelayedTo   map[string]string
+	DeliveredTo map[string]string
+
+	// Recipients to report, by action.
+	Recipients          []*Recipient
+	FailedRecipients    []*Recipient
+	PendingRecipients   []*Recipient
+	DelayedRecipients   []*Recipient
+	DeliveredRecipients []*Recipient
+	RelayedRecipients   []*Recipient
+
+	// Envelope ID given by the sender (ENVID), if any.
+	EnvID string
+
+	// Until when we will keep retrying the delivery.
+	RetryUntil string
+
+	// Original message (or its headers), with its content type and
+	// description.
+	OriginalMessage     string
+	OriginalContentType string
+	OriginalDescription string
 
 	// Message-ID of the original message.
 	OriginalMessageID string
@@ -94,17 +223,20 @@ func indent(sp int, s string) string {
 var dsnTemplate = template.Must(
 	template.New("dsn").Funcs(
 		template.FuncMap{
-			"indent": indent,
-			"trim":   strings.TrimSpace,
+			"indent":   indent,
+			"trim":     strings.TrimSpace,
+			"origRcpt": originalRecipient,
 		}).Parse(
 		`From: Mail Delivery System <postmaster-dsn@{{.OurDomain}}>
 To: <{{.Destination}}>
-Subject: Mail delivery failed: returning message to sender
+Subject: {{.Subject}}
 Message-ID: <{{.MessageID}}>
 Date: {{.Date}}
 In-Reply-To: {{.OriginalMessageID}}
 References: {{.OriginalMessageID}}
+{{- if .FailedTo}}
 X-Failed-Recipients: {{range .FailedTo}}{{.}}, {{end}}
+{{- end}}
 Auto-Submitted: auto-replied
 MIME-Version: 1.0
 Content-Type: multipart/report; report-type=delivery-status;
@@ -117,11 +249,30 @@ Content-Disposition: inline
 Content-Description: Notification
 Content-Transfer-Encoding: 8bit
 
+{{if .FailedTo -}}
 Delivery of your message to the following recipient(s) failed permanently:
 
 {{range .FailedTo}}  - {{.}}
 {{end}}
 
+{{end -}}
+{{if .DelayedTo -}}
+Delivery of your message to the following recipient(s) has been delayed:
+
+{{range .DelayedTo}}  - {{.}}
+{{end}}
+Delivery will be retried until {{.RetryUntil}}, no action is needed on
+your part.
+
+
+{{end -}}
+{{if .DeliveredTo -}}
+Your message was successfully delivered to the following recipient(s):
+
+{{range .DeliveredTo}}  - {{.}}
+{{end}}
+
+{{end -}}
 Technical details:
 {{- range .FailedRecipients}}
 - "{{.Address}}" ({{.Type}}) failed permanently with error:
@@ -131,6 +282,17 @@ Technical details:
 - "{{.Address}}" ({{.Type}}) failed repeatedly and timed out, last error:
     {{.LastFailureMessage | trim | indent 4}}
 {{- end}}
+{{- range .DelayedRecipients}}
+- "{{.Address}}" ({{.Type}}) is being retried, last error:
+    {{.LastFailureMessage | trim | indent 4}}
+{{- end}}
+{{- range .DeliveredRecipients}}
+- "{{.Address}}" ({{.Type}}) was delivered successfully.
+{{- end}}
+{{- range .RelayedRecipients}}
+- "{{.Address}}" ({{.Type}}) was relayed successfully to a server that does
+  not support delivery notifications, so no further ones will be sent.
+{{- end}}
 
 
 --{{.Boundary}}
@@ -139,9 +301,12 @@ Content-Description: Delivery Report
 Content-Transfer-Encoding: 8bit
 
 Reporting-MTA: dns; {{.OurDomain}}
+{{- if .EnvID}}
+Original-Envelope-Id: {{.EnvID}}
+{{- end}}
 
 {{range .FailedRecipients -}}
-Original-Recipient: utf-8; {{.OriginalAddress}}
+Original-Recipient: {{origRcpt .}}
 Final-Recipient: utf-8; {{.Address}}
 Action: failed
 Status: 5.0.0
@@ -149,17 +314,40 @@ Diagnostic-Code: smtp; {{.LastFailureMessage | trim | indent 4}}
 
 {{end -}}
 {{range .PendingRecipients -}}
-Original-Recipient: utf-8; {{.OriginalAddress}}
+Original-Recipient: {{origRcpt .}}
 Final-Recipient: utf-8; {{.Address}}
 Action: failed
 Status: 4.0.0
 Diagnostic-Code: smtp; {{.LastFailureMessage | trim | indent 4}}
 
+{{end -}}
+{{range .DelayedRecipients -}}
+Original-Recipient: {{origRcpt .}}
+Final-Recipient: utf-8; {{.Address}}
+Action: delayed
+Status: 4.0.0
+Diagnostic-Code: smtp; {{.LastFailureMessage | trim | indent 4}}
+Will-Retry-Until: {{$.RetryUntil}}
+
+{{end -}}
+{{range .DeliveredRecipients -}}
+Original-Recipient: {{origRcpt .}}
+Final-Recipient: utf-8; {{.Address}}
+Action: delivered
+Status: 2.0.0
+
+{{end -}}
+{{range .RelayedRecipients -}}
+Original-Recipient: {{origRcpt .}}
+Final-Recipient: utf-8; {{.Address}}
+Action: relayed
+Status: 2.0.0
+
 {{end}}
 
 --{{.Boundary}}
-Content-Type: message/rfc822
-Content-Description: Undelivered Message
+Content-Type: {{.OriginalContentType}}
+Content-Description: {{.OriginalDescription}}
 Content-Transfer-Encoding: 8bit
 
 {{.OriginalMessage}}
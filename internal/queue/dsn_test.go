@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 const multilineErr = `550 5.7.1 [11:22:33:44::1] Our system has detected that this
@@ -38,7 +39,7 @@ func TestDSN(t *testing.T) {
 		},
 	}
 
-	msg, err := deliveryStatusNotification("dsnDomain", item)
+	msg, err := deliveryStatusNotification("dsnDomain", item, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -133,6 +134,166 @@ Data ñaca.
 --???????????--
 `
 
+func TestSuccessDSN(t *testing.T) {
+	delivered := mkR("poe@rcpt", Recipient_EMAIL, Recipient_SENT, "", "ñaca@africa.org")
+	delivered.DsnNotify = []string{"SUCCESS"}
+	delivered.DsnOrcpt = "rfc822;orig@africa.org"
+	delivered.Delivery = Recipient_DELIVERED
+
+	relayed := mkR("newman@rcpt", Recipient_EMAIL, Recipient_SENT, "", "negra@sosa.org")
+	relayed.DsnNotify = []string{"SUCCESS", "FAILURE"}
+	relayed.Delivery = Recipient_RELAYED
+
+	// The next hop is responsible for these notifications.
+	relayedDSN := mkR("ant@rcpt", Recipient_EMAIL, Recipient_SENT, "", "negra@sosa.org")
+	relayedDSN.DsnNotify = []string{"SUCCESS"}
+	relayedDSN.Delivery = Recipient_RELAYED_DSN
+
+	// Failed, but the sender does not want to know.
+	never := mkR("muchos@rcpt", Recipient_EMAIL, Recipient_FAILED, "err", "pepe@africa.org")
+	never.DsnNotify = []string{"NEVER"}
+
+	item := &Item{
+		Message: Message{
+			ID:       <-newID,
+			From:     "from@from.org",
+			To:       []string{"ñaca@africa.org", "negra@sosa.org"},
+			Rcpt:     []*Recipient{delivered, relayed, relayedDSN, never},
+			Data:     []byte(data),
+			DsnEnvid: "envid-123",
+		},
+	}
+
+	msg, err := deliveryStatusNotification("dsnDomain", item, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"Subject: Mail delivery succeeded\n",
+		"Your message was successfully delivered to the following " +
+			"recipient(s):\n\n  - negra@sosa.org\n  - ñaca@africa.org\n",
+		"\"poe@rcpt\" (EMAIL) was delivered successfully.",
+		"\"newman@rcpt\" (EMAIL) was relayed successfully",
+		"Reporting-MTA: dns; dsnDomain\nOriginal-Envelope-Id: envid-123\n",
+		"Original-Recipient: rfc822;orig@africa.org\n" +
+			"Final-Recipient: utf-8; poe@rcpt\n" +
+			"Action: delivered\nStatus: 2.0.0\n",
+		"Original-Recipient: utf-8; negra@sosa.org\n" +
+			"Final-Recipient: utf-8; newman@rcpt\n" +
+			"Action: relayed\nStatus: 2.0.0\n",
+
+		// By default, only the headers are returned on success.
+		"Content-Type: text/rfc822-headers\n" +
+			"Content-Description: Delivered Message Headers\n" +
+			"Content-Transfer-Encoding: 8bit\n\n" +
+			"Message-ID: <msgid-123@zaraza>\n\n\n\n--",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(msg), e) {
+			t.Errorf("DSN does not contain %q", e)
+		}
+	}
+
+	unexpected := []string{"X-Failed-Recipients", "ant@rcpt", "muchos@rcpt",
+		"Data ñaca"}
+	for _, u := range unexpected {
+		if strings.Contains(string(msg), u) {
+			t.Errorf("DSN contains %q", u)
+		}
+	}
+	if t.Failed() {
+		t.Log(string(msg))
+	}
+
+	// If the sender asks for the full message, we include it.
+	item.DsnRet = "FULL"
+	msg, _ = deliveryStatusNotification("dsnDomain", item, false)
+	if !strings.Contains(string(msg),
+		"Content-Type: message/rfc822\n"+
+			"Content-Description: Delivered Message\n") ||
+		!strings.Contains(string(msg), "Data ñaca") {
+		t.Errorf("DSN does not contain the full message:\n%s", msg)
+	}
+}
+
+func TestDelayedDSN(t *testing.T) {
+	delayed := mkR("poe@rcpt", Recipient_EMAIL, Recipient_PENDING,
+		"oh! horror!", "ñaca@africa.org")
+	noDelay := mkR("newman@rcpt", Recipient_EMAIL, Recipient_PENDING,
+		"oh! the humanity!", "negra@sosa.org")
+	noDelay.DsnNotify = []string{"FAILURE"}
+
+	item := &Item{
+		Message: Message{
+			ID:   <-newID,
+			From: "from@from.org",
+			To:   []string{"ñaca@africa.org", "negra@sosa.org"},
+			Rcpt: []*Recipient{
+				delayed, noDelay,
+				mkR("ant@rcpt", Recipient_EMAIL, Recipient_SENT,
+					"", "negra@sosa.org"),
+			},
+			Data:   []byte(data),
+			DsnRet: "HDRS",
+		},
+		CreatedAt: time.Now(),
+	}
+
+	msg, err := deliveryStatusNotification("dsnDomain", item, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"Subject: Mail delivery delayed: still trying to deliver\n",
+		"has been delayed:\n\n  - ñaca@africa.org\n\n" +
+			"Delivery will be retried until ",
+		"\"poe@rcpt\" (EMAIL) is being retried, last error:\n" +
+			"    oh! horror!\n",
+		"Original-Recipient: utf-8; ñaca@africa.org\n" +
+			"Final-Recipient: utf-8; poe@rcpt\n" +
+			"Action: delayed\nStatus: 4.0.0\n" +
+			"Diagnostic-Code: smtp; oh! horror!\n" +
+			"Will-Retry-Until: ",
+		"Content-Type: text/rfc822-headers\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(msg), e) {
+			t.Errorf("DSN does not contain %q", e)
+		}
+	}
+	for _, u := range []string{"newman@rcpt", "ant@rcpt", "Data ñaca"} {
+		if strings.Contains(string(msg), u) {
+			t.Errorf("DSN contains %q", u)
+		}
+	}
+	if t.Failed() {
+		t.Log(string(msg))
+	}
+
+	// If nobody wants to know about the delay, there's nothing to report.
+	delayed.DsnNotify = []string{"NEVER"}
+	msg, err = deliveryStatusNotification("dsnDomain", item, true)
+	if msg != nil || err != nil {
+		t.Errorf("expected no DSN, got %v / %q", err, msg)
+	}
+}
+
+func TestHeadersOf(t *testing.T) {
+	cases := []struct{ data, headers string }{
+		{"A: b\nC: d\n\nbody\n\nmore\n", "A: b\nC: d\n\n"},
+		{"A: b\n", "A: b\n"},
+		{"\nbody", "\n"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if h := string(headersOf([]byte(c.data))); h != c.headers {
+			t.Errorf("headersOf(%q) = %q, expected %q", c.data, h, c.headers)
+		}
+	}
+}
+
 // flexibleEq compares two strings, supporting wildcards.
 // Not particularly nice or robust, only useful for testing.
 func flexibleEq(expected, got string) bool {
@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -20,11 +21,14 @@ import (
 
 	"blitiri.com.ar/go/chasquid/internal/aliases"
 	"blitiri.com.ar/go/chasquid/internal/courier"
+	"blitiri.com.ar/go/chasquid/internal/dkim"
 	"blitiri.com.ar/go/chasquid/internal/envelope"
 	"blitiri.com.ar/go/chasquid/internal/expvarom"
 	"blitiri.com.ar/go/chasquid/internal/maillog"
 	"blitiri.com.ar/go/chasquid/internal/protoio"
+	"blitiri.com.ar/go/chasquid/internal/safeio"
 	"blitiri.com.ar/go/chasquid/internal/set"
+	"blitiri.com.ar/go/chasquid/internal/smtp"
 	"blitiri.com.ar/go/chasquid/internal/trace"
 	"blitiri.com.ar/go/log"
 
@@ -32,18 +36,30 @@ import (
 )
 
 const (
-	// Maximum size of the queue; we reject emails when we hit this.
-	maxQueueSize = 200
+	// Default for the maximum size of the queue, in bytes of message data;
+	// we reject emails when we hit this. See SetMaxSize.
+	defaultMaxSize = 1024 * 1024 * 1024
 
 	// Give up sending attempts after this duration.
 	giveUpAfter = 20 * time.Hour
 
+	// Default for how long to wait before notifying the sender that the
+	// delivery is being delayed. See SetDelayNotifyAfter.
+	defaultDelayNotifyAfter = 4 * time.Hour
+
 	// Prefix for item file names.
 	// This is for convenience, versioning, and to be able to tell them apart
 	// temporary files and other cruft.
 	// It's important that it's outside the base64 space so it doesn't get
 	// generated accidentally.
 	itemFilePrefix = "m:"
+
+	// Prefix for the file names of the message data of each item.
+	dataFilePrefix = "d:"
+
+	// Subdirectory for spooling the data of incoming messages, before they
+	// are put in the queue.
+	spoolDir = "spool"
 )
 
 var (
@@ -60,6 +76,8 @@ var (
 		"count of DSNs that we generated (queued)")
 	deliverAttempts = expvarom.NewMap("chasquid/queue/deliverAttempts",
 		"recipient_type", "attempts to deliver mail, by recipient type")
+	arcSealed = expvarom.NewMap("chasquid/queue/arcSealed",
+		"result", "count of forwarded messages ARC-sealed, by result")
 )
 
 // Channel used to get random IDs for items in the queue.
@@ -91,9 +109,17 @@ type Queue struct {
 	// Items in the queue. Map of id -> Item.
 	q map[string]*Item
 
-	// Mutex protecting q.
+	// Total size of the message data of the items in q, in bytes.
+	size int64
+
+	// Mutex protecting q and size, and the settings that can be changed
+	// while the queue is running (maxSize, hostname, dkimSigners and
+	// delayNotifyAfter).
 	mu sync.RWMutex
 
+	// Maximum total size of the message data in the queue, in bytes.
+	maxSize int64
+
 	// Couriers to use to deliver mail.
 	localC  courier.Courier
 	remoteC courier.Courier
@@ -106,13 +132,28 @@ type Queue struct {
 
 	// Aliases resolver.
 	aliases *aliases.Resolver
+
+	// Our hostname, and the DKIM signers for each domain, used to ARC-seal
+	// forwarded messages. See EnableARCSealing.
+	hostname    string
+	dkimSigners map[string]*dkim.Signer
+
+	// How long to wait before notifying the sender that the delivery is
+	// being delayed. 0 means never.
+	delayNotifyAfter time.Duration
+
+	// Closed (with mu held) when the queue is shutting down, see Shutdown.
+	stopping chan struct{}
+
+	// Running send loops.
+	loops sync.WaitGroup
 }
 
 // New creates a new Queue instance.
 func New(path string, localDomains *set.String, aliases *aliases.Resolver,
 	localC, remoteC courier.Courier) (*Queue, error) {
 
-	err := os.MkdirAll(path, 0700)
+	err := os.MkdirAll(filepath.Join(path, spoolDir), 0700)
 	q := &Queue{
 		q:            map[string]*Item{},
 		localC:       localC,
@@ -120,12 +161,65 @@ func New(path string, localDomains *set.String, aliases *aliases.Resolver,
 		localDomains: localDomains,
 		path:         path,
 		aliases:      aliases,
+
+		delayNotifyAfter: defaultDelayNotifyAfter,
+		maxSize:          defaultMaxSize,
+		stopping:         make(chan struct{}),
 	}
 	return q, err
 }
 
+// EnableARCSealing makes the queue add an ARC set to the messages it
+// forwards from non-local senders to remote recipients (via aliases), using
+// the DKIM signer of the alias' domain.
+// The hostname is the authserv-id of our Authentication-Results headers, used
+// for messages without results of our own (see Message.auth_results).
+// The signers map is not copied, so it must not be modified afterwards; to
+// change the signers, call this again with a new map.
+func (q *Queue) EnableARCSealing(hostname string, signers map[string]*dkim.Signer) {
+	q.mu.Lock()
+	q.hostname = hostname
+	q.dkimSigners = signers
+	q.mu.Unlock()
+}
+
+// SetDelayNotifyAfter sets how long a message can be in the queue before we
+// notify the sender that the delivery is being delayed (if the recipients
+// requested it). 0 disables these notifications.
+func (q *Queue) SetDelayNotifyAfter(d time.Duration) {
+	q.mu.Lock()
+	q.delayNotifyAfter = d
+	q.mu.Unlock()
+}
+
+// SetMaxSize sets the maximum total size of the message data in the queue,
+// in bytes. Messages that would go over it are rejected with a temporary
+// error.
+func (q *Queue) SetMaxSize(size int64) {
+	q.mu.Lock()
+	q.maxSize = size
+	q.mu.Unlock()
+}
+
+// SpoolDir returns the directory where incoming message data can be
+// spooled, before being put in the queue. It is in the same filesystem as the
+// queue, and its contents are removed by Load.
+func (q *Queue) SpoolDir() string {
+	return filepath.Join(q.path, spoolDir)
+}
+
 // Load the queue and launch the sending loops on startup.
 func (q *Queue) Load() error {
+	// Anything in the spool directory is from incoming messages that were
+	// not fully received before a restart.
+	spooled, err := filepath.Glob(filepath.Join(q.SpoolDir(), "*"))
+	if err != nil {
+		return err
+	}
+	for _, fname := range spooled {
+		os.Remove(fname)
+	}
+
 	files, err := filepath.Glob(q.path + "/" + itemFilePrefix + "*")
 	if err != nil {
 		return err
@@ -138,16 +232,53 @@ func (q *Queue) Load() error {
 			continue
 		}
 
+		if item.DataFile == "" {
+			// Older versions kept the data in the item itself, which has
+			// to be rewritten every time the status of a recipient changes.
+			// Move it to its own file.
+			if err := item.migrateData(); err != nil {
+				log.Errorf("error migrating queue item %q: %v", fname, err)
+			}
+		}
+
+		if err := item.loadSize(); err != nil {
+			log.Errorf("error loading queue item from %q: %v", fname, err)
+			continue
+		}
+
 		q.mu.Lock()
 		q.q[item.ID] = item
+		q.size += item.size
 		q.mu.Unlock()
 
-		go item.SendLoop(q)
+		q.startLoop(item)
 	}
 
+	q.removeOrphanData()
 	return nil
 }
 
+// removeOrphanData removes the data files that don't belong to any item.
+// They can be left behind if we stop after writing the data of an item, but
+// before writing the item itself.
+func (q *Queue) removeOrphanData() {
+	files, err := filepath.Glob(q.path + "/" + dataFilePrefix + "*")
+	if err != nil {
+		log.Errorf("error listing queue data files: %v", err)
+		return
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for _, fname := range files {
+		id := strings.TrimPrefix(filepath.Base(fname), dataFilePrefix)
+		if _, ok := q.q[id]; !ok {
+			log.Infof("removing orphan queue data file %q", fname)
+			os.Remove(fname)
+		}
+	}
+}
+
 // Len returns the number of elements in the queue.
 func (q *Queue) Len() int {
 	q.mu.RLock()
@@ -155,60 +286,222 @@ func (q *Queue) Len() int {
 	return len(q.q)
 }
 
+// Size returns the total size of the message data in the queue, in bytes.
+func (q *Queue) Size() int64 {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.size
+}
+
 // Put an envelope in the queue.
 func (q *Queue) Put(tr *trace.Trace, from string, to []string, data []byte) (string, error) {
+	return q.PutWithDSN(tr, from, to, nil, false, "", bytes.NewReader(data))
+}
+
+// PutWithDSN puts an envelope in the queue, along with the delivery status
+// notification parameters for its recipients, indexed by address (as given in
+// to). The map can be nil, and not all recipients need to be in it.
+// The MAIL parameters (Ret and EnvID) are per envelope, so they are expected
+// to be the same for all the recipients.
+// If binaryMIME is true, the message was sent with BODY=BINARYMIME, and its
+// body has to be relayed as-is.
+// authRes is the value of the Authentication-Results header the caller added
+// to the message, if any (see Message.auth_results).
+// The data is read until EOF, and written to disk without keeping it in
+// memory; if it implements Spooled, the body is not even copied.
+func (q *Queue) PutWithDSN(tr *trace.Trace, from string, to []string, dsn map[string]*smtp.DSN, binaryMIME bool, authRes string, data io.Reader) (string, error) {
 	tr = tr.NewChild("Queue.Put", from)
 	defer tr.Finish()
 
-	if q.Len() >= maxQueueSize {
+	if q.isFull() {
 		tr.Errorf("queue full")
 		return "", errQueueFull
 	}
 	putCount.Add(1)
 
+	item := q.newItem(from, dsn, binaryMIME, authRes)
+	for _, t := range to {
+		if err := q.addRcpt(tr, item, t, dsn[t]); err != nil {
+			return "", err
+		}
+	}
+
+	err := q.add(tr, item, func() error { return item.writeData(data) })
+	if err != nil {
+		return "", err
+	}
+	return item.ID, nil
+}
+
+// Spooled is implemented by readers of message data whose body is already on
+// disk, in a file within the spool directory (see SpoolDir). The queue links
+// that file into the queue directory, instead of copying the data.
+type Spooled interface {
+	io.Reader
+
+	// Spooled returns the message header, the name of the file with the
+	// body, and the offset within the file where the body begins. The file
+	// must not be modified once the message is in the queue.
+	Spooled() (header []byte, fname string, offset int64)
+}
+
+// PutPerRcpt is like PutWithDSN, but each recipient is put in the queue on
+// its own, so a failure of one of them (for example, if its aliases can't be
+// resolved, or the queue gets full) does not prevent the others from being
+// queued. The data is written only once, and shared between them.
+// It returns the IDs of the recipients that were queued, and the errors of
+// the ones that were not, both indexed by address (as given in to).
+func (q *Queue) PutPerRcpt(tr *trace.Trace, from string, to []string, dsn map[string]*smtp.DSN, binaryMIME bool, authRes string, data io.Reader) (map[string]string, map[string]error) {
+	tr = tr.NewChild("Queue.PutPerRcpt", from)
+	defer tr.Finish()
+
+	ids := map[string]string{}
+	errs := map[string]error{}
+	failAll := func(err error) (map[string]string, map[string]error) {
+		for _, t := range to {
+			errs[t] = err
+		}
+		return ids, errs
+	}
+
+	if q.isFull() {
+		tr.Errorf("queue full")
+		return failAll(errQueueFull)
+	}
+
+	// Write the data to a file of its own, from which the items take it
+	// (see shareData). It is removed once they are all queued.
+	shared := q.newItem(from, dsn, binaryMIME, authRes)
+	err := shared.writeData(data)
+	if err == nil {
+		err = shared.loadSize()
+	}
+	defer shared.removeData()
+	if err != nil {
+		return failAll(tr.Errorf("failed to write data: %v", err))
+	}
+
+	for _, t := range to {
+		putCount.Add(1)
+		item := q.newItem(from, dsn, binaryMIME, authRes)
+		err := q.addRcpt(tr, item, t, dsn[t])
+		if err == nil {
+			err = q.add(tr, item, func() error {
+				return item.shareData(shared)
+			})
+		}
+		if err != nil {
+			tr.Errorf("%s: %v", t, err)
+			errs[t] = err
+			continue
+		}
+		ids[t] = item.ID
+	}
+
+	return ids, errs
+}
+
+// isFull returns true if the queue is full, and no more items can be put in
+// it.
+func (q *Queue) isFull() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.size >= q.maxSize
+}
+
+// newItem returns a new item for the envelope, without any recipients.
+func (q *Queue) newItem(from string, dsn map[string]*smtp.DSN, binaryMIME bool, authRes string) *Item {
 	item := &Item{
 		Message: Message{
-			ID:   <-newID,
-			From: from,
-			Data: data,
+			ID:          <-newID,
+			From:        from,
+			BinaryMime:  binaryMIME,
+			AuthResults: authRes,
 		},
 		CreatedAt: time.Now(),
+		dir:       q.path,
 	}
 
-	for _, t := range to {
-		item.To = append(item.To, t)
+	for _, d := range dsn {
+		item.DsnRet = d.Ret
+		item.DsnEnvid = d.EnvID
+		break
+	}
 
-		rcpts, err := q.aliases.Resolve(tr, t)
-		if err != nil {
-			return "", fmt.Errorf("error resolving aliases for %q: %v", t, err)
-		}
+	return item
+}
 
-		// Add the recipients (after resolving aliases); this conversion is
-		// not very pretty but at least it's self contained.
-		for _, aliasRcpt := range rcpts {
-			r := &Recipient{
-				Address:         aliasRcpt.Addr,
-				Status:          Recipient_PENDING,
-				OriginalAddress: t,
-			}
-			switch aliasRcpt.Type {
-			case aliases.EMAIL:
-				r.Type = Recipient_EMAIL
-			case aliases.PIPE:
-				r.Type = Recipient_PIPE
-			default:
-				log.Errorf("unknown alias type %v when resolving %q",
-					aliasRcpt.Type, t)
-				return "", tr.Errorf("internal error - unknown alias type")
-			}
-			item.Rcpt = append(item.Rcpt, r)
-			tr.Debugf("recipient: %v", r.Address)
+// addRcpt resolves the aliases of the given recipient, and adds the
+// resulting addresses to the item.
+func (q *Queue) addRcpt(tr *trace.Trace, item *Item, t string, dsn *smtp.DSN) error {
+	rcpts, err := q.aliases.Resolve(tr, t)
+	if err != nil {
+		return fmt.Errorf("error resolving aliases for %q: %v", t, err)
+	}
+
+	// Add the recipients (after resolving aliases); this conversion is
+	// not very pretty but at least it's self contained.
+	for _, aliasRcpt := range rcpts {
+		r := &Recipient{
+			Address:         aliasRcpt.Addr,
+			Status:          Recipient_PENDING,
+			OriginalAddress: t,
+		}
+		if dsn != nil {
+			r.DsnNotify = dsn.Notify
+			r.DsnOrcpt = dsn.ORcpt
 		}
+		switch aliasRcpt.Type {
+		case aliases.EMAIL:
+			r.Type = Recipient_EMAIL
+		case aliases.PIPE:
+			r.Type = Recipient_PIPE
+		default:
+			log.Errorf("unknown alias type %v when resolving %q",
+				aliasRcpt.Type, t)
+			return tr.Errorf("internal error - unknown alias type")
+		}
+		item.Rcpt = append(item.Rcpt, r)
+		tr.Debugf("recipient: %v", r.Address)
 	}
 
-	err := item.WriteTo(q.path)
+	item.To = append(item.To, t)
+	return nil
+}
+
+// add writes the item's data (using writeData) and the item itself to disk,
+// and begins sending it.
+func (q *Queue) add(tr *trace.Trace, item *Item, writeData func() error) error {
+	// Write the data first, so the item never references data which is not
+	// on disk.
+	err := writeData()
+	if err == nil {
+		err = item.loadSize()
+	}
 	if err != nil {
-		return "", tr.Errorf("failed to write item: %v", err)
+		item.removeData()
+		return tr.Errorf("failed to write data: %v", err)
+	}
+
+	// Now that we know the size of the data, check that it fits, and
+	// reserve the space for it.
+	q.mu.Lock()
+	if q.size+item.size > q.maxSize {
+		q.mu.Unlock()
+		item.removeData()
+		tr.Errorf("queue full (message size: %d)", item.size)
+		return errQueueFull
+	}
+	q.size += item.size
+	q.mu.Unlock()
+
+	err = item.WriteTo(q.path)
+	if err != nil {
+		item.removeData()
+		q.mu.Lock()
+		q.size -= item.size
+		q.mu.Unlock()
+		return tr.Errorf("failed to write item: %v", err)
 	}
 
 	q.mu.Lock()
@@ -216,10 +509,75 @@ func (q *Queue) Put(tr *trace.Trace, from string, to []string, data []byte) (str
 	q.mu.Unlock()
 
 	// Begin to send it right away.
-	go item.SendLoop(q)
+	q.startLoop(item)
 
-	tr.Debugf("queued")
-	return item.ID, nil
+	tr.Debugf("queued %s", item.ID)
+	return nil
+}
+
+// startLoop launches the send loop for the item, unless the queue is
+// shutting down. In that case, the item stays on disk, and will be sent once
+// the queue is loaded again.
+func (q *Queue) startLoop(item *Item) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isStopping() {
+		return
+	}
+
+	q.loops.Add(1)
+	go func() {
+		defer q.loops.Done()
+		item.SendLoop(q)
+	}()
+}
+
+// isStopping returns true if the queue is shutting down.
+func (q *Queue) isStopping() bool {
+	select {
+	case <-q.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown the queue: wait for the delivery attempts in progress to
+// complete, and don't start new ones. The items stay on disk, and will be
+// sent once the queue is loaded again.
+// If the context is done before the attempts complete, it returns its error
+// without waiting further. In both cases, the state of the items is written
+// to disk before returning.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.isStopping() {
+		close(q.stopping)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.loops.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// The state is written after each attempt, but write it again, just in
+	// case, as it's cheap to do.
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	for _, item := range q.q {
+		if werr := item.WriteTo(q.path); werr != nil {
+			log.Errorf("error writing queue item %q: %v", item.ID, werr)
+		}
+	}
+	return err
 }
 
 // Remove an item from the queue.
@@ -231,8 +589,16 @@ func (q *Queue) Remove(id string) {
 	}
 
 	q.mu.Lock()
+	item := q.q[id]
 	delete(q.q, id)
+	if item != nil {
+		q.size -= item.size
+	}
 	q.mu.Unlock()
+
+	if item != nil {
+		item.removeData()
+	}
 }
 
 // DumpString returns a human-readable string with the current queue.
@@ -242,7 +608,8 @@ func (q *Queue) DumpString() string {
 	defer q.mu.RUnlock()
 	s := "# Queue status\n\n"
 	s += fmt.Sprintf("date: %v\n", time.Now())
-	s += fmt.Sprintf("length: %d\n\n", len(q.q))
+	s += fmt.Sprintf("length: %d\n", len(q.q))
+	s += fmt.Sprintf("size: %d bytes\n\n", q.size)
 
 	for id, item := range q.q {
 		s += fmt.Sprintf("## Item %s\n", id)
@@ -274,6 +641,12 @@ type Item struct {
 
 	// Go-friendly version of Message.CreatedAtTs.
 	CreatedAt time.Time
+
+	// Directory where the item's data file is.
+	dir string
+
+	// Size of the message data, in bytes.
+	size int64
 }
 
 // ItemFromFile loads an item from the given file.
@@ -285,6 +658,7 @@ func ItemFromFile(fname string) (*Item, error) {
 	}
 
 	item.CreatedAt = timeFromProto(item.CreatedAtTs)
+	item.dir = filepath.Dir(fname)
 	return item, nil
 }
 
@@ -301,6 +675,153 @@ func (item *Item) WriteTo(dir string) error {
 	return protoio.WriteTextMessage(path, &item.Message, 0600)
 }
 
+// writeData writes the message data to the item's data file.
+func (item *Item) writeData(data io.Reader) error {
+	item.DataFile = dataFilePrefix + item.ID
+
+	// If the body is already on disk, link its file, and keep the header in
+	// the item. If we can't, just copy the data as usual.
+	if s, ok := data.(Spooled); ok {
+		header, fname, offset := s.Spooled()
+		err := item.linkData(fname, header, offset)
+		if err == nil {
+			return nil
+		}
+		log.Infof("failed to link spooled data, copying it: %v", err)
+	}
+
+	return safeio.WriteFrom(
+		filepath.Join(item.dir, item.DataFile), data, 0600)
+}
+
+// shareData makes the item use the same message data as another one, by
+// linking its data file, or copying it if that fails.
+func (item *Item) shareData(from *Item) error {
+	item.DataFile = dataFilePrefix + item.ID
+
+	err := item.linkData(filepath.Join(from.dir, from.DataFile),
+		from.Header, from.DataOffset)
+	if err == nil {
+		return nil
+	}
+	log.Infof("failed to link queue data, copying it: %v", err)
+
+	data, err := from.openData()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	return safeio.WriteFrom(
+		filepath.Join(item.dir, item.DataFile), data, 0600)
+}
+
+// linkData makes the item's data file a link to the given file, which has
+// the message body starting at offset; the header is kept in the item.
+func (item *Item) linkData(fname string, header []byte, offset int64) error {
+	err := os.Link(fname, filepath.Join(item.dir, item.DataFile))
+	if err != nil {
+		return err
+	}
+	item.Header = header
+	item.DataOffset = offset
+	return nil
+}
+
+// migrateData moves the data of an item written by an older version (which
+// has it inline) to its own file.
+func (item *Item) migrateData() error {
+	err := item.writeData(bytes.NewReader(item.Data))
+	if err != nil {
+		item.DataFile = ""
+		return err
+	}
+
+	data := item.Data
+	item.Data = nil
+	if err = item.WriteTo(item.dir); err != nil {
+		// Leave it as it was, so it can be migrated on the next load.
+		item.removeData()
+		item.DataFile = ""
+		item.Data = data
+		return err
+	}
+	return nil
+}
+
+// loadSize sets the item's size from its data.
+func (item *Item) loadSize() error {
+	if item.DataFile == "" {
+		item.size = int64(len(item.Data))
+		return nil
+	}
+
+	st, err := os.Stat(filepath.Join(item.dir, item.DataFile))
+	if err != nil {
+		return err
+	}
+	item.size = int64(len(item.Header)) + st.Size() - item.DataOffset
+	return nil
+}
+
+// removeData removes the item's data file, if it has one.
+func (item *Item) removeData() {
+	if item.DataFile == "" {
+		return
+	}
+	path := filepath.Join(item.dir, item.DataFile)
+	if err := os.Remove(path); err != nil {
+		log.Errorf("failed to remove queue data file %q: %v", path, err)
+	}
+}
+
+// openData opens the item's message data for reading. The caller must close
+// it when done.
+func (item *Item) openData() (io.ReadSeekCloser, error) {
+	if item.DataFile == "" {
+		// Items from older versions have the data inline.
+		return nopCloser{bytes.NewReader(item.Data)}, nil
+	}
+
+	f, err := os.Open(filepath.Join(item.dir, item.DataFile))
+	if err != nil {
+		return nil, err
+	}
+	if item.Header == nil && item.DataOffset == 0 {
+		return f, nil
+	}
+
+	// The data file has the body (from the offset), but the header is in
+	// the item.
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	body := io.NewSectionReader(f, item.DataOffset, st.Size()-item.DataOffset)
+	return readSeekCloser{newPrefixedReader(item.Header, body), f}, nil
+}
+
+// readData reads up to n bytes of the item's message data.
+func (item *Item) readData(n int64) ([]byte, error) {
+	f, err := item.openData()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, n))
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+type readSeekCloser struct {
+	io.ReadSeeker
+	io.Closer
+}
+
 // SendLoop repeatedly attempts to send the item.
 func (item *Item) SendLoop(q *Queue) {
 	tr := trace.New("Queue.SendLoop", item.ID)
@@ -308,6 +829,11 @@ func (item *Item) SendLoop(q *Queue) {
 	tr.Printf("from %s", item.From)
 
 	for time.Since(item.CreatedAt) < giveUpAfter {
+		if q.isStopping() {
+			tr.Printf("queue is shutting down")
+			return
+		}
+
 		// Send to all recipients that are still pending.
 		var wg sync.WaitGroup
 		for _, rcpt := range item.Rcpt {
@@ -325,18 +851,22 @@ func (item *Item) SendLoop(q *Queue) {
 			break
 		}
 
-		// TODO: Consider sending a non-final notification after 30m or so,
-		// that some of the messages have been delayed.
+		// Let the sender know that the delivery is being delayed, once.
+		item.maybeNotifyDelay(tr, q)
 
 		delay := nextDelay(item.CreatedAt)
 		tr.Printf("waiting for %v", delay)
 		maillog.QueueLoop(item.ID, item.From, delay)
-		time.Sleep(delay)
+		select {
+		case <-time.After(delay):
+		case <-q.stopping:
+		}
 	}
 
 	// Completed to all recipients (some may not have succeeded).
-	if item.countRcpt(Recipient_FAILED, Recipient_PENDING) > 0 && item.From != "<>" {
-		sendDSN(tr, q, item)
+	// Send the final notification, if there's something to report.
+	if item.From != "<>" {
+		sendDSN(tr, q, item, false)
 	}
 
 	tr.Printf("all done")
@@ -350,7 +880,7 @@ func (item *Item) sendOneRcpt(wg *sync.WaitGroup, tr *trace.Trace, q *Queue, rcp
 	to := rcpt.Address
 	tr.Debugf("%s sending", to)
 
-	err, permanent := item.deliver(q, rcpt)
+	err, permanent, delivery := item.deliver(tr, q, rcpt)
 
 	item.Lock()
 	if err != nil {
@@ -367,6 +897,7 @@ func (item *Item) sendOneRcpt(wg *sync.WaitGroup, tr *trace.Trace, q *Queue, rcp
 		tr.Printf("%s sent", to)
 		maillog.SendAttempt(item.ID, item.From, to, nil, false)
 		rcpt.Status = Recipient_SENT
+		rcpt.Delivery = delivery
 	}
 	item.Unlock()
 
@@ -376,30 +907,67 @@ func (item *Item) sendOneRcpt(wg *sync.WaitGroup, tr *trace.Trace, q *Queue, rcp
 	}
 }
 
+// maybeNotifyDelay sends the sender a notification that the delivery is
+// being delayed, if the item has been in the queue for long enough and we
+// haven't done it before.
+func (item *Item) maybeNotifyDelay(tr *trace.Trace, q *Queue) {
+	q.mu.RLock()
+	notifyAfter := q.delayNotifyAfter
+	q.mu.RUnlock()
+
+	if notifyAfter <= 0 || item.From == "<>" || item.DelayNotified ||
+		time.Since(item.CreatedAt) < notifyAfter {
+		return
+	}
+
+	sendDSN(tr, q, item, true)
+
+	// Save it to disk, so we don't send it again if we restart.
+	item.Lock()
+	item.DelayNotified = true
+	item.Unlock()
+
+	err := item.WriteTo(q.path)
+	if err != nil {
+		tr.Errorf("failed to write: %v", err)
+	}
+}
+
 // deliver the item to the given recipient, using the couriers from the queue.
-// Return an error (if any), and whether it is permanent or not.
-func (item *Item) deliver(q *Queue, rcpt *Recipient) (err error, permanent bool) {
+// Return an error (if any), whether it is permanent or not, and how the
+// message was delivered (only relevant on success).
+func (item *Item) deliver(tr *trace.Trace, q *Queue, rcpt *Recipient) (err error, permanent bool, delivery Recipient_Delivery) {
+	// Each delivery gets its own reader, as they are done in parallel.
+	data, err := item.openData()
+	if err != nil {
+		return fmt.Errorf("error opening message data: %v", err),
+			false, Recipient_DELIVERED
+	}
+	defer data.Close()
+
 	if rcpt.Type == Recipient_PIPE {
 		deliverAttempts.Add("pipe", 1)
 		c := strings.Fields(rcpt.Address)
 		if len(c) == 0 {
-			return fmt.Errorf("empty pipe"), true
+			return fmt.Errorf("empty pipe"), true, Recipient_DELIVERED
 		}
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 		cmd := exec.CommandContext(ctx, c[0], c[1:]...)
-		cmd.Stdin = bytes.NewReader(item.Data)
-		return cmd.Run(), true
+		cmd.Stdin = data
+		return cmd.Run(), true, Recipient_DELIVERED
 	}
 
 	// Recipient type is EMAIL.
 	if envelope.DomainIn(rcpt.Address, q.localDomains) {
 		deliverAttempts.Add("email:local", 1)
-		return q.localC.Deliver(item.From, rcpt.Address, item.Data)
+		err, permanent = q.localC.Deliver(item.From, rcpt.Address, data)
+		return err, permanent, Recipient_DELIVERED
 	}
 
 	deliverAttempts.Add("email:remote", 1)
 	from := item.From
+	var sealed io.ReadSeeker = data
 	if !envelope.DomainIn(item.From, q.localDomains) {
 		// We're sending from a non-local to a non-local. This should
 		// happen only when there's an alias to forward email to a
@@ -415,8 +983,165 @@ func (item *Item) deliver(q *Queue, rcpt *Recipient) (err error, permanent bool)
 			envelope.UserOf(rcpt.OriginalAddress),
 			strings.Replace(from, "@", "=", -1),
 			mustIDNAToASCII(envelope.DomainOf(rcpt.OriginalAddress)))
+
+		// Seal the forwarded copy, so the receiver can see our
+		// authentication results even though SPF (and possibly DKIM) will
+		// no longer pass.
+		sealed = item.arcSeal(tr, q, rcpt, data)
+	}
+
+	// Binary MIME messages have to be relayed as-is, which only some
+	// couriers can do.
+	if item.BinaryMime {
+		bc, ok := q.remoteC.(courier.BinaryMIMECourier)
+		if !ok {
+			return fmt.Errorf("can't relay binary MIME messages"),
+				true, Recipient_RELAYED
+		}
+		err, permanent, relayed := bc.DeliverBinaryMIME(
+			from, rcpt.Address, sealed, item.dsnParams(rcpt))
+		if relayed {
+			return err, permanent, Recipient_RELAYED_DSN
+		}
+		return err, permanent, Recipient_RELAYED
 	}
-	return q.remoteC.Deliver(from, rcpt.Address, item.Data)
+
+	// Relay the DSN parameters, if the courier supports it.
+	if dc, ok := q.remoteC.(courier.DSNCourier); ok {
+		err, permanent, relayed := dc.DeliverDSN(
+			from, rcpt.Address, sealed, item.dsnParams(rcpt))
+		if relayed {
+			return err, permanent, Recipient_RELAYED_DSN
+		}
+		return err, permanent, Recipient_RELAYED
+	}
+
+	err, permanent = q.remoteC.Deliver(from, rcpt.Address, sealed)
+	return err, permanent, Recipient_RELAYED
+}
+
+// dsnParams returns the delivery status notification parameters for the
+// given recipient, to relay them to the next hop.
+func (item *Item) dsnParams(rcpt *Recipient) *smtp.DSN {
+	return &smtp.DSN{
+		Ret:    item.DsnRet,
+		EnvID:  item.DsnEnvid,
+		Notify: rcpt.DsnNotify,
+		ORcpt:  rcpt.DsnOrcpt,
+	}
+}
+
+// arcSeal returns the item's data with an ARC set added, for forwarding it to
+// the given recipient. The set is signed with the DKIM signer of the domain
+// of the original address (the alias), and carries the authentication
+// results we got when receiving the message. The Authentication-Results
+// headers in the message are not used, as they may have come with it.
+// If there is no signer for the domain, or the message can't be sealed, the
+// data is returned unchanged.
+func (item *Item) arcSeal(tr *trace.Trace, q *Queue, rcpt *Recipient, data io.ReadSeeker) io.ReadSeeker {
+	domain := envelope.DomainOf(rcpt.OriginalAddress)
+	q.mu.RLock()
+	hostname := q.hostname
+	signer, ok := q.dkimSigners[domain]
+	q.mu.RUnlock()
+	if !ok {
+		arcSealed.Add("skip", 1)
+		return data
+	}
+
+	tr = tr.NewChild("ARC.Seal", domain)
+	defer tr.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	ctx = dkim.WithTraceFunc(ctx, func(f string, a ...interface{}) {
+		tr.Debugf(f, a...)
+	})
+
+	authRes := item.AuthResults
+	if authRes == "" {
+		// https://datatracker.ietf.org/doc/html/rfc8601#section-2.2
+		authRes = hostname + "; none"
+	}
+
+	var set *dkim.ARCSet
+	_, err := data.Seek(0, io.SeekStart)
+	if err == nil {
+		set, err = signer.ARCSeal(ctx, data, authRes)
+	}
+	if err != nil {
+		arcSealed.Add("error", 1)
+		tr.Errorf("error sealing, forwarding the message unsealed: %v", err)
+		return data
+	}
+
+	arcSealed.Add("ok", 1)
+	tr.Debugf("sealed with selector %q", signer.Selector)
+
+	// envelope.AddHeader prepends, so the resulting order is ARC-Seal,
+	// ARC-Message-Signature, ARC-Authentication-Results.
+	hdrs := envelope.AddHeader(nil,
+		"ARC-Authentication-Results", set.AuthenticationResults)
+	hdrs = envelope.AddHeader(hdrs, "ARC-Message-Signature", set.MessageSignature)
+	hdrs = envelope.AddHeader(hdrs, "ARC-Seal", set.Seal)
+	return newPrefixedReader(hdrs, data)
+}
+
+// prefixedReader reads a prefix, followed by the contents of another reader.
+// Unlike io.MultiReader, it can seek, which couriers need.
+type prefixedReader struct {
+	prefix []byte
+	r      io.ReadSeeker
+
+	// Current offset.
+	off int64
+}
+
+// newPrefixedReader returns a reader for prefix followed by the contents of
+// r. It must be seeked to the beginning before reading, as couriers do.
+func newPrefixedReader(prefix []byte, r io.ReadSeeker) *prefixedReader {
+	return &prefixedReader{prefix: prefix, r: r}
+}
+
+func (p *prefixedReader) Read(b []byte) (int, error) {
+	if p.off < int64(len(p.prefix)) {
+		n := copy(b, p.prefix[p.off:])
+		p.off += int64(n)
+		return n, nil
+	}
+	n, err := p.r.Read(b)
+	p.off += int64(n)
+	return n, err
+}
+
+func (p *prefixedReader) Seek(offset int64, whence int) (int64, error) {
+	plen := int64(len(p.prefix))
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += p.off
+	case io.SeekEnd:
+		size, err := p.r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return p.off, err
+		}
+		offset += plen + size
+	default:
+		return p.off, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return p.off, fmt.Errorf("negative offset %d", offset)
+	}
+
+	rOff := offset - plen
+	if rOff < 0 {
+		rOff = 0
+	}
+	if _, err := p.r.Seek(rOff, io.SeekStart); err != nil {
+		return p.off, err
+	}
+	p.off = offset
+	return offset, nil
 }
 
 // countRcpt counts how many recipients are in the given status.
@@ -433,8 +1158,10 @@ func (item *Item) countRcpt(statuses ...Recipient_Status) int {
 	return c
 }
 
-func sendDSN(tr *trace.Trace, q *Queue, item *Item) {
-	tr.Debugf("sending DSN")
+// sendDSN sends a delivery status notification for the item, if there is
+// anything to report. If delayed is true, it's a notification for the
+// recipients whose delivery is being delayed; otherwise it's the final one.
+func sendDSN(tr *trace.Trace, q *Queue, item *Item, delayed bool) {
 
 	// Pick a (local) domain to send the DSN from. We should always find one,
 	// as otherwise we're relaying.
@@ -450,11 +1177,16 @@ func sendDSN(tr *trace.Trace, q *Queue, item *Item) {
 		}
 	}
 
-	msg, err := deliveryStatusNotification(domain, item)
+	msg, err := deliveryStatusNotification(domain, item, delayed)
 	if err != nil {
 		tr.Errorf("failed to build DSN: %v", err)
 		return
 	}
+	if msg == nil {
+		tr.Debugf("no DSN needed")
+		return
+	}
+	tr.Debugf("sending DSN (delayed: %v)", delayed)
 
 	id, err := q.Put(tr, "<>", []string{item.From}, msg)
 	if err != nil {
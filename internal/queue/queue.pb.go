@@ -115,6 +115,66 @@ func (Recipient_Status) EnumDescriptor() ([]byte, []int) {
 	return file_queue_proto_rawDescGZIP(), []int{1, 1}
 }
 
+// How the message was delivered to this recipient, used for success
+// notifications. Only relevant when the status is SENT.
+type Recipient_Delivery int32
+
+const (
+	// Unknown (items from older versions).
+	Recipient_UNKNOWN Recipient_Delivery = 0
+	// Delivered locally (including pipes).
+	Recipient_DELIVERED Recipient_Delivery = 1
+	// Relayed to a server that does not support DSN.
+	Recipient_RELAYED Recipient_Delivery = 2
+	// Relayed to a server that supports DSN; the DSN parameters were
+	// passed along, and the server is now responsible for the
+	// notifications.
+	Recipient_RELAYED_DSN Recipient_Delivery = 3
+)
+
+// Enum value maps for Recipient_Delivery.
+var (
+	Recipient_Delivery_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "DELIVERED",
+		2: "RELAYED",
+		3: "RELAYED_DSN",
+	}
+	Recipient_Delivery_value = map[string]int32{
+		"UNKNOWN":     0,
+		"DELIVERED":   1,
+		"RELAYED":     2,
+		"RELAYED_DSN": 3,
+	}
+)
+
+func (x Recipient_Delivery) Enum() *Recipient_Delivery {
+	p := new(Recipient_Delivery)
+	*p = x
+	return p
+}
+
+func (x Recipient_Delivery) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Recipient_Delivery) Descriptor() protoreflect.EnumDescriptor {
+	return file_queue_proto_enumTypes[2].Descriptor()
+}
+
+func (Recipient_Delivery) Type() protoreflect.EnumType {
+	return &file_queue_proto_enumTypes[2]
+}
+
+func (x Recipient_Delivery) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Recipient_Delivery.Descriptor instead.
+func (Recipient_Delivery) EnumDescriptor() ([]byte, []int) {
+	return file_queue_proto_rawDescGZIP(), []int{1, 2}
+}
+
 type Message struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -127,9 +187,39 @@ type Message struct {
 	From string       `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
 	To   []string     `protobuf:"bytes,3,rep,name=To,proto3" json:"To,omitempty"`
 	Rcpt []*Recipient `protobuf:"bytes,4,rep,name=rcpt,proto3" json:"rcpt,omitempty"`
-	Data []byte       `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+	// Message data. Only used by items written by older versions, the data
+	// is now kept in a separate file (see data_file).
+	Data []byte `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
 	// Creation timestamp.
 	CreatedAtTs *Timestamp `protobuf:"bytes,6,opt,name=created_at_ts,json=createdAtTs,proto3" json:"created_at_ts,omitempty"`
+	// Delivery status notification parameters given in the MAIL command
+	// (RFC 3461). RET is "FULL" or "HDRS", and ENVID is decoded. They are
+	// empty if not given.
+	DsnRet   string `protobuf:"bytes,7,opt,name=dsn_ret,json=dsnRet,proto3" json:"dsn_ret,omitempty"`
+	DsnEnvid string `protobuf:"bytes,8,opt,name=dsn_envid,json=dsnEnvid,proto3" json:"dsn_envid,omitempty"`
+	// Have we sent the sender a notification that the delivery is being
+	// delayed? We only send one per message.
+	DelayNotified bool `protobuf:"varint,9,opt,name=delay_notified,json=delayNotified,proto3" json:"delay_notified,omitempty"`
+	// Name of the file with the message data, within the queue directory.
+	// The file is written once, and never modified afterwards.
+	DataFile string `protobuf:"bytes,10,opt,name=data_file,json=dataFile,proto3" json:"data_file,omitempty"`
+	// Was the message sent with BODY=BINARYMIME (RFC 3030)? If so, the body
+	// is kept as received (only the header uses "\n" line endings), and it
+	// has to be relayed as-is, which requires the next hop to support
+	// BINARYMIME too.
+	BinaryMime bool `protobuf:"varint,11,opt,name=binary_mime,json=binaryMime,proto3" json:"binary_mime,omitempty"`
+	// Message header, for items whose data file does not have it. This
+	// happens when the data file is the spooled message (taken as-is to
+	// avoid copying the body), as we modify the header after spooling. If
+	// set, the message is this header, followed by the contents of the data
+	// file starting at data_offset.
+	Header     []byte `protobuf:"bytes,12,opt,name=header,proto3" json:"header,omitempty"`
+	DataOffset int64  `protobuf:"varint,13,opt,name=data_offset,json=dataOffset,proto3" json:"data_offset,omitempty"`
+	// Value of the Authentication-Results header we added to the message
+	// when we received it, if any. Forwarded copies are ARC-sealed with it,
+	// so we only seal the results of our own checks, and never headers
+	// that came with the message.
+	AuthResults string `protobuf:"bytes,14,opt,name=auth_results,json=authResults,proto3" json:"auth_results,omitempty"`
 }
 
 func (x *Message) Reset() {
@@ -206,6 +296,62 @@ func (x *Message) GetCreatedAtTs() *Timestamp {
 	return nil
 }
 
+func (x *Message) GetDsnRet() string {
+	if x != nil {
+		return x.DsnRet
+	}
+	return ""
+}
+
+func (x *Message) GetDsnEnvid() string {
+	if x != nil {
+		return x.DsnEnvid
+	}
+	return ""
+}
+
+func (x *Message) GetDelayNotified() bool {
+	if x != nil {
+		return x.DelayNotified
+	}
+	return false
+}
+
+func (x *Message) GetDataFile() string {
+	if x != nil {
+		return x.DataFile
+	}
+	return ""
+}
+
+func (x *Message) GetBinaryMime() bool {
+	if x != nil {
+		return x.BinaryMime
+	}
+	return false
+}
+
+func (x *Message) GetHeader() []byte {
+	if x != nil {
+		return x.Header
+	}
+	return nil
+}
+
+func (x *Message) GetDataOffset() int64 {
+	if x != nil {
+		return x.DataOffset
+	}
+	return 0
+}
+
+func (x *Message) GetAuthResults() string {
+	if x != nil {
+		return x.AuthResults
+	}
+	return ""
+}
+
 type Recipient struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -221,6 +367,15 @@ type Recipient struct {
 	// This is before expanding aliases and only used in very particular
 	// cases.
 	OriginalAddress string `protobuf:"bytes,5,opt,name=original_address,json=originalAddress,proto3" json:"original_address,omitempty"`
+	// Delivery status notification parameters given in the RCPT command for
+	// the original address (RFC 3461).
+	// NOTIFY is either "NEVER", or a combination of "SUCCESS", "FAILURE" and
+	// "DELAY"; if empty, the default applies.
+	// ORCPT is decoded, in the "<addr-type>;<address>" form; empty if not
+	// given.
+	DsnNotify []string           `protobuf:"bytes,6,rep,name=dsn_notify,json=dsnNotify,proto3" json:"dsn_notify,omitempty"`
+	DsnOrcpt  string             `protobuf:"bytes,7,opt,name=dsn_orcpt,json=dsnOrcpt,proto3" json:"dsn_orcpt,omitempty"`
+	Delivery  Recipient_Delivery `protobuf:"varint,8,opt,name=delivery,proto3,enum=queue.Recipient_Delivery" json:"delivery,omitempty"`
 }
 
 func (x *Recipient) Reset() {
@@ -290,6 +445,27 @@ func (x *Recipient) GetOriginalAddress() string {
 	return ""
 }
 
+func (x *Recipient) GetDsnNotify() []string {
+	if x != nil {
+		return x.DsnNotify
+	}
+	return nil
+}
+
+func (x *Recipient) GetDsnOrcpt() string {
+	if x != nil {
+		return x.DsnOrcpt
+	}
+	return ""
+}
+
+func (x *Recipient) GetDelivery() Recipient_Delivery {
+	if x != nil {
+		return x.Delivery
+	}
+	return Recipient_UNKNOWN
+}
+
 // Timestamp representation, for convenience.
 // We used to use the well-known type, but the dependency makes packaging much
 // more convoluted and adds very little value, so we now just include it here.
@@ -354,7 +530,7 @@ var File_queue_proto protoreflect.FileDescriptor
 
 var file_queue_proto_rawDesc = []byte{
 	0x0a, 0x0b, 0x71, 0x75, 0x65, 0x75, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x05, 0x71,
-	0x75, 0x65, 0x75, 0x65, 0x22, 0xad, 0x01, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
+	0x75, 0x65, 0x75, 0x65, 0x22, 0xa4, 0x03, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
 	0x12, 0x0e, 0x0a, 0x02, 0x49, 0x44, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x49, 0x44,
 	0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04,
 	0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x54, 0x6f, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09,
@@ -365,25 +541,52 @@ var file_queue_proto_rawDesc = []byte{
 	0x0a, 0x0d, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x5f, 0x74, 0x73, 0x18,
 	0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x2e, 0x54, 0x69,
 	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x0b, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64,
-	0x41, 0x74, 0x54, 0x73, 0x22, 0xa8, 0x02, 0x0a, 0x09, 0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65,
-	0x6e, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20,
-	0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x29, 0x0a, 0x04,
-	0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x15, 0x2e, 0x71, 0x75, 0x65,
-	0x75, 0x65, 0x2e, 0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x2e, 0x54, 0x79, 0x70,
-	0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x2f, 0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75,
-	0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x17, 0x2e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x2e,
-	0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73,
-	0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x30, 0x0a, 0x14, 0x6c, 0x61, 0x73, 0x74,
-	0x5f, 0x66, 0x61, 0x69, 0x6c, 0x75, 0x72, 0x65, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65,
-	0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x12, 0x6c, 0x61, 0x73, 0x74, 0x46, 0x61, 0x69, 0x6c,
-	0x75, 0x72, 0x65, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x29, 0x0a, 0x10, 0x6f, 0x72,
-	0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x5f, 0x61, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x05,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x0f, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x41, 0x64,
-	0x64, 0x72, 0x65, 0x73, 0x73, 0x22, 0x1b, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x09, 0x0a,
-	0x05, 0x45, 0x4d, 0x41, 0x49, 0x4c, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x49, 0x50, 0x45,
-	0x10, 0x01, 0x22, 0x2b, 0x0a, 0x06, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x0b, 0x0a, 0x07,
-	0x50, 0x45, 0x4e, 0x44, 0x49, 0x4e, 0x47, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x53, 0x45, 0x4e,
-	0x54, 0x10, 0x01, 0x12, 0x0a, 0x0a, 0x06, 0x46, 0x41, 0x49, 0x4c, 0x45, 0x44, 0x10, 0x02, 0x22,
+	0x41, 0x74, 0x54, 0x73, 0x12, 0x17, 0x0a, 0x07, 0x64, 0x73, 0x6e, 0x5f, 0x72, 0x65, 0x74, 0x18,
+	0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64, 0x73, 0x6e, 0x52, 0x65, 0x74, 0x12, 0x1b, 0x0a,
+	0x09, 0x64, 0x73, 0x6e, 0x5f, 0x65, 0x6e, 0x76, 0x69, 0x64, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x08, 0x64, 0x73, 0x6e, 0x45, 0x6e, 0x76, 0x69, 0x64, 0x12, 0x25, 0x0a, 0x0e, 0x64, 0x65,
+	0x6c, 0x61, 0x79, 0x5f, 0x6e, 0x6f, 0x74, 0x69, 0x66, 0x69, 0x65, 0x64, 0x18, 0x09, 0x20, 0x01,
+	0x28, 0x08, 0x52, 0x0d, 0x64, 0x65, 0x6c, 0x61, 0x79, 0x4e, 0x6f, 0x74, 0x69, 0x66, 0x69, 0x65,
+	0x64, 0x12, 0x1b, 0x0a, 0x09, 0x64, 0x61, 0x74, 0x61, 0x5f, 0x66, 0x69, 0x6c, 0x65, 0x18, 0x0a,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x64, 0x61, 0x74, 0x61, 0x46, 0x69, 0x6c, 0x65, 0x12, 0x1f,
+	0x0a, 0x0b, 0x62, 0x69, 0x6e, 0x61, 0x72, 0x79, 0x5f, 0x6d, 0x69, 0x6d, 0x65, 0x18, 0x0b, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x0a, 0x62, 0x69, 0x6e, 0x61, 0x72, 0x79, 0x4d, 0x69, 0x6d, 0x65, 0x12,
+	0x16, 0x0a, 0x06, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x06, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x12, 0x1f, 0x0a, 0x0b, 0x64, 0x61, 0x74, 0x61, 0x5f,
+	0x6f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x64, 0x61,
+	0x74, 0x61, 0x4f, 0x66, 0x66, 0x73, 0x65, 0x74, 0x12, 0x21, 0x0a, 0x0c, 0x61, 0x75, 0x74, 0x68,
+	0x5f, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x73, 0x18, 0x0e, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b,
+	0x61, 0x75, 0x74, 0x68, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x73, 0x22, 0xe1, 0x03, 0x0a, 0x09,
+	0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x61, 0x64, 0x64,
+	0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64, 0x64, 0x72,
+	0x65, 0x73, 0x73, 0x12, 0x29, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x0e, 0x32, 0x15, 0x2e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x2e, 0x52, 0x65, 0x63, 0x69, 0x70, 0x69,
+	0x65, 0x6e, 0x74, 0x2e, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x2f,
+	0x0a, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x17,
+	0x2e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x2e, 0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74,
+	0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12,
+	0x30, 0x0a, 0x14, 0x6c, 0x61, 0x73, 0x74, 0x5f, 0x66, 0x61, 0x69, 0x6c, 0x75, 0x72, 0x65, 0x5f,
+	0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x12, 0x6c,
+	0x61, 0x73, 0x74, 0x46, 0x61, 0x69, 0x6c, 0x75, 0x72, 0x65, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x12, 0x29, 0x0a, 0x10, 0x6f, 0x72, 0x69, 0x67, 0x69, 0x6e, 0x61, 0x6c, 0x5f, 0x61, 0x64,
+	0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0f, 0x6f, 0x72, 0x69,
+	0x67, 0x69, 0x6e, 0x61, 0x6c, 0x41, 0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x1d, 0x0a, 0x0a,
+	0x64, 0x73, 0x6e, 0x5f, 0x6e, 0x6f, 0x74, 0x69, 0x66, 0x79, 0x18, 0x06, 0x20, 0x03, 0x28, 0x09,
+	0x52, 0x09, 0x64, 0x73, 0x6e, 0x4e, 0x6f, 0x74, 0x69, 0x66, 0x79, 0x12, 0x1b, 0x0a, 0x09, 0x64,
+	0x73, 0x6e, 0x5f, 0x6f, 0x72, 0x63, 0x70, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x64, 0x73, 0x6e, 0x4f, 0x72, 0x63, 0x70, 0x74, 0x12, 0x35, 0x0a, 0x08, 0x64, 0x65, 0x6c, 0x69,
+	0x76, 0x65, 0x72, 0x79, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x19, 0x2e, 0x71, 0x75, 0x65,
+	0x75, 0x65, 0x2e, 0x52, 0x65, 0x63, 0x69, 0x70, 0x69, 0x65, 0x6e, 0x74, 0x2e, 0x44, 0x65, 0x6c,
+	0x69, 0x76, 0x65, 0x72, 0x79, 0x52, 0x08, 0x64, 0x65, 0x6c, 0x69, 0x76, 0x65, 0x72, 0x79, 0x22,
+	0x1b, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x09, 0x0a, 0x05, 0x45, 0x4d, 0x41, 0x49, 0x4c,
+	0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x49, 0x50, 0x45, 0x10, 0x01, 0x22, 0x2b, 0x0a, 0x06,
+	0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x0b, 0x0a, 0x07, 0x50, 0x45, 0x4e, 0x44, 0x49, 0x4e,
+	0x47, 0x10, 0x00, 0x12, 0x08, 0x0a, 0x04, 0x53, 0x45, 0x4e, 0x54, 0x10, 0x01, 0x12, 0x0a, 0x0a,
+	0x06, 0x46, 0x41, 0x49, 0x4c, 0x45, 0x44, 0x10, 0x02, 0x22, 0x44, 0x0a, 0x08, 0x44, 0x65, 0x6c,
+	0x69, 0x76, 0x65, 0x72, 0x79, 0x12, 0x0b, 0x0a, 0x07, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e,
+	0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x44, 0x45, 0x4c, 0x49, 0x56, 0x45, 0x52, 0x45, 0x44, 0x10,
+	0x01, 0x12, 0x0b, 0x0a, 0x07, 0x52, 0x45, 0x4c, 0x41, 0x59, 0x45, 0x44, 0x10, 0x02, 0x12, 0x0f,
+	0x0a, 0x0b, 0x52, 0x45, 0x4c, 0x41, 0x59, 0x45, 0x44, 0x5f, 0x44, 0x53, 0x4e, 0x10, 0x03, 0x22,
 	0x3b, 0x0a, 0x09, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x12, 0x18, 0x0a, 0x07,
 	0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x73,
 	0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x61, 0x6e, 0x6f, 0x73, 0x18,
@@ -406,25 +609,27 @@ func file_queue_proto_rawDescGZIP() []byte {
 	return file_queue_proto_rawDescData
 }
 
-var file_queue_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_queue_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
 var file_queue_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_queue_proto_goTypes = []interface{}{
-	(Recipient_Type)(0),   // 0: queue.Recipient.Type
-	(Recipient_Status)(0), // 1: queue.Recipient.Status
-	(*Message)(nil),       // 2: queue.Message
-	(*Recipient)(nil),     // 3: queue.Recipient
-	(*Timestamp)(nil),     // 4: queue.Timestamp
+	(Recipient_Type)(0),     // 0: queue.Recipient.Type
+	(Recipient_Status)(0),   // 1: queue.Recipient.Status
+	(Recipient_Delivery)(0), // 2: queue.Recipient.Delivery
+	(*Message)(nil),         // 3: queue.Message
+	(*Recipient)(nil),       // 4: queue.Recipient
+	(*Timestamp)(nil),       // 5: queue.Timestamp
 }
 var file_queue_proto_depIdxs = []int32{
-	3, // 0: queue.Message.rcpt:type_name -> queue.Recipient
-	4, // 1: queue.Message.created_at_ts:type_name -> queue.Timestamp
+	4, // 0: queue.Message.rcpt:type_name -> queue.Recipient
+	5, // 1: queue.Message.created_at_ts:type_name -> queue.Timestamp
 	0, // 2: queue.Recipient.type:type_name -> queue.Recipient.Type
 	1, // 3: queue.Recipient.status:type_name -> queue.Recipient.Status
-	4, // [4:4] is the sub-list for method output_type
-	4, // [4:4] is the sub-list for method input_type
-	4, // [4:4] is the sub-list for extension type_name
-	4, // [4:4] is the sub-list for extension extendee
-	0, // [0:4] is the sub-list for field type_name
+	2, // 4: queue.Recipient.delivery:type_name -> queue.Recipient.Delivery
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
 }
 
 func init() { file_queue_proto_init() }
@@ -475,7 +680,7 @@ func file_queue_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_queue_proto_rawDesc,
-			NumEnums:      2,
+			NumEnums:      3,
 			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
@@ -2,13 +2,22 @@ package queue
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"blitiri.com.ar/go/chasquid/internal/aliases"
+	"blitiri.com.ar/go/chasquid/internal/dkim"
 	"blitiri.com.ar/go/chasquid/internal/set"
+	"blitiri.com.ar/go/chasquid/internal/smtp"
 	"blitiri.com.ar/go/chasquid/internal/testlib"
 	"blitiri.com.ar/go/chasquid/internal/trace"
 )
@@ -48,6 +57,15 @@ func TestBasic(t *testing.T) {
 		t.Fatalf("%d items not removed from the queue after delivery", q.Len())
 	}
 
+	// Their data files must be removed too.
+	noData := func() bool {
+		files, _ := filepath.Glob(dir + "/" + dataFilePrefix + "*")
+		return len(files) == 0
+	}
+	if !testlib.WaitFor(noData, 2*time.Second) {
+		t.Errorf("data files not removed after delivery")
+	}
+
 	cases := []struct {
 		courier    *testlib.TestCourier
 		expectedTo string
@@ -164,31 +182,408 @@ func TestAliases(t *testing.T) {
 	}
 }
 
+func TestPutPerRcpt(t *testing.T) {
+	localC := testlib.NewTestCourier()
+	remoteC := testlib.NewTestCourier()
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	errDB := errors.New("db error")
+	userExists := func(tr *trace.Trace, user, domain string) (bool, error) {
+		if user == "broken" {
+			return false, errDB
+		}
+		return true, nil
+	}
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(userExists),
+		localC, remoteC)
+	q.aliases.AddDomain("loco")
+	tr := trace.New("test", "TestPutPerRcpt")
+	defer tr.Finish()
+
+	// The broken recipient fails, but the others are queued.
+	localC.Expect(1)
+	remoteC.Expect(1)
+	ids, errs := q.PutPerRcpt(tr, "from",
+		[]string{"am@loco", "broken@loco", "x@remote"}, nil, false, "",
+		bytes.NewReader([]byte("data")))
+	if len(ids) != 2 || ids["am@loco"] == "" || ids["x@remote"] == "" {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+	if len(errs) != 1 || errs["broken@loco"] == nil {
+		t.Errorf("unexpected recipient errors: %v", errs)
+	}
+	localC.Wait()
+	remoteC.Wait()
+	if localC.ReqFor["am@loco"] == nil || remoteC.ReqFor["x@remote"] == nil {
+		t.Errorf("missing requests: %v %v", localC.ReqFor, remoteC.ReqFor)
+	}
+	if string(remoteC.ReqFor["x@remote"].Data) != "data" {
+		t.Errorf("unexpected data: %q", remoteC.ReqFor["x@remote"].Data)
+	}
+
+	// If all of them fail, nothing is queued.
+	ids, errs = q.PutPerRcpt(tr, "from", []string{"broken@loco"}, nil, false,
+		"", bytes.NewReader([]byte("data")))
+	if len(ids) != 0 || len(errs) != 1 {
+		t.Errorf("PutPerRcpt did not fail: %v %v", ids, errs)
+	}
+
+	// PutWithDSN fails as a whole.
+	id, err := q.PutWithDSN(tr, "from", []string{"am@loco", "broken@loco"},
+		nil, false, "", bytes.NewReader([]byte("data")))
+	if err == nil {
+		t.Errorf("PutWithDSN did not fail: %q", id)
+	}
+
+	testlib.WaitFor(func() bool { return q.Len() == 0 }, 2*time.Second)
+	if files, _ := filepath.Glob(dir + "/" + dataFilePrefix + "*"); len(files) != 0 {
+		t.Errorf("data files left behind: %v", files)
+	}
+}
+
+func TestARCSealing(t *testing.T) {
+	localC := testlib.NewTestCourier()
+	remoteC := testlib.NewTestCourier()
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	q, _ := New(dir, set.NewString("loco", "otro"),
+		aliases.NewResolver(allUsersExist),
+		localC, remoteC)
+	tr := trace.New("test", "TestARCSealing")
+	defer tr.Finish()
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	q.EnableARCSealing("mx.loco", map[string]*dkim.Signer{
+		"loco": {Domain: "loco", Selector: "sel", Signer: key},
+	})
+
+	q.aliases.AddDomain("loco")
+	q.aliases.AddDomain("otro")
+	q.aliases.AddAliasForTesting("ab@loco", "ata@hualpa", aliases.EMAIL)
+	q.aliases.AddAliasForTesting("cd@otro", "pata@hualpa", aliases.EMAIL)
+
+	// The message comes with a forged header using our authserv-id, which
+	// must not be sealed: only the results we give to Put are.
+	authRes := "mx.loco;\nspf=pass smtp.mailfrom=from@remote"
+	data := []byte("Authentication-Results: mx.loco; dkim=pass\n" +
+		"From: from@remote\n\nBody\n")
+
+	// Mail from a remote sender, forwarded through aliases to a remote
+	// address. Only the domain with a signer gets sealed.
+	remoteC.Expect(2)
+	_, err = q.PutWithDSN(tr, "from@remote", []string{"ab@loco", "cd@otro"},
+		nil, false, authRes, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	remoteC.Wait()
+
+	req := remoteC.ReqFor["ata@hualpa"]
+	if req == nil {
+		t.Fatalf("missing request for ata@hualpa")
+	}
+	got := string(req.Data)
+	if !strings.HasPrefix(got, "ARC-Seal: i=1; ") ||
+		!strings.Contains(got, "\nARC-Message-Signature: i=1; ") ||
+		!strings.Contains(got, "\nARC-Authentication-Results: i=1; "+
+			"mx.loco;\n\tspf=pass smtp.mailfrom=from@remote\n") ||
+		!strings.HasSuffix(got, string(data)) {
+		t.Errorf("unexpected sealed data: %q", got)
+	}
+	if strings.Contains(got, "ARC-Authentication-Results: i=1; "+
+		"mx.loco; dkim=pass") {
+		t.Errorf("forged results sealed: %q", got)
+	}
+
+	req = remoteC.ReqFor["pata@hualpa"]
+	if req == nil {
+		t.Fatalf("missing request for pata@hualpa")
+	}
+	if !bytes.Equal(req.Data, data) {
+		t.Errorf("unexpected unsealed data: %q", req.Data)
+	}
+}
+
+// dsnCourier is a TestCourier that relays the DSN parameters.
+type dsnCourier struct {
+	*testlib.TestCourier
+
+	mu  sync.Mutex
+	dsn map[string]*smtp.DSN
+}
+
+func (c *dsnCourier) DeliverDSN(from string, to string, data io.ReadSeeker, dsn *smtp.DSN) (error, bool, bool) {
+	c.mu.Lock()
+	c.dsn[to] = dsn
+	c.mu.Unlock()
+	err, permanent := c.Deliver(from, to, data)
+	return err, permanent, true
+}
+
+func TestPutPerRcptQueueFull(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	courier := &blockingCourier{release: make(chan struct{})}
+	defer close(courier.release)
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		courier, courier)
+	tr := trace.New("test", "TestPutPerRcptQueueFull")
+	defer tr.Finish()
+
+	// There's only room for one copy of the message, so the first recipient
+	// is queued, but the second one fails.
+	q.SetMaxSize(6)
+	ids, errs := q.PutPerRcpt(tr, "from", []string{"a@remote", "b@remote"},
+		nil, false, "", bytes.NewReader([]byte("data")))
+	if len(ids) != 1 || ids["a@remote"] == "" {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+	if len(errs) != 1 || errs["b@remote"] != errQueueFull {
+		t.Errorf("unexpected recipient errors: %v", errs)
+	}
+
+	// Only the data file of the queued item is left.
+	files, _ := filepath.Glob(dir + "/" + dataFilePrefix + "*")
+	if len(files) != 1 || q.Len() != 1 || q.Size() != 4 {
+		t.Errorf("unexpected queue: %d items, size %d, data files %v",
+			q.Len(), q.Size(), files)
+	}
+}
+
+func TestDSNParams(t *testing.T) {
+	localC := testlib.NewTestCourier()
+	remoteC := &dsnCourier{
+		TestCourier: testlib.NewTestCourier(),
+		dsn:         map[string]*smtp.DSN{},
+	}
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		localC, remoteC)
+	tr := trace.New("test", "TestDSNParams")
+	defer tr.Finish()
+
+	q.aliases.AddDomain("loco")
+	q.aliases.AddAliasForTesting("ab@loco", "pq@loco", aliases.EMAIL)
+	q.aliases.AddAliasForTesting("ab@loco", "x@remote", aliases.EMAIL)
+
+	dsn := map[string]*smtp.DSN{
+		"ab@loco": {
+			Ret:    "HDRS",
+			EnvID:  "envid",
+			Notify: []string{"SUCCESS"},
+			ORcpt:  "rfc822;orig@loco",
+		},
+	}
+
+	// Expect the deliveries, and the success DSN for pq@loco. There is no
+	// DSN for x@remote, as the parameters were relayed.
+	localC.Expect(2)
+	remoteC.Expect(1)
+	id, err := q.PutWithDSN(tr, "from@loco", []string{"ab@loco"}, dsn, false,
+		"", strings.NewReader("Subject: test\n\nbody\n"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The parameters are saved in the item.
+	item, err := ItemFromFile(fmt.Sprintf("%s/%s%s", dir, itemFilePrefix, id))
+	if err != nil {
+		t.Errorf("error loading item: %v", err)
+	} else if item.DsnRet != "HDRS" || item.DsnEnvid != "envid" ||
+		len(item.Rcpt) != 2 ||
+		item.Rcpt[0].DsnOrcpt != "rfc822;orig@loco" ||
+		item.Rcpt[1].DsnNotify[0] != "SUCCESS" {
+		t.Errorf("unexpected item: %v", item)
+	}
+
+	localC.Wait()
+	remoteC.Wait()
+
+	if d := remoteC.dsn["x@remote"]; d == nil || d.Ret != "HDRS" ||
+		d.EnvID != "envid" || d.ORcpt != "rfc822;orig@loco" ||
+		len(d.Notify) != 1 || d.Notify[0] != "SUCCESS" {
+		t.Errorf("unexpected relayed DSN parameters: %v", d)
+	}
+
+	req := localC.ReqFor["from@loco"]
+	if req == nil {
+		t.Fatal("missing DSN")
+	}
+	msg := string(req.Data)
+	if req.From != "<>" ||
+		!strings.Contains(msg, "Final-Recipient: utf-8; pq@loco\n"+
+			"Action: delivered\n") ||
+		strings.Contains(msg, "x@remote") {
+		t.Errorf("wrong DSN: %q", msg)
+	}
+}
+
+// binaryCourier is a dsnCourier that can also relay binary MIME messages.
+type binaryCourier struct {
+	*dsnCourier
+
+	binary map[string]bool
+}
+
+func (c *binaryCourier) DeliverBinaryMIME(from string, to string, data io.ReadSeeker, dsn *smtp.DSN) (error, bool, bool) {
+	c.mu.Lock()
+	c.binary[to] = true
+	c.mu.Unlock()
+	return c.DeliverDSN(from, to, data, dsn)
+}
+
+func TestBinaryMIME(t *testing.T) {
+	localC := testlib.NewTestCourier()
+	remoteC := &binaryCourier{
+		dsnCourier: &dsnCourier{
+			TestCourier: testlib.NewTestCourier(),
+			dsn:         map[string]*smtp.DSN{},
+		},
+		binary: map[string]bool{},
+	}
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		localC, remoteC)
+	tr := trace.New("test", "TestBinaryMIME")
+	defer tr.Finish()
+
+	// The courier supports binary MIME, so it gets the message as-is.
+	data := "Subject: test\n\nb\r\nbody\x00secret\r"
+	remoteC.Expect(1)
+	_, err := q.PutWithDSN(tr, "from@loco", []string{"x@remote"}, nil, true,
+		"", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	remoteC.Wait()
+	req := remoteC.ReqFor["x@remote"]
+	if !remoteC.binary["x@remote"] || string(req.Data) != data {
+		t.Errorf("unexpected delivery: binary %v, data %q",
+			remoteC.binary["x@remote"], req.Data)
+	}
+
+	// A courier which does not support it fails permanently, and the sender
+	// gets a notification with only the headers.
+	q.remoteC = remoteC.dsnCourier
+	localC.Expect(1)
+	_, err = q.PutWithDSN(tr, "from@loco", []string{"y@remote"}, nil, true,
+		"", strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	localC.Wait()
+	req = localC.ReqFor["from@loco"]
+	msg := string(req.Data)
+	if !strings.Contains(msg, "Action: failed") ||
+		!strings.Contains(msg, "text/rfc822-headers") ||
+		strings.Contains(msg, "secret") {
+		t.Errorf("wrong DSN: %q", msg)
+	}
+}
+
+func TestDelayNotification(t *testing.T) {
+	localC := testlib.NewTestCourier()
+	remoteC := testlib.NewTestCourier()
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		localC, remoteC)
+	q.SetDelayNotifyAfter(2 * time.Hour)
+	tr := trace.New("test", "TestDelayNotification")
+	defer tr.Finish()
+
+	item := &Item{
+		Message: Message{
+			ID:   <-newID,
+			From: "from@loco",
+			Rcpt: []*Recipient{
+				mkR("to@to", Recipient_EMAIL, Recipient_PENDING, "err", "to@to")},
+			Data: []byte("data"),
+		},
+		CreatedAt: time.Now().Add(-1 * time.Hour),
+	}
+	q.q[item.ID] = item
+
+	// Not enough time has passed.
+	item.maybeNotifyDelay(tr, q)
+	if item.DelayNotified || q.Len() != 1 {
+		t.Fatalf("unexpected delay notification")
+	}
+
+	// Now it should be sent.
+	item.CreatedAt = time.Now().Add(-3 * time.Hour)
+	localC.Expect(1)
+	item.maybeNotifyDelay(tr, q)
+	localC.Wait()
+
+	req := localC.ReqFor["from@loco"]
+	if req == nil {
+		t.Fatal("missing DSN")
+	}
+	if req.From != "<>" ||
+		!strings.Contains(string(req.Data), "Action: delayed") {
+		t.Errorf("wrong DSN: %q", string(req.Data))
+	}
+
+	// The flag must be persisted, so it survives a restart.
+	loaded, err := ItemFromFile(dir + "/" + itemFilePrefix + item.ID)
+	if err != nil {
+		t.Fatalf("error loading item: %v", err)
+	}
+	if !loaded.DelayNotified {
+		t.Errorf("DelayNotified not persisted")
+	}
+
+	// And it is only sent once: no new DSN gets queued.
+	testlib.WaitFor(func() bool { return q.Len() == 1 }, 2*time.Second)
+	item.maybeNotifyDelay(tr, q)
+	if q.Len() != 1 {
+		t.Errorf("delay notification sent twice")
+	}
+
+	// It can be disabled.
+	q.SetDelayNotifyAfter(0)
+	item.DelayNotified = false
+	item.maybeNotifyDelay(tr, q)
+	if item.DelayNotified {
+		t.Errorf("delay notification sent despite being disabled")
+	}
+}
+
 func TestFullQueue(t *testing.T) {
 	dir := testlib.MustTempDir(t)
 	defer testlib.RemoveIfOk(t, dir)
 	q, _ := New(dir, set.NewString(),
 		aliases.NewResolver(allUsersExist),
 		testlib.DumbCourier, testlib.DumbCourier)
+	q.SetMaxSize(10)
 	tr := trace.New("test", "TestFullQueue")
 	defer tr.Finish()
 
-	// Force-insert maxQueueSize items in the queue.
-	oneID := ""
-	for i := 0; i < maxQueueSize; i++ {
-		item := &Item{
-			Message: Message{
-				ID:   <-newID,
-				From: fmt.Sprintf("from-%d", i),
-				Rcpt: []*Recipient{
-					mkR("to", Recipient_EMAIL, Recipient_PENDING, "", "")},
-				Data: []byte("data"),
-			},
-			CreatedAt: time.Now(),
-		}
-		q.q[item.ID] = item
-		oneID = item.ID
+	// Force-insert an item that takes most of the queue.
+	item := &Item{
+		Message: Message{
+			ID:   <-newID,
+			From: "from",
+			Rcpt: []*Recipient{
+				mkR("to", Recipient_EMAIL, Recipient_PENDING, "", "")},
+			Data: []byte("data-1"),
+		},
+		CreatedAt: time.Now(),
+		size:      6,
 	}
+	q.q[item.ID] = item
+	q.size += item.size
 
 	// This one should fail due to the queue being too big.
 	id, err := q.Put(tr, "from", []string{"to"}, []byte("data-qf"))
@@ -196,13 +591,28 @@ func TestFullQueue(t *testing.T) {
 		t.Errorf("Not failed as expected: %v - %v", id, err)
 	}
 
-	// Remove one, and try again: it should succeed.
+	// The data of the rejected message must not be left behind.
+	if files, _ := filepath.Glob(dir + "/" + dataFilePrefix + "*"); len(files) != 0 {
+		t.Errorf("data files left behind: %v", files)
+	}
+
+	// A smaller one fits.
+	id, err = q.Put(tr, "from", []string{"to"}, []byte("data"))
+	if err != nil {
+		t.Errorf("Put: %v", err)
+	}
+	q.Remove(id)
+
+	// Remove the big one, and try again: it should succeed.
 	// Write it first so we don't get complaints about the file not existing
 	// (as we did not all the items properly).
-	q.q[oneID].WriteTo(q.path)
-	q.Remove(oneID)
+	item.WriteTo(q.path)
+	q.Remove(item.ID)
+	if q.Size() != 0 {
+		t.Errorf("unexpected size after removing all items: %d", q.Size())
+	}
 
-	id, err = q.Put(tr, "from", []string{"to"}, []byte("data"))
+	id, err = q.Put(tr, "from", []string{"to"}, []byte("data-qf"))
 	if err != nil {
 		t.Errorf("Put: %v", err)
 	}
@@ -215,6 +625,8 @@ func TestPipes(t *testing.T) {
 	q, _ := New(dir, set.NewString("loco"),
 		aliases.NewResolver(allUsersExist),
 		testlib.DumbCourier, testlib.DumbCourier)
+	tr := trace.New("test", "TestPipes")
+	defer tr.Finish()
 
 	item := &Item{
 		Message: Message{
@@ -227,7 +639,7 @@ func TestPipes(t *testing.T) {
 		CreatedAt: time.Now(),
 	}
 
-	if err, _ := item.deliver(q, item.Rcpt[0]); err != nil {
+	if err, _, _ := item.deliver(tr, q, item.Rcpt[0]); err != nil {
 		t.Errorf("pipe delivery failed: %v", err)
 	}
 }
@@ -306,6 +718,230 @@ func TestSerialization(t *testing.T) {
 	}
 }
 
+// blockingCourier blocks deliveries until released, and then returns err.
+type blockingCourier struct {
+	// If not nil, gets a value every time a delivery starts.
+	started chan struct{}
+
+	release chan struct{}
+	err     error
+}
+
+func (c *blockingCourier) Deliver(from string, to string, data io.ReadSeeker) (error, bool) {
+	if c.started != nil {
+		c.started <- struct{}{}
+	}
+	<-c.release
+	return c.err, false
+}
+
+func TestMigration(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+
+	// Save an item like older versions did, with the data inline.
+	item := &Item{
+		Message: Message{
+			ID:   <-newID,
+			From: "from@loco",
+			Rcpt: []*Recipient{
+				mkR("to@to", Recipient_EMAIL, Recipient_PENDING, "", "to@to")},
+			Data: []byte("data"),
+		},
+		CreatedAt: time.Now(),
+	}
+	if err := item.WriteTo(dir); err != nil {
+		t.Fatalf("failed to write item: %v", err)
+	}
+
+	remoteC := &blockingCourier{release: make(chan struct{})}
+	defer close(remoteC.release)
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		testlib.DumbCourier, remoteC)
+	if err := q.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	// The item must have been rewritten without the data, which is now in
+	// its own file.
+	loaded, err := ItemFromFile(dir + "/" + itemFilePrefix + item.ID)
+	if err != nil {
+		t.Fatalf("error loading item: %v", err)
+	}
+	if len(loaded.Data) != 0 || loaded.DataFile != dataFilePrefix+item.ID {
+		t.Errorf("item not migrated: data %q, data file %q",
+			loaded.Data, loaded.DataFile)
+	}
+	data, err := os.ReadFile(dir + "/" + loaded.DataFile)
+	if err != nil || string(data) != "data" {
+		t.Errorf("unexpected data file: %q, %v", data, err)
+	}
+
+	if q.Len() != 1 || q.Size() != 4 {
+		t.Errorf("unexpected queue length/size: %d/%d", q.Len(), q.Size())
+	}
+}
+
+// spooledReader is message data with the body in a spool file.
+type spooledReader struct {
+	io.Reader
+
+	header []byte
+	fname  string
+	offset int64
+}
+
+func (r *spooledReader) Spooled() ([]byte, string, int64) {
+	return r.header, r.fname, r.offset
+}
+
+func TestPutSpooled(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+
+	remoteC := &blockingCourier{release: make(chan struct{})}
+	defer close(remoteC.release)
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		testlib.DumbCourier, remoteC)
+	tr := trace.New("test", "TestPutSpooled")
+	defer tr.Finish()
+
+	// The spool has the original header, which was replaced.
+	spool := q.SpoolDir() + "/spooled"
+	err := os.WriteFile(spool, []byte("Old: header\n\nbody\n"), 0600)
+	if err != nil {
+		t.Fatalf("error writing spool: %v", err)
+	}
+	header := []byte("New: header\n\n")
+	msg := "New: header\n\nbody\n"
+
+	checkData := func(item *Item) {
+		t.Helper()
+		if err := item.loadSize(); err != nil || item.size != int64(len(msg)) {
+			t.Errorf("unexpected size: %d, %v", item.size, err)
+		}
+		data, err := item.readData(1024)
+		if err != nil || string(data) != msg {
+			t.Errorf("unexpected data: %q, %v", data, err)
+		}
+	}
+
+	id, err := q.PutWithDSN(tr, "from", []string{"to@remote"}, nil, false,
+		"", &spooledReader{strings.NewReader(msg), header, spool, 13})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The data file is the spool file, not a copy.
+	q.mu.RLock()
+	item := q.q[id]
+	q.mu.RUnlock()
+	spoolSt, _ := os.Stat(spool)
+	dataSt, err := os.Stat(filepath.Join(dir, item.DataFile))
+	if err != nil || !os.SameFile(spoolSt, dataSt) {
+		t.Errorf("data file is not the spool file: %v", err)
+	}
+	checkData(item)
+
+	// Same when loading the item from disk.
+	loaded, err := ItemFromFile(dir + "/" + itemFilePrefix + id)
+	if err != nil {
+		t.Fatalf("error loading item: %v", err)
+	}
+	checkData(loaded)
+
+	// If the spool file can't be linked, the data is copied.
+	id, err = q.PutWithDSN(tr, "from", []string{"to@remote"}, nil, false,
+		"", &spooledReader{strings.NewReader(msg), header, spool + "x", 13})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	q.mu.RLock()
+	item = q.q[id]
+	q.mu.RUnlock()
+	if item.Header != nil || item.DataOffset != 0 {
+		t.Errorf("data was not copied: %q %d", item.Header, item.DataOffset)
+	}
+	checkData(item)
+
+	if q.Size() != 2*int64(len(msg)) {
+		t.Errorf("unexpected queue size: %d", q.Size())
+	}
+}
+
+func TestLoadCleanup(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		testlib.DumbCourier, testlib.DumbCourier)
+
+	// Leftovers from a previous run: a partially received message, and data
+	// without an item.
+	leftovers := []string{
+		q.SpoolDir() + "/partial",
+		dir + "/" + dataFilePrefix + "orphan",
+	}
+	for _, fname := range leftovers {
+		if err := os.WriteFile(fname, []byte("data"), 0600); err != nil {
+			t.Fatalf("error writing %q: %v", fname, err)
+		}
+	}
+
+	if err := q.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	for _, fname := range leftovers {
+		if _, err := os.Stat(fname); !os.IsNotExist(err) {
+			t.Errorf("%q was not removed: %v", fname, err)
+		}
+	}
+}
+
+func TestPrefixedReader(t *testing.T) {
+	r := newPrefixedReader([]byte("prefix "), strings.NewReader("content"))
+
+	// Read it twice, like couriers do when retrying.
+	for i := 0; i < 2; i++ {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil || string(buf) != "prefix content" {
+			t.Errorf("%d: got %q, %v", i, buf, err)
+		}
+	}
+
+	seeks := []struct {
+		offset   int64
+		whence   int
+		expected string
+	}{
+		{3, io.SeekStart, "fix content"},
+		{9, io.SeekStart, "ntent"},
+		{-4, io.SeekEnd, "tent"},
+		{0, io.SeekEnd, ""},
+	}
+	for _, c := range seeks {
+		if _, err := r.Seek(c.offset, c.whence); err != nil {
+			t.Errorf("Seek(%d, %d): %v", c.offset, c.whence, err)
+			continue
+		}
+		buf, err := io.ReadAll(r)
+		if err != nil || string(buf) != c.expected {
+			t.Errorf("Seek(%d, %d): got %q, %v, expected %q",
+				c.offset, c.whence, buf, err, c.expected)
+		}
+	}
+
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("negative seek did not fail")
+	}
+}
+
 func mkR(a string, t Recipient_Type, s Recipient_Status, m, o string) *Recipient {
 	return &Recipient{
 		Address:            a,
@@ -315,3 +951,63 @@ func mkR(a string, t Recipient_Type, s Recipient_Status, m, o string) *Recipient
 		OriginalAddress:    o,
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+
+	remoteC := &blockingCourier{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+		err:     errors.New("temporary error"),
+	}
+	q, _ := New(dir, set.NewString("loco"),
+		aliases.NewResolver(allUsersExist),
+		testlib.DumbCourier, remoteC)
+
+	tr := trace.New("test", "TestShutdown")
+	defer tr.Finish()
+
+	id, err := q.Put(tr, "from@loco", []string{"to@remote"}, []byte("data"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	<-remoteC.started
+
+	// The delivery attempt is in progress, so Shutdown waits for it until
+	// the context expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+
+	// Once the attempt completes, Shutdown returns.
+	close(remoteC.release)
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	// New items are saved, but not sent.
+	id2, err := q.Put(tr, "from@loco", []string{"to@remote"}, []byte("data"))
+	if err != nil {
+		t.Fatalf("Put after shutdown: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := len(remoteC.started); n != 0 {
+		t.Errorf("%d deliveries started after shutdown", n)
+	}
+
+	// Both items are on disk, with the result of the attempt.
+	item, err := ItemFromFile(dir + "/" + itemFilePrefix + id)
+	if err != nil {
+		t.Fatalf("error loading item: %v", err)
+	}
+	if r := item.Rcpt[0]; r.Status != Recipient_PENDING ||
+		r.LastFailureMessage != "temporary error" {
+		t.Errorf("unexpected recipient state: %v", r)
+	}
+	if _, err := ItemFromFile(dir + "/" + itemFilePrefix + id2); err != nil {
+		t.Errorf("error loading item: %v", err)
+	}
+}
@@ -3,6 +3,8 @@
 package safeio
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"path"
 	"syscall"
@@ -23,6 +25,12 @@ type FileOp func(fname string) error
 // Note this relies on same-directory Rename being atomic, which holds in most
 // reasonably modern filesystems.
 func WriteFile(filename string, data []byte, perm os.FileMode, ops ...FileOp) error {
+	return WriteFrom(filename, bytes.NewReader(data), perm, ops...)
+}
+
+// WriteFrom is like WriteFile, but the contents are read from r until EOF,
+// so they don't need to be in memory.
+func WriteFrom(filename string, r io.Reader, perm os.FileMode, ops ...FileOp) error {
 	// Note we create the temporary file in the same directory, otherwise we
 	// would have no expectation of Rename being atomic.
 	// We make the file names start with "." so there's no confusion with the
@@ -46,7 +54,7 @@ func WriteFile(filename string, data []byte, perm os.FileMode, ops ...FileOp) er
 		}
 	}
 
-	if _, err = tmpf.Write(data); err != nil {
+	if _, err = io.Copy(tmpf, r); err != nil {
 		tmpf.Close()
 		os.Remove(tmpf.Name())
 		return err
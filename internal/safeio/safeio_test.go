@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"testing"
@@ -112,6 +113,35 @@ func TestWriteFileWithFailingOp(t *testing.T) {
 	}
 }
 
+func TestWriteFromWithFailingReader(t *testing.T) {
+	dir := testlib.MustTempDir(t)
+	defer testlib.RemoveIfOk(t, dir)
+
+	readError := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader("content"), &errReader{readError})
+	err := WriteFrom("file1", r, 0660)
+	if err != readError {
+		t.Errorf("different error, got %v, expected %v", err, readError)
+	}
+
+	// Neither the file nor the temporary file must be left behind.
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("files left behind after failure: %v", entries)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
 // TODO: We should test the possible failure scenarios for WriteFile, but it
 // gets tricky without being able to do failure injection (or turning the code
 // into a mess).
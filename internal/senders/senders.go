@@ -0,0 +1,251 @@
+// Package senders implements the sender authorization policy, which decides
+// which addresses an authenticated user can send as.
+//
+// A user can send as:
+//   - Their own address.
+//   - Variants of it, with suffixes and drop characters (see the aliases
+//     package for details).
+//   - Local addresses that resolve to them, for example aliases which have
+//     them as a recipient.
+//   - Addresses explicitly listed for them in the domain's allow-list file.
+//
+// # Allow-list file format
+//
+// The file can contain lines of the form:
+//
+//	user: address, address
+//
+// Lines starting with "#" are ignored, as well as empty lines.
+// The user is the local part of the authenticated user, in the file's
+// domain. Addresses without a domain get the file's domain added.
+//
+// This is useful for shared or role addresses, which are not aliases.
+package senders
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"blitiri.com.ar/go/chasquid/internal/aliases"
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+	"blitiri.com.ar/go/chasquid/internal/normalize"
+	"blitiri.com.ar/go/chasquid/internal/set"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// Authorizer checks if authenticated users can send as a given address.
+type Authorizer struct {
+	// Resolver used to check the suffix variants and aliases.
+	aliasesR *aliases.Resolver
+
+	// Map of domain -> allow-list file for that domain.
+	// We keep track of them for reloading purposes.
+	files map[string]string
+
+	// Map of user@domain -> addresses they're allowed to send as, from the
+	// allow-list files.
+	allowed map[string]*set.String
+
+	// Mutex protecting the structure.
+	mu sync.Mutex
+}
+
+// NewAuthorizer returns a new Authorizer, which uses the given resolver.
+func NewAuthorizer(aliasesR *aliases.Resolver) *Authorizer {
+	return &Authorizer{
+		aliasesR: aliasesR,
+		files:    map[string]string{},
+		allowed:  map[string]*set.String{},
+	}
+}
+
+// AddFile adds the allow-list file for the given domain, replacing the
+// addresses allowed by its previous one, if any. It is not an error if the
+// file does not exist; it will be considered when reloading.
+// If the file can't be loaded, the current addresses are kept.
+func (a *Authorizer) AddFile(domain, path string) error {
+	a.mu.Lock()
+	a.files[domain] = path
+	a.mu.Unlock()
+
+	allowed, err := parseFile(domain, path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.removeAllowed(domain)
+	for user, addrs := range allowed {
+		a.allowed[user] = addrs
+	}
+	return nil
+}
+
+// RemoveDomain removes the allow-list file for the given domain, and the
+// addresses allowed by it.
+func (a *Authorizer) RemoveDomain(domain string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.files, domain)
+	a.removeAllowed(domain)
+}
+
+// removeAllowed removes the addresses allowed for the users of the given
+// domain. Must be called with mu held.
+func (a *Authorizer) removeAllowed(domain string) {
+	for user := range a.allowed {
+		if envelope.DomainOf(user) == domain {
+			delete(a.allowed, user)
+		}
+	}
+}
+
+// Reload the allow-list files for all known domains.
+func (a *Authorizer) Reload() error {
+	newAllowed := map[string]*set.String{}
+
+	a.mu.Lock()
+	files := map[string]string{}
+	for domain, path := range a.files {
+		files[domain] = path
+	}
+	a.mu.Unlock()
+
+	for domain, path := range files {
+		allowed, err := parseFile(domain, path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error parsing %q: %v", path, err)
+		}
+
+		for user, addrs := range allowed {
+			newAllowed[user] = addrs
+		}
+	}
+
+	a.mu.Lock()
+	a.allowed = newAllowed
+	a.mu.Unlock()
+
+	return nil
+}
+
+// Authorized checks if user@domain (which must be already authenticated)
+// can send as the given address.
+func (a *Authorizer) Authorized(tr *trace.Trace, user, domain, addr string) (bool, error) {
+	tr = tr.NewChild("Senders.Authorized", addr)
+	defer tr.Finish()
+
+	id, err := normalize.Addr(user + "@" + domain)
+	if err != nil {
+		return false, err
+	}
+
+	// The null sender can't be used to impersonate anyone.
+	if addr == "<>" {
+		tr.Debugf("null sender, allowed")
+		return true, nil
+	}
+
+	addr, err = normalize.Addr(addr)
+	if err != nil {
+		tr.Debugf("invalid address: %v", err)
+		return false, nil
+	}
+
+	if addr == id {
+		tr.Debugf("own address, allowed")
+		return true, nil
+	}
+
+	a.mu.Lock()
+	listed := a.allowed[id].Has(addr)
+	a.mu.Unlock()
+	if listed {
+		tr.Debugf("in the allow-list of %s, allowed", id)
+		return true, nil
+	}
+
+	// Resolve the address, to see if it ends up being the user. This covers
+	// the suffix and drop character variants, and the aliases.
+	// Non-local addresses resolve to themselves, so they won't match.
+	rcpts, err := a.aliasesR.Resolve(tr, addr)
+	if err != nil {
+		tr.Errorf("error resolving: %v", err)
+		return false, err
+	}
+	for _, rcpt := range rcpts {
+		if rcpt.Type == aliases.EMAIL && rcpt.Addr == id {
+			tr.Debugf("resolves to %s, allowed", id)
+			return true, nil
+		}
+	}
+
+	tr.Debugf("not allowed for %s", id)
+	return false, nil
+}
+
+func parseFile(domain, path string) (map[string]*set.String, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	allowed, err := parseReader(domain, f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %v", path, err)
+	}
+	return allowed, nil
+}
+
+func parseReader(domain string, r io.Reader) (map[string]*set.String, error) {
+	allowed := map[string]*set.String{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, rawAddrs, ok := strings.Cut(line, ":")
+		user, rawAddrs = strings.TrimSpace(user), strings.TrimSpace(rawAddrs)
+		if !ok || user == "" || rawAddrs == "" || strings.Contains(user, "@") {
+			continue
+		}
+
+		id, err := normalize.Addr(user + "@" + domain)
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range strings.Split(rawAddrs, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			if !strings.Contains(addr, "@") {
+				addr = addr + "@" + domain
+			}
+			addr, err = normalize.Addr(addr)
+			if err != nil || envelope.DomainOf(addr) == "" {
+				continue
+			}
+
+			if allowed[id] == nil {
+				allowed[id] = &set.String{}
+			}
+			allowed[id].Add(addr)
+		}
+	}
+
+	return allowed, scanner.Err()
+}
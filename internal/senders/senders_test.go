@@ -0,0 +1,205 @@
+package senders
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/chasquid/internal/aliases"
+	"blitiri.com.ar/go/chasquid/internal/testlib"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+func allUsersExist(tr *trace.Trace, user, domain string) (bool, error) {
+	return true, nil
+}
+
+func newTestAuthorizer(t *testing.T) (*Authorizer, string) {
+	t.Helper()
+	dir := testlib.MustTempDir(t)
+
+	resolver := aliases.NewResolver(allUsersExist)
+	resolver.SuffixSep = "+"
+	resolver.DropChars = "."
+	resolver.AddDomain("dom")
+	resolver.AddAliasForTesting("team@dom", "alice@dom", aliases.EMAIL)
+	resolver.AddAliasForTesting("team@dom", "bob@dom", aliases.EMAIL)
+	resolver.AddAliasForTesting("pipe@dom", "alice@dom", aliases.PIPE)
+
+	a := NewAuthorizer(resolver)
+	testlib.Rewrite(t, dir+"/senders", `
+# Comment.
+alice: info, news@dom, alice@example.com
+bob@dom: ignored@dom
+carol:
+`)
+	if err := a.AddFile("dom", dir+"/senders"); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	return a, dir
+}
+
+func TestAuthorized(t *testing.T) {
+	a, dir := newTestAuthorizer(t)
+	defer testlib.RemoveIfOk(t, dir)
+	tr := trace.New("test", "TestAuthorized")
+	defer tr.Finish()
+
+	cases := []struct {
+		user, addr string
+		allowed    bool
+	}{
+		// Own address, normalized.
+		{"alice", "alice@dom", true},
+		{"alice", "ALICE@Dom", true},
+		{"Alice", "alice@dom", true},
+
+		// Null sender.
+		{"alice", "<>", true},
+
+		// Suffix and drop characters variants.
+		{"alice", "alice+something@dom", true},
+		{"alice", "a.lice@dom", true},
+		{"bob", "alice+something@dom", false},
+
+		// Aliases that resolve to the user, but not pipes.
+		{"alice", "team@dom", true},
+		{"bob", "team+x@dom", true},
+		{"carol", "team@dom", false},
+		{"alice", "pipe@dom", false},
+
+		// Allow-list.
+		{"alice", "info@dom", true},
+		{"alice", "news@dom", true},
+		{"alice", "alice@example.com", true},
+		{"bob", "info@dom", false},
+		{"bob", "ignored@dom", false},
+
+		// Other users and domains.
+		{"alice", "bob@dom", false},
+		{"alice", "alice@otherdom", false},
+		{"alice", "invalid@\xff", false},
+	}
+	for _, c := range cases {
+		ok, err := a.Authorized(tr, c.user, "dom", c.addr)
+		if err != nil {
+			t.Errorf("%s as %q: unexpected error: %v", c.user, c.addr, err)
+		}
+		if ok != c.allowed {
+			t.Errorf("%s as %q: got %v, expected %v",
+				c.user, c.addr, ok, c.allowed)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	a, dir := newTestAuthorizer(t)
+	defer testlib.RemoveIfOk(t, dir)
+	tr := trace.New("test", "TestReload")
+	defer tr.Finish()
+
+	testlib.Rewrite(t, dir+"/senders", "bob: info\n")
+	if err := a.Reload(); err != nil {
+		t.Fatalf("error reloading: %v", err)
+	}
+
+	if ok, _ := a.Authorized(tr, "alice", "dom", "info@dom"); ok {
+		t.Errorf("alice still allowed as info@dom after reload")
+	}
+	if ok, _ := a.Authorized(tr, "bob", "dom", "info@dom"); !ok {
+		t.Errorf("bob not allowed as info@dom after reload")
+	}
+
+	// Files that don't exist are skipped.
+	os.Remove(dir + "/senders")
+	if err := a.Reload(); err != nil {
+		t.Fatalf("error reloading: %v", err)
+	}
+	if ok, _ := a.Authorized(tr, "bob", "dom", "info@dom"); ok {
+		t.Errorf("bob still allowed as info@dom after removing the file")
+	}
+	if err := a.AddFile("other", dir+"/doesnotexist"); err != nil {
+		t.Errorf("error adding a file that does not exist: %v", err)
+	}
+
+	// Files that can't be read are errors.
+	if err := a.AddFile("other", dir); err == nil {
+		t.Errorf("no error adding a directory")
+	}
+	if err := a.Reload(); err == nil {
+		t.Errorf("no error reloading with a directory")
+	}
+}
+
+func TestAddFileAgain(t *testing.T) {
+	a, dir := newTestAuthorizer(t)
+	defer testlib.RemoveIfOk(t, dir)
+	tr := trace.New("test", "TestAddFileAgain")
+	defer tr.Finish()
+
+	// Adding the file again replaces what was loaded before.
+	testlib.Rewrite(t, dir+"/senders", "bob: info\n")
+	if err := a.AddFile("dom", dir+"/senders"); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	if ok, _ := a.Authorized(tr, "alice", "dom", "info@dom"); ok {
+		t.Errorf("alice still allowed as info@dom")
+	}
+	if ok, _ := a.Authorized(tr, "bob", "dom", "info@dom"); !ok {
+		t.Errorf("bob not allowed as info@dom")
+	}
+
+	// If it can't be loaded, the current addresses are kept.
+	if err := a.AddFile("dom", dir); err == nil {
+		t.Errorf("no error adding a directory")
+	}
+	if ok, _ := a.Authorized(tr, "bob", "dom", "info@dom"); !ok {
+		t.Errorf("bob not allowed as info@dom after a failed load")
+	}
+
+	// If it doesn't exist, there are no addresses.
+	if err := a.AddFile("dom", dir+"/doesnotexist"); err != nil {
+		t.Errorf("error adding a file that does not exist: %v", err)
+	}
+	if ok, _ := a.Authorized(tr, "bob", "dom", "info@dom"); ok {
+		t.Errorf("bob still allowed as info@dom")
+	}
+}
+
+func TestRemoveDomain(t *testing.T) {
+	a, dir := newTestAuthorizer(t)
+	defer testlib.RemoveIfOk(t, dir)
+	tr := trace.New("test", "TestRemoveDomain")
+	defer tr.Finish()
+
+	a.RemoveDomain("dom")
+	if ok, _ := a.Authorized(tr, "alice", "dom", "info@dom"); ok {
+		t.Errorf("alice still allowed as info@dom after removing the domain")
+	}
+
+	// The file is not loaded again on reload.
+	if err := a.Reload(); err != nil {
+		t.Fatalf("error reloading: %v", err)
+	}
+	if ok, _ := a.Authorized(tr, "alice", "dom", "info@dom"); ok {
+		t.Errorf("alice allowed as info@dom after reload")
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	tr := trace.New("test", "TestResolveErrors")
+	defer tr.Finish()
+
+	resolver := aliases.NewResolver(
+		func(tr *trace.Trace, user, domain string) (bool, error) {
+			return false, errors.New("oops")
+		})
+	resolver.AddDomain("dom")
+	a := NewAuthorizer(resolver)
+
+	ok, err := a.Authorized(tr, "alice", "dom", "bob@dom")
+	if ok || err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expected error, got %v, %v", ok, err)
+	}
+}
@@ -1,9 +1,12 @@
 // Package set implement sets for various types. Well, only string for now :)
 package set
 
-// String set.
+import "sync"
+
+// String set. It is safe for concurrent use.
 type String struct {
-	m map[string]struct{}
+	m  map[string]struct{}
+	mu sync.RWMutex
 }
 
 // NewString returns a new string set, with the given values in it.
@@ -15,6 +18,8 @@ func NewString(values ...string) *String {
 
 // Add values to the string set.
 func (s *String) Add(values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.m == nil {
 		s.m = map[string]struct{}{}
 	}
@@ -28,9 +33,20 @@ func (s *String) Add(values ...string) {
 func (s *String) Has(value string) bool {
 	// We explicitly allow s to be nil *in this function* to simplify callers'
 	// code.  Note that Add will not tolerate it, and will panic.
-	if s == nil || s.m == nil {
+	if s == nil {
 		return false
 	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	_, ok := s.m[value]
 	return ok
 }
+
+// Remove values from the string set. Values that are not in it are ignored.
+func (s *String) Remove(values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range values {
+		delete(s.m, v)
+	}
+}
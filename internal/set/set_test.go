@@ -18,6 +18,9 @@ func TestString(t *testing.T) {
 	s2 := NewString("a", "b", "c")
 	expectStrings(s2, []string{"a", "b", "c"}, []string{"notin"}, t)
 
+	s2.Remove("b", "notin")
+	expectStrings(s2, []string{"a", "c"}, []string{"b", "notin"}, t)
+
 	// Test that Has works (and not panics) on a nil set.
 	var s3 *String
 	if s3.Has("x") {
@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DSN holds the Delivery Status Notification parameters for a single
+// recipient, as given in the MAIL and RCPT commands.
+// https://tools.ietf.org/html/rfc3461
+type DSN struct {
+	// RET parameter of MAIL: "FULL" or "HDRS", or empty if not given.
+	Ret string
+
+	// ENVID parameter of MAIL (decoded), or empty if not given.
+	EnvID string
+
+	// NOTIFY parameter of RCPT: either "NEVER", or a combination of
+	// "SUCCESS", "FAILURE" and "DELAY". Empty if not given.
+	Notify []string
+
+	// ORCPT parameter of RCPT (decoded), in the "<addr-type>;<address>"
+	// form, or empty if not given.
+	ORcpt string
+}
+
+// Maximum length of the ENVID and ORCPT values.
+// https://tools.ietf.org/html/rfc3461#section-4.2
+// https://tools.ietf.org/html/rfc3461#section-4.4
+const (
+	maxEnvIDLen = 100
+	maxORcptLen = 500
+)
+
+// mailParams returns the DSN parameters for the MAIL command, with a leading
+// space; or an empty string if there are none.
+func (d *DSN) mailParams() string {
+	s := ""
+	if d.Ret != "" {
+		s += " RET=" + d.Ret
+	}
+	if d.EnvID != "" {
+		s += " ENVID=" + EncodeXtext(d.EnvID)
+	}
+	return s
+}
+
+// rcptParams returns the DSN parameters for the RCPT command, with a leading
+// space; or an empty string if there are none.
+func (d *DSN) rcptParams() string {
+	s := ""
+	if len(d.Notify) > 0 {
+		s += " NOTIFY=" + strings.Join(d.Notify, ",")
+	}
+	if d.ORcpt != "" {
+		addrType, addr, _ := strings.Cut(d.ORcpt, ";")
+		s += " ORCPT=" + addrType + ";" + EncodeXtext(addr)
+	}
+	return s
+}
+
+// ParseRet parses the value of the RET parameter.
+func ParseRet(v string) (string, error) {
+	v = strings.ToUpper(v)
+	if v != "FULL" && v != "HDRS" {
+		return "", fmt.Errorf("invalid RET value %q", v)
+	}
+	return v, nil
+}
+
+// ParseEnvID parses (and decodes) the value of the ENVID parameter.
+func ParseEnvID(v string) (string, error) {
+	if len(v) > maxEnvIDLen {
+		return "", fmt.Errorf("ENVID too long")
+	}
+	return DecodeXtext(v)
+}
+
+// ParseNotify parses the value of the NOTIFY parameter.
+func ParseNotify(v string) ([]string, error) {
+	notify := []string{}
+	seen := map[string]bool{}
+	for _, n := range strings.Split(strings.ToUpper(v), ",") {
+		switch n {
+		case "NEVER", "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return nil, fmt.Errorf("invalid NOTIFY value %q", n)
+		}
+		if !seen[n] {
+			notify = append(notify, n)
+			seen[n] = true
+		}
+	}
+
+	// NEVER can't be combined with other values.
+	if seen["NEVER"] && len(notify) > 1 {
+		return nil, fmt.Errorf("NOTIFY=NEVER combined with other values")
+	}
+	return notify, nil
+}
+
+// ParseORcpt parses (and decodes) the value of the ORCPT parameter.
+// The result is in the "<addr-type>;<address>" form.
+func ParseORcpt(v string) (string, error) {
+	if len(v) > maxORcptLen {
+		return "", fmt.Errorf("ORCPT too long")
+	}
+	addrType, addr, ok := strings.Cut(v, ";")
+	if !ok || addrType == "" || addr == "" {
+		return "", fmt.Errorf("invalid ORCPT value")
+	}
+	for _, c := range addrType {
+		if !isAtext(c) {
+			return "", fmt.Errorf("invalid ORCPT address type")
+		}
+	}
+
+	addr, err := DecodeXtext(addr)
+	if err != nil {
+		return "", err
+	}
+	return addrType + ";" + addr, nil
+}
+
+// isAtext returns true if the character is valid in an RFC 5322 atom.
+func isAtext(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", c)
+}
+
+// EncodeXtext encodes the string using xtext.
+// https://tools.ietf.org/html/rfc3461#section-4
+func EncodeXtext(s string) string {
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&sb, "+%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// DecodeXtext decodes an xtext-encoded string.
+// https://tools.ietf.org/html/rfc3461#section-4
+func DecodeXtext(s string) (string, error) {
+	sb := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("invalid xtext: truncated hexchar")
+			}
+			// Per the RFC the hex digits must be uppercase, but we are
+			// lenient on that.
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid xtext: invalid hexchar")
+			}
+			sb.WriteByte(byte(b))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("invalid xtext: invalid character")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
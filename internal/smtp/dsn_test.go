@@ -0,0 +1,98 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestXtext(t *testing.T) {
+	cases := []struct{ plain, encoded string }{
+		{"", ""},
+		{"abc", "abc"},
+		{"a+b=c d", "a+2Bb+3Dc+20d"},
+		{"user@domain", "user@domain"},
+		{"\t\x7f", "+09+7F"},
+		{"ñ", "+C3+B1"},
+	}
+	for _, c := range cases {
+		if got := EncodeXtext(c.plain); got != c.encoded {
+			t.Errorf("EncodeXtext(%q) = %q, expected %q",
+				c.plain, got, c.encoded)
+		}
+		got, err := DecodeXtext(c.encoded)
+		if got != c.plain || err != nil {
+			t.Errorf("DecodeXtext(%q) = %q, %v; expected %q",
+				c.encoded, got, err, c.plain)
+		}
+	}
+
+	// Lowercase hex digits are accepted.
+	if got, err := DecodeXtext("a+2bb"); got != "a+b" || err != nil {
+		t.Errorf("DecodeXtext(a+2bb) = %q, %v", got, err)
+	}
+
+	for _, s := range []string{"+", "+2", "a+2", "+XY", "a=b", "a b", "ñ"} {
+		if got, err := DecodeXtext(s); err == nil {
+			t.Errorf("DecodeXtext(%q) = %q, expected error", s, got)
+		}
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	if v, err := ParseRet("hdrs"); v != "HDRS" || err != nil {
+		t.Errorf("ParseRet(hdrs) = %q, %v", v, err)
+	}
+	if v, err := ParseRet("blah"); err == nil {
+		t.Errorf("ParseRet(blah) = %q, expected error", v)
+	}
+
+	if v, err := ParseEnvID("a+2Bb"); v != "a+b" || err != nil {
+		t.Errorf("ParseEnvID(a+2Bb) = %q, %v", v, err)
+	}
+	if v, err := ParseEnvID(string(make([]byte, 101))); err == nil {
+		t.Errorf("ParseEnvID(long) = %q, expected error", v)
+	}
+
+	notifyCases := []struct {
+		v      string
+		notify []string
+		ok     bool
+	}{
+		{"NEVER", []string{"NEVER"}, true},
+		{"success,Delay", []string{"SUCCESS", "DELAY"}, true},
+		{"FAILURE,FAILURE", []string{"FAILURE"}, true},
+		{"NEVER,SUCCESS", nil, false},
+		{"SUCCESS,", nil, false},
+		{"", nil, false},
+		{"blah", nil, false},
+	}
+	for _, c := range notifyCases {
+		notify, err := ParseNotify(c.v)
+		if diff := cmp.Diff(c.notify, notify); diff != "" || (err == nil) != c.ok {
+			t.Errorf("ParseNotify(%q) = %v, %v; expected %v, ok=%v",
+				c.v, notify, err, c.notify, c.ok)
+		}
+	}
+
+	orcptCases := []struct {
+		v, orcpt string
+		ok       bool
+	}{
+		{"rfc822;a@b", "rfc822;a@b", true},
+		{"rfc822;a+2Bx@b", "rfc822;a+x@b", true},
+		{"utf-8;a@b", "utf-8;a@b", true},
+		{"rfc822", "", false},
+		{";a@b", "", false},
+		{"rfc822;", "", false},
+		{"rfc 822;a@b", "", false},
+		{"rfc822;a=b", "", false},
+	}
+	for _, c := range orcptCases {
+		orcpt, err := ParseORcpt(c.v)
+		if orcpt != c.orcpt || (err == nil) != c.ok {
+			t.Errorf("ParseORcpt(%q) = %q, %v; expected %q, ok=%v",
+				c.v, orcpt, err, c.orcpt, c.ok)
+		}
+	}
+}
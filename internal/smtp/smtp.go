@@ -2,11 +2,14 @@
 // 5321.  It extends net/smtp as follows:
 //
 //   - Supports SMTPUTF8, via MailAndRcpt.
+//   - Uses CHUNKING (BDAT) for sending data, if the server supports it.
+//   - Supports BINARYMIME, via SetBinaryMIME.
 //   - Adds IsPermanent.
 package smtp
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"net"
 	"net/smtp"
@@ -21,6 +24,9 @@ import (
 // A Client represents a client connection to an SMTP server.
 type Client struct {
 	*smtp.Client
+
+	// Send the data as binary MIME? See SetBinaryMIME.
+	binaryMIME bool
 }
 
 // NewClient uses the given connection to create a new Client.
@@ -37,7 +43,7 @@ func NewClient(conn net.Conn, host string) (*Client, error) {
 	lr := &io.LimitedReader{R: c.Text.Reader.R, N: 2 * 1024 * 1024}
 	c.Text.Reader.R = bufio.NewReader(lr)
 
-	return &Client{c}, nil
+	return &Client{Client: c}, nil
 }
 
 // cmd sends a command and returns the response over the text connection.
@@ -56,7 +62,10 @@ func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, s
 // MailAndRcpt issues MAIL FROM and RCPT TO commands, in sequence.
 // It will check the addresses, decide if SMTPUTF8 is needed, and apply the
 // necessary transformations.
-func (c *Client) MailAndRcpt(from string, to string) error {
+// If dsn is not nil and the server supports the DSN extension, the DSN
+// parameters are included in the commands; use RelaysDSN to find out if
+// that is the case.
+func (c *Client) MailAndRcpt(from string, to string, dsn *DSN) error {
 	from, fromNeeds, err := c.prepareForSMTPUTF8(from)
 	if err != nil {
 		return err
@@ -69,18 +78,156 @@ func (c *Client) MailAndRcpt(from string, to string) error {
 	smtputf8Needed := fromNeeds || toNeeds
 
 	cmdStr := "MAIL FROM:<%s>"
-	if ok, _ := c.Extension("8BITMIME"); ok {
+	if c.binaryMIME {
+		cmdStr += " BODY=BINARYMIME"
+	} else if ok, _ := c.Extension("8BITMIME"); ok {
 		cmdStr += " BODY=8BITMIME"
 	}
 	if smtputf8Needed {
 		cmdStr += " SMTPUTF8"
 	}
+	relayDSN := dsn != nil && c.RelaysDSN()
+	if relayDSN {
+		cmdStr += dsn.mailParams()
+	}
 	_, _, err = c.cmd(250, cmdStr, from)
 	if err != nil {
 		return err
 	}
 
-	_, _, err = c.cmd(25, "RCPT TO:<%s>", to)
+	cmdStr = "RCPT TO:<%s>"
+	if relayDSN {
+		cmdStr += dsn.rcptParams()
+	}
+	_, _, err = c.cmd(25, cmdStr, to)
+	return err
+}
+
+// RelaysDSN returns true if the server supports the DSN extension, in which
+// case the DSN parameters given to MailAndRcpt are relayed, and the server
+// becomes responsible for the delivery notifications.
+// https://tools.ietf.org/html/rfc3461#section-4
+func (c *Client) RelaysDSN() bool {
+	ok, _ := c.Extension("DSN")
+	return ok
+}
+
+// SetBinaryMIME makes the client send the message as binary MIME
+// (BODY=BINARYMIME): the body is sent as-is using BDAT, without converting
+// its line endings. It must be called before MailAndRcpt.
+// Binary data can't be sent to a server which does not support both the
+// BINARYMIME and CHUNKING extensions (we don't know how to convert it), in
+// which case it returns a permanent error.
+// https://tools.ietf.org/html/rfc3030#section-3
+func (c *Client) SetBinaryMIME() error {
+	ok1, _ := c.Extension("BINARYMIME")
+	ok2, _ := c.Extension("CHUNKING")
+	if !ok1 || !ok2 {
+		return &textproto.Error{Code: 554,
+			Msg: "5.6.3 binary MIME message, but server does not support BINARYMIME"}
+	}
+	c.binaryMIME = true
+	return nil
+}
+
+// Data issues a DATA command to the server and returns a writer that can be
+// used to write the mail headers and body. If the server supports the
+// CHUNKING extension, the data is sent using BDAT commands instead.
+// The caller should close the writer before calling any more methods on c.
+func (c *Client) Data() (io.WriteCloser, error) {
+	if c.binaryMIME {
+		return &bdatWriter{c: c, binary: true}, nil
+	}
+	if ok, _ := c.Extension("CHUNKING"); !ok {
+		return c.Client.Data()
+	}
+	return &bdatWriter{c: c}, nil
+}
+
+// Size of the chunks we send with BDAT.
+const bdatChunkSize = 1024 * 1024
+
+// bdatWriter sends the data written to it in chunks using BDAT commands.
+// Like the DATA writer, it converts "\n" line endings into "\r\n".
+// For binary MIME, only the header is converted, the body is sent as-is.
+// https://tools.ietf.org/html/rfc3030
+type bdatWriter struct {
+	c   *Client
+	buf []byte
+
+	// Last byte written (after conversion), to handle line endings across
+	// writes.
+	last byte
+
+	// Binary MIME data? If so, we track the length of the current header
+	// line, to find the empty line which ends the header, and stop
+	// converting after it.
+	binary  bool
+	lineLen int
+	inBody  bool
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if b == '\n' && w.last != '\r' && !w.inBody {
+			w.buf = append(w.buf, '\r')
+		}
+		w.buf = append(w.buf, b)
+		w.last = b
+
+		if w.binary && !w.inBody {
+			if b == '\n' {
+				w.inBody = w.lineLen == 0
+				w.lineLen = 0
+			} else if b != '\r' {
+				w.lineLen++
+			}
+		}
+
+		if len(w.buf) >= bdatChunkSize {
+			if err := w.c.bdat(w.buf, false); err != nil {
+				return i, err
+			}
+			w.buf = w.buf[:0]
+		}
+	}
+	return len(p), nil
+}
+
+func (w *bdatWriter) Close() error {
+	// Make sure the message ends in a newline, like the DATA writer does.
+	// Binary bodies are sent as they are.
+	if w.last != 0 && w.last != '\n' && !w.inBody {
+		w.buf = append(w.buf, '\r', '\n')
+	}
+	return w.c.bdat(w.buf, true)
+}
+
+// bdat sends a BDAT command with the given chunk, and waits for the server's
+// response.
+func (c *Client) bdat(chunk []byte, last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	_, err := fmt.Fprintf(c.Text.W, "%s\r\n", cmd)
+	if err == nil {
+		_, err = c.Text.W.Write(chunk)
+	}
+	if err == nil {
+		err = c.Text.W.Flush()
+	}
+	c.Text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
 	return err
 }
 
@@ -77,7 +77,7 @@ func TestBasic(t *testing.T) {
 		t.Fatalf("Hello failed: %v", err)
 	}
 
-	if err := c.MailAndRcpt("from@from", "to@to"); err != nil {
+	if err := c.MailAndRcpt("from@from", "to@to", nil); err != nil {
 		t.Fatalf("MailAndRcpt failed: %v", err)
 	}
 
@@ -106,7 +106,7 @@ func TestSMTPUTF8(t *testing.T) {
 		t.Fatalf("Hello failed: %v", err)
 	}
 
-	if err := c.MailAndRcpt("año@ñudo", "ñaca@ñoño"); err != nil {
+	if err := c.MailAndRcpt("año@ñudo", "ñaca@ñoño", nil); err != nil {
 		t.Fatalf("MailAndRcpt failed: %v\nDialog: %s", err, fake.Client())
 	}
 
@@ -130,7 +130,7 @@ func TestSMTPUTF8NotSupported(t *testing.T) {
 		t.Fatalf("Hello failed: %v", err)
 	}
 
-	if err := c.MailAndRcpt("año@ñudo", "ñaca@ñoño"); err != nil {
+	if err := c.MailAndRcpt("año@ñudo", "ñaca@ñoño", nil); err != nil {
 		terr, ok := err.(*textproto.Error)
 		if !ok || terr.Code != 599 {
 			t.Fatalf("MailAndRcpt failed with unexpected error: %v\nDialog: %s",
@@ -162,7 +162,7 @@ func TestFallbackToIDNA(t *testing.T) {
 		t.Fatalf("Hello failed: %v", err)
 	}
 
-	if err := c.MailAndRcpt("gran@ñudo", "alto@ñoño"); err != nil {
+	if err := c.MailAndRcpt("gran@ñudo", "alto@ñoño", nil); err != nil {
 		terr, ok := err.(*textproto.Error)
 		if !ok || terr.Code != 599 {
 			t.Fatalf("MailAndRcpt failed with unexpected error: %v\nDialog: %s",
@@ -176,6 +176,206 @@ func TestFallbackToIDNA(t *testing.T) {
 	}
 }
 
+func TestDSN(t *testing.T) {
+	dsn := &DSN{
+		Ret:    "HDRS",
+		EnvID:  "id+ =x",
+		Notify: []string{"SUCCESS", "FAILURE"},
+		ORcpt:  "rfc822;orig+x@to",
+	}
+
+	// Server supports DSN, so the parameters are relayed.
+	fake, client := fakeDialog(`< 220 welcome
+> EHLO a_test
+< 250-server replies your hello
+< 250 DSN
+> MAIL FROM:<from@from> RET=HDRS ENVID=id+2B+20+3Dx
+< 250 MAIL FROM is fine
+> RCPT TO:<to@to> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;orig+2Bx@to
+< 250 RCPT TO is fine
+`)
+
+	c := mustNewClient(t, fake)
+	if err := c.Hello("a_test"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if !c.RelaysDSN() {
+		t.Errorf("RelaysDSN returned false, expected true")
+	}
+	if err := c.MailAndRcpt("from@from", "to@to", dsn); err != nil {
+		t.Fatalf("MailAndRcpt failed: %v", err)
+	}
+	if cmds := fake.Client(); client != cmds {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", cmds, client)
+	}
+
+	// Server does not support DSN, so the parameters are not sent.
+	fake, client = fakeDialog(`< 220 welcome
+> EHLO a_test
+< 250 server replies your hello
+> MAIL FROM:<from@from>
+< 250 MAIL FROM is fine
+> RCPT TO:<to@to>
+< 250 RCPT TO is fine
+`)
+
+	c = mustNewClient(t, fake)
+	if err := c.Hello("a_test"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if c.RelaysDSN() {
+		t.Errorf("RelaysDSN returned true, expected false")
+	}
+	if err := c.MailAndRcpt("from@from", "to@to", dsn); err != nil {
+		t.Fatalf("MailAndRcpt failed: %v", err)
+	}
+	if cmds := fake.Client(); client != cmds {
+		t.Fatalf("Got:\n%s\nExpected:\n%s", cmds, client)
+	}
+}
+
+func TestBDAT(t *testing.T) {
+	fake, client := fakeDialog(`< 220 welcome
+> EHLO a_test
+< 250-server replies your hello
+< 250-CHUNKING
+< 250 HELP
+> MAIL FROM:<from@from>
+< 250 MAIL FROM is fine
+> RCPT TO:<to@to>
+< 250 RCPT TO is fine
+< 250 data is fine
+`)
+	// The data is sent after the RCPT, the server replies as usual.
+	client += "BDAT 25 LAST\r\nSubject: x\r\n\r\nbody\r\nend\r\n"
+
+	c := mustNewClient(t, fake)
+	if err := c.Hello("a_test"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if err := c.MailAndRcpt("from@from", "to@to", nil); err != nil {
+		t.Fatalf("MailAndRcpt failed: %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+	for _, s := range []string{"Subject: x\n", "\r", "\nbody\r\n", "end"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	cmds := fake.Client()
+	if client != cmds {
+		t.Fatalf("Got:\n%q\nExpected:\n%q", cmds, client)
+	}
+}
+
+func TestBDATChunks(t *testing.T) {
+	fake, client := fakeDialog(`< 220 welcome
+> EHLO a_test
+< 250-server replies your hello
+< 250 CHUNKING
+< 250 first chunk ok
+< 250 last chunk ok
+`)
+	data := strings.Repeat("x", bdatChunkSize+10) + "\r\n"
+	client += fmt.Sprintf("BDAT %d\r\n%s", bdatChunkSize, data[:bdatChunkSize])
+	client += fmt.Sprintf("BDAT 12 LAST\r\n%s", data[bdatChunkSize:])
+
+	c := mustNewClient(t, fake)
+	if err := c.Hello("a_test"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	cmds := fake.Client()
+	if client != cmds {
+		t.Fatalf("Unexpected client commands (%d bytes, expected %d)",
+			len(cmds), len(client))
+	}
+}
+
+func TestBinaryMIME(t *testing.T) {
+	fake, client := fakeDialog(`< 220 welcome
+> EHLO a_test
+< 250-server replies your hello
+< 250-8BITMIME
+< 250-BINARYMIME
+< 250 CHUNKING
+> MAIL FROM:<from@from> BODY=BINARYMIME
+< 250 MAIL FROM is fine
+> RCPT TO:<to@to>
+< 250 RCPT TO is fine
+< 250 data is fine
+`)
+	// The header line endings are converted, but the body is sent as-is.
+	client += "BDAT 23 LAST\r\nSubject: x\r\n\r\nb\no\r\nd\ry\x00"
+
+	c := mustNewClient(t, fake)
+	if err := c.Hello("a_test"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if err := c.SetBinaryMIME(); err != nil {
+		t.Fatalf("SetBinaryMIME failed: %v", err)
+	}
+	if err := c.MailAndRcpt("from@from", "to@to", nil); err != nil {
+		t.Fatalf("MailAndRcpt failed: %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %v", err)
+	}
+	for _, s := range []string{"Subject: x\n", "\n", "b\no\r\nd\ry\x00"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	cmds := fake.Client()
+	if client != cmds {
+		t.Fatalf("Got:\n%q\nExpected:\n%q", cmds, client)
+	}
+}
+
+func TestBinaryMIMENotSupported(t *testing.T) {
+	for _, exts := range []string{"250 CHUNKING", "250 BINARYMIME"} {
+		fake, _ := fakeDialog(`< 220 welcome
+> EHLO a_test
+< 250-server replies your hello
+< ` + exts + `
+`)
+		c := mustNewClient(t, fake)
+		if err := c.Hello("a_test"); err != nil {
+			t.Fatalf("Hello failed: %v", err)
+		}
+		err := c.SetBinaryMIME()
+		if err == nil || !IsPermanent(err) {
+			t.Errorf("%q: expected permanent error, got %v", exts, err)
+		}
+	}
+}
+
 func TestLineTooLong(t *testing.T) {
 	// Fake the server sending a >2MiB reply.
 	dialog := `< 220 welcome
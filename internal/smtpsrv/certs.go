@@ -0,0 +1,196 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+
+	"blitiri.com.ar/go/chasquid/internal/acme"
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+	"blitiri.com.ar/go/chasquid/internal/expvarom"
+	"blitiri.com.ar/go/chasquid/internal/normalize"
+)
+
+var (
+	certExpiry = expvarom.NewMap("chasquid/smtpIn/certExpiry",
+		"certificate",
+		"expiration time of the TLS certificates, in seconds since epoch")
+)
+
+// LoadCert loads a TLS certificate (chain) and its private key from the given
+// files.
+func LoadCert(certPath, keyPath string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return cert, err
+	}
+
+	// Parse the leaf once, instead of on every handshake and for the
+	// metrics.
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// AddCerts (TLS) to the server.
+func (s *Server) AddCerts(certPath, keyPath string) error {
+	cert, err := LoadCert(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	certs := append(s.certs[:len(s.certs):len(s.certs)], cert)
+	s.mu.Unlock()
+
+	s.SetCerts(certs)
+	return nil
+}
+
+// SetCerts replaces the server's TLS certificates. New TLS handshakes use the
+// new ones, but it does not affect established connections.
+// The slice must not be modified afterwards.
+func (s *Server) SetCerts(certs []tls.Certificate) {
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+
+	// Update the expiration metrics, removing the ones for certificates
+	// that are no longer there.
+	old := []string{}
+	certExpiry.Do(func(kv expvar.KeyValue) {
+		old = append(old, kv.Key)
+	})
+	for _, name := range old {
+		certExpiry.Delete(name)
+	}
+	for _, cert := range certs {
+		if cert.Leaf == nil {
+			continue
+		}
+		v := new(expvar.Int)
+		v.Set(cert.Leaf.NotAfter.Unix())
+		certExpiry.Set(certName(cert.Leaf), v)
+	}
+}
+
+// numCerts returns how many TLS certificates the server has.
+func (s *Server) numCerts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.certs)
+}
+
+// getCertificate returns the certificate to use for a TLS handshake. It is
+// used as the tls.Config.GetCertificate, so we can change the certificates
+// while running. It selects the certificate in the same way the tls package
+// does by default: the first one that supports the client hello (which
+// includes matching the server name), and if there is none, the first one.
+func (s *Server) getCertificate(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	certs := s.certs
+	s.mu.Unlock()
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates configured")
+	}
+	for i := range certs {
+		if chi.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+// getConfigForClient is used as the tls.Config.GetConfigForClient, to answer
+// the ACME TLS-ALPN-01 challenges. For all other connections it returns nil,
+// so the regular configuration is used.
+func (s *Server) getConfigForClient(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+	if s.ACME == nil || !acme.IsChallenge(chi) {
+		return nil, nil
+	}
+	return s.ACME.GetConfigForClient(chi)
+}
+
+// certName returns a name to identify the certificate with, in the metrics.
+func certName(leaf *x509.Certificate) string {
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames[0]
+	}
+	return leaf.Subject.CommonName
+}
+
+// checkClientCert checks the TLS client certificate, if the client sent
+// one, and sets the identity it maps to (see certIdentity). If implicit
+// authentication is enabled, it also authenticates the connection with it.
+// Clients with certificates we don't accept can still authenticate by
+// other means.
+func (c *Conn) checkClientCert() {
+	if c.clientCAs == nil || !c.mode.IsSubmission ||
+		len(c.tlsConnState.PeerCertificates) == 0 {
+		return
+	}
+
+	user, domain, err := c.certIdentity(c.tlsConnState.PeerCertificates)
+	if err != nil {
+		c.tr.Errorf("client certificate not accepted: %v", err)
+		return
+	}
+	c.tr.Debugf("client certificate for %s@%s", user, domain)
+	c.certUser, c.certDomain = user, domain
+
+	if c.clientCertImplicitAuth {
+		c.completeAuth(user, domain)
+	}
+}
+
+// OID of the emailAddress attribute, which can be in the certificate
+// subject. https://tools.ietf.org/html/rfc5280#appendix-A.1
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// certIdentity verifies the client certificate chain against our CAs, and
+// returns the address the certificate maps to: the first address in one of
+// our local domains, out of its subject alternative names, the subject's
+// emailAddress, and the subject's common name, in that order.
+func (c *Conn) certIdentity(chain []*x509.Certificate) (string, string, error) {
+	cert := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, ic := range chain[1:] {
+		intermediates.AddCert(ic)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         c.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	candidates := append([]string{}, cert.EmailAddresses...)
+	for _, atv := range cert.Subject.Names {
+		if v, ok := atv.Value.(string); ok && atv.Type.Equal(oidEmailAddress) {
+			candidates = append(candidates, v)
+		}
+	}
+	candidates = append(candidates, cert.Subject.CommonName)
+
+	for _, addr := range candidates {
+		if !strings.Contains(addr, "@") {
+			continue
+		}
+		addr, err := normalize.Addr(addr)
+		if err != nil {
+			continue
+		}
+		user, domain := envelope.Split(addr)
+		if user != "" && c.localDomains.Has(domain) {
+			return user, domain, nil
+		}
+	}
+	return "", "", fmt.Errorf("no address in a local domain in %q",
+		cert.Subject)
+}
@@ -0,0 +1,273 @@
+package smtpsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/set"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// writeCert generates a self-signed certificate for the given name, valid
+// until notAfter, and writes it and its key to dir. Returns their paths.
+func writeCert(t *testing.T, dir, name string, notAfter time.Time) (string, string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("error marshalling key: %v", err)
+	}
+
+	certPath, keyPath := dir+"/"+name+".pem", dir+"/"+name+".key"
+	err = os.WriteFile(certPath,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyPath,
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+			0600)
+	}
+	if err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestCerts(t *testing.T) {
+	dir := t.TempDir()
+	expA := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	expB := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+
+	s := NewServer()
+	if s.numCerts() != 0 {
+		t.Errorf("new server has certificates")
+	}
+	if _, err := s.getCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Errorf("got a certificate without any configured")
+	}
+
+	if err := s.AddCerts(writeCert(t, dir, "a.example", expA)); err != nil {
+		t.Fatalf("AddCerts: %v", err)
+	}
+	if err := s.AddCerts(writeCert(t, dir, "b.example", expB)); err != nil {
+		t.Fatalf("AddCerts: %v", err)
+	}
+	if err := s.AddCerts(dir+"/doesnotexist", dir+"/a.example.key"); err == nil {
+		t.Errorf("AddCerts with missing files did not fail")
+	}
+
+	check := func(serverName, expected string) {
+		t.Helper()
+		chi := &tls.ClientHelloInfo{
+			ServerName:        serverName,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+		cert, err := s.getCertificate(chi)
+		if err != nil {
+			t.Fatalf("%q: getCertificate: %v", serverName, err)
+		}
+		if name := certName(cert.Leaf); name != expected {
+			t.Errorf("%q: got certificate for %q, expected %q",
+				serverName, name, expected)
+		}
+	}
+	check("a.example", "a.example")
+	check("b.example", "b.example")
+	check("other", "a.example")
+	check("", "a.example")
+
+	checkExpiry := func(name string, exp time.Time) {
+		t.Helper()
+		v := certExpiry.Get(name)
+		if exp.IsZero() {
+			if v != nil {
+				t.Errorf("%q: unexpected expiry metric %v", name, v)
+			}
+			return
+		}
+		if v == nil || v.String() != strconv.FormatInt(exp.Unix(), 10) {
+			t.Errorf("%q: expiry metric is %v, expected %d",
+				name, v, exp.Unix())
+		}
+	}
+	checkExpiry("a.example", expA)
+	checkExpiry("b.example", expB)
+
+	// Replace them, only b should remain.
+	certB, err := LoadCert(dir+"/b.example.pem", dir+"/b.example.key")
+	if err != nil {
+		t.Fatalf("LoadCert: %v", err)
+	}
+	s.SetCerts([]tls.Certificate{certB})
+	check("a.example", "b.example")
+	checkExpiry("a.example", time.Time{})
+	checkExpiry("b.example", expB)
+}
+
+// testCA is a certificate authority for client certificates, for testing.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(name string) (*testCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}, err
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	p := x509.NewCertPool()
+	p.AddCert(ca.cert)
+	return p
+}
+
+// issue a client certificate with the subject and email addresses from the
+// template.
+func (ca *testCA) issue(tmpl *x509.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	if tmpl.ExtKeyUsage == nil {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, err
+}
+
+func TestCheckClientCert(t *testing.T) {
+	ca, err := newTestCA("Test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := newTestCA("Other CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ca   *testCA
+		tmpl *x509.Certificate
+		addr string
+	}{
+		// Subject alternative names, taking the first local one.
+		{ca, &x509.Certificate{
+			EmailAddresses: []string{"x@remote", "User@Local"},
+		}, "user@local"},
+
+		// The subject's emailAddress and common name.
+		{ca, &x509.Certificate{Subject: pkix.Name{
+			ExtraNames: []pkix.AttributeTypeAndValue{
+				{Type: oidEmailAddress, Value: "mon@local"}},
+			CommonName: "cn@local",
+		}}, "mon@local"},
+		{ca, &x509.Certificate{
+			Subject: pkix.Name{CommonName: "cn@local"},
+		}, "cn@local"},
+
+		// No address in a local domain.
+		{ca, &x509.Certificate{
+			Subject:        pkix.Name{CommonName: "monitoring"},
+			EmailAddresses: []string{"x@remote"},
+		}, ""},
+
+		// Issued by a different CA.
+		{otherCA, &x509.Certificate{
+			EmailAddresses: []string{"user@local"},
+		}, ""},
+
+		// Not for client authentication.
+		{ca, &x509.Certificate{
+			EmailAddresses: []string{"user@local"},
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ""},
+	}
+
+	localDomains := &set.String{}
+	localDomains.Add("local")
+	for _, implicit := range []bool{false, true} {
+		for i, tc := range cases {
+			cert, err := tc.ca.issue(tc.tmpl)
+			if err != nil {
+				t.Fatalf("%d: error issuing certificate: %v", i, err)
+			}
+
+			c := &Conn{
+				tr:                     trace.New("test", "TestCheckClientCert"),
+				mode:                   ModeSubmission,
+				localDomains:           localDomains,
+				clientCAs:              ca.pool(),
+				clientCertImplicitAuth: implicit,
+				tlsConnState: &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{cert.Leaf},
+				},
+			}
+			c.checkClientCert()
+
+			addr := ""
+			if c.certUser != "" {
+				addr = c.certUser + "@" + c.certDomain
+			}
+			if addr != tc.addr {
+				t.Errorf("%d: got %q, expected %q", i, addr, tc.addr)
+			}
+
+			expectAuth := implicit && tc.addr != ""
+			if c.completedAuth != expectAuth ||
+				(expectAuth && c.authUser+"@"+c.authDomain != tc.addr) {
+				t.Errorf("%d (implicit: %v): completedAuth %v as %q@%q",
+					i, implicit, c.completedAuth, c.authUser, c.authDomain)
+			}
+		}
+	}
+}
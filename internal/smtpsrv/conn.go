@@ -5,30 +5,43 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"math/rand"
+	"mime"
 	"net"
 	"net/mail"
 	"net/textproto"
 	"os"
-	"os/exec"
+	"path"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync/atomic"
 	"time"
 
+	"blitiri.com.ar/go/chasquid/internal/acme"
 	"blitiri.com.ar/go/chasquid/internal/aliases"
 	"blitiri.com.ar/go/chasquid/internal/auth"
+	"blitiri.com.ar/go/chasquid/internal/dkim"
+	"blitiri.com.ar/go/chasquid/internal/dmarc"
+	"blitiri.com.ar/go/chasquid/internal/dnsbl"
 	"blitiri.com.ar/go/chasquid/internal/domaininfo"
 	"blitiri.com.ar/go/chasquid/internal/envelope"
 	"blitiri.com.ar/go/chasquid/internal/expvarom"
+	"blitiri.com.ar/go/chasquid/internal/greylist"
 	"blitiri.com.ar/go/chasquid/internal/haproxy"
 	"blitiri.com.ar/go/chasquid/internal/maillog"
+	"blitiri.com.ar/go/chasquid/internal/milter"
 	"blitiri.com.ar/go/chasquid/internal/normalize"
+	"blitiri.com.ar/go/chasquid/internal/policy"
 	"blitiri.com.ar/go/chasquid/internal/queue"
+	"blitiri.com.ar/go/chasquid/internal/senders"
 	"blitiri.com.ar/go/chasquid/internal/set"
+	"blitiri.com.ar/go/chasquid/internal/smtp"
 	"blitiri.com.ar/go/chasquid/internal/tlsconst"
 	"blitiri.com.ar/go/chasquid/internal/trace"
 	"blitiri.com.ar/go/spf"
@@ -52,6 +65,22 @@ var (
 		"result", "count of hook invocations, by result")
 	wrongProtoCount = expvarom.NewMap("chasquid/smtpIn/wrongProtoCount",
 		"command", "count of commands for other protocols")
+	dkimSigned = expvarom.NewMap("chasquid/smtpIn/dkimSigned",
+		"result", "count of DKIM signing attempts, by result")
+	dkimVerified = expvarom.NewMap("chasquid/smtpIn/dkimVerified",
+		"result", "count of DKIM signature verifications, by result")
+	dmarcResults = expvarom.NewMap("chasquid/smtpIn/dmarcResults",
+		"result", "count of DMARC evaluation results, by result")
+	dmarcActions = expvarom.NewMap("chasquid/smtpIn/dmarcActions",
+		"action", "count of actions taken on DMARC failures, by action")
+	rateLimited = expvarom.NewMap("chasquid/smtpIn/rateLimited",
+		"limit", "count of rate-limited connections and commands, by limit")
+	greylistResults = expvarom.NewMap("chasquid/smtpIn/greylistResults",
+		"result", "count of greylisting checks, by result")
+	dnsblResults = expvarom.NewMap("chasquid/smtpIn/dnsblResults",
+		"result", "count of DNSBL checks on incoming connections, by result")
+	senderChecks = expvarom.NewMap("chasquid/smtpIn/senderChecks",
+		"result", "count of sender authorization checks, by location and result")
 )
 
 var (
@@ -60,6 +89,13 @@ var (
 
 	// Some go tests disable SPF, to avoid leaking DNS lookups.
 	disableSPFForTesting = false
+
+	// Some go tests override the TXT lookups done for DKIM and DMARC, to
+	// avoid leaking DNS lookups and to be able to test them.
+	lookupTXTForTesting func(ctx context.Context, domain string) ([]string, error) = nil
+
+	// Some go tests override the lookups done for the DNSBL checks.
+	lookupHostForTesting func(ctx context.Context, host string) ([]string, error) = nil
 )
 
 // SocketMode represents the mode for a socket (listening or connection).
@@ -71,6 +107,10 @@ type SocketMode struct {
 	// Is this mode TLS-wrapped? That means that we don't use STARTTLS, the
 	// connection is directly established over TLS (like HTTPS).
 	TLS bool
+
+	// Is this mode LMTP (RFC 2033)? It is used by content filters and other
+	// MTAs in front of us to hand off mail locally.
+	IsLMTP bool
 }
 
 func (mode SocketMode) String() string {
@@ -78,6 +118,9 @@ func (mode SocketMode) String() string {
 	if mode.IsSubmission {
 		s = "submission"
 	}
+	if mode.IsLMTP {
+		s = "LMTP"
+	}
 	if mode.TLS {
 		s += "+TLS"
 	}
@@ -89,6 +132,7 @@ var (
 	ModeSMTP          = SocketMode{IsSubmission: false, TLS: false}
 	ModeSubmission    = SocketMode{IsSubmission: true, TLS: false}
 	ModeSubmissionTLS = SocketMode{IsSubmission: true, TLS: true}
+	ModeLMTP          = SocketMode{IsLMTP: true}
 )
 
 // Conn represents an incoming SMTP connection.
@@ -96,11 +140,18 @@ type Conn struct {
 	// Main hostname, used for display only.
 	hostname string
 
+	// Hostname configured for the server, used as our authserv-id.
+	// Unlike hostname, the client can't change it (e.g. via SNI).
+	authservID string
+
 	// Maximum data size.
 	maxDataSize int64
 
-	// Post-DATA hook location.
-	postDataHook string
+	// Directory where the hooks are.
+	hookPath string
+
+	// Policy daemon to use instead of the hooks, if not nil.
+	policy *policy.Client
 
 	// Connection information.
 	conn         net.Conn
@@ -124,12 +175,43 @@ type Conn struct {
 	// Envelope.
 	mailFrom string
 	rcptTo   []string
-	data     []byte
+
+	// Message data. The header is kept in memory (in data), and the whole
+	// message is spooled to disk as it arrives; the body begins at
+	// bodyOffset within the spool.
+	data       []byte
+	spool      *spoolWriter
+	bodyOffset int64
+
+	// Did the client use BODY=BINARYMIME in the MAIL command?
+	binaryMIME bool
+
+	// Are we in the middle of a BDAT transfer?
+	chunking bool
+
+	// Delivery status notification parameters given in MAIL, and the
+	// resulting ones for each recipient (including those given in RCPT).
+	dsnRet   string
+	dsnEnvID string
+	dsn      map[string]*smtp.DSN
+
+	// In LMTP mode, the recipients we could not queue the message for, and
+	// why. See replyPerRcpt.
+	rcptErrs map[string]error
 
 	// SPF results.
 	spfResult spf.Result
 	spfError  error
 
+	// DKIM verification results, nil if we didn't verify.
+	dkimVerifyResult *dkim.VerifyResult
+
+	// DMARC evaluation, nil if we didn't evaluate.
+	dmarcResult *dmarc.Evaluation
+
+	// Value of the Authentication-Results header we added, if any.
+	authResults string
+
 	// Are we using TLS?
 	onTLS bool
 
@@ -143,6 +225,59 @@ type Conn struct {
 	aliasesR     *aliases.Resolver
 	dinfo        *domaininfo.DB
 
+	// Sender authorization policy, nil if authenticated users can send as
+	// any address.
+	senders *senders.Authorizer
+
+	// Greylisting database, nil if greylisting is disabled.
+	greylist *greylist.DB
+
+	// Is the sender exempt from greylisting?
+	greylistExempt bool
+
+	// DNSBL checker (nil if disabled), the score at which an address is
+	// considered listed, and what to do in that case ("reject" or "tag").
+	dnsbl          *dnsbl.Checker
+	dnsblThreshold int
+	dnsblAction    string
+
+	// DNSBL results for the remote address, nil if we didn't check.
+	dnsblResult *dnsbl.Result
+
+	// Milters to run, taken from the server at creation time, and our
+	// sessions with them.
+	milters        []*milter.Filter
+	milterSessions []*milterSession
+
+	// Did a milter ask us to discard the current message?
+	milterDiscard bool
+
+	// DKIM signers, per domain, taken from the server at creation time.
+	dkimSigners map[string]*dkim.Signer
+
+	// What to do with messages failing DMARC with a "quarantine" policy.
+	dmarcQuarantineAction string
+
+	// CAs to verify TLS client certificates against (nil if we don't ask
+	// for them), and whether a valid one authenticates the client without
+	// AUTH EXTERNAL.
+	clientCAs              *x509.CertPool
+	clientCertImplicitAuth bool
+
+	// User and domain the TLS client certificate maps to, empty if there is
+	// no valid one. See checkClientCert.
+	certUser   string
+	certDomain string
+
+	// Addresses to authenticate local users as, by user name, when they
+	// connect over a unix socket. See checkPeerCred.
+	unixPeerAuth map[string]string
+
+	// Networks whose clients can relay without authenticating, and the one
+	// the client is in (nil if it is not in any). See trustedNetwork.
+	trustedNets []*net.IPNet
+	trustedNet  *net.IPNet
+
 	// Have we successfully completed AUTH?
 	completedAuth bool
 
@@ -156,16 +291,53 @@ type Conn struct {
 	// Queue where we put incoming mails.
 	queue *queue.Queue
 
+	// Rate limiter, shared by all connections. Can be nil.
+	limiter *rateLimiter
+
 	// Time we wait for network operations.
 	commandTimeout time.Duration
 
 	// Enable HAProxy on incoming connections.
 	haproxyEnabled bool
+
+	// Trust the TLS information given by the proxy, if any.
+	haproxyTrustTLS bool
+
+	// Header sent by the proxy, if haproxyEnabled.
+	proxyHeader *haproxy.Header
+
+	// Closed when the server is shutting down. Can be nil.
+	shutdown <-chan struct{}
+
+	// Set to 1 while waiting for a command outside of a transaction, so
+	// the server can interrupt us if it's shutting down. Accessed
+	// atomically.
+	idle int32
+}
+
+// shuttingDown returns true if the server is shutting down.
+func (c *Conn) shuttingDown() bool {
+	select {
+	case <-c.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// interruptIfIdle interrupts the wait for a command, if we are waiting for
+// one outside of a transaction. It is called by the server when shutting
+// down, from a different goroutine, with the underlying network connection.
+func (c *Conn) interruptIfIdle(nc net.Conn) {
+	if atomic.LoadInt32(&c.idle) == 1 {
+		nc.SetReadDeadline(time.Now())
+	}
 }
 
 // Close the connection.
 func (c *Conn) Close() {
 	c.conn.Close()
+	c.closeSpool()
 }
 
 // Handle implements the main protocol loop (reading commands, sending
@@ -181,6 +353,22 @@ func (c *Conn) Handle() {
 	// then our initial greeting.
 	c.conn.SetDeadline(time.Now().Add(c.commandTimeout))
 
+	// Set up a buffered reader and writer from the conn.
+	// They will be used to do line-oriented, limited I/O.
+	c.reader = bufio.NewReader(c.conn)
+	c.writer = bufio.NewWriter(c.conn)
+
+	// Apply the connection limits before doing any work for the client,
+	// like the TLS handshake. With HAProxy, we only know the client's
+	// address after the proxy header, so they're applied then.
+	c.remoteAddr = c.conn.RemoteAddr()
+	if !c.haproxyEnabled {
+		if !c.limitConnection() {
+			return
+		}
+		defer c.limiter.disconnect(c.remoteAddr)
+	}
+
 	if tc, ok := c.conn.(*tls.Conn); ok {
 		// For TLS connections, complete the handshake and get the state, so
 		// it can be used when we say hello below.
@@ -191,29 +379,65 @@ func (c *Conn) Handle() {
 		}
 
 		cstate := tc.ConnectionState()
+		if acme.IsChallengeConn(&cstate) {
+			// The ACME server only needs the handshake, to validate the
+			// challenge.
+			c.tr.Debugf("ACME TLS-ALPN-01 challenge for %q", cstate.ServerName)
+			return
+		}
 		c.tlsConnState = &cstate
 		if name := c.tlsConnState.ServerName; name != "" {
 			c.hostname = name
 		}
 	}
 
-	// Set up a buffered reader and writer from the conn.
-	// They will be used to do line-oriented, limited I/O.
-	c.reader = bufio.NewReader(c.conn)
-	c.writer = bufio.NewWriter(c.conn)
-
-	c.remoteAddr = c.conn.RemoteAddr()
 	if c.haproxyEnabled {
-		src, dst, err := haproxy.Handshake(c.reader)
+		h, err := haproxy.Handshake(c.reader)
 		if err != nil {
 			c.tr.Errorf("error in haproxy handshake: %v", err)
 			return
 		}
-		c.remoteAddr = src
-		c.tr.Debugf("haproxy handshake: %v -> %v", src, dst)
+		c.useProxyHeader(h)
+
+		if !c.limitConnection() {
+			return
+		}
+		defer c.limiter.disconnect(c.remoteAddr)
+	}
+
+	c.trustedNet = c.trustedNetwork()
+	if c.trustedNet != nil {
+		c.tr.Debugf("client is in trusted network %s", c.trustedNet)
+	}
+
+	if c.tlsConnState != nil {
+		c.checkClientCert()
+	}
+	c.checkPeerCred()
+
+	if code, msg := c.dnsblCheck(); code != 0 {
+		c.printfLine("%d %s", code, msg)
+		return
+	}
+
+	if code, msg := c.runStageHook("post-connect"); code != 0 {
+		maillog.Rejected(c.remoteAddr, "", nil, "hook post-connect: "+msg)
+		c.printfLine("%d %s", code, msg)
+		return
 	}
 
-	c.printfLine("220 %s ESMTP chasquid", c.hostname)
+	defer c.milterClose()
+	if code, msg := c.milterConnect(); code != 0 {
+		maillog.Rejected(c.remoteAddr, "", nil, "milter: "+msg)
+		c.printfLine("%d %s", code, msg)
+		return
+	}
+
+	if c.mode.IsLMTP {
+		c.printfLine("220 %s LMTP chasquid", c.hostname)
+	} else {
+		c.printfLine("220 %s ESMTP chasquid", c.hostname)
+	}
 
 	var cmd, params string
 	var err error
@@ -229,8 +453,27 @@ loop:
 
 		c.conn.SetDeadline(time.Now().Add(c.commandTimeout))
 
+		// If the server is shutting down, don't start new transactions.
+		// The client will try again later.
+		idle := c.mailFrom == ""
+		if idle {
+			atomic.StoreInt32(&c.idle, 1)
+			if c.shuttingDown() {
+				c.tr.Printf("server is shutting down, closing connection")
+				c.printfLine("421 4.3.2 Server shutting down, try again later")
+				break
+			}
+		}
+
 		cmd, params, err = c.readCommand()
+		atomic.StoreInt32(&c.idle, 0)
 		if err != nil {
+			if idle && c.shuttingDown() {
+				// We were interrupted by the server shutting down.
+				c.tr.Printf("server is shutting down, closing connection")
+				c.printfLine("421 4.3.2 Server shutting down, try again later")
+				break
+			}
 			c.printfLine("554 error reading command: %v", err)
 			break
 		}
@@ -249,6 +492,8 @@ loop:
 			code, msg = c.HELO(params)
 		case "EHLO":
 			code, msg = c.EHLO(params)
+		case "LHLO":
+			code, msg = c.LHLO(params)
 		case "HELP":
 			code, msg = c.HELP(params)
 		case "NOOP":
@@ -266,6 +511,8 @@ loop:
 		case "DATA":
 			// DATA handles the whole sequence.
 			code, msg = c.DATA(params)
+		case "BDAT":
+			code, msg = c.BDAT(params)
 		case "STARTTLS":
 			code, msg = c.STARTTLS(params)
 		case "AUTH":
@@ -312,6 +559,12 @@ loop:
 			if err != nil {
 				break
 			}
+
+			// 421 means we are closing the connection.
+			// https://tools.ietf.org/html/rfc5321#section-4.2.2
+			if code == 421 {
+				break
+			}
 		}
 	}
 
@@ -326,11 +579,19 @@ loop:
 
 // HELO SMTP command handler.
 func (c *Conn) HELO(params string) (code int, msg string) {
+	if c.mode.IsLMTP {
+		return 500, "5.5.1 This is LMTP, use LHLO"
+	}
 	if len(strings.TrimSpace(params)) == 0 {
 		return 501, "Invisible customers are not welcome!"
 	}
 	c.ehloDomain = strings.Fields(params)[0]
 
+	if code, msg := c.heloChecks(); code != 0 {
+		c.ehloDomain = ""
+		return code, msg
+	}
+
 	types := []string{
 		"general store", "used armor dealership", "second-hand bookstore",
 		"liquor emporium", "antique weapons outlet", "delicatessen",
@@ -342,23 +603,61 @@ func (c *Conn) HELO(params string) (code int, msg string) {
 	return 250, msg
 }
 
+// heloChecks runs the post-ehlo hook and the milters on the HELO/EHLO
+// domain, which is already in c.ehloDomain.
+func (c *Conn) heloChecks() (code int, msg string) {
+	if code, msg := c.runStageHook("post-ehlo"); code != 0 {
+		maillog.Rejected(c.remoteAddr, "", nil, "hook post-ehlo: "+msg)
+		return code, msg
+	}
+	return c.milterHelo()
+}
+
 // EHLO SMTP command handler.
 func (c *Conn) EHLO(params string) (code int, msg string) {
+	if c.mode.IsLMTP {
+		return 500, "5.5.1 This is LMTP, use LHLO"
+	}
+	return c.ehlo(params)
+}
+
+// LHLO LMTP command handler. It works like EHLO, but only in LMTP mode.
+// https://tools.ietf.org/html/rfc2033#section-4.1
+func (c *Conn) LHLO(params string) (code int, msg string) {
+	if !c.mode.IsLMTP {
+		return 500, "5.5.1 LHLO is only for LMTP"
+	}
+	return c.ehlo(params)
+}
+
+func (c *Conn) ehlo(params string) (code int, msg string) {
 	if len(strings.TrimSpace(params)) == 0 {
 		return 501, "Invisible customers are not welcome!"
 	}
 	c.ehloDomain = strings.Fields(params)[0]
 	c.isESMTP = true
 
+	if code, msg := c.heloChecks(); code != 0 {
+		c.ehloDomain = ""
+		return code, msg
+	}
+
 	buf := bytes.NewBuffer(nil)
 	fmt.Fprintf(buf, c.hostname+" - Your hour of destiny has come.\n")
 	fmt.Fprintf(buf, "8BITMIME\n")
+	fmt.Fprintf(buf, "BINARYMIME\n")
+	fmt.Fprintf(buf, "CHUNKING\n")
+	fmt.Fprintf(buf, "DSN\n")
 	fmt.Fprintf(buf, "PIPELINING\n")
 	fmt.Fprintf(buf, "SMTPUTF8\n")
 	fmt.Fprintf(buf, "ENHANCEDSTATUSCODES\n")
 	fmt.Fprintf(buf, "SIZE %d\n", c.maxDataSize)
 	if c.onTLS {
-		fmt.Fprintf(buf, "AUTH PLAIN\n")
+		mechs := c.authr.Mechanisms()
+		if c.certUser != "" {
+			mechs = append(mechs, "EXTERNAL")
+		}
+		fmt.Fprintf(buf, "AUTH %s\n", strings.Join(mechs, " "))
 	} else {
 		fmt.Fprintf(buf, "STARTTLS\n")
 	}
@@ -404,12 +703,13 @@ func (c *Conn) NOOP(params string) (code int, msg string) {
 // MAIL SMTP command handler.
 func (c *Conn) MAIL(params string) (code int, msg string) {
 	// params should be: "FROM:<name@host>", and possibly followed by
-	// options such as "BODY=8BITMIME" (which we ignore).
+	// options such as "BODY=8BITMIME". We only care about BODY=BINARYMIME
+	// and the DSN parameters, and ignore the rest.
 	// Check that it begins with "FROM:" first, it's mandatory.
 	if !strings.HasPrefix(strings.ToLower(params), "from:") {
 		return 500, "5.5.2 Unknown command"
 	}
-	if c.mode.IsSubmission && !c.completedAuth {
+	if c.mode.IsSubmission && !c.completedAuth && c.trustedNet == nil {
 		return 550, "5.7.9 Mail to submission port must be authenticated"
 	}
 
@@ -423,6 +723,25 @@ func (c *Conn) MAIL(params string) (code int, msg string) {
 	// but that's not according to the RFC. We reset the envelope instead.
 	c.resetEnvelope()
 
+	for _, opt := range strings.Fields(params[5:])[1:] {
+		k, v, _ := strings.Cut(opt, "=")
+		switch strings.ToUpper(k) {
+		case "BODY":
+			// Binary messages can only be sent using BDAT.
+			// https://tools.ietf.org/html/rfc3030#section-3
+			c.binaryMIME = strings.EqualFold(v, "BINARYMIME")
+		case "RET":
+			// https://tools.ietf.org/html/rfc3461#section-4.3
+			c.dsnRet, err = smtp.ParseRet(v)
+		case "ENVID":
+			// https://tools.ietf.org/html/rfc3461#section-4.4
+			c.dsnEnvID, err = smtp.ParseEnvID(v)
+		}
+		if err != nil {
+			return 501, "5.5.4 Malformed DSN parameter: " + err.Error()
+		}
+	}
+
 	// Special case a null reverse-path, which is explicitly allowed and used
 	// for notification messages.
 	// It should be written "<>", we check for that and remove spaces just to
@@ -458,6 +777,13 @@ func (c *Conn) MAIL(params string) (code int, msg string) {
 				"5.7.23 SPF check failed: %v", c.spfError)
 		}
 
+		// Senders that pass SPF and that have used TLS with us before are
+		// not greylisted. This must be done before the security level
+		// check, which can raise the domain's level.
+		c.greylistExempt = c.greylist != nil && c.spfResult == spf.Pass &&
+			c.dinfo.KnownIncomingSecLevel(envelope.DomainOf(addr)) >
+				domaininfo.SecLevel_PLAIN
+
 		if !c.secLevelCheck(addr) {
 			maillog.Rejected(c.remoteAddr, addr, nil,
 				"security level check failed")
@@ -472,6 +798,32 @@ func (c *Conn) MAIL(params string) (code int, msg string) {
 		}
 	}
 
+	if code, msg := c.checkSender("envelope", addr); code != 0 {
+		maillog.Rejected(c.remoteAddr, addr, nil, msg)
+		return code, msg
+	}
+
+	if code, msg := c.runStageHook("post-mail", "MAIL_FROM="+addr); code != 0 {
+		maillog.Rejected(c.remoteAddr, addr, nil, "hook post-mail: "+msg)
+		return code, msg
+	}
+
+	args := strings.Fields(params[5:])[1:]
+	if code, msg := c.milterMail(addr, args); code != 0 {
+		maillog.Rejected(c.remoteAddr, addr, nil, "milter: "+msg)
+		return code, msg
+	}
+
+	// Only count the message once we would accept it, so the rejected
+	// attempts don't use up the client's limit.
+	if limit := c.limiter.message(c.remoteAddr); limit != "" {
+		c.tr.Errorf("rate limited: too many %s", limit)
+		rateLimited.Add(limit, 1)
+		maillog.Rejected(c.remoteAddr, addr, nil,
+			"rate limited: too many "+limit)
+		return 451, "4.7.1 Too many messages, try again later"
+	}
+
 	c.mailFrom = addr
 	return 250, "2.1.5 You feel like you are being watched"
 }
@@ -479,7 +831,8 @@ func (c *Conn) MAIL(params string) (code int, msg string) {
 // checkSPF for the given address, based on the current connection.
 func (c *Conn) checkSPF(addr string) (spf.Result, error) {
 	// Does not apply to authenticated connections, they're allowed regardless.
-	if c.completedAuth {
+	// Neither to trusted networks, as they relay on our behalf.
+	if c.completedAuth || c.trustedNet != nil {
 		return "", nil
 	}
 
@@ -536,10 +889,128 @@ func (c *Conn) secLevelCheck(addr string) bool {
 	return ok
 }
 
+// checkSender checks if the authenticated user can send as the given
+// address, according to the sender authorization policy. The location is
+// where the address comes from ("envelope" or "header"), for tracing.
+// Returns a non-zero code (and the corresponding message) if not.
+func (c *Conn) checkSender(location, addr string) (code int, msg string) {
+	if c.senders == nil || !c.completedAuth {
+		return 0, ""
+	}
+
+	ok, err := c.senders.Authorized(c.tr, c.authUser, c.authDomain, addr)
+	if err != nil {
+		senderChecks.Add(location+":error", 1)
+		c.tr.Errorf("error checking sender %q: %v", addr, err)
+		return 451, "4.4.3 Temporary error checking sender address"
+	}
+	if !ok {
+		senderChecks.Add(location+":denied", 1)
+		c.tr.Errorf("%s@%s is not authorized to send as %q (%s)",
+			c.authUser, c.authDomain, addr, location)
+		return 550, fmt.Sprintf("5.7.1 Not authorized to send as %s", addr)
+	}
+
+	senderChecks.Add(location+":allowed", 1)
+	return 0, ""
+}
+
+// headerAddrParser parses the addresses in the message headers. We only care
+// about the addresses themselves, so display names in charsets we don't know
+// are left undecoded instead of making the parsing fail.
+var headerAddrParser = &mail.AddressParser{
+	WordDecoder: &mime.WordDecoder{
+		CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		},
+	},
+}
+
+// checkHeaderFrom checks the addresses in the From header of the message
+// with checkSender.
+func (c *Conn) checkHeaderFrom() (code int, msg string) {
+	if c.senders == nil {
+		return 0, ""
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(c.data))
+	if err != nil {
+		// This can only happen if the message can't be parsed, which
+		// checkData should have already caught.
+		return 554, "5.6.0 Error parsing message: " + err.Error()
+	}
+
+	// Without a From header, we can't tell who the message claims to be
+	// from, so we can't allow it.
+	values := m.Header["From"]
+	if len(values) == 0 {
+		senderChecks.Add("header:missing", 1)
+		c.tr.Errorf("message has no From header")
+		return 550, "5.7.1 Missing From header"
+	}
+
+	// Check all the From headers, in case there is more than one.
+	froms := []*mail.Address{}
+	for _, v := range values {
+		addrs, err := headerAddrParser.ParseList(v)
+		if err != nil {
+			senderChecks.Add("header:invalid", 1)
+			c.tr.Errorf("error parsing From header: %v", err)
+			return 550, "5.7.1 Invalid From header"
+		}
+		froms = append(froms, addrs...)
+	}
+
+	for _, from := range froms {
+		addr, err := normalize.DomainToUnicode(from.Address)
+		if err != nil {
+			addr = from.Address
+		}
+		if code, msg := c.checkSender("header", addr); code != 0 {
+			return code, msg
+		}
+	}
+
+	return 0, ""
+}
+
+// greylistCheck checks if the recipient is allowed by greylisting, for the
+// current client and sender.
+func (c *Conn) greylistCheck(addr string) bool {
+	// Only greylist incoming mail from unauthenticated clients.
+	if c.greylist == nil || c.completedAuth || c.mode.IsSubmission ||
+		c.trustedNet != nil {
+		return true
+	}
+
+	if c.greylistExempt {
+		greylistResults.Add("exempt", 1)
+		c.tr.Debugf("greylisting: sender is exempt")
+		return true
+	}
+
+	_, network := ipKey(c.remoteAddr)
+	if network == "" {
+		greylistResults.Add("skip", 1)
+		c.tr.Debugf("greylisting: unknown client network, skipping")
+		return true
+	}
+
+	res := c.greylist.Check(c.tr, network, c.mailFrom, addr)
+	greylistResults.Add(string(res), 1)
+	if !res.Accepted() {
+		c.tr.Errorf("greylisted (%s)", res)
+		return false
+	}
+	c.tr.Debugf("greylisting: %s", res)
+	return true
+}
+
 // RCPT SMTP command handler.
 func (c *Conn) RCPT(params string) (code int, msg string) {
 	// params should be: "TO:<name@host>", and possibly followed by options
-	// such as "NOTIFY=SUCCESS,DELAY" (which we ignore).
+	// such as "NOTIFY=SUCCESS,DELAY". We only care about the DSN ones, and
+	// ignore the rest.
 	// Check that it begins with "TO:" first, it's mandatory.
 	if !strings.HasPrefix(strings.ToLower(params), "to:") {
 		return 500, "5.5.2 Unknown command"
@@ -555,6 +1026,30 @@ func (c *Conn) RCPT(params string) (code int, msg string) {
 		return 500, "5.5.4 Malformed command: " + err.Error()
 	}
 
+	if limit := c.limiter.recipient(c.remoteAddr); limit != "" {
+		c.tr.Errorf("rate limited: too many %s", limit)
+		rateLimited.Add(limit, 1)
+		maillog.Rejected(c.remoteAddr, c.mailFrom, []string{rawAddr},
+			"rate limited: too many "+limit)
+		return 451, "4.7.1 Too many recipients, try again later"
+	}
+
+	dsn := &smtp.DSN{Ret: c.dsnRet, EnvID: c.dsnEnvID}
+	for _, opt := range strings.Fields(params[3:])[1:] {
+		k, v, _ := strings.Cut(opt, "=")
+		switch strings.ToUpper(k) {
+		case "NOTIFY":
+			// https://tools.ietf.org/html/rfc3461#section-4.1
+			dsn.Notify, err = smtp.ParseNotify(v)
+		case "ORCPT":
+			// https://tools.ietf.org/html/rfc3461#section-4.2
+			dsn.ORcpt, err = smtp.ParseORcpt(v)
+		}
+		if err != nil {
+			return 501, "5.5.4 Malformed DSN parameter: " + err.Error()
+		}
+	}
+
 	// RFC says 100 is the minimum limit for this, but it seems excessive.
 	// https://tools.ietf.org/html/rfc5321#section-4.5.3.1.8
 	if len(c.rcptTo) > 100 {
@@ -577,7 +1072,7 @@ func (c *Conn) RCPT(params string) (code int, msg string) {
 	}
 
 	localDst := envelope.DomainIn(addr, c.localDomains)
-	if !localDst && !c.completedAuth {
+	if !localDst && !c.completedAuth && c.trustedNet == nil {
 		maillog.Rejected(c.remoteAddr, c.mailFrom, []string{addr},
 			"relay not allowed")
 		return 503, "5.7.1 Relay not allowed"
@@ -603,9 +1098,40 @@ func (c *Conn) RCPT(params string) (code int, msg string) {
 				"local user does not exist")
 			return 550, "5.1.1 Destination address is unknown (user does not exist)"
 		}
+
+		if !c.greylistCheck(addr) {
+			maillog.Rejected(c.remoteAddr, c.mailFrom, []string{addr},
+				"greylisted")
+			return 451, "4.7.1 Greylisted, please try again later"
+		}
 	}
 
+	if code, msg := c.runStageHook("post-rcpt", "RCPT="+addr); code != 0 {
+		maillog.Rejected(c.remoteAddr, c.mailFrom, []string{addr},
+			"hook post-rcpt: "+msg)
+		return code, msg
+	}
+
+	args := strings.Fields(params[3:])[1:]
+	if code, msg := c.milterRcpt(addr, args); code != 0 {
+		maillog.Rejected(c.remoteAddr, c.mailFrom, []string{addr},
+			"milter: "+msg)
+		return code, msg
+	}
+
+	if !localDst && !c.completedAuth {
+		maillog.Relayed(c.remoteAddr, c.mailFrom, addr,
+			fmt.Sprintf("trusted network %s", c.trustedNet))
+	}
+
+	// Only count the recipient once we accept it, like we do for messages.
+	c.limiter.addRecipient(c.remoteAddr)
+
 	c.rcptTo = append(c.rcptTo, addr)
+	if c.dsn == nil {
+		c.dsn = map[string]*smtp.DSN{}
+	}
+	c.dsn[addr] = dsn
 	return 250, "2.1.5 You have an eerie feeling..."
 }
 
@@ -620,18 +1146,40 @@ func (c *Conn) DATA(params string) (code int, msg string) {
 	if len(c.rcptTo) == 0 {
 		return 503, "5.5.1 Need an address to send to"
 	}
+	if c.binaryMIME {
+		// https://tools.ietf.org/html/rfc3030#section-3
+		return 503, "5.5.1 BINARYMIME requires BDAT"
+	}
+	if c.chunking {
+		// https://tools.ietf.org/html/rfc3030#section-2
+		return 503, "5.5.1 DATA cannot be used after BDAT"
+	}
+
+	// Create the spool before going ahead, so we can still reject the
+	// message if that fails. There can be one left from a previous failed
+	// attempt, which we discard.
+	c.closeSpool()
+	var err error
+	c.spool, err = c.newSpool(false)
+	if err != nil {
+		c.tr.Errorf("error creating spool: %v", err)
+		return 451, "4.3.0 Error spooling message, please try again later"
+	}
 
 	// We're going ahead.
-	err := c.writeResponse(354, "You suddenly realize it is unnaturally quiet")
+	err = c.writeResponse(354, "You suddenly realize it is unnaturally quiet")
 	if err != nil {
 		return 554, fmt.Sprintf("5.4.0 Error writing DATA response: %v", err)
 	}
 
 	c.tr.Debugf("<- 354  You experience a strange sense of peace")
-	if c.onTLS {
-		tlsCount.Add("tls", 1)
-	} else {
-		tlsCount.Add("plain", 1)
+
+	if c.mode.IsLMTP {
+		// From now on, there is one reply per recipient.
+		rcpts := c.rcptTo
+		defer func() {
+			code, msg = c.replyPerRcpt(rcpts, code, msg)
+		}()
 	}
 
 	// Increase the deadline for the data transfer to the connection-level
@@ -641,7 +1189,7 @@ func (c *Conn) DATA(params string) (code int, msg string) {
 	// Create a dot reader, limited to the maximum size.
 	dotr := textproto.NewReader(bufio.NewReader(
 		io.LimitReader(c.reader, c.maxDataSize))).DotReader()
-	c.data, err = io.ReadAll(dotr)
+	_, err = io.Copy(c.spool, dotr)
 	if err != nil {
 		if err == io.ErrUnexpectedEOF {
 			// Message is too big already. But we need to keep reading until we see
@@ -654,16 +1202,171 @@ func (c *Conn) DATA(params string) (code int, msg string) {
 		return 554, fmt.Sprintf("5.4.0 Error reading DATA: %v", err)
 	}
 
-	c.tr.Debugf("-> ... %d bytes of data", len(c.data))
+	c.tr.Debugf("-> ... %d bytes of data", c.spool.size)
+
+	return c.processData()
+}
+
+// BDAT SMTP command handler (CHUNKING extension).
+// https://tools.ietf.org/html/rfc3030
+func (c *Conn) BDAT(params string) (code int, msg string) {
+	// params should be "<size> [LAST]".
+	args := strings.Fields(params)
+	if len(args) == 0 {
+		// We can't tell how much data the client is going to send, so there
+		// is no way to stay in sync with it.
+		return 421, "4.5.0 Missing chunk size, bye"
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		return 421, "4.5.0 Invalid chunk size, bye"
+	}
+	last := false
+	if len(args) == 2 && strings.EqualFold(args[1], "LAST") {
+		last = true
+	}
+
+	// The client sends the chunk without waiting for our reply, so we must
+	// always read it, even if we are going to reject it.
+	// Increase the deadline for the data transfer to the connection-level
+	// one, we don't want the command timeout to interfere.
+	c.conn.SetDeadline(c.deadline)
+	malformed := len(args) > 2 || (len(args) == 2 && !last)
+	if !c.chunking {
+		// First chunk, discard any leftovers from a previous failed DATA.
+		c.closeSpool()
+	}
+	received := int64(0)
+	if c.spool != nil {
+		received = c.spool.received
+	}
+	tooBig := received+size > c.maxDataSize
+	accept := !malformed && !tooBig &&
+		c.ehloDomain != "" && c.mailFrom != "" && len(c.rcptTo) > 0
+	var spoolErr error
+	if accept && c.spool == nil {
+		// Binary MIME data is kept as-is.
+		c.spool, spoolErr = c.newSpool(!c.binaryMIME)
+	}
+	if !accept || spoolErr != nil {
+		_, err = io.CopyN(io.Discard, c.reader, size)
+	} else {
+		_, err = io.CopyN(c.spool, c.reader, size)
+	}
+	if err != nil {
+		return 421, fmt.Sprintf("4.4.2 Error reading BDAT chunk: %v", err)
+	}
+	c.tr.Debugf("-> ... %d bytes of data (last: %v)", size, last)
+
+	if malformed {
+		c.resetEnvelope()
+		return 501, "5.5.4 Malformed command"
+	}
+	if c.ehloDomain == "" {
+		return 503, "5.5.1 Invisible customers are not welcome!"
+	}
+	if c.mailFrom == "" {
+		return 503, "5.5.1 Sender not yet given"
+	}
+	if len(c.rcptTo) == 0 {
+		return 503, "5.5.1 Need an address to send to"
+	}
+	if tooBig {
+		// The message is discarded, so the client has to start over.
+		c.resetEnvelope()
+		return 552, "5.3.4 Message too big"
+	}
+	if spoolErr == nil {
+		spoolErr = c.spool.err
+	}
+	if spoolErr != nil {
+		c.tr.Errorf("error spooling: %v", spoolErr)
+		c.resetEnvelope()
+		return 451, "4.3.0 Error spooling message, please try again later"
+	}
+
+	c.chunking = true
+	if !last {
+		return 250, fmt.Sprintf("2.0.0 %d bytes received", size)
+	}
+
+	c.tr.Debugf("-> ... %d bytes of data in total", c.spool.size)
+
+	if c.mode.IsLMTP {
+		rcpts := c.rcptTo
+		code, msg = c.processData()
+		return c.replyPerRcpt(rcpts, code, msg)
+	}
+	return c.processData()
+}
+
+// processData processes the message received via DATA or BDAT, and puts it in
+// the queue.
+func (c *Conn) processData() (code int, msg string) {
+	if c.onTLS {
+		tlsCount.Add("tls", 1)
+	} else {
+		tlsCount.Add("plain", 1)
+	}
+
+	if err := c.spool.finish(); err != nil {
+		c.tr.Errorf("error spooling: %v", err)
+		return 451, "4.3.0 Error spooling message, please try again later"
+	}
+	if err := c.splitHeader(); err != nil {
+		maillog.Rejected(c.remoteAddr, c.mailFrom, c.rcptTo, err.Error())
+		return 552, "5.3.4 Message header too big"
+	}
 
 	if err := checkData(c.data); err != nil {
 		maillog.Rejected(c.remoteAddr, c.mailFrom, c.rcptTo, err.Error())
 		return 554, err.Error()
 	}
 
+	// The headers we use to mark messages can only be trusted if we added
+	// them, so remove the ones that came with the message.
+	c.data = removeMarkerHeaders(c.data)
+
+	// Verify DKIM signatures and DMARC policies on incoming
+	// (non-authenticated) mail.
+	if !c.completedAuth && !c.mode.IsSubmission && c.trustedNet == nil {
+		c.dkimVerify()
+		if code, msg := c.dmarcCheck(); code != 0 {
+			maillog.Rejected(c.remoteAddr, c.mailFrom, c.rcptTo, msg)
+			return code, msg
+		}
+
+		if c.dnsblListed() {
+			c.data = envelope.AddHeader(c.data, "X-DNSBL",
+				c.dnsblResult.String())
+		}
+	}
+
+	if c.completedAuth {
+		if code, msg := c.checkHeaderFrom(); code != 0 {
+			maillog.Rejected(c.remoteAddr, c.mailFrom, c.rcptTo, msg)
+			return code, msg
+		}
+	}
+
 	c.addReceivedHeader()
+	c.addAuthenticationResults()
+
+	if code, msg := c.milterData(); code != 0 {
+		maillog.Rejected(c.remoteAddr, c.mailFrom, c.rcptTo, "milter: "+msg)
+		return code, msg
+	}
+	if c.milterDiscard {
+		// The client is told the message was accepted, but we drop it.
+		c.tr.Printf("Discarded by milter, from %s to %s",
+			c.mailFrom, c.rcptTo)
+		maillog.Rejected(c.remoteAddr, c.mailFrom, c.rcptTo,
+			"discarded by milter")
+		c.resetEnvelope()
+		return 250, "2.0.0 You hear a faint splash in the distance"
+	}
 
-	hookOut, permanent, err := c.runPostDataHook(c.data)
+	hookOut, permanent, err := c.runPostDataHook(c.message())
 	if err != nil {
 		maillog.Rejected(c.remoteAddr, c.mailFrom, c.rcptTo, err.Error())
 		if permanent {
@@ -673,16 +1376,48 @@ func (c *Conn) DATA(params string) (code int, msg string) {
 	}
 	c.data = append(hookOut, c.data...)
 
+	// Sign authenticated mail, if we have a signer for the sender's domain.
+	// This is done last, so the signature covers the headers we added.
+	if c.completedAuth {
+		c.dkimSign()
+	}
+
 	// There are no partial failures here: we put it in the queue, and then if
 	// individual deliveries fail, we report via email.
 	// If we fail to queue, return a transient error.
-	msgID, err := c.queue.Put(c.tr, c.mailFrom, c.rcptTo, c.data)
-	if err != nil {
-		return 451, fmt.Sprintf("4.3.0 Failed to queue message: %v", err)
-	}
+	// The exception is LMTP, where each recipient gets its own reply, so we
+	// queue them separately, and the ones that failed get their own error
+	// (see replyPerRcpt).
+	if c.mode.IsLMTP {
+		var ids map[string]string
+		ids, c.rcptErrs = c.queue.PutPerRcpt(
+			c.tr, c.mailFrom, c.rcptTo, c.dsn, c.binaryMIME, c.authResults,
+			c.message())
+		for _, rcpt := range c.rcptTo {
+			if rerr, ok := c.rcptErrs[rcpt]; ok {
+				maillog.Rejected(c.remoteAddr, c.mailFrom,
+					[]string{rcpt}, rerr.Error())
+				continue
+			}
+			c.tr.Printf("Queued from %s to %s - %s",
+				c.mailFrom, rcpt, ids[rcpt])
+			maillog.Queued(c.remoteAddr, c.mailFrom,
+				[]string{rcpt}, ids[rcpt])
+		}
+		if len(ids) == 0 {
+			return 451, "4.3.0 Failed to queue message"
+		}
+	} else {
+		msgID, err := c.queue.PutWithDSN(
+			c.tr, c.mailFrom, c.rcptTo, c.dsn, c.binaryMIME, c.authResults,
+			c.message())
+		if err != nil {
+			return 451, fmt.Sprintf("4.3.0 Failed to queue message: %v", err)
+		}
 
-	c.tr.Printf("Queued from %s to %s - %s", c.mailFrom, c.rcptTo, msgID)
-	maillog.Queued(c.remoteAddr, c.mailFrom, c.rcptTo, msgID)
+		c.tr.Printf("Queued from %s to %s - %s", c.mailFrom, c.rcptTo, msgID)
+		maillog.Queued(c.remoteAddr, c.mailFrom, c.rcptTo, msgID)
+	}
 
 	// It is very important that we reset the envelope before returning,
 	// so clients can send other emails right away without needing to RSET.
@@ -698,6 +1433,36 @@ func (c *Conn) DATA(params string) (code int, msg string) {
 	return 250, "2.0.0 " + msgs[rand.Int()%len(msgs)]
 }
 
+// replyPerRcpt is used in LMTP mode once the message data has been sent, as
+// then there is one reply for each recipient, in the order they were given.
+// https://tools.ietf.org/html/rfc2033#section-4.2
+// Recipients we could not queue the message for (see processData) get a
+// transient error; the others get the given reply. It writes all the replies
+// except the last one, which is returned to be written as usual.
+func (c *Conn) replyPerRcpt(rcpts []string, code int, msg string) (int, string) {
+	errs := c.rcptErrs
+	c.rcptErrs = nil
+
+	for i, rcpt := range rcpts {
+		rcode, rmsg := code, msg
+		if err, ok := errs[rcpt]; ok {
+			rcode = 451
+			rmsg = fmt.Sprintf("4.3.0 Failed to queue message: %v", err)
+		}
+		if i == len(rcpts)-1 {
+			return rcode, rmsg
+		}
+
+		c.tr.Debugf("<- %d  %s (%s)", rcode, rmsg, rcpt)
+		if err := c.writeResponse(rcode, rmsg); err != nil {
+			// The caller will fail to write the last one too, and close
+			// the connection.
+			break
+		}
+	}
+	return code, msg
+}
+
 func (c *Conn) addReceivedHeader() {
 	var v string
 
@@ -708,6 +1473,9 @@ func (c *Conn) addReceivedHeader() {
 		// For authenticated users, only show the EHLO domain they gave;
 		// explicitly hide their network address.
 		v += fmt.Sprintf("from %s\n", c.ehloDomain)
+	} else if isUnix(c.remoteAddr) {
+		// Clients on unix sockets have no network address, they are local.
+		v += fmt.Sprintf("from localhost (%s; unix socket)\n", c.ehloDomain)
 	} else {
 		// For non-authenticated users we show the real address as canonical,
 		// and then the given EHLO domain for convenience and
@@ -720,7 +1488,9 @@ func (c *Conn) addReceivedHeader() {
 
 	// https://www.iana.org/assignments/mail-parameters/mail-parameters.xhtml#mail-parameters-7
 	with := "SMTP"
-	if c.isESMTP {
+	if c.mode.IsLMTP {
+		with = "LMTP"
+	} else if c.isESMTP {
 		with = "ESMTP"
 	}
 	if c.onTLS {
@@ -731,19 +1501,32 @@ func (c *Conn) addReceivedHeader() {
 	}
 	v += fmt.Sprintf("with %s\n", with)
 
+	proxyTLS := c.proxyTLS()
 	if c.tlsConnState != nil {
 		// https://tools.ietf.org/html/rfc8314#section-4.3
 		v += fmt.Sprintf("tls %s\n",
 			tlsconst.CipherSuiteName(c.tlsConnState.CipherSuite))
+	} else if proxyTLS != nil && proxyTLS.Cipher != "" {
+		v += fmt.Sprintf("tls %s\n", proxyTLS.Cipher)
 	}
 
 	v += fmt.Sprintf("(over %s, ", c.mode)
 	if c.tlsConnState != nil {
 		v += fmt.Sprintf("%s, ", tlsconst.VersionName(c.tlsConnState.Version))
+	} else if proxyTLS != nil {
+		version := proxyTLS.Version
+		if version == "" {
+			version = "TLS"
+		}
+		v += fmt.Sprintf("%s via proxy, ", version)
 	} else {
 		v += "plain text!, "
 	}
 
+	if c.trustedNet != nil && !c.completedAuth {
+		v += fmt.Sprintf("trusted network %s, ", c.trustedNet)
+	}
+
 	// Note we must NOT include c.rcptTo, that would leak BCCs.
 	v += fmt.Sprintf("envelope from %q)\n", c.mailFrom)
 
@@ -761,6 +1544,381 @@ func (c *Conn) addReceivedHeader() {
 	}
 }
 
+// dnsblCheck checks the remote address against the DNS blocklists, and saves
+// the results in the connection. Returns a non-zero code (and the
+// corresponding message) if the connection must be rejected.
+func (c *Conn) dnsblCheck() (code int, msg string) {
+	// Submission clients are often on dynamic addresses, which are usually
+	// listed, so only check incoming mail. Trusted networks are not checked
+	// either.
+	if c.dnsbl == nil || c.mode.IsSubmission || c.trustedNet != nil {
+		return 0, ""
+	}
+
+	tcp, ok := c.remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return 0, ""
+	}
+
+	tr := c.tr.NewChild("DNSBL", tcp.IP.String())
+	defer tr.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ctx = dnsbl.WithTraceFunc(ctx, func(f string, a ...interface{}) {
+		tr.Debugf(f, a...)
+	})
+	if lookupHostForTesting != nil {
+		ctx = dnsbl.WithLookupHostFunc(ctx, lookupHostForTesting)
+	}
+
+	c.dnsblResult = c.dnsbl.Check(ctx, tcp.IP)
+	tr.Debugf("result: %v", c.dnsblResult)
+
+	if !c.dnsblListed() {
+		if c.dnsblResult.Score > 0 {
+			dnsblResults.Add("below-threshold", 1)
+		} else {
+			dnsblResults.Add("pass", 1)
+		}
+		return 0, ""
+	}
+
+	if c.dnsblAction == "tag" {
+		dnsblResults.Add("tag", 1)
+		tr.Printf("listed (%v), tagging", c.dnsblResult)
+		return 0, ""
+	}
+
+	dnsblResults.Add("reject", 1)
+	tr.Errorf("listed (%v), rejecting", c.dnsblResult)
+	maillog.Rejected(c.remoteAddr, "", nil,
+		"listed in DNSBL: "+c.dnsblResult.String())
+	return 554, fmt.Sprintf("5.7.1 Rejected: %s is listed in %s",
+		tcp.IP, strings.Join(c.dnsblResult.Zones(), ", "))
+}
+
+// dnsblListed returns true if the remote address is considered listed by the
+// DNS blocklists.
+func (c *Conn) dnsblListed() bool {
+	return c.dnsblResult != nil && c.dnsblResult.Score >= c.dnsblThreshold &&
+		c.dnsblResult.Score > 0
+}
+
+// dkimVerify verifies the DKIM signatures of the message, and saves the
+// results in the connection.
+func (c *Conn) dkimVerify() {
+	tr := c.tr.NewChild("DKIM.Verify", c.mailFrom)
+	defer tr.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	ctx = dkim.WithTraceFunc(ctx, func(f string, a ...interface{}) {
+		tr.Debugf(f, a...)
+	})
+	if lookupTXTForTesting != nil {
+		ctx = dkim.WithLookupTXTFunc(ctx, lookupTXTForTesting)
+	}
+
+	res, err := dkim.VerifyMessage(ctx, c.message())
+	if err != nil {
+		// This can only happen if the message can't be parsed, which
+		// checkData should have already caught.
+		dkimVerified.Add("error", 1)
+		tr.Errorf("error verifying: %v", err)
+		return
+	}
+
+	if res.Found == 0 {
+		dkimVerified.Add(string(dkim.None), 1)
+	}
+	for _, r := range res.Results {
+		dkimVerified.Add(string(r.State), 1)
+	}
+	tr.Debugf("%d signatures found, %d valid", res.Found, res.Valid)
+	c.dkimVerifyResult = res
+}
+
+// dmarcCheck evaluates the DMARC policy of the message, and applies it.
+// Returns a non-zero code (and the corresponding message) if the message
+// must be rejected.
+func (c *Conn) dmarcCheck() (code int, msg string) {
+	tr := c.tr.NewChild("DMARC", c.mailFrom)
+	defer tr.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	ctx = dmarc.WithTraceFunc(ctx, func(f string, a ...interface{}) {
+		tr.Debugf(f, a...)
+	})
+	if lookupTXTForTesting != nil {
+		ctx = dmarc.WithLookupTXTFunc(ctx, lookupTXTForTesting)
+	}
+
+	spfDomain := ""
+	if c.spfResult == spf.Pass {
+		spfDomain = envelope.DomainOf(c.mailFrom)
+	}
+	dkimDomains := []string{}
+	if c.dkimVerifyResult != nil {
+		dkimDomains = c.dkimVerifyResult.ValidDomains()
+	}
+
+	ev := dmarc.Evaluate(ctx, c.data, spfDomain, dkimDomains)
+	c.dmarcResult = ev
+	dmarcResults.Add(string(ev.Result), 1)
+	tr.Debugf("result: %s, policy: %s, error: %v",
+		ev.Result, ev.Policy, ev.Error)
+
+	if ev.Result != dmarc.Fail {
+		return 0, ""
+	}
+
+	switch ev.Policy {
+	case dmarc.PolicyReject:
+		dmarcActions.Add("reject", 1)
+		tr.Printf("rejecting, as requested by the policy of %s", ev.Domain)
+		return 550, fmt.Sprintf(
+			"5.7.1 Rejected by the DMARC policy of %s", ev.Domain)
+	case dmarc.PolicyQuarantine:
+		return c.dmarcQuarantine(tr, ev)
+	}
+
+	return 0, ""
+}
+
+// dmarcQuarantine applies the configured quarantine action to a message
+// that failed DMARC with a "quarantine" policy.
+func (c *Conn) dmarcQuarantine(tr *trace.Trace, ev *dmarc.Evaluation) (code int, msg string) {
+	action := c.dmarcQuarantineAction
+	if action == "" {
+		action = "header"
+	}
+	dmarcActions.Add("quarantine-"+action, 1)
+	tr.Printf("quarantine (%s), as requested by the policy of %s",
+		action, ev.Domain)
+
+	switch action {
+	case "reject":
+		return 550, fmt.Sprintf(
+			"5.7.1 Rejected by the DMARC policy of %s", ev.Domain)
+	case "header":
+		c.data = envelope.AddHeader(c.data, "X-DMARC-Quarantine", ev.Domain)
+	case "none":
+		// Accept the message as-is: the result is only recorded in the
+		// Authentication-Results header.
+	}
+
+	return 0, ""
+}
+
+// dkimSign signs the message using the signer for the envelope sender's
+// domain, and prepends the resulting DKIM-Signature header.
+// If there is no signer for the domain, it does nothing.
+// Signing errors are not fatal, the message is left unsigned: they can only
+// be caused by malformed messages (e.g. lacking a From header), which we
+// don't want to block.
+func (c *Conn) dkimSign() {
+	domain := envelope.DomainOf(c.mailFrom)
+	signer, ok := c.dkimSigners[domain]
+	if !ok {
+		dkimSigned.Add("skip", 1)
+		return
+	}
+
+	tr := c.tr.NewChild("DKIM.Sign", domain)
+	defer tr.Finish()
+
+	sig, err := signer.Sign(c.message())
+	if err != nil {
+		dkimSigned.Add("error", 1)
+		tr.Errorf("error signing, leaving the message unsigned: %v", err)
+		return
+	}
+
+	dkimSigned.Add("ok", 1)
+	tr.Debugf("signed with selector %q", signer.Selector)
+	c.data = envelope.AddHeader(c.data, "DKIM-Signature", sig)
+}
+
+// addAuthenticationResults adds the Authentication-Results header, with the
+// results of the SPF and DKIM checks. It only applies to non-authenticated
+// mail, which is the one we check.
+// https://datatracker.ietf.org/doc/html/rfc8601
+func (c *Conn) addAuthenticationResults() {
+	if c.completedAuth || c.mode.IsSubmission || c.trustedNet != nil {
+		return
+	}
+
+	// Remove any existing header using our own authserv-id, as they can't be
+	// trusted and downstream filters could be confused by them.
+	// https://datatracker.ietf.org/doc/html/rfc8601#section-5
+	c.data = removeAuthResults(c.data, c.authservID)
+
+	v := c.authservID
+	results := 0
+	if c.spfResult != "" {
+		v += fmt.Sprintf(";\nspf=%s smtp.mailfrom=%s",
+			c.spfResult, authResValue(c.mailFrom))
+		results++
+	}
+	if c.dkimVerifyResult != nil {
+		v += ";\n" + c.dkimVerifyResult.AuthenticationResults()
+		results++
+	}
+	if c.dmarcResult != nil {
+		v += ";\n" + c.dmarcResult.AuthenticationResults()
+		results++
+	}
+	if results == 0 {
+		// https://datatracker.ietf.org/doc/html/rfc8601#section-2.2
+		v += "; none"
+	}
+
+	c.data = envelope.AddHeader(c.data, "Authentication-Results", v)
+	c.authResults = v
+}
+
+// removeAuthResults removes the Authentication-Results headers which use the
+// given authserv-id from the message headers.
+func removeAuthResults(data []byte, authservID string) []byte {
+	return removeHeaders(data, func(name, value string) bool {
+		if !strings.EqualFold(name, "Authentication-Results") {
+			return false
+		}
+		// The authserv-id can be followed by a version number, and is
+		// terminated by ";".
+		id, _, _ := strings.Cut(value, ";")
+		fields := strings.Fields(id)
+		return len(fields) > 0 && strings.EqualFold(fields[0], authservID)
+	})
+}
+
+// markerHeaders are the headers we add to mark messages for users and
+// filters. Copies sent by the client can't be trusted, so they are removed
+// (see removeMarkerHeaders).
+var markerHeaders = []string{
+	"X-DMARC-Quarantine",
+	"X-Milter-Quarantine",
+	"X-DNSBL",
+}
+
+// removeMarkerHeaders removes the markerHeaders from the message headers.
+func removeMarkerHeaders(data []byte) []byte {
+	return removeHeaders(data, func(name, value string) bool {
+		for _, h := range markerHeaders {
+			if strings.EqualFold(name, h) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// removeHeaders removes the headers for which drop returns true from the
+// message headers, including their continuation lines. The name is given
+// without surrounding spaces, and the value as-is.
+func removeHeaders(data []byte, drop func(name, value string) bool) []byte {
+	out := make([]byte, 0, len(data))
+	skipping := false
+	rest := data
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the headers, copy the rest as-is.
+			out = append(out, line...)
+			out = append(out, rest...)
+			break
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation line, belongs to the previous header.
+			if !skipping {
+				out = append(out, line...)
+			}
+			continue
+		}
+
+		name, value, found := strings.Cut(string(line), ":")
+		skipping = found && drop(strings.TrimSpace(name), value)
+		if !skipping {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
+// authResValue quotes the value if needed, so it can be used in an
+// Authentication-Results header.
+func authResValue(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t()<>,;:\\\"[]?=") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// useProxyHeader applies the information given by the proxy to the
+// connection.
+func (c *Conn) useProxyHeader(h *haproxy.Header) {
+	c.proxyHeader = h
+	c.tr.Debugf("haproxy handshake (v%d): %v -> %v",
+		h.Version, h.Src, h.Dst)
+
+	// Connections made by the proxy on its own behalf don't have
+	// addresses, so we keep the real ones.
+	if h.Src != nil {
+		c.remoteAddr = h.Src
+	}
+
+	if ssl := c.proxyTLS(); ssl != nil {
+		// The client connected to the proxy over TLS, which terminated it;
+		// treat it as if the client connected to us over TLS.
+		// The authority is only logged: it comes from the client, and must
+		// not change our identity (which is used, for example, as the
+		// authserv-id).
+		c.tr.Debugf("TLS terminated at the proxy: %s %s (authority %q)",
+			ssl.Version, ssl.Cipher, h.Authority)
+		c.onTLS = true
+	}
+}
+
+// proxyTLS returns the TLS information given by the proxy, if the client
+// connected to it over TLS and we trust it; nil otherwise.
+func (c *Conn) proxyTLS() *haproxy.SSL {
+	h := c.proxyHeader
+	if h == nil || h.SSL == nil || !h.SSL.TLS || !c.haproxyTrustTLS {
+		return nil
+	}
+	return h.SSL
+}
+
+// trustedNetwork returns the trusted network the client's address is in, or
+// nil if it is not in any. With HAProxy, that is the client's address as given
+// by the proxy; connections made by the proxy on its own behalf are never
+// trusted.
+func (c *Conn) trustedNetwork() *net.IPNet {
+	if c.haproxyEnabled && c.proxyHeader.Src == nil {
+		return nil
+	}
+	tcp, ok := c.remoteAddr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	for _, n := range c.trustedNets {
+		if n.Contains(tcp.IP) {
+			return n
+		}
+	}
+	return nil
+}
+
 // addrLiteral converts a net.Addr (must be TCP) into a string for use as
 // address literal, compliant with
 // https://tools.ietf.org/html/rfc5321#section-4.1.3.
@@ -782,6 +1940,35 @@ func addrLiteral(addr net.Addr) string {
 	return s
 }
 
+// limitConnection registers the connection with the rate limiter, using
+// c.remoteAddr. If it's over the limits, it tells the client and returns
+// false; otherwise, c.limiter.disconnect must be called when the connection
+// is closed.
+func (c *Conn) limitConnection() bool {
+	limit := c.limiter.connect(c.remoteAddr)
+	if limit == "" {
+		return true
+	}
+
+	c.tr.Errorf("rate limited: too many %s", limit)
+	rateLimited.Add(limit, 1)
+	maillog.Rejected(c.remoteAddr, "", nil, "rate limited: too many "+limit)
+
+	// Before the TLS handshake we can't reply without doing it, which is
+	// what we want to avoid; so we just close the connection.
+	if tc, ok := c.conn.(*tls.Conn); ok && !tc.ConnectionState().HandshakeComplete {
+		return false
+	}
+	c.printfLine("421 4.7.0 Too many connections, try again later")
+	return false
+}
+
+// isUnix returns true if the address is a unix socket one.
+func isUnix(addr net.Addr) bool {
+	_, ok := addr.(*net.UnixAddr)
+	return ok
+}
+
 // checkData performs very basic checks on the body of the email, to help
 // detect very broad problems like email loops. It does not fully check the
 // sanity of the headers or the structure of the payload.
@@ -830,55 +2017,35 @@ func sanitizeEHLODomain(s string) string {
 
 // runPostDataHook and return the new headers to add, and on error a boolean
 // indicating if it's permanent, and the error itself.
-func (c *Conn) runPostDataHook(data []byte) ([]byte, bool, error) {
+func (c *Conn) runPostDataHook(data io.Reader) ([]byte, bool, error) {
+	hook := path.Join(c.hookPath, "post-data")
 	// TODO: check if the file is executable.
-	if _, err := os.Stat(c.postDataHook); os.IsNotExist(err) {
+	if _, err := os.Stat(hook); c.policy == nil && os.IsNotExist(err) {
 		hookResults.Add("post-data:skip", 1)
 		return nil, false, nil
 	}
 	tr := trace.New("Hook.Post-DATA", c.remoteAddr.String())
 	defer tr.Finish()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, c.postDataHook)
-	cmd.Stdin = bytes.NewReader(data)
-
-	// Prepare the environment, copying some common variables so the hook has
-	// someting reasonable, and then setting the specific ones for this case.
-	for _, v := range strings.Fields("USER PWD SHELL PATH") {
-		cmd.Env = append(cmd.Env, v+"="+os.Getenv(v))
+	env := c.hookEnv()
+	dkimDomains := []string{}
+	if c.dkimVerifyResult != nil {
+		dkimDomains = c.dkimVerifyResult.ValidDomains()
 	}
-	cmd.Env = append(cmd.Env, "REMOTE_ADDR="+c.remoteAddr.String())
-	cmd.Env = append(cmd.Env, "EHLO_DOMAIN="+sanitizeEHLODomain(c.ehloDomain))
-	cmd.Env = append(cmd.Env, "EHLO_DOMAIN_RAW="+c.ehloDomain)
-	cmd.Env = append(cmd.Env, "MAIL_FROM="+c.mailFrom)
-	cmd.Env = append(cmd.Env, "RCPT_TO="+strings.Join(c.rcptTo, " "))
+	env = append(env, "DKIM_PASS="+boolToStr(len(dkimDomains) > 0))
+	env = append(env, "DKIM_DOMAINS="+strings.Join(dkimDomains, " "))
 
-	if c.completedAuth {
-		cmd.Env = append(cmd.Env, "AUTH_AS="+c.authUser+"@"+c.authDomain)
+	var out []byte
+	var permanent bool
+	var err error
+	if c.policy != nil {
+		out, permanent, err = c.queryPolicy(
+			tr, "post-data", env, data, c.messageSize())
 	} else {
-		cmd.Env = append(cmd.Env, "AUTH_AS=")
+		out, permanent, err = runHook(tr, hook, data, env)
 	}
-
-	cmd.Env = append(cmd.Env, "ON_TLS="+boolToStr(c.onTLS))
-	cmd.Env = append(cmd.Env, "FROM_LOCAL_DOMAIN="+boolToStr(
-		envelope.DomainIn(c.mailFrom, c.localDomains)))
-	cmd.Env = append(cmd.Env, "SPF_PASS="+boolToStr(c.spfResult == spf.Pass))
-
-	out, err := cmd.Output()
-	tr.Debugf("stdout: %q", out)
 	if err != nil {
 		hookResults.Add("post-data:fail", 1)
-		tr.Error(err)
-
-		permanent := false
-		if ee, ok := err.(*exec.ExitError); ok {
-			tr.Printf("stderr: %q", string(ee.Stderr))
-			if status, ok := ee.Sys().(syscall.WaitStatus); ok {
-				permanent = status.ExitStatus() == 20
-			}
-		}
 
 		// The error contains the last line of stdout, so filters can pass
 		// some rejection information back to the sender.
@@ -1012,6 +2179,8 @@ func (c *Conn) STARTTLS(params string) (code int, msg string) {
 		c.hostname = name
 	}
 
+	c.checkClientCert()
+
 	// 0 indicates not to send back a reply.
 	return 0, ""
 }
@@ -1029,71 +2198,123 @@ func (c *Conn) AUTH(params string) (code int, msg string) {
 		return 503, "5.5.1 You are already wearing that!"
 	}
 
-	// We only support PLAIN for now, so no need to make this too complicated.
-	// Params should be either "PLAIN" or "PLAIN <response>".
-	// If the response is not there, we reply with 334, and expect the
-	// response back from the client in the next message.
-
+	// Params should be either "<mechanism>" or "<mechanism> <response>".
+	// The mechanism names are case-insensitive.
+	// https://tools.ietf.org/html/rfc4954#section-4
 	sp := strings.SplitN(params, " ", 2)
-	if len(sp) < 1 || sp[0] != "PLAIN" {
-		// As we only offer plain, this should not really happen.
+	mech := strings.ToUpper(sp[0])
+	var session auth.Session
+	var err error
+	if mech == "EXTERNAL" && c.certUser != "" {
+		// The client authenticated with its TLS certificate.
+		session = auth.NewExternalSession(c.tr, c.certUser, c.certDomain)
+	} else {
+		session, err = c.authr.NewSession(c.tr, mech)
+	}
+	if err != nil {
+		// We only offer the supported ones, so this should not really happen.
 		return 534, "5.7.9 Asmodeus demands 534 zorkmids for safe passage"
 	}
 
 	// Note we use more "serious" error messages from now own, as these may
 	// find their way to the users in some circumstances.
 
-	// Get the response, either from the message or interactively.
-	response := ""
+	// The initial response is optional; "=" means it's empty.
+	var response []byte
 	if len(sp) == 2 {
-		response = sp[1]
-	} else {
-		// Reply 334 and expect the user to provide it.
+		response, err = decodeAuthResponse(sp[1])
+		if err != nil {
+			return 501, fmt.Sprintf("5.5.2 Error decoding AUTH response: %v", err)
+		}
+	}
+
+	for {
+		challenge, done, err := session.Next(response)
+		if done {
+			break
+		}
+
+		if err != nil {
+			user, domain := session.Identity()
+			if errors.Is(err, auth.ErrMalformed) {
+				// https://tools.ietf.org/html/rfc4954#section-4
+				return 501, fmt.Sprintf(
+					"5.5.2 Error decoding AUTH response: %v", err)
+			}
+
+			maillog.Auth(c.remoteAddr, user+"@"+domain, false)
+			if errors.Is(err, auth.ErrAuthFailed) {
+				return 535, "5.7.8 Incorrect user or password"
+			}
+
+			// https://tools.ietf.org/html/rfc4954#section-6
+			c.tr.Errorf("error authenticating %q@%q: %v", user, domain, err)
+			return 454, "4.7.0 Temporary authentication failure"
+		}
+
+		// Reply 334 with the challenge, and read the client's response.
 		// In this case, the text IS relevant, as it is taken as the
 		// server-side SASL challenge (empty for PLAIN).
 		// https://tools.ietf.org/html/rfc4954#section-4
-		err := c.writeResponse(334, "")
+		err = c.writeResponse(334,
+			base64.StdEncoding.EncodeToString(challenge))
 		if err != nil {
 			return 554, fmt.Sprintf("5.4.0 Error writing AUTH 334: %v", err)
 		}
 
-		response, err = c.readLine()
+		line, err := c.readLine()
 		if err != nil {
 			return 554, fmt.Sprintf("5.4.0 Error reading AUTH response: %v", err)
 		}
-	}
+		if line == "*" {
+			// The client cancelled the exchange.
+			return 501, "5.0.0 AUTH cancelled"
+		}
 
-	user, domain, passwd, err := auth.DecodeResponse(response)
-	if err != nil {
-		// https://tools.ietf.org/html/rfc4954#section-4
-		return 501, fmt.Sprintf("5.5.2 Error decoding AUTH response: %v", err)
+		response, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return 501, fmt.Sprintf("5.5.2 Error decoding AUTH response: %v", err)
+		}
 	}
 
-	// https://tools.ietf.org/html/rfc4954#section-6
-	authOk, err := c.authr.Authenticate(c.tr, user, domain, passwd)
-	if err != nil {
-		c.tr.Errorf("error authenticating %q@%q: %v", user, domain, err)
-		maillog.Auth(c.remoteAddr, user+"@"+domain, false)
-		return 454, "4.7.0 Temporary authentication failure"
-	}
-	if authOk {
-		c.authUser = user
-		c.authDomain = domain
-		c.completedAuth = true
-		maillog.Auth(c.remoteAddr, user+"@"+domain, true)
-		return 235, "2.7.0 Authentication successful"
-	}
+	c.completeAuth(session.Identity())
+	return 235, "2.7.0 Authentication successful"
+}
 
-	maillog.Auth(c.remoteAddr, user+"@"+domain, false)
-	return 535, "5.7.8 Incorrect user or password"
+// completeAuth marks the connection as authenticated as user@domain.
+func (c *Conn) completeAuth(user, domain string) {
+	c.authUser = user
+	c.authDomain = domain
+	c.completedAuth = true
+	maillog.Auth(c.remoteAddr, user+"@"+domain, true)
+}
+
+// decodeAuthResponse decodes the initial response given in the AUTH command.
+// https://tools.ietf.org/html/rfc4954#section-4
+func decodeAuthResponse(s string) ([]byte, error) {
+	if s == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(s)
 }
 
 func (c *Conn) resetEnvelope() {
+	c.milterAbort()
 	c.mailFrom = ""
 	c.rcptTo = nil
 	c.data = nil
+	c.closeSpool()
+	c.binaryMIME = false
+	c.chunking = false
+	c.dsnRet = ""
+	c.dsnEnvID = ""
+	c.dsn = nil
 	c.spfResult = ""
 	c.spfError = nil
+	c.greylistExempt = false
+	c.dkimVerifyResult = nil
+	c.dmarcResult = nil
+	c.authResults = ""
 }
 
 func (c *Conn) userExists(addr string) (bool, error) {
@@ -2,12 +2,25 @@ package smtpsrv
 
 import (
 	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"blitiri.com.ar/go/chasquid/internal/aliases"
+	"blitiri.com.ar/go/chasquid/internal/dkim"
+	"blitiri.com.ar/go/chasquid/internal/dmarc"
+	"blitiri.com.ar/go/chasquid/internal/dnsbl"
 	"blitiri.com.ar/go/chasquid/internal/domaininfo"
+	"blitiri.com.ar/go/chasquid/internal/greylist"
+	"blitiri.com.ar/go/chasquid/internal/haproxy"
+	"blitiri.com.ar/go/chasquid/internal/senders"
+	"blitiri.com.ar/go/chasquid/internal/set"
 	"blitiri.com.ar/go/chasquid/internal/testlib"
 	"blitiri.com.ar/go/chasquid/internal/trace"
 	"blitiri.com.ar/go/spf"
@@ -64,6 +77,194 @@ func TestSecLevel(t *testing.T) {
 	}
 }
 
+func TestGreylistCheck(t *testing.T) {
+	dir, err := os.MkdirTemp("", "testlib_")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v\n", dir)
+	}
+	defer testlib.RemoveIfOk(t, dir)
+
+	// No delay, so the first retry always passes.
+	gl, err := greylist.New(dir, 0, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create greylist: %v", err)
+	}
+
+	c := &Conn{
+		tr:         trace.New("testconn", "testconn"),
+		mode:       ModeSMTP,
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4")},
+		mailFrom:   "from@x",
+	}
+
+	// Greylisting disabled.
+	if !c.greylistCheck("to1@y") {
+		t.Errorf("greylisted with greylisting disabled")
+	}
+
+	c.greylist = gl
+	if c.greylistCheck("to1@y") {
+		t.Errorf("first attempt was not greylisted")
+	}
+	if !c.greylistCheck("to1@y") {
+		t.Errorf("retry was greylisted")
+	}
+
+	// Clients in the same network are treated the same.
+	c.remoteAddr = &net.TCPAddr{IP: net.ParseIP("1.2.3.5")}
+	if !c.greylistCheck("to1@y") {
+		t.Errorf("retry from the same network was greylisted")
+	}
+
+	// Exempt senders, authenticated users and clients without an IP address
+	// are never greylisted.
+	c.greylistExempt = true
+	if !c.greylistCheck("to2@y") {
+		t.Errorf("exempt sender was greylisted")
+	}
+
+	c.greylistExempt = false
+	c.completedAuth = true
+	if !c.greylistCheck("to2@y") {
+		t.Errorf("authenticated user was greylisted")
+	}
+
+	c.completedAuth = false
+	c.remoteAddr = &net.UnixAddr{Name: "/sock", Net: "unix"}
+	if !c.greylistCheck("to2@y") {
+		t.Errorf("client without IP address was greylisted")
+	}
+
+	// None of the above should have recorded to2@y.
+	c.remoteAddr = &net.TCPAddr{IP: net.ParseIP("1.2.3.4")}
+	if c.greylistCheck("to2@y") {
+		t.Errorf("first attempt for to2@y was not greylisted")
+	}
+}
+
+func TestDNSBLCheck(t *testing.T) {
+	lookupHostForTesting = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "2.0.0.127.bl1", "2.0.0.127.bl2":
+			return []string{"127.0.0.2"}, nil
+		case "3.0.0.127.bl1":
+			return []string{"127.0.0.3"}, nil
+		}
+		return nil, &net.DNSError{Err: "not found", IsNotFound: true}
+	}
+	defer func() { lookupHostForTesting = nil }()
+
+	newConn := func(ip string, mode SocketMode, action string) *Conn {
+		return &Conn{
+			tr:         trace.New("testconn", "testconn"),
+			mode:       mode,
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP(ip)},
+			dnsbl: dnsbl.NewChecker([]dnsbl.Zone{
+				{Domain: "bl1"}, {Domain: "bl2", Weight: 2}}),
+			dnsblThreshold: 2,
+			dnsblAction:    action,
+		}
+	}
+
+	// Listed on both, over the threshold: rejected.
+	c := newConn("127.0.0.2", ModeSMTP, "reject")
+	code, msg := c.dnsblCheck()
+	if code != 554 || msg != "5.7.1 Rejected: 127.0.0.2 is listed in bl1, bl2" {
+		t.Errorf("expected rejection, got %d %q", code, msg)
+	}
+	if !c.dnsblListed() || c.dnsblResult.Score != 3 {
+		t.Errorf("unexpected result: %v", c.dnsblResult)
+	}
+
+	// Same, but tagging instead.
+	c = newConn("127.0.0.2", ModeSMTP, "tag")
+	if code, msg := c.dnsblCheck(); code != 0 {
+		t.Errorf("expected tagging, got %d %q", code, msg)
+	}
+	if !c.dnsblListed() {
+		t.Errorf("expected listed result, got %v", c.dnsblResult)
+	}
+
+	// Listed, but below the threshold.
+	c = newConn("127.0.0.3", ModeSMTP, "reject")
+	if code, msg := c.dnsblCheck(); code != 0 {
+		t.Errorf("expected pass, got %d %q", code, msg)
+	}
+	if c.dnsblListed() || c.dnsblResult.Score != 1 {
+		t.Errorf("unexpected result: %v", c.dnsblResult)
+	}
+
+	// Submission connections are not checked.
+	c = newConn("127.0.0.2", ModeSubmission, "reject")
+	if code, msg := c.dnsblCheck(); code != 0 || c.dnsblResult != nil {
+		t.Errorf("submission was checked: %d %q", code, msg)
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	resolver := aliases.NewResolver(
+		func(tr *trace.Trace, user, domain string) (bool, error) {
+			return true, nil
+		})
+	resolver.SuffixSep = "+"
+	resolver.AddDomain("dom")
+	resolver.AddAliasForTesting("team@dom", "user@dom", aliases.EMAIL)
+
+	c := &Conn{
+		tr:            trace.New("testconn", "testconn"),
+		completedAuth: true,
+		authUser:      "user",
+		authDomain:    "dom",
+	}
+
+	// Without a policy, anything goes.
+	if code, msg := c.checkSender("envelope", "other@dom"); code != 0 {
+		t.Errorf("sender rejected without a policy: %d %s", code, msg)
+	}
+
+	c.senders = senders.NewAuthorizer(resolver)
+	for addr, expected := range map[string]int{
+		"user@dom":     0,
+		"user+x@dom":   0,
+		"team@dom":     0,
+		"other@dom":    550,
+		"user@example": 550,
+	} {
+		if code, msg := c.checkSender("envelope", addr); code != expected {
+			t.Errorf("%q: expected %d, got %d %s", addr, expected, code, msg)
+		}
+	}
+
+	for from, expected := range map[string]int{
+		"User <user@dom>":           0,
+		"user@dom, Team <team@dom>": 0,
+		"user@dom, other@dom":       550,
+		"Spoofed <other@dom>":       550,
+		"\"user@dom\" <other@dom>":  550,
+		"invalid <":                 550,
+
+		// Display names in unknown charsets don't get in the way.
+		"=?x-unknown?q?User?= <user@dom>":  0,
+		"=?x-unknown?q?User?= <other@dom>": 550,
+
+		// All the From headers are checked.
+		"user@dom\nFrom: other@dom": 550,
+		"user@dom\nFrom: team@dom":  0,
+	} {
+		c.data = []byte("From: " + from + "\nSubject: test\n\nbody\n")
+		if code, msg := c.checkHeaderFrom(); code != expected {
+			t.Errorf("From: %q: expected %d, got %d %s",
+				from, expected, code, msg)
+		}
+	}
+
+	// Messages without From are rejected, as we can't check them.
+	c.data = []byte("Subject: test\n\nbody\n")
+	if code, msg := c.checkHeaderFrom(); code != 550 {
+		t.Errorf("message without From: got %d %s", code, msg)
+	}
+}
+
 func TestIsHeader(t *testing.T) {
 	no := []string{
 		"a", "\n", "\n\n", " \n", " ",
@@ -205,3 +406,315 @@ func TestSanitizeEHLODomain(t *testing.T) {
 		}
 	}
 }
+
+func TestDKIMVerifyAndAuthResults(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	oldLookupTXT := lookupTXTForTesting
+	lookupTXTForTesting = func(ctx context.Context, domain string) ([]string, error) {
+		if domain != "sel._domainkey.example.com" {
+			return nil, &net.DNSError{Err: "not found", IsNotFound: true}
+		}
+		return []string{"v=DKIM1; k=ed25519; p=" +
+			base64.StdEncoding.EncodeToString(pub)}, nil
+	}
+	defer func() { lookupTXTForTesting = oldLookupTXT }()
+
+	msg := "From: from@example.com\nSubject: Hi\n\nHello\n"
+	signer := &dkim.Signer{
+		Domain:   "example.com",
+		Selector: "sel",
+		Signer:   priv,
+	}
+	sig, err := signer.Sign(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	c := &Conn{
+		tr:         trace.New("testconn", "testconn"),
+		hostname:   "sni.test",
+		authservID: "mx.test",
+		mailFrom:   "from@example.com",
+		spfResult:  spf.Pass,
+		data: []byte(
+			"Authentication-Results: mx.test; dkim=pass\n" +
+				"  header.d=forged.example\n" +
+				"Authentication-Results: other.test; spf=fail\n" +
+				"DKIM-Signature: " + strings.ReplaceAll(sig, "\n", "\n\t") +
+				"\n" + msg),
+	}
+
+	c.dkimVerify()
+	if c.dkimVerifyResult == nil || c.dkimVerifyResult.Valid != 1 {
+		t.Fatalf("unexpected verification result: %+v",
+			c.dkimVerifyResult)
+	}
+
+	c.addAuthenticationResults()
+	data := string(c.data)
+	expected := "Authentication-Results: mx.test;\n" +
+		"\tspf=pass smtp.mailfrom=from@example.com;\n" +
+		"\tdkim=pass header.d=example.com header.s=sel header.b="
+	if !strings.HasPrefix(data, expected) {
+		t.Errorf("unexpected header, got:\n%s\nexpected prefix:\n%s",
+			data, expected)
+	}
+	if strings.Contains(data, "forged.example") {
+		t.Errorf("forged Authentication-Results header not removed:\n%s",
+			data)
+	}
+	if !strings.Contains(data, "Authentication-Results: other.test;") {
+		t.Errorf("unrelated Authentication-Results header removed:\n%s",
+			data)
+	}
+
+	// Authenticated connections don't get the header.
+	c.completedAuth = true
+	c.data = []byte(msg)
+	c.addAuthenticationResults()
+	if string(c.data) != msg {
+		t.Errorf("header added to authenticated message:\n%s", c.data)
+	}
+
+	// No checks done.
+	c.completedAuth = false
+	c.spfResult = ""
+	c.dkimVerifyResult = nil
+	c.addAuthenticationResults()
+	if !strings.HasPrefix(string(c.data),
+		"Authentication-Results: mx.test; none\n") {
+		t.Errorf("unexpected header:\n%s", c.data)
+	}
+}
+
+func TestDMARCQuarantineActions(t *testing.T) {
+	msg := "From: x@dom\n\nbody\n"
+	ev := &dmarc.Evaluation{Domain: "dom", Result: dmarc.Fail,
+		Policy: dmarc.PolicyQuarantine}
+	cases := []struct {
+		action string
+		code   int
+		data   string
+	}{
+		{"", 0, "X-DMARC-Quarantine: dom\n" + msg},
+		{"header", 0, "X-DMARC-Quarantine: dom\n" + msg},
+		{"reject", 550, msg},
+		{"none", 0, msg},
+	}
+	for _, tc := range cases {
+		tr := trace.New("test", tc.action)
+		c := &Conn{
+			tr:                    tr,
+			dmarcQuarantineAction: tc.action,
+			data:                  []byte(msg),
+		}
+		code, _ := c.dmarcQuarantine(tr, ev)
+		if code != tc.code || string(c.data) != tc.data {
+			t.Errorf("%q: got %d %q, expected %d %q",
+				tc.action, code, c.data, tc.code, tc.data)
+		}
+		tr.Finish()
+	}
+}
+
+func TestRemoveAuthResults(t *testing.T) {
+	cases := []struct{ data, expected string }{
+		{"", ""},
+		{"Subject: x\n\nbody\n", "Subject: x\n\nbody\n"},
+		{"Authentication-Results: mx; spf=pass\nSubject: x\n\nbody\n",
+			"Subject: x\n\nbody\n"},
+		{"authentication-results:  MX 1;\n spf=pass\nSubject: x\n\n",
+			"Subject: x\n\n"},
+		{"Authentication-Results: mx.other; none\n\n",
+			"Authentication-Results: mx.other; none\n\n"},
+		// Only headers are affected.
+		{"Subject: x\n\nAuthentication-Results: mx; none\n",
+			"Subject: x\n\nAuthentication-Results: mx; none\n"},
+	}
+	for _, c := range cases {
+		got := string(removeAuthResults([]byte(c.data), "mx"))
+		if got != c.expected {
+			t.Errorf("removeAuthResults(%q) = %q, expected %q",
+				c.data, got, c.expected)
+		}
+	}
+}
+
+func TestRemoveMarkerHeaders(t *testing.T) {
+	cases := []struct{ data, expected string }{
+		{"Subject: x\n\nbody\n", "Subject: x\n\nbody\n"},
+		{"X-DMARC-Quarantine: dom\nSubject: x\n\nbody\n",
+			"Subject: x\n\nbody\n"},
+		{"x-milter-quarantine:\n  spam\nX-DNSBL: bl 1\nSubject: x\n\n",
+			"Subject: x\n\n"},
+		{"X-DMARC-Quarantine-Not: x\n\n", "X-DMARC-Quarantine-Not: x\n\n"},
+		// Only headers are affected.
+		{"Subject: x\n\nX-DNSBL: bl 1\n", "Subject: x\n\nX-DNSBL: bl 1\n"},
+	}
+	for _, c := range cases {
+		got := string(removeMarkerHeaders([]byte(c.data)))
+		if got != c.expected {
+			t.Errorf("removeMarkerHeaders(%q) = %q, expected %q",
+				c.data, got, c.expected)
+		}
+	}
+}
+
+func TestAuthResValue(t *testing.T) {
+	cases := []struct{ s, expected string }{
+		{"user@domain", "user@domain"},
+		{"", `""`},
+		{"a b@c", `"a b@c"`},
+		{`a"b@c`, `"a\"b@c"`},
+		{"<>", `"<>"`},
+	}
+	for _, c := range cases {
+		if got := authResValue(c.s); got != c.expected {
+			t.Errorf("authResValue(%q) = %q, expected %q",
+				c.s, got, c.expected)
+		}
+	}
+}
+
+func TestProxyTLSReceived(t *testing.T) {
+	hdr := &haproxy.Header{
+		Version: 2,
+		SSL: &haproxy.SSL{
+			TLS: true, Version: "TLSv1.3", Cipher: "TLS_AES_128_GCM_SHA256"},
+	}
+	newConn := func(trust bool) *Conn {
+		return &Conn{
+			hostname:        "mx",
+			mode:            ModeSubmission,
+			remoteAddr:      &net.TCPAddr{IP: net.ParseIP("1.2.3.4")},
+			isESMTP:         true,
+			onTLS:           trust,
+			proxyHeader:     hdr,
+			haproxyTrustTLS: trust,
+		}
+	}
+
+	c := newConn(true)
+	c.addReceivedHeader()
+	for _, s := range []string{
+		"with ESMTPS", "tls TLS_AES_128_GCM_SHA256", "TLSv1.3 via proxy"} {
+		if !strings.Contains(string(c.data), s) {
+			t.Errorf("trusted: missing %q in %q", s, c.data)
+		}
+	}
+
+	// If we don't trust the proxy, its TLS information is ignored.
+	c = newConn(false)
+	c.addReceivedHeader()
+	if !strings.Contains(string(c.data), "plain text!") ||
+		strings.Contains(string(c.data), "TLS") {
+		t.Errorf("untrusted: unexpected header %q", c.data)
+	}
+}
+
+func TestProxyAuthority(t *testing.T) {
+	c := &Conn{
+		tr:              trace.New("testconn", "testconn"),
+		hostname:        "mx",
+		authservID:      "mx",
+		haproxyEnabled:  true,
+		haproxyTrustTLS: true,
+	}
+	c.useProxyHeader(&haproxy.Header{
+		Version:   2,
+		Src:       &net.TCPAddr{IP: net.ParseIP("1.2.3.4")},
+		Authority: "evil.example",
+		SSL:       &haproxy.SSL{TLS: true, Version: "TLSv1.3"},
+	})
+
+	if !c.onTLS {
+		t.Errorf("TLS at the proxy not recognized")
+	}
+	if c.remoteAddr.String() != "1.2.3.4:0" {
+		t.Errorf("unexpected remote address %v", c.remoteAddr)
+	}
+	if c.hostname != "mx" || c.authservID != "mx" {
+		t.Errorf("authority changed our identity: %q / %q",
+			c.hostname, c.authservID)
+	}
+}
+
+func TestUnixReceived(t *testing.T) {
+	c := &Conn{
+		hostname:   "mx",
+		mode:       ModeLMTP,
+		remoteAddr: &net.UnixAddr{Name: "@", Net: "unix"},
+		ehloDomain: "filter",
+	}
+	c.addReceivedHeader()
+	if !strings.HasPrefix(string(c.data),
+		"Received: from localhost (filter; unix socket)\n") {
+		t.Errorf("unexpected Received header: %q", c.data)
+	}
+}
+
+func TestTrustedNetwork(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	client := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+	outside := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	proxy := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	cases := []struct {
+		remote  net.Addr
+		hdr     *haproxy.Header
+		trusted bool
+	}{
+		{client, nil, true},
+		{outside, nil, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, nil, false},
+
+		// With HAProxy, the address given by the proxy is the one that
+		// counts. The proxy's own connections are not trusted.
+		{client, &haproxy.Header{Src: client, Dst: proxy}, true},
+		{outside, &haproxy.Header{Src: outside, Dst: proxy}, false},
+		{proxy, &haproxy.Header{}, false},
+	}
+	for i, tc := range cases {
+		c := &Conn{
+			remoteAddr:     tc.remote,
+			trustedNets:    []*net.IPNet{lan},
+			haproxyEnabled: tc.hdr != nil,
+			proxyHeader:    tc.hdr,
+		}
+		if trusted := c.trustedNetwork() != nil; trusted != tc.trusted {
+			t.Errorf("%d: %v (proxy header %v): trusted %v, expected %v",
+				i, tc.remote, tc.hdr, trusted, tc.trusted)
+		}
+	}
+
+	// Clients in a trusted network can relay, and it is noted in the
+	// Received header.
+	c := &Conn{
+		tr:           trace.New("test", "TestTrustedNetwork"),
+		hostname:     "mx",
+		mode:         ModeSMTP,
+		remoteAddr:   client,
+		localDomains: set.NewString("local"),
+		trustedNets:  []*net.IPNet{lan},
+		ehloDomain:   "printer",
+		mailFrom:     "printer@local",
+	}
+	c.trustedNet = c.trustedNetwork()
+	if code, msg := c.RCPT("TO:<someone@remote>"); code != 250 {
+		t.Errorf("RCPT from trusted network failed: %d %s", code, msg)
+	}
+	c.addReceivedHeader()
+	if !strings.Contains(string(c.data), "trusted network 10.0.0.0/8") {
+		t.Errorf("Received header does not mention the network: %q", c.data)
+	}
+
+	// Other clients can't.
+	c.remoteAddr = outside
+	c.trustedNet = c.trustedNetwork()
+	if code, msg := c.RCPT("TO:<other@remote>"); code != 503 {
+		t.Errorf("RCPT from untrusted network: %d %s", code, msg)
+	}
+}
@@ -0,0 +1,224 @@
+package smtpsrv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+	"blitiri.com.ar/go/chasquid/internal/policy"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+	"blitiri.com.ar/go/spf"
+)
+
+// Default messages for rejections by the stage hooks, used when they don't
+// give one.
+const (
+	hookPermMsg = "5.7.1 Rejected by policy"
+	hookTempMsg = "4.7.1 Temporarily rejected by policy, please try again later"
+)
+
+// hookEnv returns the environment for running the hooks, based on the
+// current connection state. It is also what we send to the policy daemon.
+func (c *Conn) hookEnv() []string {
+	env := []string{}
+	env = append(env, "REMOTE_ADDR="+c.remoteAddr.String())
+	env = append(env, "EHLO_DOMAIN="+sanitizeEHLODomain(c.ehloDomain))
+	env = append(env, "EHLO_DOMAIN_RAW="+c.ehloDomain)
+	env = append(env, "MAIL_FROM="+c.mailFrom)
+	env = append(env, "RCPT_TO="+strings.Join(c.rcptTo, " "))
+
+	if c.completedAuth {
+		env = append(env, "AUTH_AS="+c.authUser+"@"+c.authDomain)
+	} else {
+		env = append(env, "AUTH_AS=")
+	}
+
+	env = append(env, "ON_TLS="+boolToStr(c.onTLS))
+	env = append(env, "FROM_LOCAL_DOMAIN="+boolToStr(
+		envelope.DomainIn(c.mailFrom, c.localDomains)))
+	env = append(env, "SPF_PASS="+boolToStr(c.spfResult == spf.Pass))
+
+	dnsblScore, dnsblZones := 0, []string{}
+	if c.dnsblResult != nil {
+		dnsblScore, dnsblZones = c.dnsblResult.Score, c.dnsblResult.Zones()
+	}
+	env = append(env, "DNSBL_SCORE="+strconv.Itoa(dnsblScore))
+	env = append(env, "DNSBL_ZONES="+strings.Join(dnsblZones, " "))
+	env = append(env, "DNSBL_LISTED="+boolToStr(c.dnsblListed()))
+
+	return env
+}
+
+// Timeout for running the hooks, or for the policy daemon to reply.
+const hookTimeout = 1 * time.Minute
+
+// runHook runs the given hook with the given stdin (which can be nil) and
+// environment, and returns its output. On errors, it also returns if they
+// are permanent, which the hook signals by exiting with status 20.
+func runHook(tr *trace.Trace, hook string, stdin io.Reader, env []string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdin = stdin
+
+	// Copy some common variables so the hook has something reasonable, and
+	// then add the specific ones.
+	for _, v := range strings.Fields("USER PWD SHELL PATH") {
+		cmd.Env = append(cmd.Env, v+"="+os.Getenv(v))
+	}
+	cmd.Env = append(cmd.Env, env...)
+
+	out, err := cmd.Output()
+	tr.Debugf("stdout: %q", out)
+	if err != nil {
+		tr.Error(err)
+
+		permanent := false
+		if ee, ok := err.(*exec.ExitError); ok {
+			tr.Printf("stderr: %q", string(ee.Stderr))
+			if status, ok := ee.Sys().(syscall.WaitStatus); ok {
+				permanent = status.ExitStatus() == 20
+			}
+		}
+		return out, permanent, err
+	}
+	return out, false, nil
+}
+
+// queryPolicy sends the request for the given hook to the policy daemon,
+// and returns the results in the same way as runHook, as if the hook had
+// been run: the output (the headers to add, or the rejection message), and
+// on errors, if they are permanent.
+func (c *Conn) queryPolicy(tr *trace.Trace, hook string, env []string, data io.Reader, size int64) ([]byte, bool, error) {
+	req := &policy.Request{
+		Type:  hook,
+		Attrs: map[string]string{},
+		Data:  data,
+		Size:  size,
+	}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		req.Attrs[strings.ToLower(k)] = v
+	}
+
+	resp, err := c.policy.Query(req, hookTimeout)
+	if err != nil {
+		tr.Errorf("error querying policy daemon %v: %v", c.policy, err)
+		return []byte(hookTempMsg + "\n"), false, err
+	}
+	tr.Debugf("policy daemon response: %v", resp)
+
+	switch resp.Action {
+	case policy.Reject:
+		msg := withStatusCode(resp.Message, true)
+		return []byte(msg + "\n"), true, errors.New("rejected")
+	case policy.TempFail:
+		msg := withStatusCode(resp.Message, false)
+		return []byte(msg + "\n"), false, errors.New("tempfail")
+	}
+
+	out := ""
+	for _, h := range resp.Headers {
+		out += h + "\n"
+	}
+	return []byte(out), false, nil
+}
+
+// withStatusCode returns the rejection message, with an enhanced status code
+// if it doesn't already begin with one. An empty message is replaced with
+// the default one.
+func withStatusCode(msg string, permanent bool) string {
+	if msg == "" {
+		if permanent {
+			return hookPermMsg
+		}
+		return hookTempMsg
+	}
+	if hasStatusCode(msg) {
+		return msg
+	}
+	if permanent {
+		return "5.7.1 " + msg
+	}
+	return "4.7.1 " + msg
+}
+
+// hasStatusCode checks if the message begins with an enhanced status code
+// (class.subject.detail, as in "5.7.1").
+// https://tools.ietf.org/html/rfc3463#section-2
+func hasStatusCode(msg string) bool {
+	code, _, _ := strings.Cut(msg, " ")
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 ||
+		!strings.ContainsAny(parts[0], "245") {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if len(p) < 1 || len(p) > 3 ||
+			strings.Trim(p, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// runStageHook runs the hook for the given stage of the SMTP conversation
+// (post-connect, post-ehlo, post-mail or post-rcpt), if it exists; or sends
+// the request to the policy daemon instead, if there is one.
+// The extra environment variables are added to (and override) the common
+// ones.
+// If the hook rejects, returns the code and message to reply with; the
+// message is the last line of the hook's output.
+func (c *Conn) runStageHook(stage string, extraEnv ...string) (code int, msg string) {
+	hook := path.Join(c.hookPath, stage)
+	// TODO: check if the file is executable.
+	if _, err := os.Stat(hook); c.policy == nil && os.IsNotExist(err) {
+		hookResults.Add(stage+":skip", 1)
+		return 0, ""
+	}
+	tr := trace.New("Hook."+stage, c.remoteAddr.String())
+	defer tr.Finish()
+
+	// Variables that appear more than once take the last value.
+	env := append(c.hookEnv(), extraEnv...)
+
+	var out []byte
+	var permanent bool
+	var err error
+	if c.policy != nil {
+		out, permanent, err = c.queryPolicy(tr, stage, env, nil, 0)
+	} else {
+		out, permanent, err = runHook(tr, hook, nil, env)
+	}
+	if err == nil {
+		tr.Debugf("success")
+		hookResults.Add(stage+":success", 1)
+		return 0, ""
+	}
+	hookResults.Add(stage+":fail", 1)
+
+	// post-connect rejections close the connection, so use the codes that
+	// reflect that.
+	permCode, tempCode := 550, 451
+	if stage == "post-connect" {
+		permCode, tempCode = 554, 421
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	msg = withStatusCode(strings.TrimSpace(lines[len(lines)-1]), permanent)
+	code = tempCode
+	if permanent {
+		code = permCode
+	}
+
+	c.tr.Printf("%s hook rejected: %d %s", stage, code, msg)
+	return code, msg
+}
@@ -0,0 +1,183 @@
+package smtpsrv
+
+import (
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"blitiri.com.ar/go/chasquid/internal/policy"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+func writeHook(t *testing.T, dir, name, script string) {
+	t.Helper()
+	err := os.WriteFile(path.Join(dir, name), []byte("#!/bin/sh\n"+script), 0700)
+	if err != nil {
+		t.Fatalf("error writing hook: %v", err)
+	}
+}
+
+func TestRunStageHook(t *testing.T) {
+	dir := t.TempDir()
+	writeHook(t, dir, "post-connect",
+		`echo "4.7.0 Not now, $REMOTE_ADDR"; exit 1`)
+	writeHook(t, dir, "post-ehlo",
+		`test "$EHLO_DOMAIN" = "good" && exit 0; exit 20`)
+	writeHook(t, dir, "post-mail",
+		`test "$MAIL_FROM" = "good@x" && exit 0;
+		 test "$MAIL_FROM" = "plain@x" && { echo "Go away"; exit 1; };
+		 echo "5.7.1 Bad sender"; exit 20`)
+	writeHook(t, dir, "post-rcpt",
+		`test "$RCPT_TO" = "a@x" || exit 1; echo "line 1"; echo "5.1.1 No $RCPT";
+		 exit 20`)
+
+	c := &Conn{
+		tr:         trace.New("testconn", "testconn"),
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 25},
+		hookPath:   dir,
+	}
+
+	check := func(stage string, env []string, expCode int, expMsg string) {
+		t.Helper()
+		code, msg := c.runStageHook(stage, env...)
+		if code != expCode || msg != expMsg {
+			t.Errorf("%s %v: got %d %q, expected %d %q",
+				stage, env, code, msg, expCode, expMsg)
+		}
+	}
+
+	// Temporary failure, with the message from the hook, and the code for
+	// closing the connection.
+	check("post-connect", nil, 421, "4.7.0 Not now, 1.2.3.4:25")
+
+	// Permanent failure without a message uses the default one.
+	c.ehloDomain = "bad"
+	check("post-ehlo", nil, 550, hookPermMsg)
+	c.ehloDomain = "good"
+	check("post-ehlo", nil, 0, "")
+
+	// The extra environment overrides the common one.
+	c.mailFrom = "bad@x"
+	check("post-mail", []string{"MAIL_FROM=good@x"}, 0, "")
+	check("post-mail", nil, 550, "5.7.1 Bad sender")
+
+	// Messages without an enhanced status code get one.
+	check("post-mail", []string{"MAIL_FROM=plain@x"}, 451, "4.7.1 Go away")
+
+	// Only the last line of the output is used.
+	c.rcptTo = []string{"a@x"}
+	check("post-rcpt", []string{"RCPT=b@x"}, 550, "5.1.1 No b@x")
+	c.rcptTo = nil
+	check("post-rcpt", []string{"RCPT=b@x"}, 451, hookTempMsg)
+
+	// Missing hooks are skipped.
+	c.hookPath = path.Join(dir, "doesnotexist")
+	for _, stage := range []string{
+		"post-connect", "post-ehlo", "post-mail", "post-rcpt"} {
+		check(stage, nil, 0, "")
+	}
+}
+
+func TestPolicyDaemon(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer l.Close()
+	srv := &policy.Server{Handler: func(req *policy.Request) *policy.Response {
+		switch req.Type {
+		case "post-rcpt":
+			if req.Attrs["rcpt"] == "bad@x" {
+				return &policy.Response{
+					Action: policy.Reject, Message: "5.1.1 Bad rcpt"}
+			}
+			if req.Attrs["rcpt"] == "plain@x" {
+				return &policy.Response{
+					Action: policy.Reject, Message: "Go away"}
+			}
+			return &policy.Response{Action: policy.Accept}
+		case "post-data":
+			data, _ := io.ReadAll(req.Data)
+			return &policy.Response{
+				Action: policy.Accept,
+				Headers: []string{
+					"X-Size: " + strconv.Itoa(len(data)),
+					"X-From: " + req.Attrs["mail_from"],
+				},
+			}
+		default:
+			return &policy.Response{Action: policy.TempFail}
+		}
+	}}
+	go srv.Serve(l)
+
+	c := &Conn{
+		tr:         trace.New("testconn", "testconn"),
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 25},
+		hookPath:   t.TempDir(),
+		mailFrom:   "from@x",
+		data:       []byte("Subject: x\n\n"),
+	}
+	c.policy, _ = policy.NewClient("tcp:" + l.Addr().String())
+
+	// The daemon is queried even if the hooks do not exist.
+	if code, msg := c.runStageHook("post-rcpt", "RCPT=bad@x"); code != 550 ||
+		msg != "5.1.1 Bad rcpt" {
+		t.Errorf("post-rcpt: got %d %q", code, msg)
+	}
+	if code, msg := c.runStageHook("post-rcpt", "RCPT=plain@x"); code != 550 ||
+		msg != "5.7.1 Go away" {
+		t.Errorf("post-rcpt: got %d %q", code, msg)
+	}
+	if code, msg := c.runStageHook("post-rcpt", "RCPT=good@x"); code != 0 {
+		t.Errorf("post-rcpt: got %d %q", code, msg)
+	}
+	if code, msg := c.runStageHook("post-mail"); code != 451 ||
+		msg != hookTempMsg {
+		t.Errorf("post-mail: got %d %q", code, msg)
+	}
+
+	out, _, err := c.runPostDataHook(c.message())
+	if err != nil {
+		t.Fatalf("post-data error: %v", err)
+	}
+	if string(out) != "X-Size: 12\nX-From: from@x\n" {
+		t.Errorf("post-data: unexpected output %q", out)
+	}
+
+	// If the daemon is not reachable, we fail temporarily.
+	l.Close()
+	c.policy, _ = policy.NewClient("tcp:" + l.Addr().String())
+	if code, msg := c.runStageHook("post-connect"); code != 421 ||
+		msg != hookTempMsg {
+		t.Errorf("post-connect: got %d %q", code, msg)
+	}
+}
+
+func TestHasStatusCode(t *testing.T) {
+	cases := []struct {
+		msg string
+		ok  bool
+	}{
+		{"5.7.1 Rejected", true},
+		{"4.7.0", true},
+		{"2.0.0 OK", true},
+		{"5.123.456 Odd but valid", true},
+		{"Rejected", false},
+		{"550 5.7.1 Rejected", false},
+		{"3.7.1 Bad class", false},
+		{"5.7 Too short", false},
+		{"5.7.1234 Too long", false},
+		{"5.x.1 Not a number", false},
+		{"5.7.1.2 Too many parts", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if ok := hasStatusCode(c.msg); ok != c.ok {
+			t.Errorf("hasStatusCode(%q) = %v, expected %v", c.msg, ok, c.ok)
+		}
+	}
+}
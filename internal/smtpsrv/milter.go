@@ -0,0 +1,344 @@
+package smtpsrv
+
+import (
+	"net"
+	"strings"
+
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+	"blitiri.com.ar/go/chasquid/internal/expvarom"
+	"blitiri.com.ar/go/chasquid/internal/milter"
+	"blitiri.com.ar/go/chasquid/internal/smtp"
+)
+
+var milterResults = expvarom.NewMap("chasquid/smtpIn/milterResults",
+	"result", "count of milter results, by stage and action")
+
+// milterSession is the state of a milter, for a single connection.
+type milterSession struct {
+	filter  *milter.Filter
+	session *milter.Session
+
+	// Did the milter fail? If so, the session is closed and we use the
+	// filter's default action from then on.
+	failed bool
+
+	// Did the milter accept the connection, or the current message? If so,
+	// we skip it until the end of the connection or message, respectively.
+	connAccepted bool
+	msgAccepted  bool
+
+	// Have we started a message (sent MAIL) that is not finished yet?
+	inMessage bool
+}
+
+func (ms *milterSession) skip() bool {
+	return ms.connAccepted || ms.msgAccepted ||
+		(ms.failed && ms.filter.DefaultAction == milter.Accept)
+}
+
+// fail closes the session after an error, and returns the filter's default
+// action as response.
+func (ms *milterSession) fail() *milter.Response {
+	if ms.session != nil {
+		ms.session.Close()
+		ms.session = nil
+	}
+	ms.failed = true
+	return &milter.Response{Action: ms.filter.DefaultAction}
+}
+
+// milterConnect connects to the milters, and sends them the connection
+// information. Returns the reply to use for the greeting if the connection
+// must not proceed.
+func (c *Conn) milterConnect() (code int, msg string) {
+	if len(c.milters) == 0 {
+		return 0, ""
+	}
+
+	macros := milter.Macros{
+		"j":           c.hostname,
+		"daemon_name": "chasquid",
+		"client_addr": ipOf(c.remoteAddr),
+	}
+
+	hostname := "[" + addrLiteral(c.remoteAddr) + "]"
+	if isUnix(c.remoteAddr) {
+		hostname = "localhost"
+	}
+
+	for _, f := range c.milters {
+		ms := &milterSession{filter: f}
+		c.milterSessions = append(c.milterSessions, ms)
+
+		var resp *milter.Response
+		var err error
+		ms.session, err = milter.Dial(f)
+		if err == nil {
+			resp, err = ms.session.Connect(
+				hostname, c.remoteAddr, macros)
+		}
+		if err != nil {
+			c.tr.Errorf("milter %v: error connecting: %v", f, err)
+			resp = ms.fail()
+		}
+
+		code, msg := c.milterReply(ms, "connect", resp, err)
+		if code == 0 {
+			continue
+		}
+
+		// At this stage, the reply ends the connection.
+		if code < 500 {
+			return 421, msg
+		}
+		return 554, msg
+	}
+	return 0, ""
+}
+
+// milterHelo sends the HELO/EHLO domain to the milters.
+func (c *Conn) milterHelo() (code int, msg string) {
+	return c.milterEach("helo",
+		func(s *milter.Session) (*milter.Response, error) {
+			return s.Helo(c.ehloDomain, nil)
+		})
+}
+
+// milterMail sends the envelope sender to the milters.
+func (c *Conn) milterMail(addr string, args []string) (code int, msg string) {
+	macros := milter.Macros{"mail_addr": addr}
+	if c.completedAuth {
+		macros["auth_authen"] = c.authUser + "@" + c.authDomain
+	}
+
+	for _, ms := range c.milterSessions {
+		ms.msgAccepted = false
+		ms.inMessage = true
+	}
+
+	return c.milterEach("mail",
+		func(s *milter.Session) (*milter.Response, error) {
+			return s.Mail(addr, args, macros)
+		})
+}
+
+// milterRcpt sends an envelope recipient to the milters.
+func (c *Conn) milterRcpt(addr string, args []string) (code int, msg string) {
+	macros := milter.Macros{"rcpt_addr": addr}
+	return c.milterEach("rcpt",
+		func(s *milter.Session) (*milter.Response, error) {
+			return s.Rcpt(addr, args, macros)
+		})
+}
+
+// milterData sends the message to the milters, and applies the
+// modifications they request. The milters see the message as modified by
+// the previous ones.
+func (c *Conn) milterData() (code int, msg string) {
+	defer func() {
+		for _, ms := range c.milterSessions {
+			ms.inMessage = false
+		}
+	}()
+
+	return c.milterEach("data",
+		func(s *milter.Session) (*milter.Response, error) {
+			resp, mods, err := s.Message(c.data, c.body(), c.binaryMIME, nil)
+			if err != nil {
+				return resp, err
+			}
+			if err := c.milterApply(mods); err != nil {
+				// This is our problem, not the milter's, so we don't
+				// treat it as a milter failure.
+				c.tr.Errorf("error applying milter modifications: %v", err)
+				return &milter.Response{Action: milter.TempFail}, nil
+			}
+			return resp, nil
+		})
+}
+
+// milterApply applies the modifications requested by a milter.
+func (c *Conn) milterApply(mods []milter.Modification) error {
+	if len(mods) == 0 {
+		return nil
+	}
+
+	// If the body is replaced, the new one goes to a new spool.
+	var newBody *spoolWriter
+	defer func() {
+		if newBody != nil {
+			newBody.Close()
+		}
+	}()
+
+	for _, m := range mods {
+		c.tr.Debugf("milter modification: %v", m)
+		switch m.Type {
+		case milter.AddRcpt:
+			if !c.hasRcpt(m.Addr) {
+				c.rcptTo = append(c.rcptTo, m.Addr)
+				c.dsn[m.Addr] = &smtp.DSN{Ret: c.dsnRet, EnvID: c.dsnEnvID}
+			}
+		case milter.DelRcpt:
+			for i, rcpt := range c.rcptTo {
+				if strings.EqualFold(rcpt, m.Addr) {
+					c.rcptTo = append(c.rcptTo[:i], c.rcptTo[i+1:]...)
+					delete(c.dsn, rcpt)
+					break
+				}
+			}
+		case milter.ChangeFrom:
+			c.mailFrom = m.Addr
+		case milter.Quarantine:
+			// We don't have a quarantine, so we mark the message instead,
+			// the same way we do for DMARC quarantines. Users can then
+			// filter on the header.
+			c.data = envelope.AddHeader(c.data, "X-Milter-Quarantine",
+				m.Reason)
+		case milter.ReplaceBody:
+			if newBody == nil {
+				// The filter sends the body with "\r\n" line endings,
+				// which the spool converts (unless it's binary MIME,
+				// which we keep as-is, like we do for the original).
+				// It handles line endings split across chunks.
+				var err error
+				if newBody, err = c.newSpool(!c.binaryMIME); err != nil {
+					return err
+				}
+			}
+			if _, err := newBody.Write(m.Body); err != nil {
+				return err
+			}
+		}
+	}
+
+	if newBody != nil {
+		if err := newBody.finish(); err != nil {
+			return err
+		}
+
+		// The new spool only has the body, without the header.
+		c.closeSpool()
+		c.spool, newBody = newBody, nil
+		c.bodyOffset = 0
+	}
+
+	c.data = milter.ApplyModifications(c.data, mods)
+
+	// If the milters removed all the recipients, there is nothing to
+	// deliver.
+	if len(c.rcptTo) == 0 {
+		c.tr.Printf("milters removed all recipients, discarding")
+		c.milterDiscard = true
+	}
+	return nil
+}
+
+func (c *Conn) hasRcpt(addr string) bool {
+	for _, rcpt := range c.rcptTo {
+		if strings.EqualFold(rcpt, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// milterAbort tells the milters that the current message was aborted.
+func (c *Conn) milterAbort() {
+	for _, ms := range c.milterSessions {
+		if ms.inMessage && ms.session != nil && !ms.connAccepted {
+			if err := ms.session.Abort(); err != nil {
+				c.tr.Errorf("milter %v: error aborting: %v", ms.filter, err)
+				ms.fail()
+			}
+		}
+		ms.inMessage = false
+		ms.msgAccepted = false
+	}
+	c.milterDiscard = false
+}
+
+// milterClose closes the sessions with the milters.
+func (c *Conn) milterClose() {
+	for _, ms := range c.milterSessions {
+		if ms.session != nil {
+			ms.session.Close()
+		}
+	}
+	c.milterSessions = nil
+}
+
+// milterEach runs the given function on each of the milter sessions that
+// are still interested, stopping at the first one that rejects.
+func (c *Conn) milterEach(stage string, f func(*milter.Session) (*milter.Response, error)) (code int, msg string) {
+	for _, ms := range c.milterSessions {
+		if ms.skip() {
+			continue
+		}
+
+		var resp *milter.Response
+		var err error
+		if ms.failed {
+			resp = &milter.Response{Action: ms.filter.DefaultAction}
+		} else {
+			resp, err = f(ms.session)
+			if err != nil {
+				c.tr.Errorf("milter %v: error in %s: %v", ms.filter, stage, err)
+				resp = ms.fail()
+			}
+		}
+
+		if code, msg := c.milterReply(ms, stage, resp, err); code != 0 {
+			return code, msg
+		}
+	}
+	return 0, ""
+}
+
+// milterReply processes a milter response, and returns the SMTP reply to
+// use if we should not proceed.
+func (c *Conn) milterReply(ms *milterSession, stage string, resp *milter.Response, err error) (code int, msg string) {
+	if err != nil {
+		milterResults.Add(stage+":error", 1)
+	}
+	milterResults.Add(stage+":"+resp.Action.String(), 1)
+	c.tr.Debugf("milter %v: %s: %v", ms.filter, stage, resp)
+
+	switch resp.Action {
+	case milter.Continue:
+		return 0, ""
+	case milter.Accept:
+		if stage == "connect" || stage == "helo" {
+			ms.connAccepted = true
+		} else {
+			ms.msgAccepted = true
+		}
+		return 0, ""
+	case milter.Discard:
+		c.milterDiscard = true
+		return 0, ""
+	case milter.Reject:
+		if stage == "rcpt" {
+			return 550, "5.7.1 Recipient rejected by content filter"
+		}
+		return 550, "5.7.1 Rejected by content filter"
+	case milter.TempFail:
+		return 451, "4.7.1 Temporary content filter failure, " +
+			"please try again later"
+	case milter.ReplyCode:
+		return resp.Code, resp.Text
+	}
+
+	c.tr.Errorf("milter %v: unknown action %v", ms.filter, resp.Action)
+	return 451, "4.7.1 Temporary content filter failure, " +
+		"please try again later"
+}
+
+// ipOf returns the IP address of the given network address, or its string
+// representation if it doesn't have one.
+func ipOf(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return addr.String()
+}
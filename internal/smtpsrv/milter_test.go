@@ -0,0 +1,366 @@
+package smtpsrv
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/aliases"
+	"blitiri.com.ar/go/chasquid/internal/milter"
+	"blitiri.com.ar/go/chasquid/internal/queue"
+	"blitiri.com.ar/go/chasquid/internal/set"
+	"blitiri.com.ar/go/chasquid/internal/smtp"
+	"blitiri.com.ar/go/chasquid/internal/trace"
+)
+
+// fakeMilter is a minimal in-process milter, which replies to each command
+// with the configured responses (or "continue"), and records the commands
+// it receives.
+type fakeMilter struct {
+	l net.Listener
+
+	mu        sync.Mutex
+	responses map[byte][]string
+	commands  string
+}
+
+func newFakeMilter(t *testing.T) *fakeMilter {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	m := &fakeMilter{l: l, responses: map[byte][]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.handle(conn)
+		}
+	}()
+	return m
+}
+
+func (m *fakeMilter) filter(defaultAction milter.Action) *milter.Filter {
+	return &milter.Filter{
+		Network:       "tcp",
+		Address:       m.l.Addr().String(),
+		Timeout:       time.Second,
+		DefaultAction: defaultAction,
+	}
+}
+
+// respond sets the responses for the given command. Each response is the
+// response code followed by its data. Without responses, it goes back to
+// replying "continue".
+func (m *fakeMilter) respond(cmd byte, resps ...string) {
+	m.mu.Lock()
+	if len(resps) == 0 {
+		delete(m.responses, cmd)
+	} else {
+		m.responses[cmd] = resps
+	}
+	m.mu.Unlock()
+}
+
+func (m *fakeMilter) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(hdr))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.commands += string(buf[0])
+		resps, ok := m.responses[buf[0]]
+		m.mu.Unlock()
+		if !ok {
+			resps = []string{"c"}
+		}
+
+		switch buf[0] {
+		case 'O':
+			// Version 6, all actions, all commands with replies.
+			resps = []string{"O\x00\x00\x00\x06\x00\x00\x00\xff\x00\x00\x00\x00"}
+		case 'D', 'A':
+			resps = nil
+		case 'Q':
+			return
+		}
+
+		for _, r := range resps {
+			l := make([]byte, 4)
+			binary.BigEndian.PutUint32(l, uint32(len(r)))
+			conn.Write(append(l, r...))
+		}
+	}
+}
+
+func (m *fakeMilter) received() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.commands
+}
+
+func newMilterConn(filters ...*milter.Filter) *Conn {
+	return &Conn{
+		tr:         trace.New("testconn", "testconn"),
+		hostname:   "mx.dom",
+		remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234},
+		ehloDomain: "remote",
+		milters:    filters,
+	}
+}
+
+// startMessage sends MAIL and RCPT to the milters, like the MAIL and RCPT
+// handlers would.
+func startMessage(t *testing.T, c *Conn) {
+	t.Helper()
+	c.resetEnvelope()
+	if code, msg := c.milterMail("from@remote", nil); code != 0 {
+		t.Fatalf("MAIL rejected: %d %s", code, msg)
+	}
+	c.mailFrom = "from@remote"
+	if code, msg := c.milterRcpt("to@dom", nil); code != 0 {
+		t.Fatalf("RCPT rejected: %d %s", code, msg)
+	}
+	c.rcptTo = []string{"to@dom"}
+	c.dsn = map[string]*smtp.DSN{"to@dom": {}}
+	c.data = []byte("Subject: Hi\n\nbody\n")
+}
+
+func TestMilter(t *testing.T) {
+	m1 := newFakeMilter(t)
+	m2 := newFakeMilter(t)
+	c := newMilterConn(m1.filter(milter.TempFail), m2.filter(milter.TempFail))
+	defer c.milterClose()
+
+	if code, msg := c.milterConnect(); code != 0 {
+		t.Fatalf("connect rejected: %d %s", code, msg)
+	}
+	if code, msg := c.milterHelo(); code != 0 {
+		t.Fatalf("HELO rejected: %d %s", code, msg)
+	}
+
+	// First message: the first milter modifies it, and the second one sees
+	// the modifications.
+	m1.respond('E',
+		"hX-Spam\x00yes\x00",
+		"+<new@dom>\x00",
+		"-<to@dom>\x00",
+		"qsuspicious\x00",
+		"c")
+	startMessage(t, c)
+	if code, msg := c.milterData(); code != 0 {
+		t.Fatalf("DATA rejected: %d %s", code, msg)
+	}
+	expected := "X-Milter-Quarantine: suspicious\nSubject: Hi\nX-Spam: yes\n" +
+		"\nbody\n"
+	if string(c.data) != expected {
+		t.Errorf("unexpected data: %q", c.data)
+	}
+	if len(c.rcptTo) != 1 || c.rcptTo[0] != "new@dom" || c.dsn["new@dom"] == nil {
+		t.Errorf("unexpected recipients: %v %v", c.rcptTo, c.dsn)
+	}
+	if c.milterDiscard {
+		t.Errorf("message unexpectedly discarded")
+	}
+
+	// Second message: the first milter rejects a recipient.
+	m1.respond('E')
+	m1.respond('R', "y550 5.7.1 No thanks\x00")
+	c.resetEnvelope()
+	code, msg := c.milterMail("from@remote", nil)
+	if code != 0 {
+		t.Fatalf("MAIL rejected: %d %s", code, msg)
+	}
+	code, msg = c.milterRcpt("to@dom", nil)
+	if code != 550 || msg != "5.7.1 No thanks" {
+		t.Errorf("unexpected RCPT reply: %d %s", code, msg)
+	}
+
+	// Third message: the first milter accepts the message, so only the
+	// second one sees the rest of it, and discards it.
+	m1.respond('R')
+	m1.respond('M', "a")
+	m2.respond('E', "d")
+	startMessage(t, c)
+	if code, msg := c.milterData(); code != 0 || !c.milterDiscard {
+		t.Errorf("expected discard, got %d %s (%v)", code, msg, c.milterDiscard)
+	}
+
+	// Fourth message: the second milter rejects it.
+	m1.respond('M')
+	m2.respond('E', "r")
+	startMessage(t, c)
+	code, msg = c.milterData()
+	if code != 550 || c.milterDiscard {
+		t.Errorf("unexpected DATA reply: %d %s (%v)", code, msg, c.milterDiscard)
+	}
+
+	c.resetEnvelope()
+	c.milterClose()
+
+	// Wait for the final commands to arrive, since they don't get replies.
+	// Messages that were completed (even if rejected) are not aborted.
+	expected1 := "ODCHDMDRTLNBEDMDRADMDMDRTLNBEQ"
+	expected2 := "ODCHDMDRTLLLNBEDMADMDRTLNBEDMDRTLNBEQ"
+	for i := 0; i < 100; i++ {
+		if m1.received() == expected1 && m2.received() == expected2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := m1.received(); got != expected1 {
+		t.Errorf("milter 1 commands: got %q, expected %q", got, expected1)
+	}
+	if got := m2.received(); got != expected2 {
+		t.Errorf("milter 2 commands: got %q, expected %q", got, expected2)
+	}
+}
+
+func TestMilterConnect(t *testing.T) {
+	m := newFakeMilter(t)
+
+	cases := []struct {
+		resp string
+		code int
+	}{
+		{"r", 554},
+		{"t", 421},
+		{"y421 4.3.2 Shutting down\x00", 421},
+		{"a", 0},
+	}
+	for _, tc := range cases {
+		m.respond('C', tc.resp)
+		c := newMilterConn(m.filter(milter.TempFail))
+		code, msg := c.milterConnect()
+		if code != tc.code {
+			t.Errorf("%q: unexpected reply: %d %s", tc.resp, code, msg)
+		}
+
+		// After accepting the connection, the milter is not used anymore.
+		if tc.resp == "a" {
+			startMessage(t, c)
+			if code, msg := c.milterData(); code != 0 {
+				t.Errorf("unexpected DATA reply: %d %s", code, msg)
+			}
+		}
+		c.milterClose()
+	}
+}
+
+func TestMilterErrors(t *testing.T) {
+	// Address where nothing is listening.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l.Close()
+	broken := &milter.Filter{
+		Network: "tcp",
+		Address: l.Addr().String(),
+		Timeout: time.Second,
+	}
+
+	// With the default action "accept", the milter is skipped.
+	broken.DefaultAction = milter.Accept
+	c := newMilterConn(broken)
+	if code, msg := c.milterConnect(); code != 0 {
+		t.Errorf("connect rejected: %d %s", code, msg)
+	}
+	startMessage(t, c)
+	if code, msg := c.milterData(); code != 0 {
+		t.Errorf("DATA rejected: %d %s", code, msg)
+	}
+	c.milterClose()
+
+	// With "tempfail" and "reject", we get the corresponding errors.
+	broken.DefaultAction = milter.TempFail
+	c = newMilterConn(broken)
+	if code, _ := c.milterConnect(); code != 421 {
+		t.Errorf("expected 421 at connect, got %d", code)
+	}
+	c.milterClose()
+
+	broken.DefaultAction = milter.Reject
+	c = newMilterConn(broken)
+	if code, _ := c.milterConnect(); code != 554 {
+		t.Errorf("expected 554 at connect, got %d", code)
+	}
+	c.milterClose()
+
+	// A milter that breaks in the middle of the connection.
+	m := newFakeMilter(t)
+	m.respond('R', "x")
+	c = newMilterConn(m.filter(milter.TempFail))
+	defer c.milterClose()
+	if code, msg := c.milterConnect(); code != 0 {
+		t.Fatalf("connect rejected: %d %s", code, msg)
+	}
+	c.milterMail("from@remote", nil)
+	code, msg := c.milterRcpt("to@dom", nil)
+	if code != 451 || !strings.HasPrefix(msg, "4.7.1 ") {
+		t.Errorf("unexpected RCPT reply: %d %s", code, msg)
+	}
+
+	// And it keeps failing after that.
+	c.resetEnvelope()
+	if code, _ := c.milterMail("from@remote", nil); code != 451 {
+		t.Errorf("expected 451 at MAIL, got %d", code)
+	}
+}
+
+func TestMilterReplaceBody(t *testing.T) {
+	q, err := queue.New(t.TempDir(), set.NewString(), aliases.NewResolver(nil),
+		nil, nil)
+	if err != nil {
+		t.Fatalf("queue.New: %v", err)
+	}
+
+	m := newFakeMilter(t)
+	c := newMilterConn(m.filter(milter.TempFail))
+	c.queue = q
+	defer c.closeSpool()
+	defer c.milterClose()
+	if code, msg := c.milterConnect(); code != 0 {
+		t.Fatalf("connect rejected: %d %s", code, msg)
+	}
+
+	// The new body comes in chunks, with a line ending split between two of
+	// them.
+	m.respond('E', "bnew\r", "b\nbody\r\n", "c")
+	startMessage(t, c)
+	if code, msg := c.milterData(); code != 0 {
+		t.Fatalf("DATA rejected: %d %s", code, msg)
+	}
+	body, _ := io.ReadAll(c.body())
+	if string(body) != "new\nbody\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+
+	// Binary MIME bodies are kept as-is.
+	m.respond('E', "bbin\r", "b\nary\x00\r\n", "c")
+	startMessage(t, c)
+	c.binaryMIME = true
+	if code, msg := c.milterData(); code != 0 {
+		t.Fatalf("DATA rejected: %d %s", code, msg)
+	}
+	body, _ = io.ReadAll(c.body())
+	if string(body) != "bin\r\nary\x00\r\n" {
+		t.Errorf("unexpected binary body: %q", body)
+	}
+}
@@ -0,0 +1,55 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"net"
+	"os/user"
+	"strconv"
+
+	"blitiri.com.ar/go/chasquid/internal/envelope"
+)
+
+// checkPeerCred authenticates clients that connect to the submission port
+// over a unix socket, as the address configured for their local user (see
+// Server.UnixPeerAuth), if there is one. The user is the owner of the
+// process at the other end of the socket, as told by the kernel.
+func (c *Conn) checkPeerCred() {
+	if len(c.unixPeerAuth) == 0 || !c.mode.IsSubmission {
+		return
+	}
+
+	conn := c.conn
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return
+	}
+
+	uid, err := peerUID(uc)
+	if err != nil {
+		c.tr.Errorf("error getting peer credentials: %v", err)
+		return
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		c.tr.Errorf("error looking up peer uid %d: %v", uid, err)
+		return
+	}
+
+	addr, ok := c.unixPeerAuth[u.Username]
+	if !ok {
+		c.tr.Debugf("no address for local user %q", u.Username)
+		return
+	}
+	name, domain := envelope.Split(addr)
+	if !c.localDomains.Has(domain) {
+		c.tr.Errorf("address for local user %q is not local: %q",
+			u.Username, addr)
+		return
+	}
+
+	c.tr.Debugf("local user %q authenticated as %s", u.Username, addr)
+	c.completeAuth(name, domain)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package smtpsrv
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID is only supported on Linux, see peercred_linux.go.
+func peerUID(conn *net.UnixConn) (int, error) {
+	return 0, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,345 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RateLimits to apply to incoming connections.
+// A limit of 0 means there is no limit.
+type RateLimits struct {
+	// Maximum number of concurrent connections: in total, from each IP
+	// address, and from each network (/24 for IPv4, /64 for IPv6).
+	MaxConnections           int
+	MaxConnectionsPerIP      int
+	MaxConnectionsPerNetwork int
+
+	// Maximum number of new connections per minute from each IP address.
+	MaxConnectionRatePerIP int
+
+	// Maximum number of messages and recipients per hour from each IP
+	// address. Messages and recipients only count once they are accepted
+	// (MAIL and RCPT, respectively), so rejected attempts don't use up the
+	// client's limit.
+	MaxMessagesPerHourPerIP   int
+	MaxRecipientsPerHourPerIP int
+}
+
+// rateLimiter keeps track of the connections, messages and recipients from
+// each client, and enforces the limits.
+// Its methods are safe to call on a nil limiter, in which case there are no
+// limits.
+type rateLimiter struct {
+	limits RateLimits
+
+	// Protects everything below.
+	mu sync.Mutex
+
+	// Current connections, in total, per IP and per network.
+	conns    int
+	ipConns  map[string]int
+	netConns map[string]int
+
+	// Recent connections, messages and recipients, per IP.
+	connRate *windowCounter
+	msgRate  *windowCounter
+	rcptRate *windowCounter
+
+	// Last time we removed old entries from the window counters.
+	lastSweep time.Time
+
+	// Time source, can be overridden for testing.
+	now func() time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:   limits,
+		ipConns:  map[string]int{},
+		netConns: map[string]int{},
+		connRate: newWindowCounter(time.Minute),
+		msgRate:  newWindowCounter(time.Hour),
+		rcptRate: newWindowCounter(time.Hour),
+		now:      time.Now,
+	}
+}
+
+// ipKey returns the keys to use for the IP address of the given remote
+// address, and for its network. They are empty if the address has no IP
+// (which should not happen in practice).
+func ipKey(addr net.Addr) (ip, network string) {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp.IP == nil {
+		return "", ""
+	}
+
+	if ip4 := tcp.IP.To4(); ip4 != nil {
+		return ip4.String(), ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return tcp.IP.String(),
+		tcp.IP.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// over returns true if the limit is set and the value has reached it.
+func over(value, limit int) bool {
+	return limit > 0 && value >= limit
+}
+
+// connect registers a new connection from the given address.
+// If it's over the limits, it returns a description of the limit that was
+// reached, and the connection is not registered; otherwise, it returns ""
+// and disconnect must be called once the connection is closed.
+func (l *rateLimiter) connect(addr net.Addr) string {
+	if l == nil {
+		return ""
+	}
+
+	ip, network := ipKey(addr)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.connRate.sweep(now)
+		l.msgRate.sweep(now)
+		l.rcptRate.sweep(now)
+		l.lastSweep = now
+	}
+
+	switch {
+	case over(l.conns, l.limits.MaxConnections):
+		return "connections"
+	case ip != "" && over(l.ipConns[ip], l.limits.MaxConnectionsPerIP):
+		return "connections per IP"
+	case ip != "" &&
+		over(l.netConns[network], l.limits.MaxConnectionsPerNetwork):
+		return "connections per network"
+	case ip != "" && l.limits.MaxConnectionRatePerIP > 0 &&
+		over(l.connRate.count(ip, now), l.limits.MaxConnectionRatePerIP):
+		return "connection rate per IP"
+	}
+
+	l.conns++
+	if ip != "" {
+		l.ipConns[ip]++
+		l.netConns[network]++
+		if l.limits.MaxConnectionRatePerIP > 0 {
+			l.connRate.add(ip, now)
+		}
+	}
+	return ""
+}
+
+// disconnect unregisters a connection, previously registered with connect.
+func (l *rateLimiter) disconnect(addr net.Addr) {
+	if l == nil {
+		return
+	}
+
+	ip, network := ipKey(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns--
+	if ip != "" {
+		decOrDelete(l.ipConns, ip)
+		decOrDelete(l.netConns, network)
+	}
+}
+
+func decOrDelete(m map[string]int, key string) {
+	m[key]--
+	if m[key] <= 0 {
+		delete(m, key)
+	}
+}
+
+// message registers a new message from the given address.
+// If it's over the limit, it returns a description of the limit that was
+// reached (and the message is not registered); otherwise it returns "".
+func (l *rateLimiter) message(addr net.Addr) string {
+	if l == nil || l.limits.MaxMessagesPerHourPerIP <= 0 {
+		return ""
+	}
+	if !l.countEvent(l.msgRate, addr, l.limits.MaxMessagesPerHourPerIP) {
+		return "messages per IP"
+	}
+	return ""
+}
+
+// recipient checks if a new recipient from the given address is allowed.
+// If it's over the limit, it returns a description of the limit that was
+// reached; otherwise it returns "". The recipient is not registered, that
+// is done by addRecipient once it's accepted.
+func (l *rateLimiter) recipient(addr net.Addr) string {
+	if l == nil || l.limits.MaxRecipientsPerHourPerIP <= 0 {
+		return ""
+	}
+	ip, _ := ipKey(addr)
+	if ip == "" {
+		return ""
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if over(l.rcptRate.count(ip, now), l.limits.MaxRecipientsPerHourPerIP) {
+		return "recipients per IP"
+	}
+	return ""
+}
+
+// addRecipient registers an accepted recipient from the given address,
+// previously checked with recipient.
+func (l *rateLimiter) addRecipient(addr net.Addr) {
+	if l == nil || l.limits.MaxRecipientsPerHourPerIP <= 0 {
+		return
+	}
+	ip, _ := ipKey(addr)
+	if ip == "" {
+		return
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rcptRate.add(ip, now)
+}
+
+// countEvent adds an event for the address to the given counter, if it
+// doesn't go over the limit. Returns false if it would.
+func (l *rateLimiter) countEvent(wc *windowCounter, addr net.Addr, limit int) bool {
+	ip, _ := ipKey(addr)
+	if ip == "" {
+		return true
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if over(wc.count(ip, now), limit) {
+		return false
+	}
+	wc.add(ip, now)
+	return true
+}
+
+// DumpString returns a human-readable string with the current state of the
+// limiter, for debugging purposes.
+func (l *rateLimiter) DumpString() string {
+	if l == nil {
+		return "# No rate limits\n"
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim := func(v int) string {
+		if v <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(v)
+	}
+
+	s := "# Limits\n"
+	s += fmt.Sprintf("connections: %s\n", lim(l.limits.MaxConnections))
+	s += fmt.Sprintf("connections per IP: %s\n",
+		lim(l.limits.MaxConnectionsPerIP))
+	s += fmt.Sprintf("connections per network: %s\n",
+		lim(l.limits.MaxConnectionsPerNetwork))
+	s += fmt.Sprintf("connection rate per IP (per minute): %s\n",
+		lim(l.limits.MaxConnectionRatePerIP))
+	s += fmt.Sprintf("messages per IP (per hour): %s\n",
+		lim(l.limits.MaxMessagesPerHourPerIP))
+	s += fmt.Sprintf("recipients per IP (per hour): %s\n",
+		lim(l.limits.MaxRecipientsPerHourPerIP))
+
+	s += fmt.Sprintf("\n# Connections: %d\n", l.conns)
+	for _, network := range sortedKeys(l.netConns) {
+		s += fmt.Sprintf("%s: %d\n", network, l.netConns[network])
+	}
+
+	s += "\n# Per IP (connections, conn/min, msgs/h, rcpts/h)\n"
+	ips := map[string]int{}
+	for ip := range l.ipConns {
+		ips[ip] = 1
+	}
+	for _, wc := range []*windowCounter{l.connRate, l.msgRate, l.rcptRate} {
+		for ip := range wc.events {
+			ips[ip] = 1
+		}
+	}
+	for _, ip := range sortedKeys(ips) {
+		s += fmt.Sprintf("%s: %d, %d, %d, %d\n", ip, l.ipConns[ip],
+			l.connRate.count(ip, now), l.msgRate.count(ip, now),
+			l.rcptRate.count(ip, now))
+	}
+
+	return s
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// windowCounter counts events per key, over a sliding time window.
+// It is not safe for concurrent use.
+type windowCounter struct {
+	window time.Duration
+
+	// Time of the events within the window, per key, sorted.
+	events map[string][]time.Time
+}
+
+func newWindowCounter(window time.Duration) *windowCounter {
+	return &windowCounter{
+		window: window,
+		events: map[string][]time.Time{},
+	}
+}
+
+// count returns how many events for the key are within the window.
+func (w *windowCounter) count(key string, now time.Time) int {
+	ts := w.events[key]
+	i := 0
+	for i < len(ts) && now.Sub(ts[i]) >= w.window {
+		i++
+	}
+	ts = ts[i:]
+
+	if len(ts) == 0 {
+		delete(w.events, key)
+	} else {
+		w.events[key] = ts
+	}
+	return len(ts)
+}
+
+// add an event for the key.
+func (w *windowCounter) add(key string, now time.Time) {
+	w.events[key] = append(w.events[key], now)
+}
+
+// sweep removes the events outside of the window, for all keys.
+func (w *windowCounter) sweep(now time.Time) {
+	for key := range w.events {
+		w.count(key, now)
+	}
+}
@@ -0,0 +1,210 @@
+package smtpsrv
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+// newTestLimiter returns a limiter with a fake clock, and a function to
+// advance it.
+func newTestLimiter(limits RateLimits) (*rateLimiter, func(time.Duration)) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(limits)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestIPKey(t *testing.T) {
+	cases := []struct {
+		addr        net.Addr
+		ip, network string
+	}{
+		{tcpAddr("1.2.3.4"), "1.2.3.4", "1.2.3.0/24"},
+		{tcpAddr("::ffff:1.2.3.4"), "1.2.3.4", "1.2.3.0/24"},
+		{tcpAddr("2001:db8:1:2:3::4"), "2001:db8:1:2:3::4", "2001:db8:1:2::/64"},
+		{&net.UnixAddr{Name: "/sock", Net: "unix"}, "", ""},
+		{&net.TCPAddr{}, "", ""},
+	}
+	for _, c := range cases {
+		ip, network := ipKey(c.addr)
+		if ip != c.ip || network != c.network {
+			t.Errorf("ipKey(%v) = %q, %q; expected %q, %q",
+				c.addr, ip, network, c.ip, c.network)
+		}
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	l, _ := newTestLimiter(RateLimits{
+		MaxConnections:           5,
+		MaxConnectionsPerIP:      2,
+		MaxConnectionsPerNetwork: 3,
+	})
+
+	expect := func(addr net.Addr, limit string) {
+		t.Helper()
+		if got := l.connect(addr); got != limit {
+			t.Errorf("connect(%v) = %q, expected %q", addr, got, limit)
+		}
+	}
+
+	a1, a2, a3 := tcpAddr("1.1.1.1"), tcpAddr("1.1.1.2"), tcpAddr("1.1.1.3")
+	expect(a1, "")
+	expect(a1, "")
+	expect(a1, "connections per IP")
+	expect(a2, "")
+	expect(a3, "connections per network")
+
+	// Other networks are fine, until we hit the total.
+	expect(tcpAddr("2.2.2.2"), "")
+	expect(tcpAddr("3.3.3.3"), "")
+	expect(tcpAddr("4.4.4.4"), "connections")
+
+	// Disconnecting frees up the slots.
+	l.disconnect(a1)
+	expect(tcpAddr("4.4.4.4"), "")
+	l.disconnect(a2)
+	expect(a3, "")
+
+	// Addresses without IPs only count towards the total.
+	l.disconnect(a3)
+	unix := &net.UnixAddr{Name: "/sock", Net: "unix"}
+	expect(unix, "")
+	expect(unix, "connections")
+
+	if l.conns != 5 || len(l.ipConns) != 4 || l.ipConns["1.1.1.1"] != 1 {
+		t.Errorf("unexpected state: %d %v", l.conns, l.ipConns)
+	}
+}
+
+func TestConnectionRate(t *testing.T) {
+	l, advance := newTestLimiter(RateLimits{MaxConnectionRatePerIP: 3})
+
+	addr := tcpAddr("1.1.1.1")
+	for i := 0; i < 3; i++ {
+		if limit := l.connect(addr); limit != "" {
+			t.Fatalf("%d: unexpectedly limited: %q", i, limit)
+		}
+		l.disconnect(addr)
+		advance(10 * time.Second)
+	}
+
+	if limit := l.connect(addr); limit != "connection rate per IP" {
+		t.Errorf("expected rate limit, got %q", limit)
+	}
+
+	// Other IPs are not affected.
+	if limit := l.connect(tcpAddr("1.1.1.2")); limit != "" {
+		t.Errorf("other IP was limited: %q", limit)
+	}
+
+	// After the first connection leaves the window, we can connect again.
+	advance(31 * time.Second)
+	if limit := l.connect(addr); limit != "" {
+		t.Errorf("unexpectedly limited after the window: %q", limit)
+	}
+}
+
+func TestMessageAndRecipientLimits(t *testing.T) {
+	l, advance := newTestLimiter(RateLimits{
+		MaxMessagesPerHourPerIP:   2,
+		MaxRecipientsPerHourPerIP: 3,
+	})
+
+	addr := tcpAddr("1.1.1.1")
+	for i := 0; i < 2; i++ {
+		if limit := l.message(addr); limit != "" {
+			t.Errorf("message %d: unexpectedly limited: %q", i, limit)
+		}
+	}
+	if limit := l.message(addr); limit != "messages per IP" {
+		t.Errorf("expected message limit, got %q", limit)
+	}
+
+	// Checking recipients doesn't count them, only adding them does.
+	for i := 0; i < 5; i++ {
+		if limit := l.recipient(addr); limit != "" {
+			t.Errorf("recipient check %d: unexpectedly limited: %q",
+				i, limit)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if limit := l.recipient(addr); limit != "" {
+			t.Errorf("recipient %d: unexpectedly limited: %q", i, limit)
+		}
+		l.addRecipient(addr)
+	}
+	if limit := l.recipient(addr); limit != "recipients per IP" {
+		t.Errorf("expected recipient limit, got %q", limit)
+	}
+
+	// Rejected attempts don't extend the window.
+	advance(time.Hour)
+	if limit := l.message(addr); limit != "" {
+		t.Errorf("unexpectedly limited after the window: %q", limit)
+	}
+	if limit := l.recipient(addr); limit != "" {
+		t.Errorf("unexpectedly limited after the window: %q", limit)
+	}
+
+	// Old entries get removed on the next connection.
+	advance(2 * time.Hour)
+	l.connect(tcpAddr("2.2.2.2"))
+	if len(l.msgRate.events) != 0 || len(l.rcptRate.events) != 0 {
+		t.Errorf("old events not removed: %v %v",
+			l.msgRate.events, l.rcptRate.events)
+	}
+}
+
+func TestNoLimits(t *testing.T) {
+	var nilL *rateLimiter
+	l, _ := newTestLimiter(RateLimits{})
+	addr := tcpAddr("1.1.1.1")
+
+	for _, l := range []*rateLimiter{nilL, l} {
+		for i := 0; i < 100; i++ {
+			if l.connect(addr) != "" || l.message(addr) != "" ||
+				l.recipient(addr) != "" {
+				t.Fatalf("unexpectedly limited")
+			}
+			l.addRecipient(addr)
+		}
+		l.disconnect(addr)
+	}
+
+	if s := nilL.DumpString(); s != "# No rate limits\n" {
+		t.Errorf("unexpected dump of nil limiter: %q", s)
+	}
+}
+
+func TestRateLimitDumpString(t *testing.T) {
+	l, _ := newTestLimiter(RateLimits{
+		MaxConnectionsPerIP:       10,
+		MaxConnectionRatePerIP:    10,
+		MaxRecipientsPerHourPerIP: 10,
+	})
+	l.connect(tcpAddr("1.1.1.1"))
+	l.connect(tcpAddr("1.1.1.1"))
+	l.addRecipient(tcpAddr("1.1.1.1"))
+	l.addRecipient(tcpAddr("2001:db8::1"))
+
+	s := l.DumpString()
+	for _, expected := range []string{
+		"connections: unlimited\n",
+		"connections per IP: 10\n",
+		"# Connections: 2\n",
+		"1.1.1.0/24: 2\n",
+		"1.1.1.1: 2, 2, 0, 1\n",
+		"2001:db8::1: 0, 0, 0, 1\n",
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("%q not in dump:\n%s", expected, s)
+		}
+	}
+}
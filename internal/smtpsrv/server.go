@@ -2,22 +2,36 @@
 package smtpsrv
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"net"
 	"net/http"
+	"os"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
+	"blitiri.com.ar/go/chasquid/internal/acme"
 	"blitiri.com.ar/go/chasquid/internal/aliases"
 	"blitiri.com.ar/go/chasquid/internal/auth"
 	"blitiri.com.ar/go/chasquid/internal/courier"
+	"blitiri.com.ar/go/chasquid/internal/dkim"
+	"blitiri.com.ar/go/chasquid/internal/dnsbl"
 	"blitiri.com.ar/go/chasquid/internal/domaininfo"
+	"blitiri.com.ar/go/chasquid/internal/greylist"
 	"blitiri.com.ar/go/chasquid/internal/maillog"
+	"blitiri.com.ar/go/chasquid/internal/milter"
+	"blitiri.com.ar/go/chasquid/internal/policy"
 	"blitiri.com.ar/go/chasquid/internal/queue"
+	"blitiri.com.ar/go/chasquid/internal/senders"
 	"blitiri.com.ar/go/chasquid/internal/set"
 	"blitiri.com.ar/go/chasquid/internal/userdb"
 	"blitiri.com.ar/go/log"
+	"golang.org/x/net/idna"
 )
 
 var (
@@ -42,12 +56,50 @@ type Server struct {
 	// Listeners (that came via systemd).
 	listeners map[SocketMode][]net.Listener
 
-	// TLS config (including loaded certificates).
+	// TLS config. The certificates are taken from certs, so they can be
+	// changed while running (see SetCerts).
 	tlsConfig *tls.Config
 
+	// TLS certificates. Protected by mu.
+	certs []tls.Certificate
+
+	// CAs to verify TLS client certificates against. If set, clients on
+	// the submission listeners are asked for a certificate, and if it is
+	// valid and maps to an address in a local domain, they can
+	// authenticate as it using AUTH EXTERNAL. Must be set before calling
+	// ListenAndServe.
+	ClientCAs *x509.CertPool
+
+	// Authenticate clients with a valid certificate implicitly, without
+	// them needing to use AUTH EXTERNAL.
+	ClientCertImplicitAuth bool
+
+	// Permissions of the unix sockets we listen on. If 0, they are left as
+	// created. Must be set before calling ListenAndServe.
+	UnixSocketMode os.FileMode
+
+	// Addresses to authenticate local users as, by user name, when they
+	// connect to a submission unix socket. See Conn.checkPeerCred. Must be
+	// set before calling ListenAndServe.
+	UnixPeerAuth map[string]string
+
+	// Networks whose clients can relay without authenticating, per listener
+	// mode. See Conn.trustedNetwork. Must be set before calling
+	// ListenAndServe.
+	TrustedNetworks map[SocketMode][]*net.IPNet
+
+	// ACME certificate manager, used to answer its TLS-ALPN-01 challenges.
+	// nil if ACME is not enabled. Must be set before calling
+	// ListenAndServe.
+	ACME *acme.Manager
+
 	// Use HAProxy on incoming connections.
 	HAProxyEnabled bool
 
+	// Trust the TLS information sent by the proxy: if it says the client
+	// connected to it over TLS, treat the connection as TLS.
+	HAProxyTrustTLS bool
+
 	// Local domains.
 	localDomains *set.String
 
@@ -58,9 +110,19 @@ type Server struct {
 	// Aliases resolver.
 	aliasesR *aliases.Resolver
 
+	// Sender authorization policy.
+	senders *senders.Authorizer
+
+	// Only allow authenticated users to send as their own addresses (in the
+	// envelope and the From header). See the senders package for details.
+	RestrictSenders bool
+
 	// Domain info database.
 	dinfo *domaininfo.DB
 
+	// Greylisting database, nil if greylisting is disabled.
+	greylist *greylist.DB
+
 	// Time before we give up on a connection, even if it's sending data.
 	connTimeout time.Duration
 
@@ -72,34 +134,159 @@ type Server struct {
 
 	// Path to the hooks.
 	HookPath string
+
+	// Policy daemon to use instead of the hooks, nil to use the hooks. Must
+	// be set before calling SetAliasesConfig and ListenAndServe.
+	Policy *policy.Client
+
+	// Headers to include in DKIM signatures. If empty, the dkim package
+	// defaults are used. Must be set before calling AddDKIMSigner.
+	DKIMSignedHeaders []string
+
+	// DKIM signers, per domain. The map is shared with the connections and
+	// the queue, so it is never modified: it is replaced instead. Protected
+	// by mu.
+	dkimSigners map[string]*dkim.Signer
+
+	// What to do with incoming messages that fail DMARC, when the domain's
+	// policy is "quarantine": "header" (the default), "reject", or "none".
+	DMARCQuarantineAction string
+
+	// How long a message can be in the queue before we notify the sender
+	// that its delivery is being delayed. 0 means never.
+	DelayNotificationAfter time.Duration
+
+	// Maximum total size of the message data in the queue, in bytes. Must
+	// be set before calling InitQueue, or using Reconfigure afterwards.
+	MaxQueueSize int64
+
+	// Limits to apply to incoming connections. Must be set before calling
+	// ListenAndServe.
+	RateLimits RateLimits
+
+	// Rate limiter, which enforces RateLimits.
+	limiter *rateLimiter
+
+	// Milters to run on incoming connections, in order. Must be set before
+	// calling ListenAndServe, or using Reconfigure afterwards.
+	Milters []*milter.Filter
+
+	// DNS blocklists to check incoming SMTP connections against, the score
+	// at which an address is considered listed, and what to do with
+	// connections from listed addresses: "reject" (the default) or "tag".
+	// Must be set before calling ListenAndServe, or using Reconfigure
+	// afterwards.
+	DNSBLZones     []dnsbl.Zone
+	DNSBLThreshold int
+	DNSBLAction    string
+
+	// DNSBL checker, nil if there are no zones.
+	dnsbl *dnsbl.Checker
+
+	// Closed when we start shutting down, and when we're done. See
+	// Shutdown.
+	shutdown     chan struct{}
+	shutdownDone chan struct{}
+
+	// Open listeners, and the connections being handled (with the
+	// underlying network connection), so we can close them on shutdown.
+	// Protected by mu, which also protects the settings that can be
+	// changed while running (see Reconfigure).
+	mu            sync.Mutex
+	openListeners []net.Listener
+	conns         map[*Conn]net.Conn
+
+	// Running connection handlers.
+	connsWG sync.WaitGroup
 }
 
 // NewServer returns a new empty Server.
 func NewServer() *Server {
 	authr := auth.NewAuthenticator()
 	aliasesR := aliases.NewResolver(authr.Exists)
-	return &Server{
+	s := &Server{
 		addrs:          map[SocketMode][]string{},
 		listeners:      map[SocketMode][]net.Listener{},
-		tlsConfig:      &tls.Config{},
 		connTimeout:    20 * time.Minute,
 		commandTimeout: 1 * time.Minute,
 		localDomains:   &set.String{},
 		authr:          authr,
 		aliasesR:       aliasesR,
+		senders:        senders.NewAuthorizer(aliasesR),
+		dkimSigners:    map[string]*dkim.Signer{},
+
+		DelayNotificationAfter: 4 * time.Hour,
+		MaxQueueSize:           1024 * 1024 * 1024,
+		DNSBLThreshold:         1,
+		DNSBLAction:            "reject",
+
+		shutdown:     make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+		conns:        map[*Conn]net.Conn{},
+	}
+	s.tlsConfig = &tls.Config{
+		GetCertificate:     s.getCertificate,
+		GetConfigForClient: s.getConfigForClient,
 	}
+	return s
 }
 
-// AddCerts (TLS) to the server.
-func (s *Server) AddCerts(certPath, keyPath string) error {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+// AddDKIMSigner for the given domain, using the given selector and the
+// private key in keyPath.
+func (s *Server) AddDKIMSigner(domain, selector, keyPath string) error {
+	key, err := dkim.LoadPrivateKey(keyPath)
 	if err != nil {
 		return err
 	}
-	s.tlsConfig.Certificates = append(s.tlsConfig.Certificates, cert)
+
+	// The domain in the signature must be in its ASCII form.
+	adomain, err := idna.ToASCII(domain)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	signers := map[string]*dkim.Signer{}
+	for d, signer := range s.dkimSigners {
+		signers[d] = signer
+	}
+	signers[domain] = &dkim.Signer{
+		Domain:   adomain,
+		Selector: selector,
+		Signer:   key,
+		Headers:  s.DKIMSignedHeaders,
+	}
+	s.setDKIMSigners(signers)
 	return nil
 }
 
+// RemoveDKIMSigner removes the DKIM signer of the given domain, if it has
+// one.
+func (s *Server) RemoveDKIMSigner(domain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dkimSigners[domain]; !ok {
+		return
+	}
+
+	signers := map[string]*dkim.Signer{}
+	for d, signer := range s.dkimSigners {
+		if d != domain {
+			signers[d] = signer
+		}
+	}
+	s.setDKIMSigners(signers)
+}
+
+// setDKIMSigners replaces the DKIM signers map. Must be called with mu held.
+func (s *Server) setDKIMSigners(signers map[string]*dkim.Signer) {
+	s.dkimSigners = signers
+	if s.queue != nil {
+		s.queue.EnableARCSealing(s.Hostname, signers)
+	}
+}
+
 // AddAddr adds an address for the server to listen on.
 func (s *Server) AddAddr(a string, m SocketMode) {
 	s.addrs[m] = append(s.addrs[m], a)
@@ -116,6 +303,17 @@ func (s *Server) AddDomain(d string) {
 	s.aliasesR.AddDomain(d)
 }
 
+// RemoveDomain removes a local domain from the server, along with its
+// users, aliases, sender allow-list and DKIM signer. Connections that are
+// already open may still use some of them.
+func (s *Server) RemoveDomain(d string) {
+	s.localDomains.Remove(d)
+	s.aliasesR.RemoveDomain(d)
+	s.authr.Unregister(d)
+	s.senders.RemoveDomain(d)
+	s.RemoveDKIMSigner(d)
+}
+
 // AddUserDB adds a userdb.DB instance as backend for the domain.
 func (s *Server) AddUserDB(domain string, db *userdb.DB) {
 	s.authr.Register(domain, auth.WrapNoErrorBackend(db))
@@ -126,6 +324,11 @@ func (s *Server) AddAliasesFile(domain, f string) error {
 	return s.aliasesR.AddAliasesFile(domain, f)
 }
 
+// AddSendersFile adds the sender allow-list file for the given domain.
+func (s *Server) AddSendersFile(domain, f string) error {
+	return s.senders.AddFile(domain, f)
+}
+
 // SetAuthFallback sets the authentication backend to use as fallback.
 func (s *Server) SetAuthFallback(be auth.Backend) {
 	s.authr.Fallback = be
@@ -136,6 +339,7 @@ func (s *Server) SetAliasesConfig(suffixSep, dropChars string) {
 	s.aliasesR.SuffixSep = suffixSep
 	s.aliasesR.DropChars = dropChars
 	s.aliasesR.ResolveHook = path.Join(s.HookPath, "alias-resolve")
+	s.aliasesR.Policy = s.Policy
 }
 
 // InitDomainInfo initializes the domain info database.
@@ -149,6 +353,16 @@ func (s *Server) InitDomainInfo(dir string) *domaininfo.DB {
 	return s.dinfo
 }
 
+// InitGreylist initializes the greylisting database, which enables
+// greylisting of incoming mail.
+func (s *Server) InitGreylist(dir string, delay, retryWindow, expiry time.Duration) {
+	var err error
+	s.greylist, err = greylist.New(dir, delay, retryWindow, expiry)
+	if err != nil {
+		log.Fatalf("Error opening greylist database: %v", err)
+	}
+}
+
 // InitQueue initializes the queue.
 func (s *Server) InitQueue(path string, localC, remoteC courier.Courier) {
 	q, err := queue.New(path, s.localDomains, s.aliasesR, localC, remoteC)
@@ -156,11 +370,21 @@ func (s *Server) InitQueue(path string, localC, remoteC courier.Courier) {
 		log.Fatalf("Error initializing queue: %v", err)
 	}
 
+	// Forwarded messages are ARC-sealed using the DKIM signers.
+	s.mu.Lock()
+	q.EnableARCSealing(s.Hostname, s.dkimSigners)
+	q.SetDelayNotifyAfter(s.DelayNotificationAfter)
+	q.SetMaxSize(s.MaxQueueSize)
+	s.mu.Unlock()
+
 	err = q.Load()
 	if err != nil {
 		log.Fatalf("Error loading queue: %v", err)
 	}
+
+	s.mu.Lock()
 	s.queue = q
+	s.mu.Unlock()
 
 	http.HandleFunc("/debug/queue",
 		func(w http.ResponseWriter, r *http.Request) {
@@ -168,6 +392,32 @@ func (s *Server) InitQueue(path string, localC, remoteC courier.Courier) {
 		})
 }
 
+// Reconfigure calls f with the server locked, so it can change the settings
+// that are applied to each new connection while the server is running:
+// MaxDataSize, RestrictSenders, DMARCQuarantineAction, Milters, the DNSBL
+// settings, and the queue settings (DelayNotificationAfter and
+// MaxQueueSize). Connections that are already open keep the previous
+// settings.
+func (s *Server) Reconfigure(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+
+	s.initDNSBL()
+	if s.queue != nil {
+		s.queue.SetDelayNotifyAfter(s.DelayNotificationAfter)
+		s.queue.SetMaxSize(s.MaxQueueSize)
+	}
+}
+
+// initDNSBL (re)creates the DNSBL checker. Must be called with mu held.
+func (s *Server) initDNSBL() {
+	s.dnsbl = nil
+	if len(s.DNSBLZones) > 0 {
+		s.dnsbl = dnsbl.NewChecker(s.DNSBLZones)
+	}
+}
+
 // periodicallyReload some of the server's information, such as aliases and
 // the user databases.
 func (s *Server) periodicallyReload() {
@@ -187,17 +437,27 @@ func (s *Server) periodicallyReload() {
 			log.Errorf("Error reloading authenticators: %v", err)
 		}
 
+		err = s.senders.Reload()
+		if err != nil {
+			log.Errorf("Error reloading sender allow-lists: %v", err)
+		}
+
 		err = s.dinfo.Reload()
 		if err != nil {
 			log.Errorf("Error reloading domaininfo: %v", err)
 		}
+
+		if s.greylist != nil {
+			s.greylist.Expire()
+		}
 	}
 }
 
 // ListenAndServe on the addresses and listeners that were previously added.
-// This function will not return.
+// This function will not return until the server is shut down (see
+// Shutdown).
 func (s *Server) ListenAndServe() {
-	if len(s.tlsConfig.Certificates) == 0 {
+	if s.numCerts() == 0 && s.ACME == nil {
 		// chasquid assumes there's at least one valid certificate (for things
 		// like STARTTLS, user authentication, etc.), so we fail if none was
 		// found.
@@ -208,15 +468,26 @@ func (s *Server) ListenAndServe() {
 
 	go s.periodicallyReload()
 
+	s.limiter = newRateLimiter(s.RateLimits)
+	http.HandleFunc("/debug/ratelimit",
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(s.limiter.DumpString()))
+		})
+
+	s.mu.Lock()
+	s.initDNSBL()
+	s.mu.Unlock()
+
 	for m, addrs := range s.addrs {
 		for _, addr := range addrs {
-			l, err := net.Listen("tcp", addr)
+			l, err := s.listen(addr)
 			if err != nil {
 				log.Fatalf("Error listening: %v", err)
 			}
 
 			log.Infof("Server listening on %s (%v)", addr, m)
 			maillog.Listening(addr)
+			s.addOpenListener(l)
 			go s.serve(l, m)
 		}
 	}
@@ -225,48 +496,212 @@ func (s *Server) ListenAndServe() {
 		for _, l := range ls {
 			log.Infof("Server listening on %s (%v, via systemd)", l.Addr(), m)
 			maillog.Listening(l.Addr().String())
+			s.addOpenListener(l)
 			go s.serve(l, m)
 		}
 	}
 
-	// Never return. If the serve goroutines have problems, they will abort
-	// execution.
-	for {
-		time.Sleep(24 * time.Hour)
+	// Wait until we are shut down. If the serve goroutines have problems,
+	// they will abort execution.
+	<-s.shutdownDone
+}
+
+// listen on the given address, which can be "unix:<path>" for a unix socket,
+// or a TCP address otherwise.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove the socket left behind by a previous run, if any, as otherwise
+	// we can't listen on it. Only do it if it is a socket, to prevent
+	// accidents.
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if s.UnixSocketMode != 0 {
+		if err := os.Chmod(path, s.UnixSocketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (s *Server) addOpenListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		l.Close()
+		return
 	}
+	s.openListeners = append(s.openListeners, l)
+}
+
+// shuttingDown returns true if Shutdown has been called.
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown the server gracefully: stop accepting connections, and let the
+// open transactions complete, while replying to new commands with a 421
+// (so clients retry later). Then, shut down the queue, waiting for the
+// delivery attempts in progress.
+// If the context is done before that, the remaining connections are closed,
+// the queue state is saved, and its error is returned.
+// ListenAndServe returns once this is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.shuttingDown() {
+		s.mu.Unlock()
+		return errors.New("already shutting down")
+	}
+	close(s.shutdown)
+
+	for _, l := range s.openListeners {
+		l.Close()
+	}
+
+	// Connections waiting for a command outside of a transaction won't get
+	// one, so interrupt them. The rest will notice after their transaction.
+	for c, nc := range s.conns {
+		c.interruptIfIdle(nc)
+	}
+	log.Infof("Shutting down, waiting for %d connections", len(s.conns))
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connsWG.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.mu.Lock()
+		log.Errorf("Shutdown timed out, closing %d connections", len(s.conns))
+		for _, nc := range s.conns {
+			nc.Close()
+		}
+		s.mu.Unlock()
+	}
+
+	if s.queue != nil {
+		log.Infof("Shutting down the queue")
+		if qerr := s.queue.Shutdown(ctx); qerr != nil && err == nil {
+			err = qerr
+		}
+	}
+
+	close(s.shutdownDone)
+	return err
+}
+
+// useHAProxy returns true if the connections on the given listener come
+// through HAProxy. That is never the case for LMTP and unix sockets, which
+// are for local clients.
+func (s *Server) useHAProxy(l net.Listener, mode SocketMode) bool {
+	return s.HAProxyEnabled && !mode.IsLMTP && l.Addr().Network() != "unix"
 }
 
 func (s *Server) serve(l net.Listener, mode SocketMode) {
+	// On submission, ask for client certificates if we can verify them.
+	// They are checked by the connection (see Conn.checkClientCert), so
+	// clients with certificates we don't accept can still use passwords.
+	tlsConfig := s.tlsConfig
+	if mode.IsSubmission && s.ClientCAs != nil {
+		tlsConfig = s.tlsConfig.Clone()
+		tlsConfig.ClientAuth = tls.RequestClientCert
+		tlsConfig.ClientCAs = s.ClientCAs
+	}
+
 	// If this mode is expected to be TLS-wrapped, make it so.
 	if mode.TLS {
-		l = tls.NewListener(l, s.tlsConfig)
+		l = tls.NewListener(l, tlsConfig)
 	}
 
-	pdhook := path.Join(s.HookPath, "post-data")
+	haproxyEnabled := s.useHAProxy(l, mode)
 
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return
+			}
 			log.Fatalf("Error accepting: %v", err)
 		}
 
+		s.mu.Lock()
+		if s.shuttingDown() {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		var sendersA *senders.Authorizer
+		if s.RestrictSenders {
+			sendersA = s.senders
+		}
+
 		sc := &Conn{
-			hostname:       s.Hostname,
-			maxDataSize:    s.MaxDataSize,
-			postDataHook:   pdhook,
-			conn:           conn,
-			mode:           mode,
-			tlsConfig:      s.tlsConfig,
-			haproxyEnabled: s.HAProxyEnabled,
-			onTLS:          mode.TLS,
-			authr:          s.authr,
-			aliasesR:       s.aliasesR,
-			localDomains:   s.localDomains,
-			dinfo:          s.dinfo,
-			deadline:       time.Now().Add(s.connTimeout),
-			commandTimeout: s.commandTimeout,
-			queue:          s.queue,
+			hostname:               s.Hostname,
+			authservID:             s.Hostname,
+			maxDataSize:            s.MaxDataSize,
+			hookPath:               s.HookPath,
+			policy:                 s.Policy,
+			conn:                   conn,
+			mode:                   mode,
+			tlsConfig:              tlsConfig,
+			clientCAs:              s.ClientCAs,
+			clientCertImplicitAuth: s.ClientCertImplicitAuth,
+			unixPeerAuth:           s.UnixPeerAuth,
+			trustedNets:            s.TrustedNetworks[mode],
+			haproxyEnabled:         haproxyEnabled,
+			haproxyTrustTLS:        s.HAProxyTrustTLS,
+			onTLS:                  mode.TLS,
+			authr:                  s.authr,
+			aliasesR:               s.aliasesR,
+			senders:                sendersA,
+			localDomains:           s.localDomains,
+			dinfo:                  s.dinfo,
+			greylist:               s.greylist,
+			dnsbl:                  s.dnsbl,
+			dnsblThreshold:         s.DNSBLThreshold,
+			dnsblAction:            s.DNSBLAction,
+			milters:                s.Milters,
+			dkimSigners:            s.dkimSigners,
+			dmarcQuarantineAction:  s.DMARCQuarantineAction,
+			deadline:               time.Now().Add(s.connTimeout),
+			commandTimeout:         s.commandTimeout,
+			queue:                  s.queue,
+			limiter:                s.limiter,
+			shutdown:               s.shutdown,
 		}
-		go sc.Handle()
+
+		s.conns[sc] = conn
+		s.connsWG.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.connsWG.Done()
+			sc.Handle()
+
+			s.mu.Lock()
+			delete(s.conns, sc)
+			s.mu.Unlock()
+		}()
 	}
 }
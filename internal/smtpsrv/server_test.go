@@ -1,17 +1,29 @@
 package smtpsrv
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"net/smtp"
+	"net/textproto"
 	"os"
+	"os/user"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"blitiri.com.ar/go/chasquid/internal/aliases"
 	"blitiri.com.ar/go/chasquid/internal/maillog"
+	"blitiri.com.ar/go/chasquid/internal/queue"
 	"blitiri.com.ar/go/chasquid/internal/testlib"
 	"blitiri.com.ar/go/chasquid/internal/userdb"
 )
@@ -33,10 +45,18 @@ var (
 	submissionAddr    = ""
 	submissionTLSAddr = ""
 
+	// Paths to the LMTP and submission unix sockets, only set when using
+	// the internal server.
+	lmtpAddr           = ""
+	submissionUnixAddr = ""
+
 	// TLS configuration to use in the clients.
 	// Will contain the generated server certificate as root CA.
 	tlsConfig *tls.Config
 
+	// CA for the client certificates the server accepts.
+	clientCA *testCA
+
 	// Test couriers, so we can validate that emails got sent.
 	localC  = testlib.NewTestCourier()
 	remoteC = testlib.NewTestCourier()
@@ -165,6 +185,199 @@ func TestAuth(t *testing.T) {
 	sendEmailWithAuth(t, c, auth)
 }
 
+func TestAuthLogin(t *testing.T) {
+	c := mustDial(t, ModeSubmission, true)
+	defer c.Close()
+
+	// The "broken" domain backend doesn't support SCRAM, so it should not
+	// be advertised.
+	if _, mechs := c.Extension("AUTH"); mechs != "PLAIN LOGIN" {
+		t.Errorf("unexpected AUTH mechanisms: %q", mechs)
+	}
+	simpleCmd(t, c, "AUTH SCRAM-SHA-256", 534)
+
+	b64 := base64.StdEncoding.EncodeToString
+	msg := simpleCmd(t, c, "AUTH LOGIN", 334)
+	if msg != b64([]byte("Username:")) {
+		t.Errorf("unexpected challenge: %q", msg)
+	}
+	simpleCmd(t, c, b64([]byte("testuser@localhost")), 334)
+	simpleCmd(t, c, b64([]byte("testpasswd")), 235)
+	c.Close()
+
+	// Username as the initial response, and lower case mechanism.
+	c = mustDial(t, ModeSubmission, true)
+	simpleCmd(t, c, "auth login "+b64([]byte("testuser@localhost")), 334)
+	simpleCmd(t, c, b64([]byte("wrong")), 535)
+
+	// Cancelled exchange.
+	simpleCmd(t, c, "AUTH LOGIN", 334)
+	simpleCmd(t, c, "*", 501)
+}
+
+func TestDKIMSign(t *testing.T) {
+	c := mustDial(t, ModeSubmission, true)
+	defer c.Close()
+
+	auth := smtp.PlainAuth("", "testuser@localhost", "testpasswd", "127.0.0.1")
+	if err := c.Auth(auth); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if err := c.Mail("testuser@localhost"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("to@localhost"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	msg := "From: testuser@localhost\nSubject: Hi!\n\nSigned email\n"
+	if _, err = w.Write([]byte(msg)); err != nil {
+		t.Fatalf("Data write: %v", err)
+	}
+
+	localC.Expect(1)
+	if err = w.Close(); err != nil {
+		t.Fatalf("Data close: %v", err)
+	}
+	localC.Wait()
+
+	localC.Lock()
+	data := string(localC.ReqFor["testuser@localhost"].Data)
+	localC.Unlock()
+
+	if !strings.HasPrefix(data, "DKIM-Signature: v=1; a=ed25519-sha256;") {
+		t.Errorf("message not signed:\n%s", data)
+	}
+	if !strings.Contains(data, "d=localhost; s=sel;") {
+		t.Errorf("unexpected domain or selector:\n%s", data)
+	}
+}
+
+// fakeLookupTXT is used for DKIM and DMARC lookups, so we don't leak DNS
+// queries and can test policies.
+func fakeLookupTXT(ctx context.Context, domain string) ([]string, error) {
+	txts := map[string][]string{
+		"_dmarc.dmarc-reject":     {"v=DMARC1; p=reject"},
+		"_dmarc.dmarc-quarantine": {"v=DMARC1; p=quarantine"},
+	}[domain]
+	if txts == nil {
+		return nil, &net.DNSError{Err: "not found", IsNotFound: true}
+	}
+	return txts, nil
+}
+
+// sendDMARCTestEmail sends an email over the SMTP port with the given From
+// header, returning the error from the final DATA step.
+func sendDMARCTestEmail(t *testing.T, from string) error {
+	c := mustDial(t, ModeSMTP, false)
+	defer c.Close()
+
+	if err := c.Mail("from@from"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("to@localhost"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	msg := "From: " + from + "\nSubject: Hi!\n\nDMARC test\n"
+	if _, err = w.Write([]byte(msg)); err != nil {
+		t.Fatalf("Data write: %v", err)
+	}
+	return w.Close()
+}
+
+func TestDMARC(t *testing.T) {
+	// The reject policy results in a permanent error.
+	err := sendDMARCTestEmail(t, "someone@dmarc-reject")
+	if tperr, ok := err.(*textproto.Error); !ok || tperr.Code != 550 ||
+		tperr.Msg != "5.7.1 Rejected by the DMARC policy of dmarc-reject" {
+		t.Errorf("expected DMARC rejection, got %v", err)
+	}
+
+	// The quarantine policy uses the default action, which adds a header.
+	localC.Expect(1)
+	if err := sendDMARCTestEmail(t, "someone@dmarc-quarantine"); err != nil {
+		t.Fatalf("Data close: %v", err)
+	}
+	localC.Wait()
+
+	localC.Lock()
+	data := string(localC.ReqFor["testuser@localhost"].Data)
+	localC.Unlock()
+
+	if !strings.Contains(data, "X-DMARC-Quarantine: dmarc-quarantine\n") {
+		t.Errorf("missing quarantine header:\n%s", data)
+	}
+	expected := "\tdmarc=fail (p=quarantine dis=quarantine) " +
+		"header.from=dmarc-quarantine\n"
+	if !strings.Contains(data, expected) {
+		t.Errorf("missing DMARC result in Authentication-Results:\n%s",
+			data)
+	}
+}
+
+func TestForgedAuthResults(t *testing.T) {
+	c := mustDial(t, ModeSMTP, false)
+	defer c.Close()
+
+	// Ask for a different server name, which must not change the
+	// authserv-id we use.
+	cfg := tlsConfig.Clone()
+	cfg.ServerName = "x.invalid"
+	cfg.InsecureSkipVerify = true
+	if err := c.StartTLS(cfg); err != nil {
+		t.Fatalf("StartTLS: %v", err)
+	}
+
+	if err := c.Mail("from@from"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err := c.Rcpt("to@localhost"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	msg := "Authentication-Results: localhost; dkim=pass; dmarc=pass\n" +
+		"X-DMARC-Quarantine: forged\nX-Milter-Quarantine: forged\n" +
+		"From: someone@from\nSubject: Hi!\n\nForged results\n"
+	if _, err = w.Write([]byte(msg)); err != nil {
+		t.Fatalf("Data write: %v", err)
+	}
+
+	localC.Expect(1)
+	if err = w.Close(); err != nil {
+		t.Fatalf("Data close: %v", err)
+	}
+	localC.Wait()
+
+	localC.Lock()
+	data := string(localC.ReqFor["testuser@localhost"].Data)
+	localC.Unlock()
+
+	if strings.Contains(data, "dkim=pass") {
+		t.Errorf("forged Authentication-Results not removed:\n%s", data)
+	}
+	if !strings.Contains(data, "Authentication-Results: localhost;") {
+		t.Errorf("missing our Authentication-Results:\n%s", data)
+	}
+	if strings.Contains(data, "x.invalid;") {
+		t.Errorf("Authentication-Results uses the client's SNI:\n%s", data)
+	}
+	if strings.Contains(data, "forged") {
+		t.Errorf("forged quarantine headers not removed:\n%s", data)
+	}
+}
+
 func TestSubmissionWithoutAuth(t *testing.T) {
 	c := mustDial(t, ModeSubmission, true)
 	defer c.Close()
@@ -193,6 +406,84 @@ func TestAuthOnSMTP(t *testing.T) {
 	sendEmailWithAuth(t, c, auth)
 }
 
+// externalAuth implements smtp.Auth for the EXTERNAL mechanism, with an
+// empty authorization identity.
+type externalAuth struct{}
+
+func (externalAuth) Start(*smtp.ServerInfo) (string, []byte, error) {
+	return "EXTERNAL", nil, nil
+}
+
+func (externalAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	return []byte{}, nil
+}
+
+func TestClientCert(t *testing.T) {
+	cert, err := clientCA.issue(&x509.Certificate{
+		EmailAddresses: []string{"testuser@localhost"},
+	})
+	if err != nil {
+		t.Fatalf("error issuing client certificate: %v", err)
+	}
+	certConfig := tlsConfig.Clone()
+	certConfig.Certificates = []tls.Certificate{cert}
+
+	dial := func(mode SocketMode, conf *tls.Config) *smtp.Client {
+		t.Helper()
+		var conn net.Conn
+		var err error
+		if mode.TLS {
+			conn, err = tls.Dial("tcp", submissionTLSAddr, conf)
+		} else {
+			conn, err = net.Dial("tcp", submissionAddr)
+		}
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		c, err := smtp.NewClient(conn, "127.0.0.1")
+		if err != nil {
+			t.Fatalf("smtp.NewClient: %v", err)
+		}
+		if err = c.Hello("test"); err != nil {
+			t.Fatalf("c.Hello: %v", err)
+		}
+		if !mode.TLS {
+			if err = c.StartTLS(conf); err != nil {
+				t.Fatalf("StartTLS: %v", err)
+			}
+		}
+		return c
+	}
+
+	// With the certificate, EXTERNAL is offered and works, on both
+	// submission ports.
+	for _, mode := range []SocketMode{ModeSubmission, ModeSubmissionTLS} {
+		c := dial(mode, certConfig)
+		if _, params := c.Extension("AUTH"); !strings.Contains(params, "EXTERNAL") {
+			t.Errorf("%v: EXTERNAL not offered: %q", mode, params)
+		}
+		sendEmailWithAuth(t, c, externalAuth{})
+		c.Close()
+	}
+
+	// Asking for someone else's identity fails.
+	c := dial(ModeSubmissionTLS, certConfig)
+	simpleCmd(t, c, "AUTH EXTERNAL "+
+		base64.StdEncoding.EncodeToString([]byte("other@localhost")), 535)
+	c.Close()
+
+	// Without the certificate, EXTERNAL is not offered nor accepted.
+	c = dial(ModeSubmissionTLS, tlsConfig)
+	if _, params := c.Extension("AUTH"); strings.Contains(params, "EXTERNAL") {
+		t.Errorf("EXTERNAL offered without a certificate: %q", params)
+	}
+	simpleCmd(t, c, "AUTH EXTERNAL =", 534)
+	c.Close()
+}
+
 func TestBrokenAuth(t *testing.T) {
 	c := mustDial(t, ModeSubmission, true)
 	defer c.Close()
@@ -263,6 +554,31 @@ func TestRcptOption(t *testing.T) {
 	}
 }
 
+func TestDSNParams(t *testing.T) {
+	c := mustDial(t, ModeSMTP, false)
+	defer c.Close()
+
+	if ok, _ := c.Extension("DSN"); !ok {
+		t.Fatalf("DSN not advertised in EHLO")
+	}
+
+	simpleCmd(t, c, "MAIL FROM:<from@from> RET=HDRS ENVID=QQ+2BA", 250)
+	simpleCmd(t, c,
+		"RCPT TO:<to@localhost> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;to+40x", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost> NOTIFY=NEVER", 250)
+	simpleCmd(t, c, "RSET", 250)
+
+	// Malformed parameters.
+	simpleCmd(t, c, "MAIL FROM:<from@from> RET=BLAH", 501)
+	simpleCmd(t, c, "MAIL FROM:<from@from> ENVID=a+ZZ", 501)
+	c.Close()
+
+	c = mustDial(t, ModeSMTP, false)
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost> NOTIFY=NEVER,DELAY", 501)
+	simpleCmd(t, c, "RCPT TO:<to@localhost> ORCPT=rfc822", 501)
+}
+
 func TestRelayForbidden(t *testing.T) {
 	c := mustDial(t, ModeSMTP, false)
 	defer c.Close()
@@ -402,6 +718,277 @@ func TestTooMuchData(t *testing.T) {
 	localC.Wait()
 }
 
+// bdat sends a BDAT command with the given chunk, and checks the reply code.
+func bdat(t *testing.T, c *smtp.Client, chunk string, last bool, expected int) {
+	t.Helper()
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	if err := c.Text.PrintfLine(cmd); err != nil {
+		t.Fatalf("Failed to write %s: %v", cmd, err)
+	}
+	if _, err := c.Text.W.WriteString(chunk); err != nil {
+		t.Fatalf("Failed to write chunk: %v", err)
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		t.Fatalf("Failed to flush chunk: %v", err)
+	}
+
+	if _, _, err := c.Text.ReadResponse(expected); err != nil {
+		t.Errorf("Incorrect %s response: %v", cmd, err)
+	}
+}
+
+func TestBDAT(t *testing.T) {
+	c := mustDial(t, ModeSMTP, false)
+	defer c.Close()
+
+	if ok, _ := c.Extension("CHUNKING"); !ok {
+		t.Fatalf("CHUNKING not advertised in EHLO")
+	}
+	if ok, _ := c.Extension("BINARYMIME"); !ok {
+		t.Fatalf("BINARYMIME not advertised in EHLO")
+	}
+
+	simpleCmd(t, c, "MAIL FROM:<from@from> BODY=BINARYMIME", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+
+	// BINARYMIME can't be sent with DATA.
+	simpleCmd(t, c, "DATA", 503)
+
+	// Binary MIME bodies are kept as-is, only the header line endings are
+	// converted.
+	localC.Expect(1)
+	bdat(t, c, "Subject: Hi!\r\n", false, 250)
+	bdat(t, c, "", false, 250)
+	bdat(t, c, "\r\nThis is a\r\nbinary\x00\r", false, 250)
+	bdat(t, c, "\nchunked email\n", true, 250)
+	localC.Wait()
+
+	data := string(localC.ReqFor["testuser@localhost"].Data)
+	if !strings.HasSuffix(data,
+		"Subject: Hi!\n\nThis is a\r\nbinary\x00\r\nchunked email\n") {
+		t.Errorf("unexpected data: %q", data)
+	}
+
+	// The envelope is reset after the message is queued.
+	bdat(t, c, "lalala\r\n", true, 503)
+
+	// Without BINARYMIME, the line endings are converted.
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	localC.Expect(1)
+	bdat(t, c, "Subject: Hi!\r\n\r\nThis is a\r", false, 250)
+	bdat(t, c, "\nchunked email\r\n", true, 250)
+	localC.Wait()
+
+	data = string(localC.ReqFor["testuser@localhost"].Data)
+	if !strings.HasSuffix(data, "Subject: Hi!\n\nThis is a\nchunked email\n") {
+		t.Errorf("unexpected data: %q", data)
+	}
+}
+
+func TestBDATErrors(t *testing.T) {
+	c := mustDial(t, ModeSMTP, false)
+	defer c.Close()
+
+	// DATA can't be used after BDAT.
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	bdat(t, c, "Subject: Hi!\r\n", false, 250)
+	simpleCmd(t, c, "DATA", 503)
+
+	// Malformed command, the chunk is discarded along with the envelope.
+	simpleCmd(t, c, "BDAT 0 NOTLAST", 501)
+	c.Close()
+
+	// Invalid size, we can't keep the connection in sync.
+	c = mustDial(t, ModeSMTP, false)
+	simpleCmd(t, c, "BDAT x", 421)
+	c.Close()
+}
+
+func TestBDATTooMuchData(t *testing.T) {
+	c := mustDial(t, ModeSMTP, false)
+	defer c.Close()
+
+	// Too much data in a single chunk.
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	bdat(t, c, strings.Repeat(str1MiB, maxDataSizeMiB+1), true, 552)
+
+	// Too much data across chunks.
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	for i := 0; i < maxDataSizeMiB; i++ {
+		bdat(t, c, str1MiB, false, 250)
+	}
+	bdat(t, c, str1MiB, false, 552)
+
+	// The limit should not prevent the connection from continuing.
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	localC.Expect(1)
+	bdat(t, c, "Subject: Hi!\r\n\r\nBody\r\n", true, 250)
+	localC.Wait()
+}
+
+func TestLMTP(t *testing.T) {
+	if lmtpAddr == "" {
+		t.Skip("no LMTP server to test")
+	}
+
+	conn, err := net.Dial("unix", lmtpAddr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatalf("smtp.NewClient: %v", err)
+	}
+	defer c.Close()
+
+	simpleCmd(t, c, "EHLO test", 500)
+	simpleCmd(t, c, "LHLO test", 250)
+
+	// After DATA there is one reply per recipient. The message can't be
+	// queued for loop@localhost, as its aliases can't be resolved.
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	simpleCmd(t, c, "RCPT TO:<loop@localhost>", 250)
+	simpleCmd(t, c, "RCPT TO:<testuser@localhost>", 250)
+	simpleCmd(t, c, "DATA", 354)
+
+	localC.Expect(2)
+	if _, err := c.Text.W.WriteString("Subject: Hi!\r\n\r\nLMTP\r\n.\r\n"); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		t.Fatalf("Failed to flush data: %v", err)
+	}
+	for i, expected := range []int{250, 451, 250} {
+		if _, _, err := c.Text.ReadResponse(expected); err != nil {
+			t.Errorf("%d: incorrect DATA response: %v", i, err)
+		}
+	}
+	localC.Wait()
+
+	localC.Lock()
+	data := string(localC.ReqFor["testuser@localhost"].Data)
+	localC.Unlock()
+	if !strings.Contains(data, "with LMTP") {
+		t.Errorf("Received header does not mention LMTP: %q", data)
+	}
+
+	// Same with BDAT.
+	simpleCmd(t, c, "MAIL FROM:<from@from>", 250)
+	simpleCmd(t, c, "RCPT TO:<loop@localhost>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	localC.Expect(1)
+	bdat(t, c, "Subject: Hi!\r\n\r\nLMTP\r\n", true, 451)
+	if _, _, err := c.Text.ReadResponse(250); err != nil {
+		t.Errorf("Incorrect BDAT response: %v", err)
+	}
+	localC.Wait()
+}
+
+func TestUnixPeerAuth(t *testing.T) {
+	if submissionUnixAddr == "" {
+		t.Skip("no submission unix socket to test")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	fi, err := os.Stat(submissionUnixAddr)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode().Perm() != 0660 {
+		t.Errorf("unexpected socket permissions: %v", fi.Mode())
+	}
+
+	conn, err := net.Dial("unix", submissionUnixAddr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c, err := smtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatalf("smtp.NewClient: %v", err)
+	}
+	defer c.Close()
+	if err = c.Hello("test"); err != nil {
+		t.Fatalf("c.Hello: %v", err)
+	}
+
+	// We are authenticated as the address configured for our user, without
+	// needing AUTH (nor TLS).
+	if err = c.Mail("testuser@localhost"); err != nil {
+		t.Fatalf("Mail: %v", err)
+	}
+	if err = c.Rcpt("to@localhost"); err != nil {
+		t.Fatalf("Rcpt: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data: %v", err)
+	}
+	if _, err = w.Write([]byte("Subject: Hi!\n\nUnix\n")); err != nil {
+		t.Errorf("Data write: %v", err)
+	}
+	localC.Expect(1)
+	if err = w.Close(); err != nil {
+		t.Fatalf("Data close: %v", err)
+	}
+	localC.Wait()
+
+	localC.Lock()
+	data := string(localC.ReqFor["testuser@localhost"].Data)
+	localC.Unlock()
+	if !strings.Contains(data, "with ESMTPA") {
+		t.Errorf("Received header does not show authentication: %q", data)
+	}
+}
+
+func TestUseHAProxy(t *testing.T) {
+	tcpL, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer tcpL.Close()
+	unixL, err := net.Listen("unix", t.TempDir()+"/sock")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer unixL.Close()
+
+	s := &Server{HAProxyEnabled: true}
+	cases := []struct {
+		l        net.Listener
+		mode     SocketMode
+		expected bool
+	}{
+		{tcpL, ModeSMTP, true},
+		{tcpL, ModeSubmission, true},
+		{tcpL, ModeLMTP, false},
+		{unixL, ModeSMTP, false},
+		{unixL, ModeSubmission, false},
+		{unixL, ModeLMTP, false},
+	}
+	for _, c := range cases {
+		if got := s.useHAProxy(c.l, c.mode); got != c.expected {
+			t.Errorf("%s %v: got %v, expected %v",
+				c.l.Addr().Network(), c.mode, got, c.expected)
+		}
+	}
+
+	s.HAProxyEnabled = false
+	if s.useHAProxy(tcpL, ModeSMTP) {
+		t.Errorf("HAProxy used even if disabled")
+	}
+}
+
 func simpleCmd(t *testing.T, c *smtp.Client, cmd string, expected int) string {
 	t.Helper()
 	if err := c.Text.PrintfLine(cmd); err != nil {
@@ -480,6 +1067,226 @@ func TestStartTLSOnTLS(t *testing.T) {
 	}
 }
 
+func TestShutdown(t *testing.T) {
+	// Use a separate server, so we don't affect the other tests. We can't
+	// use InitQueue and ListenAndServe, as they register HTTP handlers, which
+	// can only be done once; so we do the relevant parts by hand.
+	tmpDir := t.TempDir()
+	s := NewServer()
+	s.Hostname = "localhost"
+	s.InitDomainInfo(tmpDir + "/domaininfo")
+	s.AddDomain("localhost")
+	s.limiter = newRateLimiter(s.RateLimits)
+
+	var err error
+	s.queue, err = queue.New(tmpDir+"/queue", s.localDomains, s.aliasesR,
+		localC, remoteC)
+	if err != nil {
+		t.Fatalf("queue.New: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	s.addOpenListener(l)
+	go s.serve(l, ModeSMTP)
+
+	// One client in the middle of a transaction, and one idle.
+	inTx, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial: %v", err)
+	}
+	defer inTx.Close()
+	if err := inTx.Mail("from@plain"); err != nil {
+		t.Fatalf("MAIL FROM: %v", err)
+	}
+
+	idle, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial: %v", err)
+	}
+	defer idle.Close()
+	if err := idle.Hello("localhost"); err != nil {
+		t.Fatalf("HELO: %v", err)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+
+	// The idle client gets told right away.
+	if _, _, err := idle.Text.ReadResponse(421); err != nil {
+		t.Errorf("idle: expected 421, got %v", err)
+	}
+
+	// The one in a transaction can complete it, and is told afterwards.
+	simpleCmd(t, inTx, "NOOP", 250)
+	simpleCmd(t, inTx, "RSET", 250)
+	if _, _, err := inTx.Text.ReadResponse(421); err != nil {
+		t.Errorf("in transaction: expected 421, got %v", err)
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	<-s.shutdownDone
+
+	// New connections are not accepted.
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("connection accepted after shutdown")
+	}
+
+	if err := s.Shutdown(context.Background()); err == nil {
+		t.Errorf("second Shutdown did not fail")
+	}
+}
+
+func TestReplaceDKIMSigner(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := generateDKIMKey(tmpDir + "/dkim_privkey.pem"); err != nil {
+		t.Fatalf("generateDKIMKey: %v", err)
+	}
+
+	s := NewServer()
+	for _, sel := range []string{"sel1", "sel2"} {
+		err := s.AddDKIMSigner("dom", sel, tmpDir+"/dkim_privkey.pem")
+		if err != nil {
+			t.Fatalf("AddDKIMSigner: %v", err)
+		}
+	}
+	if got := s.dkimSigners["dom"].Selector; got != "sel2" {
+		t.Errorf("signer not replaced, selector is %q", got)
+	}
+
+	// On errors, the current signer is kept.
+	err := s.AddDKIMSigner("dom", "sel3", tmpDir+"/doesnotexist")
+	if err == nil {
+		t.Errorf("AddDKIMSigner with a missing key did not fail")
+	}
+	if got := s.dkimSigners["dom"].Selector; got != "sel2" {
+		t.Errorf("signer changed after an error, selector is %q", got)
+	}
+
+	s.RemoveDKIMSigner("dom")
+	if _, ok := s.dkimSigners["dom"]; ok {
+		t.Errorf("signer not removed")
+	}
+	s.RemoveDKIMSigner("dom")
+}
+
+// startLimitedServer starts a separate server with the given rate limits,
+// listening in the given mode, and returns it and its address.
+// The server is shut down when the test finishes.
+func startLimitedServer(t *testing.T, mode SocketMode, limits RateLimits) (*Server, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	if _, err := testlib.GenerateCert(tmpDir); err != nil {
+		t.Fatalf("GenerateCert: %v", err)
+	}
+
+	s := NewServer()
+	s.Hostname = "localhost"
+	s.AddCerts(tmpDir+"/cert.pem", tmpDir+"/key.pem")
+	s.InitDomainInfo(tmpDir + "/domaininfo")
+	s.AddDomain("localhost")
+	s.RateLimits = limits
+	s.limiter = newRateLimiter(s.RateLimits)
+
+	var err error
+	s.queue, err = queue.New(tmpDir+"/queue", s.localDomains, s.aliasesR,
+		localC, remoteC)
+	if err != nil {
+		t.Fatalf("queue.New: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s.addOpenListener(l)
+	go s.serve(l, mode)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return s, l.Addr().String()
+}
+
+func TestMessageLimitOnlyCountsAccepted(t *testing.T) {
+	_, addr := startLimitedServer(t, ModeSMTP,
+		RateLimits{MaxMessagesPerHourPerIP: 1})
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial: %v", err)
+	}
+	defer c.Close()
+	simpleCmd(t, c, "HELO localhost", 250)
+
+	// Rejected senders don't count towards the limit.
+	simpleCmd(t, c, "MAIL FROM:<nodomain>", 501)
+
+	simpleCmd(t, c, "MAIL FROM:<from@plain>", 250)
+	simpleCmd(t, c, "RSET", 250)
+	simpleCmd(t, c, "MAIL FROM:<from@plain>", 451)
+}
+
+func TestRecipientLimitOnlyCountsAccepted(t *testing.T) {
+	s, addr := startLimitedServer(t, ModeSMTP,
+		RateLimits{MaxRecipientsPerHourPerIP: 1})
+	s.aliasesR.AddAliasForTesting(
+		"to@localhost", "testuser@localhost", aliases.EMAIL)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("smtp.Dial: %v", err)
+	}
+	defer c.Close()
+	simpleCmd(t, c, "HELO localhost", 250)
+	simpleCmd(t, c, "MAIL FROM:<from@plain>", 250)
+
+	// Rejected recipients don't count towards the limit.
+	simpleCmd(t, c, "RCPT TO:<x@remote>", 503)
+
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 250)
+	simpleCmd(t, c, "RCPT TO:<to@localhost>", 451)
+}
+
+func TestConnLimitBeforeTLS(t *testing.T) {
+	_, addr := startLimitedServer(t, ModeSubmissionTLS,
+		RateLimits{MaxConnectionsPerIP: 1})
+
+	// The first connection takes the only slot. Completing the handshake
+	// makes sure the server has registered it.
+	first, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer first.Close()
+
+	// The second one is over the limit, and must be closed right away,
+	// without waiting for (or doing) the handshake.
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	if n, err := second.Read(buf); err != io.EOF {
+		t.Errorf("expected EOF, got %d bytes (%q), %v", n, buf[:n], err)
+	}
+}
+
 //
 // === Benchmarks ===
 //
@@ -542,6 +1349,19 @@ func (b brokenAuthBE) Reload() error {
 	return fmt.Errorf("failed to reload")
 }
 
+func generateDKIMKey(path string) error {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	return os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+}
+
 // realMain is the real main function, which returns the value to pass to
 // os.Exit(). We have to do this so we can use defer.
 func realMain(m *testing.M) int {
@@ -592,6 +1412,18 @@ func realMain(m *testing.M) int {
 		s.AddAddr(submissionAddr, ModeSubmission)
 		s.AddAddr(submissionTLSAddr, ModeSubmissionTLS)
 
+		lmtpAddr = tmpDir + "/lmtp.sock"
+		s.AddAddr("unix:"+lmtpAddr, ModeLMTP)
+
+		submissionUnixAddr = tmpDir + "/submission.sock"
+		s.AddAddr("unix:"+submissionUnixAddr, ModeSubmission)
+		s.UnixSocketMode = 0660
+		if u, err := user.Current(); err == nil {
+			s.UnixPeerAuth = map[string]string{
+				u.Username: "testuser@localhost",
+			}
+		}
+
 		s.InitQueue(tmpDir+"/queue", localC, remoteC)
 		s.InitDomainInfo(tmpDir + "/domaininfo")
 
@@ -599,15 +1431,38 @@ func realMain(m *testing.M) int {
 		udb.AddUser("testuser", "testpasswd")
 		s.aliasesR.AddAliasForTesting(
 			"to@localhost", "testuser@localhost", aliases.EMAIL)
+		s.aliasesR.AddAliasForTesting(
+			"loop@localhost", "loop@localhost", aliases.EMAIL)
 		s.AddDomain("localhost")
 		s.AddUserDB("localhost", udb)
 
 		s.AddDomain("broken")
 		s.authr.Register("broken", &brokenAuthBE{})
 
+		clientCA, err = newTestCA("Test client CA")
+		if err != nil {
+			fmt.Printf("Failed to generate client CA: %v\n", err)
+			return 1
+		}
+		s.ClientCAs = clientCA.pool()
+
+		err = generateDKIMKey(tmpDir + "/dkim_privkey.pem")
+		if err != nil {
+			fmt.Printf("Failed to generate DKIM key: %v\n", err)
+			return 1
+		}
+		err = s.AddDKIMSigner("localhost", "sel", tmpDir+"/dkim_privkey.pem")
+		if err != nil {
+			fmt.Printf("Failed to add DKIM signer: %v\n", err)
+			return 1
+		}
+
 		// Disable SPF lookups, to avoid leaking DNS queries.
 		disableSPFForTesting = true
 
+		// Use fake TXT lookups for DKIM and DMARC, for the same reason.
+		lookupTXTForTesting = fakeLookupTXT
+
 		// Disable reloading.
 		reloadEvery = nil
 
@@ -0,0 +1,191 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Maximum size of the message header. We keep the header in memory, as we
+// need to inspect and modify it, while the body stays on disk.
+const maxHeaderSize = 1024 * 1024
+
+// spoolWriter writes the incoming message data to a spool file, so we don't
+// need to keep it in memory.
+//
+// Write errors are recorded instead of returned, so the callers can keep
+// reading the data from the client (to stay in sync with it), and check err
+// once they are done.
+type spoolWriter struct {
+	f *os.File
+
+	// Convert "\r\n" line endings to "\n"? Internally we use "\n", the dot
+	// reader does the conversion for DATA, but for BDAT we need to do it
+	// ourselves.
+	toLF bool
+
+	// Was the last byte given to Write a "\r"? If so, we hold it until we
+	// know if it's followed by "\n".
+	cr bool
+
+	// Bytes given to Write, and bytes written to the file.
+	received int64
+	size     int64
+
+	// First write error, if any.
+	err error
+}
+
+// newSpool creates a new spool file, within the queue's spool directory.
+// The file is removed when the spool is closed (by then, the queue has its
+// own link to it if the message was queued). If we crash before that, the
+// queue removes it when loading.
+func (c *Conn) newSpool(toLF bool) (*spoolWriter, error) {
+	f, err := os.CreateTemp(c.queue.SpoolDir(), "data-")
+	if err != nil {
+		return nil, err
+	}
+	return &spoolWriter{f: f, toLF: toLF}, nil
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	s.received += int64(len(p))
+	if s.err != nil {
+		return len(p), nil
+	}
+
+	buf := p
+	if s.toLF {
+		buf = make([]byte, 0, len(p)+1)
+		if s.cr {
+			buf = append(buf, '\r')
+			s.cr = false
+		}
+		buf = append(buf, p...)
+		if len(buf) > 0 && buf[len(buf)-1] == '\r' {
+			buf = buf[:len(buf)-1]
+			s.cr = true
+		}
+		buf = bytes.ReplaceAll(buf, []byte("\r\n"), []byte("\n"))
+	}
+
+	n, err := s.f.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	return len(p), nil
+}
+
+// finish writes any pending data, and returns the first write error, if
+// any.
+func (s *spoolWriter) finish() error {
+	if s.cr {
+		s.cr = false
+		s.toLF = false
+		s.Write([]byte("\r"))
+	}
+	return s.err
+}
+
+// Close and remove the spool file.
+func (s *spoolWriter) Close() error {
+	err := s.f.Close()
+	os.Remove(s.f.Name())
+	return err
+}
+
+// section returns a reader for the spooled data, starting at the given
+// offset.
+func (s *spoolWriter) section(off int64) *io.SectionReader {
+	return io.NewSectionReader(s.f, off, s.size-off)
+}
+
+// splitHeader reads the message header from the spool into c.data, and
+// leaves the rest of the message (the body) on disk.
+// For binary MIME, the spool has the data as received, so we convert the
+// header's line endings to "\n" (as we use internally), but leave the body
+// untouched.
+func (c *Conn) splitHeader() error {
+	r := bufio.NewReader(
+		io.LimitReader(c.spool.section(0), maxHeaderSize))
+	c.data = nil
+	for {
+		line, err := r.ReadBytes('\n')
+		c.data = append(c.data, line...)
+		if bytes.Equal(line, []byte("\n")) || bytes.Equal(line, []byte("\r\n")) {
+			// The header ends with the first empty line, which we keep
+			// with it.
+			break
+		}
+		if err == io.EOF {
+			if int64(len(c.data)) < c.spool.size {
+				return fmt.Errorf("header too big")
+			}
+			// The whole message is the header.
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	c.bodyOffset = int64(len(c.data))
+	if c.binaryMIME {
+		c.data = bytes.ReplaceAll(c.data, []byte("\r\n"), []byte("\n"))
+	}
+	return nil
+}
+
+// body returns a reader for the message body.
+func (c *Conn) body() io.Reader {
+	if c.spool == nil {
+		return bytes.NewReader(nil)
+	}
+	return c.spool.section(c.bodyOffset)
+}
+
+// message returns a reader for the whole message: the header (c.data),
+// followed by the body.
+// It implements queue.Spooled, so the queue can take the spool file as-is.
+func (c *Conn) message() io.Reader {
+	r := io.MultiReader(bytes.NewReader(c.data), c.body())
+	if c.spool == nil {
+		return r
+	}
+	return &spooledMessage{r, c.data, c.spool.f.Name(), c.bodyOffset}
+}
+
+// spooledMessage is a message whose body is in a spool file.
+type spooledMessage struct {
+	io.Reader
+
+	header []byte
+	fname  string
+	offset int64
+}
+
+// Spooled implements queue.Spooled.
+func (m *spooledMessage) Spooled() ([]byte, string, int64) {
+	return m.header, m.fname, m.offset
+}
+
+// messageSize returns the size of the message returned by message().
+func (c *Conn) messageSize() int64 {
+	size := int64(len(c.data))
+	if c.spool != nil {
+		size += c.spool.size - c.bodyOffset
+	}
+	return size
+}
+
+// closeSpool closes the spool file, if any, discarding its data.
+func (c *Conn) closeSpool() {
+	if c.spool != nil {
+		c.spool.Close()
+		c.spool = nil
+	}
+	c.bodyOffset = 0
+}
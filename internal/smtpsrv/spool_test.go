@@ -0,0 +1,136 @@
+package smtpsrv
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"blitiri.com.ar/go/chasquid/internal/queue"
+)
+
+func newTestSpool(t *testing.T, toLF bool) *spoolWriter {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "spool-")
+	if err != nil {
+		t.Fatalf("error creating spool: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return &spoolWriter{f: f, toLF: toLF}
+}
+
+func TestSpoolWriterToLF(t *testing.T) {
+	cases := []struct {
+		writes   []string
+		expected string
+	}{
+		{[]string{"a\r\nb\r\n"}, "a\nb\n"},
+		{[]string{"a\r", "\nb\r", "\n"}, "a\nb\n"},
+		{[]string{"a\r", "", "\n"}, "a\n"},
+		{[]string{"a\rb\r"}, "a\rb\r"},
+		{[]string{"a\r", "b\r\r", "\n"}, "a\rb\r\n"},
+		{[]string{"\n\r\n", "\r"}, "\n\n\r"},
+	}
+	for _, c := range cases {
+		s := newTestSpool(t, true)
+		for _, w := range c.writes {
+			s.Write([]byte(w))
+		}
+		if err := s.finish(); err != nil {
+			t.Fatalf("%q: error finishing: %v", c.writes, err)
+		}
+
+		got, _ := io.ReadAll(s.section(0))
+		if string(got) != c.expected {
+			t.Errorf("%q: got %q, expected %q", c.writes, got, c.expected)
+		}
+		if s.size != int64(len(c.expected)) {
+			t.Errorf("%q: size is %d, expected %d",
+				c.writes, s.size, len(c.expected))
+		}
+	}
+}
+
+func TestSpoolWriterError(t *testing.T) {
+	s := newTestSpool(t, false)
+	s.f.Close()
+
+	// Errors are not returned by Write, so callers keep reading from the
+	// client.
+	if n, err := s.Write([]byte("data")); n != 4 || err != nil {
+		t.Errorf("Write returned %d, %v", n, err)
+	}
+	if s.finish() == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if s.received != 4 {
+		t.Errorf("received is %d, expected 4", s.received)
+	}
+}
+
+func TestSplitHeader(t *testing.T) {
+	bigHeader := "Subject: " + strings.Repeat("x", maxHeaderSize) + "\n"
+	cases := []struct {
+		msg, header string
+		err         bool
+	}{
+		{"Subject: x\n\nbody\n", "Subject: x\n\n", false},
+		{"Subject: x\nTo: y\n\nbody\n\nmore\n", "Subject: x\nTo: y\n\n", false},
+		{"\nbody\n", "\n", false},
+		{"Subject: x\n", "Subject: x\n", false},
+		{"Subject: x", "Subject: x", false},
+		{"", "", false},
+		{bigHeader + "\nbody\n", "", true},
+	}
+	for _, c := range cases {
+		conn := &Conn{spool: newTestSpool(t, false)}
+		conn.spool.Write([]byte(c.msg))
+
+		err := conn.splitHeader()
+		if c.err {
+			if err == nil {
+				t.Errorf("%.20q: expected error, got nil", c.msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%.20q: unexpected error: %v", c.msg, err)
+			continue
+		}
+
+		if string(conn.data) != c.header {
+			t.Errorf("%q: got header %q, expected %q",
+				c.msg, conn.data, c.header)
+		}
+		msg, _ := io.ReadAll(conn.message())
+		if string(msg) != c.msg {
+			t.Errorf("%q: got message %q", c.msg, msg)
+		}
+	}
+}
+
+func TestSpooledMessage(t *testing.T) {
+	conn := &Conn{spool: newTestSpool(t, false)}
+	conn.spool.Write([]byte("Subject: x\n\nbody\n"))
+	if err := conn.splitHeader(); err != nil {
+		t.Fatalf("error splitting header: %v", err)
+	}
+	conn.data = append([]byte("New: y\n"), conn.data...)
+
+	// The queue can take the spool file, with the new header.
+	s, ok := conn.message().(queue.Spooled)
+	if !ok {
+		t.Fatalf("message is not spooled")
+	}
+	header, fname, offset := s.Spooled()
+	if string(header) != "New: y\nSubject: x\n\n" ||
+		fname != conn.spool.f.Name() || offset != 12 {
+		t.Errorf("unexpected spooled data: %q %q %d", header, fname, offset)
+	}
+
+	// Closing the spool removes the file.
+	conn.closeSpool()
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("spool file not removed: %v", err)
+	}
+}
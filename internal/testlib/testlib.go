@@ -8,6 +8,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"io"
 	"math/big"
 	"net"
 	"os"
@@ -100,9 +101,17 @@ type TestCourier struct {
 }
 
 // Deliver the given mail (saving it in tc.Requests).
-func (tc *TestCourier) Deliver(from string, to string, data []byte) (error, bool) {
+func (tc *TestCourier) Deliver(from string, to string, data io.ReadSeeker) (error, bool) {
 	defer tc.wg.Done()
-	dr := &deliverRequest{from, to, data}
+	_, err := data.Seek(0, io.SeekStart)
+	if err != nil {
+		return err, false
+	}
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return err, false
+	}
+	dr := &deliverRequest{from, to, buf}
 	tc.Lock()
 	tc.Requests = append(tc.Requests, dr)
 	tc.ReqFor[to] = dr
@@ -129,7 +138,7 @@ func NewTestCourier() *TestCourier {
 
 type dumbCourier struct{}
 
-func (c dumbCourier) Deliver(from string, to string, data []byte) (error, bool) {
+func (c dumbCourier) Deliver(from string, to string, data io.ReadSeeker) (error, bool) {
 	return nil, false
 }
 
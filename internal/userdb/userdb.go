@@ -18,6 +18,12 @@
 // allow the user to change this, at least for now.
 // A PLAIN scheme is also supported for debugging purposes.
 //
+// Alongside the scheme, we can optionally store the SCRAM-SHA-256
+// credentials, so users can authenticate using that SASL mechanism (see
+// AddUserWithSCRAM). They are derived from the password with PBKDF2, which is
+// much cheaper to brute-force than scrypt, so they are only stored if
+// requested.
+//
 // # Writing
 //
 // The functions that write a database file will not preserve ordering,
@@ -29,18 +35,31 @@ package userdb
 //go:generate protoc --go_out=. --go_opt=paths=source_relative userdb.proto
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"errors"
 	"fmt"
+	"math"
 	"sync"
 
+	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/scrypt"
 
 	"blitiri.com.ar/go/chasquid/internal/normalize"
 	"blitiri.com.ar/go/chasquid/internal/protoio"
 )
 
+// DefaultSCRAMIterations is the default number of PBKDF2 iterations for the
+// SCRAM-SHA-256 credentials. It is well above the minimum of 4096 recommended
+// by RFC 7677, to make brute-forcing them from a leaked database harder.
+const DefaultSCRAMIterations = 100000
+
+// minSCRAMIterations is the minimum number of iterations we accept, as per
+// RFC 7677.
+const minSCRAMIterations = 4096
+
 // DB represents a single user database.
 type DB struct {
 	fname string
@@ -130,7 +149,32 @@ func (p *Password) PasswordMatches(plain string) bool {
 
 // AddUser to the database. If the user is already present, override it.
 // Note we enforce that the name has been normalized previously.
+// Only the scrypt hash is stored, so the user can't use SCRAM-SHA-256; see
+// AddUserWithSCRAM.
 func (db *DB) AddUser(name, plainPassword string) error {
+	return db.addUser(name, plainPassword, 0)
+}
+
+// AddUserWithSCRAM is like AddUser, but also stores the SCRAM-SHA-256
+// credentials, computed with the given number of PBKDF2 iterations (at least
+// 4096), so the user can authenticate using that mechanism.
+// If the database leaks, the credentials can be brute-forced at the speed of
+// PBKDF2, which is much faster than scrypt; so use as many iterations as the
+// clients can afford (see DefaultSCRAMIterations).
+func (db *DB) AddUserWithSCRAM(name, plainPassword string, iterations int) error {
+	if iterations < minSCRAMIterations {
+		return fmt.Errorf("too few SCRAM iterations (%d), minimum is %d",
+			iterations, minSCRAMIterations)
+	}
+	if iterations > math.MaxInt32 {
+		return fmt.Errorf("too many SCRAM iterations (%d)", iterations)
+	}
+	return db.addUser(name, plainPassword, iterations)
+}
+
+// addUser to the database. The SCRAM-SHA-256 credentials are only stored if
+// scramIterations is not 0.
+func (db *DB) addUser(name, plainPassword string, scramIterations int) error {
 	if norm, err := normalize.User(name); err != nil || name != norm {
 		return errors.New("invalid username")
 	}
@@ -155,9 +199,18 @@ func (db *DB) AddUser(name, plainPassword string) error {
 		return fmt.Errorf("scrypt failed: %v", err)
 	}
 
+	var scram *ScramSHA256
+	if scramIterations != 0 {
+		scram, err = newScramSHA256(plainPassword, scramIterations)
+		if err != nil {
+			return err
+		}
+	}
+
 	db.mu.Lock()
 	db.db.Users[name] = &Password{
-		Scheme: &Password_Scrypt{s},
+		Scheme:      &Password_Scrypt{s},
+		ScramSha256: scram,
 	}
 	db.mu.Unlock()
 
@@ -182,6 +235,37 @@ func (db *DB) Exists(name string) bool {
 	return present
 }
 
+// SCRAMCredentials returns the SCRAM-SHA-256 credentials of the user.
+// ok is false if the user does not exist, or has no SCRAM credentials.
+func (db *DB) SCRAMCredentials(name string) (
+	salt []byte, iterations int, storedKey, serverKey []byte, ok bool) {
+	db.mu.RLock()
+	passwd, present := db.db.Users[name]
+	db.mu.RUnlock()
+
+	if !present || passwd.ScramSha256 == nil {
+		return nil, 0, nil, nil, false
+	}
+
+	s := passwd.ScramSha256
+	return s.Salt, int(s.Iterations), s.StoredKey, s.ServerKey, true
+}
+
+// AllHaveSCRAMCredentials returns true if all the users have SCRAM-SHA-256
+// credentials. Users don't have them unless their password was set using
+// AddUserWithSCRAM.
+func (db *DB) AllHaveSCRAMCredentials() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, passwd := range db.db.Users {
+		if passwd.ScramSha256 == nil {
+			return false
+		}
+	}
+	return true
+}
+
 ///////////////////////////////////////////////////////////
 // Encryption schemes
 //
@@ -195,6 +279,37 @@ func (p *Plain) PasswordMatches(plain string) bool {
 	return plain == string(p.Password)
 }
 
+// newScramSHA256 generates the SCRAM-SHA-256 credentials for the given
+// password, as per RFC 5802 section 3.
+func newScramSHA256(plainPassword string, iterations int) (*ScramSHA256, error) {
+	s := &ScramSHA256{
+		Iterations: int32(iterations),
+
+		// 16 bytes of salt (will be filled later).
+		Salt: make([]byte, 16),
+	}
+
+	n, err := rand.Read(s.Salt)
+	if n != 16 || err != nil {
+		return nil, fmt.Errorf("failed to get salt - %d - %v", n, err)
+	}
+
+	salted := pbkdf2.Key([]byte(plainPassword), s.Salt,
+		int(s.Iterations), sha256.Size, sha256.New)
+
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	s.StoredKey = storedKey[:]
+	s.ServerKey = hmacSHA256(salted, []byte("Server Key"))
+	return s, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
 // PasswordMatches implementation for the scrypt scheme, which we use by
 // default.
 func (s *Scrypt) PasswordMatches(plain string) bool {
@@ -1,11 +1,16 @@
 package userdb
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
 // Remove the file if the test was successful. Used in defer statements, to
@@ -327,3 +332,80 @@ func TestExists(t *testing.T) {
 		t.Errorf("known user does not exist")
 	}
 }
+
+func TestSCRAMCredentials(t *testing.T) {
+	fname := mustCreateDB(t, "")
+	defer removeIfSuccessful(t, fname)
+	db := mustLoad(t, fname)
+
+	if _, _, _, _, ok := db.SCRAMCredentials("unknown"); ok {
+		t.Errorf("unknown user has SCRAM credentials")
+	}
+	if !db.AllHaveSCRAMCredentials() {
+		t.Errorf("empty database is missing SCRAM credentials")
+	}
+
+	// They are not stored unless requested.
+	if err := db.AddUser("user", "pencil"); err != nil {
+		t.Fatalf("error adding user: %v", err)
+	}
+	if _, _, _, _, ok := db.SCRAMCredentials("user"); ok {
+		t.Errorf("user has SCRAM credentials without asking for them")
+	}
+	if db.AllHaveSCRAMCredentials() {
+		t.Errorf("database has all SCRAM credentials")
+	}
+
+	if err := db.AddUserWithSCRAM("user", "pencil", 5000); err != nil {
+		t.Fatalf("error adding user: %v", err)
+	}
+
+	salt, iter, storedKey, serverKey, ok := db.SCRAMCredentials("user")
+	if !ok {
+		t.Fatalf("user has no SCRAM credentials")
+	}
+	if len(salt) != 16 || iter != 5000 {
+		t.Errorf("unexpected salt (%q) or iterations (%d)", salt, iter)
+	}
+
+	// Compute them independently, and compare.
+	salted := pbkdf2.Key([]byte("pencil"), salt, iter, 32, sha256.New)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	expectedStored := sha256.Sum256(clientKey)
+	if !bytes.Equal(storedKey, expectedStored[:]) {
+		t.Errorf("stored key mismatch: %x != %x", storedKey, expectedStored)
+	}
+	expectedServer := hmacSHA256(salted, []byte("Server Key"))
+	if !bytes.Equal(serverKey, expectedServer) {
+		t.Errorf("server key mismatch: %x != %x", serverKey, expectedServer)
+	}
+
+	// Users with the plain scheme don't have SCRAM credentials.
+	fname = mustCreateDB(t, "users:< key: 'u' value:< plain:< password: 'p' >>>")
+	defer removeIfSuccessful(t, fname)
+	db = mustLoad(t, fname)
+	if _, _, _, _, ok := db.SCRAMCredentials("u"); ok {
+		t.Errorf("plain user has SCRAM credentials")
+	}
+	if db.AllHaveSCRAMCredentials() {
+		t.Errorf("database with a plain user has all SCRAM credentials")
+	}
+
+	// Setting the password again adds them.
+	if err := db.AddUserWithSCRAM("u", "p", DefaultSCRAMIterations); err != nil {
+		t.Fatalf("error adding user: %v", err)
+	}
+	if !db.AllHaveSCRAMCredentials() {
+		t.Errorf("database is missing SCRAM credentials")
+	}
+	if _, iter, _, _, _ := db.SCRAMCredentials("u"); iter != DefaultSCRAMIterations {
+		t.Errorf("unexpected iterations: %d", iter)
+	}
+
+	// The number of iterations must be reasonable.
+	for _, iter := range []int{0, -1, 4095, math.MaxInt32 + 1} {
+		if err := db.AddUserWithSCRAM("u", "p", iter); err == nil {
+			t.Errorf("AddUserWithSCRAM with %d iterations worked", iter)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"expvar"
 	"flag"
 	"fmt"
@@ -120,7 +119,7 @@ func launchMonitoringServer(conf *config.Config) {
 
 	srv := &http.Server{Addr: conf.MonitoringAddress}
 
-	http.HandleFunc("/exit", exitHandler(srv))
+	http.HandleFunc("/exit", exitHandler)
 	http.HandleFunc("/metrics", expvarom.MetricsHandler)
 	http.HandleFunc("/debug/flags", debugFlagsHandler)
 	http.HandleFunc("/debug/config", debugConfigHandler(conf))
@@ -178,6 +177,7 @@ os hostname <i>{{.Hostname}}</i><br>
 
 <ul>
   <li><a href="/debug/queue">queue</a>
+  <li><a href="/debug/ratelimit">rate limits</a>
   <li>monitoring
     <ul>
       <li><a href="/debug/traces">traces</a>
@@ -204,26 +204,21 @@ os hostname <i>{{.Hostname}}</i><br>
 </html>
 `))
 
-func exitHandler(srv *http.Server) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Use POST method for exiting", http.StatusMethodNotAllowed)
-			return
-		}
+func exitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Use POST method for exiting", http.StatusMethodNotAllowed)
+		return
+	}
 
-		log.Infof("Received /exit")
-		http.Error(w, "OK exiting", http.StatusOK)
+	log.Infof("Received /exit")
 
-		// Launch srv.Shutdown asynchronously, and then exit.
-		// The http documentation says to wait for Shutdown to return before
-		// exiting, to gracefully close all ongoing requests.
-		go func() {
-			if err := srv.Shutdown(context.Background()); err != nil {
-				log.Fatalf("Monitoring server shutdown failed: %v", err)
-			}
-			os.Exit(0)
-		}()
+	// Use the same graceful shutdown as for SIGTERM; chasquid will exit once
+	// it is done.
+	if !requestShutdown("/exit") {
+		http.Error(w, "Already shutting down", http.StatusServiceUnavailable)
+		return
 	}
+	http.Error(w, "OK exiting", http.StatusOK)
 }
 
 func debugFlagsHandler(w http.ResponseWriter, r *http.Request) {
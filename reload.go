@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/chasquid/internal/config"
+	"blitiri.com.ar/go/chasquid/internal/dnsbl"
+	"blitiri.com.ar/go/chasquid/internal/expvarom"
+	"blitiri.com.ar/go/chasquid/internal/milter"
+	"blitiri.com.ar/go/chasquid/internal/normalize"
+	"blitiri.com.ar/go/chasquid/internal/smtpsrv"
+	"blitiri.com.ar/go/log"
+)
+
+var (
+	reloadResults = expvarom.NewMap("chasquid/reloadResults",
+		"result", "count of reloads, by result")
+)
+
+// Options in chasquid.conf that can be changed by reloading, see
+// applyConfig. Changes to the others need a restart.
+var reloadableOptions = map[string]bool{
+	"max_data_size_mb":         true,
+	"max_queue_size_mb":        true,
+	"delay_notification_after": true,
+	"dmarc_quarantine_action":  true,
+	"restrict_senders":         true,
+	"milter":                   true,
+	"dnsbl":                    true,
+	"dnsbl_threshold":          true,
+	"dnsbl_action":             true,
+}
+
+// applyConfig sets the server options that can be changed by reloading. If
+// any of them is invalid, it returns an error without changing anything.
+func applyConfig(s *smtpsrv.Server, conf *config.Config) error {
+	switch conf.DmarcQuarantineAction {
+	case "header", "reject", "none":
+	default:
+		return fmt.Errorf("invalid dmarc_quarantine_action: %q",
+			conf.DmarcQuarantineAction)
+	}
+
+	switch conf.DnsblAction {
+	case "reject", "tag":
+	default:
+		return fmt.Errorf("invalid dnsbl_action: %q", conf.DnsblAction)
+	}
+
+	delayNotificationAfter, err := parseDuration(
+		"delay_notification_after", conf.DelayNotificationAfter)
+	if err != nil {
+		return err
+	}
+
+	var zones []dnsbl.Zone
+	for _, z := range conf.Dnsbl {
+		zones = append(zones, dnsbl.Zone{
+			Domain: z.Zone,
+			Weight: int(z.Weight),
+			Codes:  z.ReturnCodes,
+		})
+	}
+
+	var milters []*milter.Filter
+	for _, m := range conf.Milter {
+		f, err := parseMilter(m)
+		if err != nil {
+			return err
+		}
+		milters = append(milters, f)
+	}
+
+	s.Reconfigure(func() {
+		s.MaxDataSize = conf.MaxDataSizeMb * 1024 * 1024
+		s.MaxQueueSize = conf.MaxQueueSizeMb * 1024 * 1024
+		s.DelayNotificationAfter = delayNotificationAfter
+		s.DMARCQuarantineAction = conf.DmarcQuarantineAction
+		s.RestrictSenders = conf.RestrictSenders
+		s.Milters = milters
+		s.DNSBLZones = zones
+		s.DNSBLThreshold = int(conf.DnsblThreshold)
+		s.DNSBLAction = conf.DnsblAction
+	})
+	return nil
+}
+
+// loadCerts loads the certificates from
+// "certs/<directory>/{fullchain,privkey}.pem". The structure matches
+// letsencrypt's, to make it easier for that case.
+func loadCerts() ([]tls.Certificate, error) {
+	log.Infof("Loading certificates")
+	entries, err := readDir("certs/")
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []tls.Certificate{}
+	for _, info := range entries {
+		if !info.IsDir() {
+			// Skip non-directories.
+			continue
+		}
+
+		name := info.Name()
+		dir := filepath.Join("certs/", name)
+		log.Infof("  %s", name)
+
+		certPath := filepath.Join(dir, "fullchain.pem")
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			continue
+		}
+		keyPath := filepath.Join(dir, "privkey.pem")
+		if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+			continue
+		}
+
+		cert, err := smtpsrv.LoadCert(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %q: %v", dir, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// loadDomains loads the domains from "domains/" into the server, and returns
+// them. The ones in loaded were loaded before: if they are still there,
+// their sender allow-lists and DKIM signers are reloaded (the server reloads
+// users and aliases on its own); if they are not, they are removed from the
+// server.
+// If any of the names is invalid, it returns an error without changing
+// anything.
+func loadDomains(s *smtpsrv.Server, loaded map[string]bool) (map[string]bool, error) {
+	entries, err := readDir("domains/")
+	if err != nil {
+		return nil, err
+	}
+
+	// Map of domain -> directory.
+	dirs := map[string]string{}
+	for _, info := range entries {
+		domain, err := normalize.Domain(info.Name())
+		if err != nil {
+			return nil, fmt.Errorf("invalid name %+q: %v", info.Name(), err)
+		}
+		dirs[domain] = filepath.Join("domains", info.Name())
+	}
+
+	log.Infof("Domain config paths:")
+	domains := map[string]bool{}
+	for domain, dir := range dirs {
+		domains[domain] = true
+		if !loaded[domain] {
+			loadDomain(domain, dir, s)
+		} else {
+			log.Infof("  %s (reloading senders and DKIM)", domain)
+			loadSendersAndDKIM(domain, dir, s)
+		}
+	}
+
+	for domain := range loaded {
+		// We always keep localhost as a local domain, see main.
+		if domains[domain] || domain == "localhost" {
+			continue
+		}
+		log.Infof("  %s (removed)", domain)
+		s.RemoveDomain(domain)
+	}
+
+	return domains, nil
+}
+
+// Requests to reload, with the reason. See requestReload.
+var reloadRequests = make(chan string, 1)
+
+// requestReload asks the reloader to reload the configuration. If there is
+// already a request pending, they are handled together.
+func requestReload(reason string) {
+	select {
+	case reloadRequests <- reason:
+	default:
+	}
+}
+
+// Requests to reload only the certificates, see requestCertsReload.
+var certsReloadRequests = make(chan struct{}, 1)
+
+// requestCertsReload asks the reloader to reload the certificates, for
+// example because we got new ones via ACME.
+func requestCertsReload() {
+	select {
+	case certsReloadRequests <- struct{}{}:
+	default:
+	}
+}
+
+// reloader reloads the configuration, the certificates and the domains when
+// requested (see requestReload and requestCertsReload), and also when the
+// files change, if checking for changes is enabled.
+type reloader struct {
+	s *smtpsrv.Server
+
+	// Configuration we started with. The options that are not reloadable
+	// are checked against it, so we can tell if they need a restart.
+	conf *config.Config
+
+	// Domains loaded from "domains/".
+	domains map[string]bool
+
+	// Snapshot of the files, to detect changes. See snapshot.
+	lastSnapshot string
+}
+
+// run the reloader. If checkInterval is not 0, check for changes with that
+// frequency. This function does not return.
+func (r *reloader) run(checkInterval time.Duration) {
+	var check <-chan time.Time
+	if checkInterval > 0 {
+		r.lastSnapshot = snapshot()
+
+		//lint:ignore SA1015 This lasts the program's lifetime.
+		check = time.Tick(checkInterval)
+	}
+
+	for {
+		select {
+		case reason := <-reloadRequests:
+			r.reload(reason)
+		case <-certsReloadRequests:
+			log.Infof("Reloading certificates")
+			r.reloadCerts()
+		case <-check:
+			if snapshot() != r.lastSnapshot {
+				r.reload("files changed")
+			}
+		}
+	}
+}
+
+func (r *reloader) reload(reason string) {
+	log.Infof("Reloading (%s)", reason)
+	r.lastSnapshot = snapshot()
+	ok := true
+
+	conf, err := config.Load("chasquid.conf", *configOverrides)
+	if err == nil {
+		err = applyConfig(r.s, conf)
+	}
+	if err != nil {
+		log.Errorf("Error reloading config, keeping the current one: %v", err)
+		ok = false
+	} else {
+		restart := []string{}
+		for _, name := range config.Changed(r.conf, conf) {
+			if !reloadableOptions[name] {
+				restart = append(restart, name)
+			}
+		}
+		if len(restart) > 0 {
+			log.Errorf("These options changed, but need a restart to apply: %s",
+				strings.Join(restart, ", "))
+		}
+	}
+
+	if !r.reloadCerts() {
+		ok = false
+	}
+
+	domains, err := loadDomains(r.s, r.domains)
+	if err != nil {
+		log.Errorf("Error reloading domains, keeping the current ones: %v",
+			err)
+		ok = false
+	} else {
+		r.domains = domains
+	}
+
+	if ok {
+		reloadResults.Add("success", 1)
+		log.Infof("Reload complete")
+	} else {
+		reloadResults.Add("error", 1)
+		log.Errorf("Reload completed with errors")
+	}
+}
+
+// reloadCerts reloads the certificates. If there is an error, it keeps the
+// current ones, and returns false.
+func (r *reloader) reloadCerts() bool {
+	certs, err := loadCerts()
+	if err == nil && len(certs) == 0 {
+		err = errors.New("no valid certificates found")
+	}
+	if err != nil {
+		log.Errorf("Error reloading certificates, keeping the current ones: %v",
+			err)
+		return false
+	}
+	r.s.SetCerts(certs)
+	return true
+}
+
+// snapshot returns a description of the files that we reload: chasquid.conf,
+// the entries in certs/ and domains/, the certificates, and the DKIM
+// selectors and keys. It is used to detect changes, so it includes their
+// sizes and modification times.
+func snapshot() string {
+	sb := &strings.Builder{}
+	add := func(path string) {
+		// Use Stat so we follow symlinks, as certbot updates the files by
+		// changing where the links point to.
+		fi, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(sb, "%s: %v\n", path, err)
+			return
+		}
+		fmt.Fprintf(sb, "%s %d %d\n", path, fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	add("chasquid.conf")
+
+	entries, _ := os.ReadDir("domains")
+	for _, e := range entries {
+		fmt.Fprintf(sb, "domains/%s\n", e.Name())
+		add(filepath.Join("domains", e.Name(), "dkim_selector"))
+	}
+
+	entries, _ = os.ReadDir("certs")
+	for _, e := range entries {
+		add(filepath.Join("certs", e.Name(), "fullchain.pem"))
+		add(filepath.Join("certs", e.Name(), "privkey.pem"))
+		add(filepath.Join("certs", e.Name(), "dkim_privkey.pem"))
+	}
+
+	return sb.String()
+}
@@ -47,6 +47,11 @@ check "AUTH_AS=user@testserver"
 check "PATH="
 check "REMOTE_ADDR="
 check "SPF_PASS=0"
+check "DKIM_PASS=0"
+check "DKIM_DOMAINS="
+check "DNSBL_SCORE=0"
+check "DNSBL_ZONES="
+check "DNSBL_LISTED=0"
 
 
 # Check that failures in the script result in failing delivery.
@@ -15,6 +15,7 @@ generate_certs_for testserver
 # Start with the user with the wrong password, and no aliases.
 chasquid-util-user-add someone@testserver password111
 rm -f config/domains/testserver/aliases
+rm -rf config/domains/newdomain
 
 mkdir -p .logs
 chasquid -v=2 --logfile=.logs/chasquid.log --config_dir=config \
@@ -64,6 +65,24 @@ then
 fi
 
 
+#
+# Manual reload of the domains.
+#
+
+# Add a new domain, with an alias to the existing user. Before the reload it
+# is not local, so delivery to it would not reach the user.
+mkdir -p config/domains/newdomain
+echo "alias: someone@testserver" > config/domains/newdomain/aliases
+
+# The SIGHUP above also reloaded, so wait for the second reload.
+pkill -HUP -s 0 chasquid
+wait_until '[ "$(grep -c "Reload complete" .logs/chasquid.log)" -ge 2 ]'
+
+rm .mail/someone@testserver
+run_msmtp alias@newdomain < content
+wait_for_file .mail/someone@testserver
+
+
 # Test that we can make the server exit using the /exit endpoint.
 # First, a GET should fail with status 405.
 fexp http://localhost:1099/exit -status 405
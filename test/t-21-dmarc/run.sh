@@ -0,0 +1,59 @@
+#!/bin/bash
+
+# Test DMARC policy evaluation, which requires overriding the DNS server.
+
+set -e
+. "$(dirname "$0")/../util/lib.sh"
+
+init
+
+# Build with the DNS override, so we can fake DNS records.
+export GOTAGS="dnsoverride"
+
+generate_certs_for testserver
+add_user user@testserver secretpassword
+
+mkdir -p .logs
+
+minidns_bg --addr=":9053" -zones=zones >> .logs/minidns.log 2>&1
+wait_until_ready 9053
+
+chasquid -v=2 --logfile=.logs/chasquid.log --config_dir=config \
+	--testing__dns_addr=127.0.0.1:9053 &
+wait_until_ready 1025
+
+function run_dialog() {
+	if ! chamuyero "$1" > ".logs/$1.log" 2>&1 ; then
+		fail "test $1 failed, see .logs/$1.log"
+	fi
+}
+
+# Aligned via SPF: delivered, and the result is recorded.
+run_dialog pass.cmy
+wait_for_file .mail/user@testserver
+if ! grep -q "dmarc=pass (p=reject) header.from=pass.test" \
+		.mail/user@testserver; then
+	fail "DMARC pass result not found in the message"
+fi
+rm .mail/user@testserver
+
+# Not aligned with a reject policy: rejected at DATA.
+run_dialog reject.cmy
+if ! grep -q "rejected.*Rejected by the DMARC policy of reject.test" \
+		.logs/mail_log; then
+	fail "DMARC rejection not found in the mail log"
+fi
+
+# Not aligned with a quarantine policy: delivered with the quarantine header
+# (the default action).
+run_dialog quarantine.cmy
+wait_for_file .mail/user@testserver
+if ! grep -q "X-DMARC-Quarantine: quarantine.test" .mail/user@testserver; then
+	fail "DMARC quarantine header not found in the message"
+fi
+if ! grep -q "dmarc=fail (p=quarantine dis=quarantine)" \
+		.mail/user@testserver; then
+	fail "DMARC fail result not found in the message"
+fi
+
+success
@@ -168,7 +168,7 @@ func one() error {
 			return err
 		}
 	} else {
-		err = client.MailAndRcpt("test@test", "null@testserver")
+		err = client.MailAndRcpt("test@test", "null@testserver", nil)
 		if err != nil {
 			return err
 		}